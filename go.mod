@@ -3,3 +3,9 @@ module github.com/ihs7/helm-git-diff
 go 1.25.2
 
 require github.com/pmezard/go-difflib v1.0.0
+
+require (
+	golang.org/x/sys v0.47.0
+	golang.org/x/term v0.45.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -1,22 +1,443 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
+	"io/fs"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"runtime/pprof"
+	"runtime/trace"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/pmezard/go-difflib/difflib"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
+
+	"github.com/ihs7/helm-git-diff/pkg/manifest"
+	"github.com/ihs7/helm-git-diff/pkg/render"
+)
+
+const (
+	defaultBase  = "origin/main"
+	baseApproved = "approved"
+	pinFileName  = ".helm-git-diff-pins.yaml"
+
+	auditStateFileName = ".helm-git-diff-audit.yaml"
+	auditLogFileName   = ".helm-git-diff-audit.log"
+	repoConfigFileName = ".helm-git-diff.yaml"
+
+	defaultReviewersFile = ".helm-git-diff-reviewers"
+	defaultContextLines  = 3
+	defaultChartExcludes = "examples,test,ci"
+)
+
+const (
+	policyResourceLimits = "resource-limits"
+	policyProbes         = "probes"
+	policyPDB            = "pdb"
+)
+
+var policyNames = []string{policyResourceLimits, policyProbes, policyPDB}
+
+const (
+	riskDestructive = "destructive"
+	riskRBAC        = "rbac"
+	riskCRD         = "crd"
+	riskReplicaDrop = "replica-drop"
+)
+
+var defaultRiskWeights = map[string]int{
+	riskDestructive: 10,
+	riskRBAC:        5,
+	riskCRD:         5,
+	riskReplicaDrop: 3,
+}
+
+const (
+	commentGitHub = "github"
+	commentGitLab = "gitlab"
+	commentMarker = "<!-- helm-git-diff -->"
+
+	runMarkerPrefix = "<!-- helm-git-diff-run: "
+	runMarkerSuffix = " -->"
+	lastRunComment  = "comment"
+
+	trailerPrefix     = "Helm-Git-Diff-"
+	signingKeyEnv     = "HELM_GIT_DIFF_SIGNING_KEY"
+	trailerSignedWith = "hmac-sha256:"
+)
+
+const (
+	changeAdded    = "added"
+	changeRemoved  = "removed"
+	changeModified = "modified"
+)
+
+const (
+	annotationSkip        = "helm-git-diff.io/skip"
+	annotationExtraValues = "helm-git-diff.io/extra-values"
+	annotationIgnore      = "helm-git-diff.io/ignore-changes"
+
+	annotationHook             = "helm.sh/hook"
+	annotationHookWeight       = "helm.sh/hook-weight"
+	annotationHookDeletePolicy = "helm.sh/hook-delete-policy"
+)
+
+const (
+	colorAuto   = "auto"
+	colorAlways = "always"
+	colorNever  = "never"
+)
+
+const (
+	annotationArgoSyncOptions = "argocd.argoproj.io/sync-options"
+	annotationFluxPrune       = "kustomize.toolkit.fluxcd.io/prune"
+	annotationResourcePolicy  = "helm.sh/resource-policy"
+)
+
+const (
+	actionDelete   = "delete"
+	actionRecreate = "recreate"
+)
+
+var immutableFields = map[string][]string{
+	"Deployment":            {"spec.selector"},
+	"ReplicaSet":            {"spec.selector"},
+	"DaemonSet":             {"spec.selector"},
+	"StatefulSet":           {"spec.selector", "spec.serviceName", "spec.volumeClaimTemplates", "spec.podManagementPolicy"},
+	"Job":                   {"spec.selector", "spec.template", "spec.completionMode"},
+	"Service":               {"spec.clusterIP"},
+	"PersistentVolumeClaim": {"spec.storageClassName", "spec.accessModes", "spec.selector", "spec.volumeName"},
+	"StorageClass":          {"provisioner", "parameters", "reclaimPolicy", "volumeBindingMode"},
+}
+
+const (
+	outputText     = "text"
+	outputJSON     = "json"
+	outputMarkdown = "markdown"
+)
+
+const (
+	statusChanged   = "changed"
+	statusUnchanged = "unchanged"
+	statusSkipped   = "skipped"
+	statusFailed    = "failed"
+)
+
+const exitChartsFailed = 3
+
+const largeFileSize = 1 << 20
+
+const teamUnassigned = "unassigned"
+
+var (
+	helmBinary    = "helm"
+	kubectlBinary = "kubectl"
+	streams       = &outputStreams{stderr: os.Stderr}
+)
+
+// vcs reads chart files at git references. Tests can replace repoVCS with a fake.
+type vcs interface {
+	archive(ref string, paths []string) ([]byte, error)
+	show(ref, path string) ([]byte, error)
+	exists(ref, path string) (bool, error)
+}
+
+type gitVCS struct{}
+
+var repoVCS vcs = gitVCS{}
+
+var (
+	errDifferencesFound = errors.New("differences found")
+	errChartsFailed     = errors.New("one or more charts failed")
 )
 
 const (
-	defaultBase = "origin/main"
+	reasonInvalidChart    = "invalid-chart"
+	reasonNotApproved     = "not-approved"
+	reasonExtractFailed   = "extract-failed"
+	reasonPluginMissing   = "dependency-plugin-missing"
+	reasonDependencyBuild = "dependency-build-failed"
+	reasonValuesFailed    = "values-failed"
+	reasonRenderFailed    = "render-failed"
+	reasonParseFailed     = "parse-failed"
+	reasonPackageFailed   = "package-failed"
+	reasonDryRunFailed    = "dry-run-failed"
+	reasonUnknown         = "error"
+)
+
+type reasonError struct {
+	reason string
+	err    error
+}
+
+func (e *reasonError) Error() string {
+	return e.err.Error()
+}
+
+func (e *reasonError) Unwrap() error {
+	return e.err
+}
+
+func withReason(reason string, err error) error {
+	return &reasonError{reason: reason, err: err}
+}
+
+func errorReason(err error) string {
+	var reasonErr *reasonError
+	if errors.As(err, &reasonErr) {
+		return reasonErr.reason
+	}
+	return reasonUnknown
+}
+
+// errorHint is a command that likely fixes the environment problem behind a failure.
+type errorHint struct {
+	Problem string `json:"problem"`
+	Command string `json:"command"`
+}
+
+type hintedError struct {
+	err   error
+	hints []errorHint
+}
+
+func (e *hintedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *hintedError) Unwrap() error {
+	return e.err
+}
+
+func withHints(err error, hints ...errorHint) error {
+	if len(hints) == 0 {
+		return err
+	}
+	return &hintedError{err: err, hints: hints}
+}
+
+// hintRules derive hints from the output of helm and git embedded in error messages.
+var hintRules = []func(message string) []errorHint{
+	repositoryHints,
+	credentialHints,
+	helmVersionHints,
+}
+
+// invocationArgs are the arguments the plugin was run with, used to suggest re-runs.
+var invocationArgs = os.Args[1:]
+
+func errorHints(err error) []errorHint {
+	var hints []errorHint
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if hinted, ok := e.(*hintedError); ok {
+			hints = append(hints, hinted.hints...)
+		}
+	}
+	message := err.Error()
+	for _, rule := range hintRules {
+		for _, hint := range rule(message) {
+			if !slices.Contains(hints, hint) {
+				hints = append(hints, hint)
+			}
+		}
+	}
+	return hints
+}
+
+func formatErrorHints(hints []errorHint) string {
+	var b strings.Builder
+	for _, hint := range hints {
+		fmt.Fprintf(&b, "Hint: %s\n  %s\n", hint.Problem, hint.Command)
+	}
+	return b.String()
+}
+
+func printError(w io.Writer, err error) {
+	fmt.Fprintf(w, "Error: %s\n%s", strings.TrimRight(err.Error(), "\n"), formatErrorHints(errorHints(err)))
+}
+
+var repositoryDefinitionPattern = regexp.MustCompile(`no repository definition for ([^\n]+?)\.?(?:\s+Please|\n|$)`)
+
+func repositoryHints(message string) []errorHint {
+	match := repositoryDefinitionPattern.FindStringSubmatch(message)
+	if match == nil {
+		return nil
+	}
+	var hints []errorHint
+	for _, repository := range strings.Split(match[1], ", ") {
+		repository = strings.TrimSpace(repository)
+		if strings.HasPrefix(repository, "oci://") {
+			continue
+		}
+		hints = append(hints, errorHint{
+			Problem: fmt.Sprintf("dependency repository %s is not configured", repository),
+			Command: fmt.Sprintf("helm repo add %s %s", repositoryName(repository), repository),
+		})
+	}
+	return hints
+}
+
+var (
+	unauthorizedPattern = regexp.MustCompile(`(?i)\b401 unauthorized\b|\b403 forbidden\b|status code 40[13]\b|failed to authorize|authentication required|requested access to the resource is denied`)
+	ociHostPattern      = regexp.MustCompile(`oci://([^/\s"']+)`)
+	repositoryPattern   = regexp.MustCompile(`https?://[^\s"']+`)
 )
 
+func credentialHints(message string) []errorHint {
+	if !unauthorizedPattern.MatchString(message) {
+		return nil
+	}
+	if match := ociHostPattern.FindStringSubmatch(message); match != nil {
+		return []errorHint{{
+			Problem: fmt.Sprintf("registry %s rejected the credentials", match[1]),
+			Command: fmt.Sprintf("helm registry login %s --username <user> --password-stdin", match[1]),
+		}}
+	}
+	if url := repositoryPattern.FindString(message); url != "" {
+		url = strings.TrimSuffix(strings.TrimRight(url, ".,:;"), "/index.yaml")
+		return []errorHint{{
+			Problem: fmt.Sprintf("repository %s rejected the credentials", url),
+			Command: fmt.Sprintf("helm repo add %s %s --force-update --username <user> --password-stdin", repositoryName(url), url),
+		}}
+	}
+	return nil
+}
+
+var unknownFlagPattern = regexp.MustCompile(`unknown flag: (--[\w-]+)`)
+
+func helmVersionHints(message string) []errorHint {
+	match := unknownFlagPattern.FindStringSubmatch(message)
+	if match == nil {
+		return nil
+	}
+	return []errorHint{{
+		Problem: fmt.Sprintf("helm does not support %s, Helm 3.18+ is required", match[1]),
+		Command: rerunCommand("--helm-binary", "/path/to/newer/helm"),
+	}}
+}
+
+func repositoryName(repository string) string {
+	u, err := url.Parse(repository)
+	if err != nil || u.Host == "" {
+		return path.Base(repository)
+	}
+	if name := path.Base(u.Path); name != "." && name != "/" {
+		return name
+	}
+	name, _, _ := strings.Cut(u.Hostname(), ".")
+	return name
+}
+
+// rerunCommand returns the current invocation with flagName set to value.
+func rerunCommand(flagName, value string) string {
+	name := strings.TrimLeft(flagName, "-")
+	command := []string{"helm", "git-diff"}
+	for i := 0; i < len(invocationArgs); i++ {
+		arg := invocationArgs[i]
+		if !strings.HasPrefix(arg, "-") {
+			command = append(command, shellQuote(arg))
+			continue
+		}
+		trimmed := strings.TrimLeft(arg, "-")
+		if trimmed == name {
+			i++
+			continue
+		}
+		if strings.HasPrefix(trimmed, name+"=") {
+			continue
+		}
+		command = append(command, shellQuote(arg))
+	}
+	return strings.Join(append(command, flagName, shellQuote(value)), " ")
+}
+
+var shellSafePattern = regexp.MustCompile(`^[\w@%+=:,./-]+$`)
+
+func shellQuote(arg string) string {
+	if shellSafePattern.MatchString(arg) {
+		return arg
+	}
+	return "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+}
+
 type multiFlag []string
 
+type repoConfig struct {
+	Values      []string               `yaml:"values"`
+	Set         []string               `yaml:"set"`
+	Namespace   string                 `yaml:"namespace"`
+	Exclude     []string               `yaml:"exclude"`
+	Policies    []string               `yaml:"policies"`
+	RiskWeights map[string]int         `yaml:"risk-weights"`
+	Teams       map[string]teamConfig  `yaml:"teams"`
+	Charts      map[string]chartConfig `yaml:"charts"`
+}
+
+type teamConfig struct {
+	Namespaces []string `yaml:"namespaces"`
+	Charts     []string `yaml:"charts"`
+}
+
+type teamRollup struct {
+	Team        string   `json:"team"`
+	Charts      []string `json:"charts"`
+	Resources   int      `json:"resources"`
+	Destructive int      `json:"destructive"`
+}
+
+type chartConfig struct {
+	Values      []string `yaml:"values"`
+	Set         []string `yaml:"set"`
+	ReleaseName string   `yaml:"release-name"`
+	Namespace   string   `yaml:"namespace"`
+}
+
+type chartEnv struct {
+	Name        string
+	ValuesFiles []string
+}
+
+type envFlag []chartEnv
+
+type chartPermutation struct {
+	Key    string
+	Values []string
+}
+
+type permuteFlag []chartPermutation
+
 func (m *multiFlag) String() string {
 	return strings.Join(*m, ",")
 }
@@ -26,36 +447,443 @@ func (m *multiFlag) Set(value string) error {
 	return nil
 }
 
+type colorFlag string
+
+func (e *envFlag) String() string {
+	names := make([]string, 0, len(*e))
+	for _, env := range *e {
+		names = append(names, env.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (e *envFlag) Set(value string) error {
+	name, files, ok := strings.Cut(value, "=")
+	name = strings.TrimSpace(name)
+	valuesFiles := splitList([]string{files})
+	if !ok || name == "" || len(valuesFiles) == 0 {
+		return fmt.Errorf("expected name=values-file[,values-file], got %q", value)
+	}
+	for _, env := range *e {
+		if env.Name == name {
+			return fmt.Errorf("environment %q specified more than once", name)
+		}
+	}
+	*e = append(*e, chartEnv{Name: name, ValuesFiles: valuesFiles})
+	return nil
+}
+
+func (p *permuteFlag) String() string {
+	keys := make([]string, 0, len(*p))
+	for _, permutation := range *p {
+		keys = append(keys, permutation.Key)
+	}
+	return strings.Join(keys, ",")
+}
+
+func (p *permuteFlag) Set(value string) error {
+	key, values, ok := strings.Cut(value, "=")
+	key = strings.TrimSpace(key)
+	permutationValues := splitList([]string{values})
+	if !ok || key == "" || len(permutationValues) == 0 {
+		return fmt.Errorf("expected key=value[,value], got %q", value)
+	}
+	for _, permutation := range *p {
+		if permutation.Key == key {
+			return fmt.Errorf("permutation %q specified more than once", key)
+		}
+	}
+	*p = append(*p, chartPermutation{Key: key, Values: permutationValues})
+	return nil
+}
+
+func (c *colorFlag) String() string {
+	return string(*c)
+}
+
+func (c *colorFlag) Set(value string) error {
+	switch value {
+	case colorAuto, colorAlways, colorNever:
+		*c = colorFlag(value)
+		return nil
+	}
+	return fmt.Errorf("must be one of %s, %s, %s", colorAuto, colorAlways, colorNever)
+}
+
 type Config struct {
 	Base                string
 	Current             string
 	Charts              []string
 	ChartDir            string
+	ChartDirs           []string
 	ValuesFiles         string
 	SetValues           []string
 	FailOnDiff          bool
 	NoColor             bool
+	Color               string
 	SkipDependencyBuild bool
+	NoCache             bool
+	HelmBinary          string
+	KubectlBinary       string
+	ServerDryRun        bool
+	ReleaseName         string
+	Namespace           string
+	KubeVersion         string
+	APIVersions         []string
+	IncludeCRDs         bool
+	PostRenderer        string
+	ValuesFromRef       bool
+	ValuesCoverage      bool
+	RiskyFunctions      bool
+	ValuesDrift         bool
+	AgainstRelease      bool
+	IdentityRules       string
+	ExactNames          bool
+	ConfigFile          string
+	SortKeys            bool
+	IgnoreFields        []string
+	IgnoreHelmLabels    bool
+	ShowSecrets         bool
+	InjectOwnership     bool
+	Summary             bool
+	Context             int
+	SideBySide          bool
+	NoPager             bool
+	ChartExcludes       string
+	Comment             string
+	LookupFixtures      string
+	AllowLookup         bool
+	Inventory           string
+	PackageDiff         bool
+	ChartSize           bool
+	Concurrency         int
+	Envs                []chartEnv
+	Permutations        []chartPermutation
+	RequiredLabels      []string
+	Policies            []string
+	RiskThreshold       int
+	SinceLastRun        string
+	SaveRun             string
+	Trailer             string
+	VerifyTrailer       string
+	SignReport          string
+	GrepResource        string
+	Anchors             bool
+	RequiredAnnotations []string
+	Since               string
+	RoutingOutput       string
+	DestructiveOutput   string
+	ReviewersFile       string
+	CI                  string
+	CPUProfile          string
+	MemProfile          string
+	Trace               string
+	Output              string
+	ReleaseNotes        string
+	Batch               string
 	hasDifferences      bool
 	useColor            bool
+	violations          []string
+	pins                map[string]string
+	routes              []chartRoute
+	failures            []chartFailure
+	results             []chartResult
+	pruned              []prunedResource
+	identityRules       []identityRule
+	repoConfig          *repoConfig
+	lookupHelper        string
+	pagerBuffer         *bytes.Buffer
+	fingerprints        runFingerprints
+	previousRun         runFingerprints
+	inventory           []inventoryItem
+	reportSigner        crypto.Signer
+	destructiveChanges  []destructiveChange
+	teams               []teamRollup
+	resourceFilter      *resourceSelector
+	changedCharts       []string
+	destructive         int
+	restarts            int
+	dryRunRejected      int
+	changed             int
+	unchanged           int
+	skipped             int
+}
+
+type chartFailure struct {
+	Chart  string
+	Reason string
+	Err    error
+}
+
+type chartResult struct {
+	Chart      string           `json:"chart"`
+	Status     string           `json:"status"`
+	Summary    string           `json:"summary"`
+	RiskScore  int              `json:"riskScore"`
+	Risks      []string         `json:"risks,omitempty"`
+	Notes      []string         `json:"notes,omitempty"`
+	Resources  []resourceResult `json:"resources,omitempty"`
+	Kinds      []kindCount      `json:"kinds,omitempty"`
+	Hooks      []string         `json:"hooks,omitempty"`
+	Restarts   []string         `json:"restarts,omitempty"`
+	Highlights []string         `json:"highlights,omitempty"`
+	Hints      []errorHint      `json:"hints,omitempty"`
+}
+
+type changeTotals struct {
+	Added    int `json:"added"`
+	Modified int `json:"modified"`
+	Removed  int `json:"removed"`
+}
+
+type kindCount struct {
+	Kind string `json:"kind"`
+	changeTotals
+}
+
+type resourceResult struct {
+	Kind        string `json:"kind"`
+	Namespace   string `json:"namespace,omitempty"`
+	Name        string `json:"name"`
+	Change      string `json:"change"`
+	Diff        string `json:"diff"`
+	DryRunError string `json:"dryRunError,omitempty"`
+	Restart     bool   `json:"restart,omitempty"`
+}
+
+type inventoryItem struct {
+	Chart      string `json:"chart"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Source     string `json:"source"`
+}
+
+type destructiveChange struct {
+	Chart      string `json:"chart"`
+	APIVersion string `json:"apiVersion"`
+	Kind       string `json:"kind"`
+	Namespace  string `json:"namespace"`
+	Name       string `json:"name"`
+	Action     string `json:"action"`
+	Reason     string `json:"reason"`
+}
+
+type prunedResource struct {
+	Chart    string `json:"chart"`
+	Resource string `json:"resource"`
+	Kept     bool   `json:"kept,omitempty"`
+}
+
+type auditEntry struct {
+	Time string `json:"time"`
+	From string `json:"from"`
+	To   string `json:"to"`
+	chartResult
+}
+
+type report struct {
+	Charts     []chartResult     `json:"charts"`
+	Changed    int               `json:"changed"`
+	Unchanged  int               `json:"unchanged"`
+	Skipped    int               `json:"skipped"`
+	Errors     int               `json:"errors"`
+	Violations []string          `json:"violations,omitempty"`
+	Pruned     []prunedResource  `json:"pruned,omitempty"`
+	Teams      []teamRollup      `json:"teams,omitempty"`
+	Totals     changeTotals      `json:"totals"`
+	Provenance *reportProvenance `json:"provenance,omitempty"`
+
+	// summary renders kind counts in place of the diffs in Markdown.
+	summary bool
+}
+
+type reportProvenance struct {
+	Base    string            `json:"base"`
+	Current string            `json:"current"`
+	Charts  map[string]string `json:"charts"`
+}
+
+type signedReport struct {
+	PayloadType string            `json:"payloadType"`
+	Payload     string            `json:"payload"`
+	Signatures  []reportSignature `json:"signatures"`
+}
+
+type reportSignature struct {
+	KeyID string `json:"keyid"`
+	Sig   string `json:"sig"`
+}
+
+type resource = manifest.Resource
+
+type resourceChange struct {
+	Key     string
+	Change  string
+	Base    *resource
+	Current *resource
+}
+
+type identityRule struct {
+	APIVersion string `yaml:"apiVersion"`
+	Kind       string `yaml:"kind"`
+	Field      string `yaml:"field"`
+	NameSuffix string `yaml:"nameSuffix"`
+	nameSuffix *regexp.Regexp
+}
+
+type chartRoute struct {
+	Chart      string   `json:"chart"`
+	Categories []string `json:"categories"`
+}
+
+type chartSources struct {
+	Path            string
+	SkipReason      string
+	Lifecycle       string
+	BaseRef         string
+	Base            string
+	Current         string
+	BaseManifest    string
+	CurrentManifest string
+	PackageDiffs    []string
+	ValuesImpact    []string
+	Coverage        []string
+	Release         string
+	BaseValues      string
+	CurrentValues   string
+	Env             string
+	EnvValues       []string
+	Permutation     []string
+	PermutationOf   string
+	SetValues       []string
+	ReleaseName     string
+	Namespace       string
+	RiskyFunctions  []string
+	DependencyNotes []string
+	ValuesDrift     []string
+	SizeChanges     []string
+	DryRunErrors    map[string]string
+	Err             error
+	cleanups        []func()
+	inWorkdir       bool
+}
+
+type batchFile struct {
+	Repositories []batchRepository `yaml:"repositories"`
+}
+
+type batchRepository struct {
+	Name     string   `yaml:"name"`
+	Path     string   `yaml:"path"`
+	URL      string   `yaml:"url"`
+	Base     string   `yaml:"base"`
+	Current  string   `yaml:"current"`
+	ChartDir string   `yaml:"chart-dir"`
+	Charts   []string `yaml:"charts"`
+}
+
+type templateOptions = render.Options
+
+type chartDependency struct {
+	Name       string `yaml:"name"`
+	Version    string `yaml:"version"`
+	Repository string `yaml:"repository"`
+	Alias      string `yaml:"alias"`
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "approve" {
+		if err := checkGitRepo(); err != nil {
+			printError(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := runApprove(os.Args[2:]); err != nil {
+			printError(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		if err := checkGitRepo(); err != nil {
+			printError(os.Stderr, err)
+			os.Exit(1)
+		}
+		err := runAudit(os.Args[2:])
+		if errors.Is(err, errChartsFailed) {
+			os.Exit(exitChartsFailed)
+		}
+		if err != nil {
+			printError(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	config := parseFlags()
 
-	if err := checkGitRepo(); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	if config.Batch == "" {
+		if err := checkGitRepo(); err != nil {
+			printError(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+
+	stopProfiling, err := startProfiling(config)
+	if err != nil {
+		printError(os.Stderr, err)
 		os.Exit(1)
 	}
 
-	if err := run(config); err != nil {
-		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+	err = run(config)
+	if stopErr := stopProfiling(); stopErr != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", stopErr)
+	}
+	if errors.Is(err, errDifferencesFound) {
+		os.Exit(1)
+	}
+	if errors.Is(err, errChartsFailed) {
+		os.Exit(exitChartsFailed)
+	}
+	if err != nil {
+		printError(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+func discoverTools(config *Config) error {
+	var err error
+	helmBinary, err = resolveTool("helm", "--helm-binary", config.HelmBinary, "version", "--short")
+	if err != nil || !config.ServerDryRun {
+		return err
+	}
+	kubectlBinary, err = resolveTool("kubectl", "--kubectl-binary", config.KubectlBinary, "version", "--client")
+	return err
+}
+
+func resolveTool(name, flagName, override string, probeArgs ...string) (string, error) {
+	path, err := exec.LookPath(name)
+	if override != "" {
+		path, err = exec.LookPath(override)
+		if err != nil {
+			return "", fmt.Errorf("%s %s: %w", flagName, override, err)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%s not found in PATH; install it or pass %s (searched: %s)", name, flagName, strings.Join(filepath.SplitList(os.Getenv("PATH")), string(os.PathListSeparator)))
+		return "", withHints(err, errorHint{Problem: fmt.Sprintf("point %s at an installed %s", flagName, name), Command: rerunCommand(flagName, "/path/to/"+name)})
+	}
+
+	if output, err := exec.Command(path, probeArgs...).CombinedOutput(); err != nil {
+		return "", fmt.Errorf("running %s %s failed (%v: %s); check that it is built for %s/%s or pass %s", path, strings.Join(probeArgs, " "), err, strings.TrimSpace(string(output)), runtime.GOOS, runtime.GOARCH, flagName)
+	}
+	return path, nil
+}
+
 func checkGitRepo() error {
-	cmd := exec.Command("git", "rev-parse", "--git-dir")
+	cmd := gitCommand("rev-parse", "--git-dir")
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("not a git repository (or any of the parent directories)")
 	}
@@ -66,19 +894,90 @@ func parseFlags() *Config {
 	config := &Config{}
 
 	var setValues multiFlag
+	var envs envFlag
+	var permutations permuteFlag
+	var apiVersions multiFlag
+	var chartDirs multiFlag
+	var ignoreFields multiFlag
+	color := colorFlag(colorAuto)
+	var requiredLabels multiFlag
+	var requiredAnnotations multiFlag
+	var policies multiFlag
 
 	flag.StringVar(&config.Base, "base", defaultBase, "Base git reference to compare from")
 	flag.StringVar(&config.Current, "current", "HEAD", "Current git reference to compare to")
-	flag.StringVar(&config.ChartDir, "chart-dir", ".", "Directory containing Helm charts")
+	flag.StringVar(&config.Since, "since", "", "Detect charts changed by any commit since this reference instead of comparing --base and --current")
+	flag.Var(&chartDirs, "chart-dir", "Directory containing Helm charts, searched at any depth (can specify multiple; default: .)")
 	flag.StringVar(&config.ValuesFiles, "values", "", "Comma-separated list of values files to use")
 	flag.Var(&setValues, "set", "Set values on the command line (can specify multiple or separate values with commas: key1=val1,key2=val2)")
+	flag.BoolVar(&config.Summary, "summary", false, "Print per-chart counts of changed resources by kind instead of full diffs")
+	flag.IntVar(&config.Context, "context", defaultContextLines, "Number of unchanged lines shown around each change")
+	flag.BoolVar(&config.SideBySide, "side-by-side", false, "Show diffs in two columns, base on the left and current on the right")
+	flag.StringVar(&config.ChartExcludes, "chart-excludes", defaultChartExcludes, "Comma-separated directories at a chart's root that are ignored for change detection and rendering (empty to include everything)")
+	flag.BoolVar(&config.NoPager, "no-pager", false, "Do not pipe long output through $PAGER or less when writing to a terminal")
+	flag.StringVar(&config.GrepResource, "grep-resource", "", "Only show changes to this resource in all charts: kind/name or kind/namespace/name (name may be a glob)")
+	flag.BoolVar(&config.Anchors, "anchors", false, "Start every chart and resource section of text output with a machine-parsable ##[chart:...] or ##[resource:...] line")
 	flag.BoolVar(&config.FailOnDiff, "fail-on-diff", false, "Exit with code 1 if differences are found")
-	flag.BoolVar(&config.NoColor, "no-color", false, "Disable colored output")
+	flag.BoolVar(&config.NoColor, "no-color", false, "Disable colored output (same as --color=never)")
+	flag.Var(&color, "color", "When to use colored output: auto, always or never")
+	flag.BoolVar(&config.ValuesFromRef, "values-from-ref", false, "Read --values files from the same git reference as the chart being rendered")
+	flag.StringVar(&config.ReleaseName, "release-name", "", "Release name passed to helm template (default: chart name)")
+	flag.StringVar(&config.Namespace, "namespace", "", "Namespace passed to helm template")
+	flag.StringVar(&config.KubeVersion, "kube-version", "", "Kubernetes version used for Capabilities.KubeVersion")
+	flag.Var(&apiVersions, "api-versions", "Kubernetes API versions used for Capabilities.APIVersions (can specify multiple or separate with commas)")
+	flag.BoolVar(&config.IncludeCRDs, "include-crds", false, "Include CRDs in the rendered manifests")
+	flag.StringVar(&config.PostRenderer, "post-renderer", "", "Path to an executable used as helm post-renderer")
+	flag.BoolVar(&config.ValuesCoverage, "values-coverage", false, "Report values keys used by templates that no values file or --set provides")
+	flag.BoolVar(&config.ValuesDrift, "values-drift", false, "Warn when values.yaml and templates stop agreeing on which keys exist between the references")
+	flag.BoolVar(&config.RiskyFunctions, "risky-functions", false, "Report new template calls to functions that read cluster state or are random (lookup, now, randAlphaNum, ...)")
+	flag.BoolVar(&config.AgainstRelease, "against-release", false, "Diff the current reference against the manifest deployed in the cluster (helm get manifest)")
+	flag.BoolVar(&config.SortKeys, "sort-keys", true, "Sort mapping keys of rendered resources before diffing")
+	flag.Var(&ignoreFields, "ignore-field", "Field to drop from rendered resources before diffing, e.g. metadata.annotations.checksum/config (can specify multiple; * matches any key or list item)")
+	flag.BoolVar(&config.IgnoreHelmLabels, "ignore-helm-labels", false, "Ignore labels that change with every chart release (helm.sh/chart, app.kubernetes.io/version, app.kubernetes.io/managed-by)")
+	flag.BoolVar(&config.ShowSecrets, "show-secrets", false, "Show Secret data in diffs instead of replacing values with hashes")
+	flag.BoolVar(&config.InjectOwnership, "inject-ownership", false, "Add the release labels and annotations helm install sets (app.kubernetes.io/managed-by, meta.helm.sh/release-name, meta.helm.sh/release-namespace) before diffing")
+	flag.StringVar(&config.LookupFixtures, "lookup-fixtures", "", "YAML file with Kubernetes objects returned by lookup calls while rendering")
+	flag.BoolVar(&config.AllowLookup, "allow-lookup", false, "Let lookup calls query the current cluster while rendering (helm template --dry-run=server)")
+	flag.StringVar(&config.Inventory, "inventory", "", "Write an inventory of all resources rendered at the current reference to this file (.csv or .json)")
+	flag.StringVar(&config.ConfigFile, "config", "", "Configuration file with per-chart settings (default: "+repoConfigFileName+" in the git root, if present)")
+	flag.StringVar(&config.IdentityRules, "identity-rules", "", "YAML file with rules for matching resources between references by field or name pattern")
+	flag.BoolVar(&config.ExactNames, "exact-names", false, "Do not match removed and added resources whose names differ only in a generated hash suffix")
 	flag.BoolVar(&config.SkipDependencyBuild, "skip-dependency-build", false, "Skip building chart dependencies (use if dependencies are already up to date)")
+	flag.StringVar(&config.HelmBinary, "helm-binary", "", "Path or name of the helm executable (default: helm from PATH)")
+	flag.StringVar(&config.KubectlBinary, "kubectl-binary", "", "Path or name of the kubectl executable used by --server-dry-run (default: kubectl from PATH)")
+	flag.BoolVar(&config.ServerDryRun, "server-dry-run", false, "Submit added and modified resources to the cluster with a server-side dry run and report rejections")
+	flag.BoolVar(&config.NoCache, "no-cache", false, "Do not reuse or store built chart dependencies in the cache directory")
+	flag.Var(&permutations, "permute", "Render each chart once per combination of values: key=value[,value] (can specify multiple; both references use the same values)")
+	flag.Var(&envs, "env", "Render each chart once per environment: name=values-file[,values-file], relative to the chart (can specify multiple)")
+	flag.IntVar(&config.Concurrency, "concurrency", runtime.NumCPU(), "Number of charts to build and render in parallel")
+	flag.BoolVar(&config.PackageDiff, "package-diff", false, "Also compare the files helm package would include at both references")
+	flag.BoolVar(&config.ChartSize, "chart-size", false, "Report changes in chart size and file count, and new binary or large files")
+	flag.Var(&requiredLabels, "require-label", "Label that every added resource must carry (can specify multiple or separate with commas)")
+	flag.Var(&policies, "policy", "Policy the current rendering must not newly violate: "+strings.Join(policyNames, ", ")+" (can specify multiple or separate with commas)")
+	flag.IntVar(&config.RiskThreshold, "risk-threshold", 0, "Fail when a chart's risk score is above this value (0 disables)")
+	flag.Var(&requiredAnnotations, "require-annotation", "Annotation that every added resource must carry (can specify multiple or separate with commas)")
+	flag.StringVar(&config.DestructiveOutput, "destructive-output", "", "Write a JSON document listing every resource the change would delete or recreate to this file")
+	flag.StringVar(&config.RoutingOutput, "routing-output", "", "Write a JSON document mapping change categories to suggested reviewers to this file")
+	flag.StringVar(&config.ReviewersFile, "reviewers-file", defaultReviewersFile, "File mapping change categories to reviewers, relative to the git root")
+	flag.StringVar(&config.Output, "output", outputText, "Output format: text, json or markdown")
+	flag.StringVar(&config.ReleaseNotes, "release-notes", "", "Print release notes instead of diffs: markdown")
+	flag.StringVar(&config.Batch, "batch", "", "Diff every repository listed in this YAML file and print a combined report")
+	flag.StringVar(&config.SinceLastRun, "since-last-run", "", "Only show resource changes that differ from a previous run: a file written by --save-run, or \"comment\" to read them from the --comment pull request comment")
+	flag.StringVar(&config.SaveRun, "save-run", "", "Write fingerprints of this run's resource changes to this file for a later --since-last-run")
+	flag.StringVar(&config.Trailer, "trailer", "", "Write a signed block of per-chart diff digests, usable as commit trailers, to this file (- for stdout); key from $"+signingKeyEnv)
+	flag.StringVar(&config.VerifyTrailer, "verify-trailer", "", "Check that this run's diff matches a signed block from --trailer, read from a file or from the message of a commit")
+	flag.StringVar(&config.SignReport, "sign-report", "", "Sign the JSON report, with the compared commits and per-chart diff digests, using this PEM private key (requires --output json)")
+	flag.StringVar(&config.Comment, "comment", "", "Post or update a sticky pull request comment with the diff (supported: github, gitlab)")
+	flag.StringVar(&config.CI, "ci", "", "Publish results for a CI system (supported: github)")
+	flag.StringVar(&config.CPUProfile, "cpuprofile", "", "Write a CPU profile to this file")
+	flag.StringVar(&config.MemProfile, "memprofile", "", "Write a heap profile to this file on exit")
+	flag.StringVar(&config.Trace, "trace", "", "Write an execution trace to this file")
 
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: helm git-diff [flags] [CHART...]\n\n")
-		fmt.Fprintf(os.Stderr, "Show Kubernetes resource differences between git commits for Helm charts.\n\n")
+		fmt.Fprintf(os.Stderr, "Usage: helm git-diff [flags] [CHART...]\n")
+		fmt.Fprintf(os.Stderr, "       helm git-diff approve [--ref REF] CHART...\n\n")
+		fmt.Fprintf(os.Stderr, "Show Kubernetes resource differences between git commits for Helm charts.\n")
+		fmt.Fprintf(os.Stderr, "Use --base %s to diff each chart against its commit pinned in %s.\n\n", baseApproved, pinFileName)
 		fmt.Fprintf(os.Stderr, "Flags:\n")
 		flag.PrintDefaults()
 	}
@@ -86,486 +985,6760 @@ func parseFlags() *Config {
 	flag.Parse()
 	config.Charts = flag.Args()
 	config.SetValues = setValues
+	config.Color = string(color)
+	config.Envs = envs
+	config.Permutations = permutations
+	config.APIVersions = splitList(apiVersions)
+	config.ChartDirs = chartDirs
+	config.ChartDir = "."
+	if len(chartDirs) > 0 {
+		config.ChartDir = chartDirs[0]
+	}
+	config.IgnoreFields = splitList(ignoreFields)
+	config.RequiredLabels = splitList(requiredLabels)
+	config.RequiredAnnotations = splitList(requiredAnnotations)
+	config.Policies = splitList(policies)
 
 	if err := detectChartContext(config); err != nil {
 		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
 	}
 
-	config.useColor = shouldUseColor(config.NoColor)
+	config.useColor = shouldUseColor(config.Color, config.NoColor)
+
+	return config
+}
+
+func shouldUseColor(mode string, noColor bool) bool {
+	if noColor || mode == colorNever {
+		return false
+	}
+	if mode == colorAlways {
+		enableVirtualTerminal(os.Stdout)
+		return true
+	}
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if force, ok := colorForcedByEnv(); ok {
+		if force {
+			enableVirtualTerminal(os.Stdout)
+		}
+		return force
+	}
+	if os.Getenv("CLICOLOR") == "0" {
+		return false
+	}
+	if isCI() {
+		return false
+	}
+	if !isTerminal(os.Stdout) {
+		return false
+	}
+	return enableVirtualTerminal(os.Stdout)
+}
+
+func colorForcedByEnv() (bool, bool) {
+	if value := os.Getenv("FORCE_COLOR"); value != "" {
+		return value != "0" && !strings.EqualFold(value, "false"), true
+	}
+	if value := os.Getenv("CLICOLOR_FORCE"); value != "" && value != "0" {
+		return true, true
+	}
+	return false, false
+}
+
+func isTerminal(f *os.File) bool {
+	return term.IsTerminal(int(f.Fd()))
+}
+
+func isCI() bool {
+	ci := strings.ToLower(os.Getenv("CI"))
+	return ci == "true" || ci == "1"
+}
+
+func startProfiling(config *Config) (func() error, error) {
+	var stops []func() error
+
+	stop := func() error {
+		var errs []error
+		for i := len(stops) - 1; i >= 0; i-- {
+			errs = append(errs, stops[i]())
+		}
+		return errors.Join(errs...)
+	}
+
+	if config.CPUProfile != "" {
+		f, err := os.Create(config.CPUProfile)
+		if err != nil {
+			return nil, fmt.Errorf("creating CPU profile: %w", err)
+		}
+		if err := pprof.StartCPUProfile(f); err != nil {
+			_ = f.Close()
+			return nil, fmt.Errorf("starting CPU profile: %w", err)
+		}
+		stops = append(stops, func() error {
+			pprof.StopCPUProfile()
+			return f.Close()
+		})
+	}
+
+	if config.Trace != "" {
+		f, err := os.Create(config.Trace)
+		if err != nil {
+			_ = stop()
+			return nil, fmt.Errorf("creating trace: %w", err)
+		}
+		if err := trace.Start(f); err != nil {
+			_ = f.Close()
+			_ = stop()
+			return nil, fmt.Errorf("starting trace: %w", err)
+		}
+		stops = append(stops, func() error {
+			trace.Stop()
+			return f.Close()
+		})
+	}
+
+	if config.MemProfile != "" {
+		stops = append(stops, func() error {
+			f, err := os.Create(config.MemProfile)
+			if err != nil {
+				return fmt.Errorf("creating memory profile: %w", err)
+			}
+			runtime.GC()
+			if err := pprof.WriteHeapProfile(f); err != nil {
+				_ = f.Close()
+				return fmt.Errorf("writing memory profile: %w", err)
+			}
+			return f.Close()
+		})
+	}
+
+	return stop, nil
+}
+
+func detectChartContext(config *Config) error {
+	if len(config.Charts) > 0 {
+		return nil
+	}
+
+	if _, err := os.Stat("Chart.yaml"); err == nil {
+		cwd, err := os.Getwd()
+		if err != nil {
+			return err
+		}
+
+		gitRootPath, err := getGitRoot()
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(gitRootPath, cwd)
+		if err != nil {
+			return err
+		}
+
+		parentPath := filepath.Dir(relPath)
+		chartName := filepath.Base(relPath)
+
+		config.ChartDir = parentPath
+		config.Charts = []string{chartName}
+	}
+
+	return nil
+}
+
+func run(config *Config) error {
+	if config.CI != "" && config.CI != "github" {
+		return fmt.Errorf("unsupported --ci value %q (supported: github)", config.CI)
+	}
+	if config.Comment != "" && config.Comment != commentGitHub && config.Comment != commentGitLab {
+		return fmt.Errorf("unsupported --comment value %q (supported: github, gitlab)", config.Comment)
+	}
+	if config.Output != outputText && config.Output != outputJSON && config.Output != outputMarkdown {
+		return fmt.Errorf("unsupported --output value %q (supported: text, json, markdown)", config.Output)
+	}
+	if config.ReleaseNotes != "" && config.ReleaseNotes != outputMarkdown {
+		return fmt.Errorf("unsupported --release-notes value %q (supported: markdown)", config.ReleaseNotes)
+	}
+	if config.ReleaseNotes != "" && config.Output != outputText {
+		return fmt.Errorf("--release-notes cannot be combined with --output %s", config.Output)
+	}
+	if err := validatePolicies(config.Policies); err != nil {
+		return err
+	}
+	if config.SinceLastRun == lastRunComment && config.Comment == "" {
+		return fmt.Errorf("--since-last-run comment requires --comment")
+	}
+	if config.SignReport != "" {
+		if config.Output != outputJSON {
+			return fmt.Errorf("--sign-report requires --output json")
+		}
+		signer, err := loadReportSigner(config.SignReport)
+		if err != nil {
+			return fmt.Errorf("loading report signing key: %w", err)
+		}
+		config.reportSigner = signer
+	}
+	if (config.Trailer != "" || config.VerifyTrailer != "") && os.Getenv(signingKeyEnv) == "" {
+		return fmt.Errorf("--trailer and --verify-trailer require the signing key in $%s", signingKeyEnv)
+	}
+	if config.Trailer == "-" && textOutput(config) == io.Discard {
+		return fmt.Errorf("--trailer - requires text output on stdout; write the block to a file instead")
+	}
+	if config.GrepResource != "" {
+		selector, err := parseResourceSelector(config.GrepResource)
+		if err != nil {
+			return err
+		}
+		config.resourceFilter = &selector
+	}
+	if config.Concurrency < 1 {
+		return fmt.Errorf("--concurrency must be at least 1, got %d", config.Concurrency)
+	}
+	if config.Context < 0 {
+		return fmt.Errorf("--context must not be negative, got %d", config.Context)
+	}
+	if err := discoverTools(config); err != nil {
+		return err
+	}
+	if config.LookupFixtures != "" {
+		if config.AllowLookup {
+			return fmt.Errorf("--lookup-fixtures cannot be combined with --allow-lookup")
+		}
+		fixtures, err := render.LoadLookupFixtures(config.LookupFixtures)
+		if err != nil {
+			return fmt.Errorf("loading lookup fixtures: %w", err)
+		}
+		config.lookupHelper, err = render.LookupHelper(fixtures)
+		if err != nil {
+			return fmt.Errorf("loading lookup fixtures: %w", err)
+		}
+	}
+	if config.IdentityRules != "" {
+		rules, err := loadIdentityRules(config.IdentityRules)
+		if err != nil {
+			return fmt.Errorf("loading identity rules: %w", err)
+		}
+		config.identityRules = rules
+	}
+	if config.SinceLastRun != "" {
+		previous, err := loadPreviousRun(config)
+		if err != nil {
+			return fmt.Errorf("loading last run: %w", err)
+		}
+		config.previousRun = previous
+	}
+	startPager(config)
+	defer func() {
+		if err := flushPager(config); err != nil {
+			streams.diagnosticf("Warning: running pager: %v", err)
+		}
+	}()
+	out := streams.locked(textOutput(config))
+
+	if config.Batch != "" {
+		if err := runBatch(config, out); err != nil {
+			return err
+		}
+	} else if err := diffRepository(config, out); err != nil {
+		return err
+	}
+
+	if config.Anchors {
+		fmt.Fprintln(out, "##[run]")
+	}
+	if len(config.pruned) > 0 {
+		fmt.Fprint(out, formatPruneSection(config.pruned))
+	}
+	if len(config.teams) > 0 {
+		fmt.Fprint(out, formatTeamSection(config.teams))
+	}
+
+	if config.resourceFilter != nil && config.changed == 0 {
+		fmt.Fprintf(out, "No changes to %s\n", config.GrepResource)
+	}
+	if config.Summary {
+		fmt.Fprintf(out, "TOTAL: %s\n", formatTotals(resourceTotals(config.results), config.changed))
+	}
+	if config.restarts > 0 {
+		fmt.Fprintf(out, "ROLLOUT: %s will restart\n", workloadCount(config.restarts))
+	}
+	fmt.Fprintf(out, "RESULT: changed=%d unchanged=%d skipped=%d errors=%d\n", config.changed, config.unchanged, config.skipped, len(config.failures))
+
+	if err := writeReport(config, streams.locked(os.Stdout)); err != nil {
+		return fmt.Errorf("writing %s output: %w", config.Output, err)
+	}
+
+	if config.Trailer != "" {
+		if err := writeTrailer(config); err != nil {
+			return fmt.Errorf("writing trailer: %w", err)
+		}
+	}
+
+	if config.VerifyTrailer != "" {
+		if err := verifyTrailer(config); err != nil {
+			return fmt.Errorf("verifying trailer: %w", err)
+		}
+	}
+
+	if config.SaveRun != "" {
+		if err := writeRunFingerprints(config.SaveRun, config.fingerprints); err != nil {
+			return fmt.Errorf("writing run fingerprints: %w", err)
+		}
+	}
+
+	if config.Inventory != "" {
+		if err := writeInventory(config.Inventory, config.inventory); err != nil {
+			return fmt.Errorf("writing inventory: %w", err)
+		}
+	}
+
+	if config.DestructiveOutput != "" {
+		if err := writeDestructiveChanges(config.DestructiveOutput, config.destructiveChanges, config.failures); err != nil {
+			return fmt.Errorf("writing destructive changes: %w", err)
+		}
+	}
+
+	if config.CI == "github" {
+		if err := writeGitHubOutputs(config); err != nil {
+			return fmt.Errorf("writing GitHub outputs: %w", err)
+		}
+	}
+
+	if config.Comment != "" {
+		if err := postComment(config); err != nil {
+			return fmt.Errorf("posting %s comment: %w", config.Comment, err)
+		}
+	}
+
+	if config.RoutingOutput != "" {
+		if err := writeRouting(config); err != nil {
+			return fmt.Errorf("writing routing output: %w", err)
+		}
+	}
+
+	gateErr := checkGates(config)
+	if len(config.failures) > 0 {
+		if gateErr != nil && !errors.Is(gateErr, errDifferencesFound) {
+			printError(streams.locked(streams.stderr), gateErr)
+		}
+		return errChartsFailed
+	}
+	return gateErr
+}
+
+// checkGates reports policy violations and returns the first failed gate.
+func checkGates(config *Config) error {
+	if len(config.violations) > 0 {
+		streams.diagnosticf("Policy violations:\n  %s", strings.Join(config.violations, "\n  "))
+		return fmt.Errorf("%d policy violations introduced by this change", len(config.violations))
+	}
+
+	if config.RiskThreshold > 0 {
+		var risky []string
+		for _, result := range config.results {
+			if result.RiskScore > config.RiskThreshold {
+				risky = append(risky, fmt.Sprintf("%s (%d)", result.Chart, result.RiskScore))
+			}
+		}
+		if len(risky) > 0 {
+			return fmt.Errorf("risk score above %d: %s", config.RiskThreshold, strings.Join(risky, ", "))
+		}
+	}
+
+	if config.dryRunRejected > 0 {
+		return fmt.Errorf("%d resources rejected by server-side dry run", config.dryRunRejected)
+	}
+
+	if config.FailOnDiff && config.hasDifferences {
+		return errDifferencesFound
+	}
+
+	return nil
+}
+
+func diffRepository(config *Config, out io.Writer) error {
+	repoConfig, err := loadRepoConfig(config.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("loading configuration: %w", err)
+	}
+	config.repoConfig = repoConfig
+	if len(config.Policies) == 0 && repoConfig != nil {
+		config.Policies = repoConfig.Policies
+	}
+
+	if config.Base == baseApproved {
+		pins, err := loadPins()
+		if err != nil {
+			return fmt.Errorf("loading approved pins: %w", err)
+		}
+		config.pins = pins
+	}
+
+	comparable, err := checkRefs(config, out)
+	if err != nil {
+		return err
+	}
+	if comparable {
+		if err := diffChangedCharts(config, out); err != nil {
+			return err
+		}
+	}
+
+	if config.Inventory != "" {
+		return inventoryCharts(config)
+	}
+	return nil
+}
+
+func diffChangedCharts(config *Config, out io.Writer) error {
+	if len(config.Charts) == 0 {
+		detect := detectChangedCharts
+		if config.pins != nil {
+			detect = detectChangedApprovedCharts
+		}
+		changedCharts, err := detect(config)
+		if err != nil {
+			return fmt.Errorf("detecting changed charts: %w", err)
+		}
+		config.Charts = excludeCharts(changedCharts, config.repoConfig)
+
+		if len(config.Charts) == 0 {
+			fmt.Fprintln(out, "No chart changes detected")
+			return nil
+		}
+
+		fmt.Fprintf(out, "Detected changed charts: %s\n\n", strings.Join(config.Charts, ", "))
+	}
+
+	return diffCharts(config)
+}
+
+func checkRefs(config *Config, out io.Writer) (bool, error) {
+	current, err := verifyRef("--current", config.Current)
+	if err != nil {
+		return false, err
+	}
+	if config.Base == baseApproved || config.AgainstRelease {
+		return true, nil
+	}
+	base, err := verifyRef("--base", config.Base)
+	if err != nil {
+		return false, err
+	}
+
+	if base == current {
+		if config.Current == "HEAD" && workingTreeDirty() {
+			return true, nil
+		}
+		fmt.Fprintf(out, "Base %s equals current %s (%s), nothing to compare\n", config.Base, config.Current, shortCommit(base))
+		return false, nil
+	}
+	if gitCommand("merge-base", "--is-ancestor", current, base).Run() == nil {
+		streams.diagnosticf("Warning: --base %s is ahead of --current %s, changes are shown in reverse (swap the refs?)", config.Base, config.Current)
+	}
+	return true, nil
+}
+
+func verifyRef(flagName, ref string) (string, error) {
+	output, err := gitCommand("rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+	if err == nil {
+		return strings.TrimSpace(string(output)), nil
+	}
+
+	message := fmt.Sprintf("%s %s not found", flagName, ref)
+	var hints []errorHint
+	if suggestions := refSuggestions(ref); len(suggestions) > 0 {
+		message += fmt.Sprintf(", did you mean %s?", strings.Join(suggestions, " or "))
+		hints = append(hints, errorHint{Problem: fmt.Sprintf("%s exists as %s", ref, suggestions[0]), Command: rerunCommand(flagName, suggestions[0])})
+	} else if remote, branch, ok := strings.Cut(ref, "/"); ok && remoteExists(remote) {
+		hints = append(hints, errorHint{Problem: fmt.Sprintf("%s has not been fetched", ref), Command: fmt.Sprintf("git fetch %s %s", remote, branch)})
+	}
+	if shallow, err := gitCommand("rev-parse", "--is-shallow-repository").Output(); err == nil && strings.TrimSpace(string(shallow)) == "true" {
+		hints = append(hints, errorHint{Problem: "the repository is a shallow clone (use fetch-depth: 0 in actions/checkout)", Command: "git fetch --unshallow"})
+	}
+	return "", withHints(errors.New(message), hints...)
+}
+
+func refSuggestions(ref string) []string {
+	output, err := gitCommand("for-each-ref", "--format=%(refname:short)", "refs/heads", "refs/remotes", "refs/tags").Output()
+	if err != nil {
+		return nil
+	}
+	name := path.Base(ref)
+	var suggestions []string
+	for _, candidate := range strings.Split(strings.TrimSpace(string(output)), "\n") {
+		if candidate == "" || candidate == ref || strings.HasSuffix(candidate, "/HEAD") {
+			continue
+		}
+		if candidate == name || strings.HasSuffix(candidate, "/"+name) {
+			suggestions = append(suggestions, candidate)
+		}
+	}
+	if len(suggestions) > 3 {
+		suggestions = suggestions[:3]
+	}
+	return suggestions
+}
+
+func remoteExists(remote string) bool {
+	return gitCommand("remote", "get-url", remote).Run() == nil
+}
+
+func workingTreeDirty() bool {
+	output, err := gitCommand("status", "--porcelain").Output()
+	return err != nil || len(bytes.TrimSpace(output)) > 0
+}
+
+func runBatch(config *Config, out io.Writer) error {
+	batch, err := loadBatch(config.Batch)
+	if err != nil {
+		return fmt.Errorf("loading batch file: %w", err)
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return err
+	}
+	batchDir, err := filepath.Abs(filepath.Dir(config.Batch))
+	if err != nil {
+		return err
+	}
+
+	template := *config
+	var valuesFiles []string
+	for _, valuesFile := range splitList([]string{config.ValuesFiles}) {
+		absPath, err := filepath.Abs(valuesFile)
+		if err != nil {
+			return err
+		}
+		valuesFiles = append(valuesFiles, absPath)
+	}
+	template.ValuesFiles = strings.Join(valuesFiles, ",")
+
+	for _, repo := range batch.Repositories {
+		fmt.Fprintf(out, "==> %s\n", repo.Name)
+
+		repoConfig := template
+		if repo.Base != "" {
+			repoConfig.Base = repo.Base
+		}
+		if repo.Current != "" {
+			repoConfig.Current = repo.Current
+		}
+		if repo.ChartDir != "" {
+			repoConfig.ChartDir = repo.ChartDir
+			repoConfig.ChartDirs = []string{repo.ChartDir}
+		}
+		repoConfig.Charts = nil
+
+		err := diffBatchRepository(&repoConfig, repo, batchDir, out)
+		if chdirErr := os.Chdir(cwd); chdirErr != nil {
+			return chdirErr
+		}
+		if err != nil {
+			recordChartError(config, repo.Name, err)
+			fmt.Fprintln(out)
+			continue
+		}
+		mergeBatchResults(config, &repoConfig, repo.Name)
+		fmt.Fprintln(out)
+	}
+
+	return nil
+}
+
+func diffBatchRepository(config *Config, repo batchRepository, batchDir string, out io.Writer) error {
+	dir := repo.Path
+	if repo.URL != "" {
+		cloneDir, err := os.MkdirTemp("", "helm-git-diff-batch-*")
+		if err != nil {
+			return fmt.Errorf("creating temp dir: %w", err)
+		}
+		defer func() {
+			_ = os.RemoveAll(cloneDir)
+		}()
+		if output, err := gitCommand("clone", "--quiet", repo.URL, cloneDir).CombinedOutput(); err != nil {
+			return fmt.Errorf("cloning %s: %s", repo.URL, strings.TrimSpace(string(output)))
+		}
+		dir = cloneDir
+	} else if !filepath.IsAbs(dir) {
+		dir = filepath.Join(batchDir, dir)
+	}
+
+	if err := os.Chdir(dir); err != nil {
+		return err
+	}
+	if err := checkGitRepo(); err != nil {
+		return err
+	}
+
+	for _, pattern := range repo.Charts {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid chart glob %q: %w", pattern, err)
+		}
+		for _, match := range matches {
+			if _, err := os.Stat(filepath.Join(match, "Chart.yaml")); err == nil {
+				config.Charts = append(config.Charts, filepath.ToSlash(match))
+			}
+		}
+	}
+	if len(repo.Charts) > 0 && len(config.Charts) == 0 {
+		fmt.Fprintln(out, "No charts match the configured globs")
+		return nil
+	}
+
+	return diffRepository(config, out)
+}
+
+func mergeBatchResults(config, repoConfig *Config, repoName string) {
+	prefix := repoName + "/"
+	for _, result := range repoConfig.results {
+		result.Chart = prefix + result.Chart
+		config.results = append(config.results, result)
+	}
+	for _, failure := range repoConfig.failures {
+		failure.Chart = prefix + failure.Chart
+		config.failures = append(config.failures, failure)
+	}
+	for _, violation := range repoConfig.violations {
+		config.violations = append(config.violations, prefix+violation)
+	}
+	for _, route := range repoConfig.routes {
+		route.Chart = prefix + route.Chart
+		config.routes = append(config.routes, route)
+	}
+	for _, pruned := range repoConfig.pruned {
+		pruned.Chart = prefix + pruned.Chart
+		config.pruned = append(config.pruned, pruned)
+	}
+	for _, item := range repoConfig.inventory {
+		item.Chart = prefix + item.Chart
+		config.inventory = append(config.inventory, item)
+	}
+	for _, chart := range repoConfig.changedCharts {
+		config.changedCharts = append(config.changedCharts, prefix+chart)
+	}
+	config.hasDifferences = config.hasDifferences || repoConfig.hasDifferences
+	config.destructive += repoConfig.destructive
+	config.changed += repoConfig.changed
+	config.unchanged += repoConfig.unchanged
+	config.skipped += repoConfig.skipped
+}
+
+func loadBatch(path string) (*batchFile, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var batch batchFile
+	if err := yaml.Unmarshal(content, &batch); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+	if len(batch.Repositories) == 0 {
+		return nil, fmt.Errorf("%s lists no repositories", path)
+	}
+	for i, repo := range batch.Repositories {
+		if (repo.Path == "") == (repo.URL == "") {
+			return nil, fmt.Errorf("repository %d: exactly one of path or url is required", i+1)
+		}
+		if repo.Name == "" {
+			batch.Repositories[i].Name = strings.TrimSuffix(filepath.Base(repo.Path+repo.URL), ".git")
+		}
+	}
+	return &batch, nil
+}
+
+func detectChangedCharts(config *Config) ([]string, error) {
+	changedFiles, err := listChangedFiles(config)
+	if err != nil {
+		return nil, err
+	}
+
+	chartDirs, err := listCurrentChartDirs(config)
+	if err != nil {
+		return nil, err
+	}
+	baseRef := config.Base
+	if config.Since != "" {
+		baseRef = config.Since
+	}
+	baseChartDirs, err := listChartDirs(baseRef)
+	if err != nil {
+		return nil, err
+	}
+	charts := topLevelCharts(append(chartDirs, baseChartDirs...))
+
+	roots := config.ChartDirs
+	if len(roots) == 0 {
+		roots = []string{config.ChartDir}
+	}
+
+	excludes := chartExcludeDirs(config)
+	chartSet := make(map[string]bool)
+	var changed []string
+	for _, file := range changedFiles {
+		if file == "" || !underAnyRoot(file, roots) {
+			continue
+		}
+
+		chart := enclosingChart(file, charts)
+		if chart == "" || chartSet[chart] {
+			continue
+		}
+		if excludedChartFile(file, chart, excludes) && !referencedChartFile(config, file, chart, baseRef) {
+			continue
+		}
+		chartSet[chart] = true
+		changed = append(changed, chartArgument(config.ChartDir, chart))
+	}
+
+	sort.Strings(changed)
+	return changed, nil
+}
+
+func chartExcludeDirs(config *Config) []string {
+	var dirs []string
+	for _, dir := range strings.Split(config.ChartExcludes, ",") {
+		if dir = strings.Trim(strings.TrimSpace(dir), "/"); dir != "" {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs
+}
+
+func excludedChartFile(file, chart string, excludes []string) bool {
+	rel := chartRelativePath(file, chart)
+	for _, dir := range excludes {
+		if strings.HasPrefix(rel, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func referencedChartFile(config *Config, file, chart, baseRef string) bool {
+	chartFile := path.Join(chart, "Chart.yaml")
+	reads := []func() ([]byte, error){
+		func() ([]byte, error) { return repoVCS.show(baseRef, chartFile) },
+		func() ([]byte, error) { return repoVCS.show(config.Current, chartFile) },
+	}
+	if config.Current == "HEAD" {
+		reads[1] = func() ([]byte, error) {
+			gitRoot, err := getGitRoot()
+			if err != nil {
+				return nil, err
+			}
+			return os.ReadFile(filepath.Join(gitRoot, filepath.FromSlash(chartFile)))
+		}
+	}
+
+	rel := chartRelativePath(file, chart)
+	for _, read := range reads {
+		content, err := read()
+		if err != nil {
+			continue
+		}
+		annotations, err := parseChartAnnotations(content)
+		if err != nil {
+			continue
+		}
+		if chartValuesReferences(annotations, config.Envs)[rel] {
+			return true
+		}
+	}
+	return false
+}
+
+func chartRelativePath(file, chart string) string {
+	if chart == "." {
+		return file
+	}
+	return strings.TrimPrefix(file, chart+"/")
+}
+
+func chartValuesReferences(annotations map[string]string, envs []chartEnv) map[string]bool {
+	files := splitList([]string{annotations[annotationExtraValues]})
+	for _, env := range envs {
+		files = append(files, env.ValuesFiles...)
+	}
+
+	references := make(map[string]bool, len(files))
+	for _, file := range files {
+		references[path.Clean(filepath.ToSlash(file))] = true
+	}
+	return references
+}
+
+func listChartDirs(ref string) ([]string, error) {
+	output, err := gitCommand("ls-tree", "-r", "--name-only", "-z", ref).Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing files at %s: %w", ref, err)
+	}
+	return chartDirsOf(splitNul(output)), nil
+}
+
+// listCurrentChartDirs lists the charts at the current reference. For HEAD
+// that includes charts that are only staged or untracked in the working tree.
+func listCurrentChartDirs(config *Config) ([]string, error) {
+	dirs, err := listChartDirs(config.Current)
+	if err != nil || config.Current != "HEAD" {
+		return dirs, err
+	}
+
+	output, err := gitCommand("ls-files", "-z", "--cached", "--others", "--exclude-standard").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing working tree files: %w", err)
+	}
+	for _, dir := range chartDirsOf(splitNul(output)) {
+		if !slices.Contains(dirs, dir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	return dirs, nil
+}
+
+func chartDirsOf(files []string) []string {
+	var dirs []string
+	for _, file := range files {
+		if file == "Chart.yaml" || strings.HasSuffix(file, "/Chart.yaml") {
+			dirs = append(dirs, path.Dir(file))
+		}
+	}
+	return dirs
+}
+
+func topLevelCharts(chartDirs []string) []string {
+	sorted := append([]string{}, chartDirs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return len(sorted[i]) < len(sorted[j])
+	})
+
+	var charts []string
+	for _, dir := range sorted {
+		if enclosingChart(dir+"/Chart.yaml", charts) == "" {
+			charts = append(charts, dir)
+		}
+	}
+	return charts
+}
+
+func enclosingChart(file string, charts []string) string {
+	for _, chart := range charts {
+		if chart == "." || strings.HasPrefix(file, chart+"/") {
+			return chart
+		}
+	}
+	return ""
+}
+
+func underAnyRoot(file string, roots []string) bool {
+	for _, root := range roots {
+		root = path.Clean(filepath.ToSlash(root))
+		if root == "." || strings.HasPrefix(file, root+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func chartArgument(chartDir, chart string) string {
+	if path.Dir(chart) == path.Clean(filepath.ToSlash(chartDir)) {
+		return path.Base(chart)
+	}
+	return chart
+}
+
+func listChangedFiles(config *Config) ([]string, error) {
+	var changed []string
+	if config.Since == "" {
+		cmd := gitCommand("diff", "--name-only", "-z", "-M", config.Base, config.Current)
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running git diff: %w", err)
+		}
+		changed = splitNul(output)
+	} else {
+		cmd := gitCommand("log", "--format=", "--name-only", "-z", "-M", "-m", config.Since+".."+config.Current)
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running git log: %w", err)
+		}
+		changed = splitNul(output)
+	}
+
+	if config.Current == "HEAD" {
+		uncommitted, err := uncommittedFiles()
+		if err != nil {
+			return nil, err
+		}
+		changed = append(changed, uncommitted...)
+	}
+
+	seen := make(map[string]bool)
+	var files []string
+	for _, file := range changed {
+		if file = strings.Trim(file, "\n"); file != "" && !seen[file] {
+			seen[file] = true
+			files = append(files, file)
+		}
+	}
+	return files, nil
+}
+
+// uncommittedFiles lists the staged, modified and untracked files of the
+// working tree, which a HEAD comparison includes.
+func uncommittedFiles() ([]string, error) {
+	modified, err := gitCommand("diff", "--name-only", "-z", "HEAD").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing uncommitted changes: %w", err)
+	}
+	untracked, err := gitCommand("ls-files", "-z", "--others", "--exclude-standard", "--full-name").Output()
+	if err != nil {
+		return nil, fmt.Errorf("listing untracked files: %w", err)
+	}
+	return append(splitNul(modified), splitNul(untracked)...), nil
+}
+
+func detectChangedApprovedCharts(config *Config) ([]string, error) {
+	paths := make([]string, 0, len(config.pins))
+	for path := range config.pins {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+
+	var charts []string
+	for _, path := range paths {
+		cmd := gitCommand("diff", "--name-only", config.pins[path], config.Current, "--", path)
+		output, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("running git diff for %s: %w", path, err)
+		}
+		if strings.TrimSpace(string(output)) != "" {
+			charts = append(charts, path)
+		}
+	}
+
+	return charts, nil
+}
+
+func diffCharts(config *Config) error {
+	prepared := make([]*chartSources, 0, len(config.Charts))
+	defer func() {
+		for _, sources := range prepared {
+			cleanupChartSources(sources)
+		}
+	}()
+
+	for _, chart := range config.Charts {
+		sources, err := prepareChart(config, chart)
+		if err != nil {
+			sources = &chartSources{Err: err}
+		}
+		prepared = append(prepared, sources)
+	}
+
+	if missing := missingValuesFiles(config, config.Charts, prepared); len(missing) > 0 {
+		return fmt.Errorf("%d values files not found:\n  %s", len(missing), strings.Join(missing, "\n  "))
+	}
+
+	prebuildDependencies(prepared, config.SkipDependencyBuild, config.Concurrency, dependencyCacheDir(config))
+
+	charts, targets := config.Charts, prepared
+	if len(config.Envs) > 0 {
+		charts, targets = expandEnvironments(config.Charts, prepared, config.Envs)
+	}
+	if len(config.Permutations) > 0 {
+		charts, targets = expandPermutations(charts, targets, config.Permutations)
+	}
+	renderCharts(config, targets)
+
+	for i, chart := range charts {
+		err := targets[i].Err
+		if err == nil {
+			err = diffChart(config, chart, targets[i])
+		}
+		if err != nil {
+			recordChartError(config, chart, err)
+		}
+	}
+	if len(config.Permutations) > 0 {
+		fmt.Fprint(streams.locked(textOutput(config)), formatPermutationSummary(config.results, charts, targets))
+	}
+	return nil
+}
+
+// inventoryCharts renders the charts at the current reference that the run
+// did not diff, so that --inventory lists every resource of the current
+// rendering and not only those of changed charts.
+func inventoryCharts(config *Config) error {
+	chartDirs, err := listCurrentChartDirs(config)
+	if err != nil {
+		return fmt.Errorf("listing charts: %w", err)
+	}
+	roots := config.ChartDirs
+	if len(roots) == 0 {
+		roots = []string{config.ChartDir}
+	}
+
+	diffed := make(map[string]bool, len(config.Charts))
+	for _, chart := range config.Charts {
+		if chartPath, err := resolveChartPath(config.ChartDir, chart); err == nil {
+			diffed[filepath.ToSlash(chartPath)] = true
+		}
+	}
+
+	var candidates []string
+	for _, dir := range topLevelCharts(chartDirs) {
+		if underAnyRoot(dir+"/Chart.yaml", roots) && !diffed[dir] {
+			candidates = append(candidates, chartArgument(config.ChartDir, dir))
+		}
+	}
+	charts := excludeCharts(candidates, config.repoConfig)
+	sort.Strings(charts)
+
+	prepared := make([]*chartSources, 0, len(charts))
+	defer func() {
+		for _, sources := range prepared {
+			cleanupChartSources(sources)
+		}
+	}()
+	for _, chart := range charts {
+		sources, err := prepareInventoryChart(config, chart)
+		if err != nil {
+			sources = &chartSources{Err: err}
+		}
+		prepared = append(prepared, sources)
+	}
+
+	prebuildDependencies(prepared, config.SkipDependencyBuild, config.Concurrency, dependencyCacheDir(config))
+
+	targets := prepared
+	if len(config.Envs) > 0 {
+		charts, targets = expandEnvironments(charts, prepared, config.Envs)
+	}
+	for i, chart := range charts {
+		sources := targets[i]
+		if sources.SkipReason != "" {
+			continue
+		}
+		err := sources.Err
+		if err == nil {
+			err = renderInventoryChart(config, chart, sources)
+		}
+		if err != nil {
+			recordChartError(config, chart, err)
+		}
+	}
+	return nil
+}
+
+// prepareInventoryChart resolves only the current side of a chart, as the
+// inventory has nothing to compare it with.
+func prepareInventoryChart(config *Config, chartName string) (*chartSources, error) {
+	chartPath, err := resolveChartPath(config.ChartDir, chartName)
+	if err != nil {
+		return nil, withReason(reasonInvalidChart, fmt.Errorf("resolving chart path: %w", err))
+	}
+
+	settings := chartSettings(config, chartName, chartPath)
+	valuesFiles := strings.Join(settings.Values, ",")
+	sources := &chartSources{Path: chartPath, SetValues: settings.Set, ReleaseName: settings.ReleaseName, Namespace: settings.Namespace, CurrentValues: valuesFiles}
+
+	if config.Current == "HEAD" {
+		workdirPath, err := getWorkdirChartPath(chartPath)
+		if err != nil {
+			return nil, withReason(reasonInvalidChart, fmt.Errorf("getting workdir chart path: %w", err))
+		}
+		sources.Current = workdirPath
+		sources.inWorkdir = true
+	} else {
+		currentPath, cleanup, err := extractChartAtRef(chartPath, config.Current)
+		if err != nil {
+			return nil, withReason(reasonExtractFailed, fmt.Errorf("extracting current chart: %w", err))
+		}
+		sources.Current = currentPath
+		sources.cleanups = append(sources.cleanups, cleanup)
+
+		if config.ValuesFromRef && valuesFiles != "" {
+			currentValues, cleanup, err := extractValuesFiles(valuesFiles, config.Current)
+			if err != nil {
+				cleanupChartSources(sources)
+				return nil, withReason(reasonValuesFailed, fmt.Errorf("extracting current values files: %w", err))
+			}
+			sources.CurrentValues = currentValues
+			sources.cleanups = append(sources.cleanups, cleanup)
+		}
+	}
+
+	reason, err := chartSkipReason(sources.Current)
+	if err != nil {
+		cleanupChartSources(sources)
+		return nil, err
+	}
+	if reason != "" {
+		sources.SkipReason = reason
+		return sources, nil
+	}
+
+	if err := removeChartExcludes(sources, chartPath, chartExcludeDirs(config), config.Envs); err != nil {
+		cleanupChartSources(sources)
+		return nil, withReason(reasonExtractFailed, fmt.Errorf("removing excluded directories: %w", err))
+	}
+	return sources, nil
+}
+
+func renderInventoryChart(config *Config, chartName string, sources *chartSources) error {
+	valuesFiles, err := sourceValuesFiles(sources, sources.Current, sources.CurrentValues)
+	if err != nil {
+		return withReason(reasonValuesFailed, fmt.Errorf("resolving current values files: %w", err))
+	}
+	manifest, err := renderChart(sources.Current, valuesFiles, chartSetValues(config, sources), chartTemplateOptions(config, sources))
+	if err != nil {
+		return withReason(reasonRenderFailed, fmt.Errorf("rendering current manifest: %w", err))
+	}
+	return collectInventory(config, chartName, manifest)
+}
+
+func collectInventory(config *Config, chartName, manifest string) error {
+	resources, err := parseManifest(manifest)
+	if err != nil {
+		return withReason(reasonParseFailed, fmt.Errorf("parsing current manifest: %w", err))
+	}
+	for _, res := range resources {
+		config.inventory = append(config.inventory, inventoryItem{
+			Chart:      chartName,
+			APIVersion: res.APIVersion,
+			Kind:       res.Kind,
+			Namespace:  res.Namespace,
+			Name:       res.Name,
+			Source:     res.Source,
+		})
+	}
+	return nil
+}
+
+func expandPermutations(charts []string, prepared []*chartSources, permutations []chartPermutation) ([]string, []*chartSources) {
+	combinations := [][]string{nil}
+	for _, permutation := range permutations {
+		var next [][]string
+		for _, combination := range combinations {
+			for _, value := range permutation.Values {
+				next = append(next, append(slices.Clone(combination), permutation.Key+"="+value))
+			}
+		}
+		combinations = next
+	}
+
+	var names []string
+	var targets []*chartSources
+	for i, sources := range prepared {
+		if sources.SkipReason != "" || sources.Err != nil {
+			names = append(names, charts[i])
+			targets = append(targets, sources)
+			continue
+		}
+		for _, combination := range combinations {
+			target := *sources
+			target.cleanups = nil
+			target.Permutation = combination
+			target.PermutationOf = charts[i]
+			names = append(names, fmt.Sprintf("%s[%s]", charts[i], strings.Join(combination, ",")))
+			targets = append(targets, &target)
+		}
+	}
+	return names, targets
+}
+
+func formatPermutationSummary(results []chartResult, charts []string, targets []*chartSources) string {
+	statuses := make(map[string]string, len(results))
+	for _, result := range results {
+		statuses[result.Chart] = result.Status
+	}
+
+	var order []string
+	byStatus := make(map[string]map[string][]string)
+	for i, target := range targets {
+		if target.PermutationOf == "" {
+			continue
+		}
+		if byStatus[target.PermutationOf] == nil {
+			order = append(order, target.PermutationOf)
+			byStatus[target.PermutationOf] = make(map[string][]string)
+		}
+		status := statuses[charts[i]]
+		byStatus[target.PermutationOf][status] = append(byStatus[target.PermutationOf][status], strings.Join(target.Permutation, ","))
+	}
+	if len(order) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteString("\nPermutations:\n")
+	for _, chart := range order {
+		var parts []string
+		for _, status := range []string{statusChanged, statusUnchanged, statusFailed} {
+			if combinations := byStatus[chart][status]; len(combinations) > 0 {
+				parts = append(parts, fmt.Sprintf("%s under [%s]", status, strings.Join(combinations, "] [")))
+			}
+		}
+		fmt.Fprintf(&b, "  %s: %s\n", chart, strings.Join(parts, "; "))
+	}
+	return b.String()
+}
+
+func missingValuesFiles(config *Config, charts []string, prepared []*chartSources) []string {
+	currentWhere := "at " + config.Current
+	currentRef := config.Current
+	if config.Current == "HEAD" {
+		currentWhere = "in the working tree"
+		currentRef = ""
+	}
+	gitRoot, err := getGitRoot()
+	if err != nil {
+		gitRoot = ""
+	}
+
+	var missing []string
+	seen := make(map[string]bool)
+	add := func(entry string) {
+		if !seen[entry] {
+			seen[entry] = true
+			missing = append(missing, entry)
+		}
+	}
+
+	for i, sources := range prepared {
+		if sources.Err != nil || sources.SkipReason != "" {
+			continue
+		}
+		type valuesSide struct {
+			path, ref, where string
+		}
+		base := valuesSide{sources.Base, sources.BaseRef, "at " + sources.BaseRef}
+		current := valuesSide{sources.Current, currentRef, currentWhere}
+		sides := []valuesSide{base, current}
+		if config.AgainstRelease {
+			sides = sides[1:]
+		}
+
+		// Values files inside the chart are read from the side's own copy.
+		for _, side := range sides {
+			if side.path == "" {
+				continue
+			}
+			chartFiles, err := chartValuesFiles(side.path, "")
+			if err != nil {
+				continue
+			}
+			files := splitList([]string{chartFiles})
+			for _, env := range config.Envs {
+				for _, envFile := range env.ValuesFiles {
+					if addedEnvValues(sources, side.path, envFile) {
+						continue
+					}
+					files = append(files, filepath.Join(side.path, envFile))
+				}
+			}
+			for _, file := range files {
+				if _, err := os.Stat(file); !os.IsNotExist(err) {
+					continue
+				}
+				if rel, err := filepath.Rel(side.path, file); err == nil && filepath.IsLocal(rel) {
+					file = filepath.Join(sources.Path, rel)
+				}
+				add(fmt.Sprintf("%s: %s (%s)", charts[i], filepath.ToSlash(file), side.where))
+			}
+		}
+
+		// --values files come from the working tree, or from each ref with
+		// --values-from-ref, where a file only the base lacks was added.
+		for _, file := range splitList(chartSettings(config, charts[i], sources.Path).Values) {
+			if !config.ValuesFromRef {
+				if !valuesFileExists(gitRoot, file, "") {
+					add(fmt.Sprintf("%s (in the working tree)", filepath.ToSlash(file)))
+				}
+				continue
+			}
+			inCurrent := sources.Current == "" || valuesFileExists(gitRoot, file, current.ref)
+			if !inCurrent {
+				add(fmt.Sprintf("%s (%s)", filepath.ToSlash(file), current.where))
+			}
+			if sources.Base != "" && !config.AgainstRelease && !inCurrent && !valuesFileExists(gitRoot, file, base.ref) {
+				add(fmt.Sprintf("%s (%s)", filepath.ToSlash(file), base.where))
+			}
+		}
+	}
+	return missing
+}
+
+// valuesFileExists reports whether a --values file exists at ref, or in the
+// working tree when ref is empty or the file is outside the repository.
+func valuesFileExists(gitRoot, valuesFile, ref string) bool {
+	if ref != "" && gitRoot != "" {
+		if gitPath, ok := valuesGitPath(gitRoot, valuesFile); ok {
+			return gitCommand("cat-file", "-e", ref+":"+gitPath).Run() == nil
+		}
+	}
+	_, err := os.Stat(valuesFile)
+	return !os.IsNotExist(err)
+}
+
+// valuesGitPath returns the path of a values file for git revision syntax,
+// and false for files outside the repository.
+func valuesGitPath(gitRoot, valuesFile string) (string, bool) {
+	if !filepath.IsAbs(valuesFile) {
+		return "./" + filepath.ToSlash(valuesFile), true
+	}
+	rel, err := filepath.Rel(gitRoot, valuesFile)
+	if err != nil || strings.HasPrefix(rel, "..") {
+		return "", false
+	}
+	return filepath.ToSlash(rel), true
+}
+
+func expandEnvironments(charts []string, prepared []*chartSources, envs []chartEnv) ([]string, []*chartSources) {
+	var names []string
+	var targets []*chartSources
+	for i, sources := range prepared {
+		if sources.SkipReason != "" || sources.Err != nil {
+			names = append(names, charts[i])
+			targets = append(targets, sources)
+			continue
+		}
+		for _, env := range envs {
+			target := *sources
+			target.cleanups = nil
+			target.Env = env.Name
+			target.EnvValues = env.ValuesFiles
+			names = append(names, fmt.Sprintf("%s[%s]", charts[i], env.Name))
+			targets = append(targets, &target)
+		}
+	}
+	return names, targets
+}
+
+func renderCharts(config *Config, prepared []*chartSources) {
+	jobs := make(chan *chartSources)
+	var wg sync.WaitGroup
+	for range max(config.Concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for sources := range jobs {
+				sources.Err = renderChartSources(config, sources)
+			}
+		}()
+	}
+
+	for _, sources := range prepared {
+		if sources.SkipReason != "" || sources.Err != nil {
+			continue
+		}
+		jobs <- sources
+	}
+	close(jobs)
+	wg.Wait()
+}
+
+func renderChartSources(config *Config, sources *chartSources) error {
+	if config.AgainstRelease && sources.Current != "" {
+		release, err := render.ReleaseName(sources.Current, chartTemplateOptions(config, sources))
+		if err != nil {
+			return withReason(reasonInvalidChart, err)
+		}
+		sources.Release = release
+		sources.BaseManifest, err = fetchReleaseManifest(release, chartTemplateOptions(config, sources).Namespace)
+		if err != nil {
+			return withReason(reasonRenderFailed, fmt.Errorf("fetching deployed manifest: %w", err))
+		}
+	} else if sources.Base != "" {
+		valuesFiles, err := sourceValuesFiles(sources, sources.Base, sources.BaseValues)
+		if err != nil {
+			return withReason(reasonValuesFailed, fmt.Errorf("resolving base values files: %w", err))
+		}
+		sources.BaseManifest, err = renderChart(sources.Base, valuesFiles, chartSetValues(config, sources), chartTemplateOptions(config, sources))
+		if err != nil {
+			return withReason(reasonRenderFailed, fmt.Errorf("rendering base manifest: %w", err))
+		}
+	}
+
+	if sources.Current != "" {
+		valuesFiles, err := sourceValuesFiles(sources, sources.Current, sources.CurrentValues)
+		if err != nil {
+			return withReason(reasonValuesFailed, fmt.Errorf("resolving current values files: %w", err))
+		}
+		sources.CurrentManifest, err = renderChart(sources.Current, valuesFiles, chartSetValues(config, sources), chartTemplateOptions(config, sources))
+		if err != nil {
+			return withReason(reasonRenderFailed, fmt.Errorf("rendering current manifest: %w", err))
+		}
+	}
+
+	if !config.AgainstRelease && sources.Base != "" && sources.Current != "" {
+		notes, err := dependencyTemplateChanges(sources, chartSetValues(config, sources), chartTemplateOptions(config, sources))
+		if err != nil {
+			return withReason(reasonRenderFailed, fmt.Errorf("rendering bumped dependencies: %w", err))
+		}
+		sources.DependencyNotes = notes
+	}
+
+	if config.ValuesDrift && !config.AgainstRelease && sources.Base != "" && sources.Current != "" {
+		drift, err := valuesDrift(sources.Base, sources.Current)
+		if err != nil {
+			return withReason(reasonValuesFailed, fmt.Errorf("checking values drift: %w", err))
+		}
+		sources.ValuesDrift = drift
+	}
+
+	if config.ChartSize && !config.AgainstRelease && sources.Current != "" {
+		sizeChanges, err := chartSizeChanges(sources.Base, sources.Current)
+		if err != nil {
+			return withReason(reasonPackageFailed, fmt.Errorf("comparing chart size: %w", err))
+		}
+		sources.SizeChanges = sizeChanges
+	}
+
+	if config.ServerDryRun && sources.Current != "" {
+		dryRunErrors, err := serverDryRun(sources.BaseManifest, sources.CurrentManifest, chartTemplateOptions(config, sources).Namespace)
+		if err != nil {
+			err = fmt.Errorf("running server-side dry run: %w", err)
+			if errorReason(err) == reasonUnknown {
+				err = withReason(reasonDryRunFailed, err)
+			}
+			return err
+		}
+		sources.DryRunErrors = dryRunErrors
+	}
+
+	if config.PackageDiff {
+		packageDiffs, err := packageChanges(sources.Base, sources.Current)
+		if err != nil {
+			return withReason(reasonPackageFailed, fmt.Errorf("comparing packages: %w", err))
+		}
+		sources.PackageDiffs = packageDiffs
+	}
+
+	if config.ValuesCoverage && sources.Current != "" {
+		coverage, err := valuesCoverage(config, sources)
+		if err != nil {
+			return withReason(reasonValuesFailed, fmt.Errorf("checking values coverage: %w", err))
+		}
+		sources.Coverage = coverage
+	}
+
+	if !config.AgainstRelease && sources.Base != "" && sources.Current != "" && sources.BaseManifest != sources.CurrentManifest {
+		impact, err := valuesImpact(config, sources)
+		if err != nil {
+			return withReason(reasonValuesFailed, fmt.Errorf("analyzing values impact: %w", err))
+		}
+		sources.ValuesImpact = impact
+	}
+
+	return nil
+}
+
+func recordChartError(config *Config, chart string, err error) {
+	reason := errorReason(err)
+	config.failures = append(config.failures, chartFailure{Chart: chart, Reason: reason, Err: err})
+	hints := errorHints(err)
+	config.results = append(config.results, chartResult{Chart: chart, Status: statusFailed, Summary: fmt.Sprintf("[%s] %v", reason, err), Hints: hints})
+	streams.diagnosticf("Error: %s [%s]: %s\n%s", chart, reason, strings.TrimRight(err.Error(), "\n"), formatErrorHints(hints))
+}
+
+func prepareChart(config *Config, chartName string) (*chartSources, error) {
+	chartPath, err := resolveChartPath(config.ChartDir, chartName)
+	if err != nil {
+		return nil, withReason(reasonInvalidChart, fmt.Errorf("resolving chart path: %w", err))
+	}
+
+	workdirPath, err := getWorkdirChartPath(chartPath)
+	if err != nil {
+		return nil, withReason(reasonInvalidChart, fmt.Errorf("getting workdir chart path: %w", err))
+	}
+
+	settings := chartSettings(config, chartName, chartPath)
+	valuesFiles := strings.Join(settings.Values, ",")
+	sources := &chartSources{Path: chartPath, SetValues: settings.Set, ReleaseName: settings.ReleaseName, Namespace: settings.Namespace}
+	_, statErr := os.Stat(filepath.Join(workdirPath, "Chart.yaml"))
+	inWorkdir := statErr == nil
+	if inWorkdir {
+		reason, err := chartSkipReason(workdirPath)
+		if err != nil {
+			return nil, err
+		}
+		if reason != "" {
+			sources.SkipReason = reason
+			return sources, nil
+		}
+	}
+
+	sources.BaseRef = config.Base
+	if config.pins != nil {
+		pin, ok := config.pins[filepath.ToSlash(chartPath)]
+		if !ok {
+			err := fmt.Errorf("%s has no approved commit in %s", chartPath, pinFileName)
+			return nil, withReason(reasonNotApproved, withHints(err, errorHint{Problem: "approve the current version of the chart", Command: "helm git-diff approve " + shellQuote(chartPath)}))
+		}
+		sources.BaseRef = pin
+	}
+
+	currentExists := inWorkdir
+	if config.Current != "HEAD" {
+		currentExists, err = chartExistsAtRef(chartPath, config.Current)
+		if err != nil {
+			return nil, withReason(reasonExtractFailed, err)
+		}
+	}
+
+	baseChartPath := chartPath
+	baseExists, err := chartExistsAtRef(chartPath, sources.BaseRef)
+	if err != nil {
+		return nil, withReason(reasonExtractFailed, err)
+	}
+	if !baseExists && currentExists {
+		oldPath, err := renamedChartPath(chartPath, sources.BaseRef, config.Current)
+		if err != nil {
+			return nil, withReason(reasonExtractFailed, err)
+		}
+		if oldPath != "" {
+			baseChartPath, baseExists = oldPath, true
+			sources.Lifecycle = "renamed from " + oldPath
+		}
+	}
+
+	switch {
+	case !baseExists && !currentExists:
+		return nil, withReason(reasonInvalidChart, fmt.Errorf("no Chart.yaml found in %s - not a valid Helm chart", chartPath))
+	case !baseExists:
+		sources.Lifecycle = "chart added"
+	case !currentExists:
+		sources.Lifecycle = "chart removed"
+	}
+
+	if baseExists {
+		basePath, cleanup, err := extractChartAtRef(baseChartPath, sources.BaseRef)
+		if err != nil {
+			return nil, withReason(reasonExtractFailed, fmt.Errorf("extracting base chart: %w", err))
+		}
+		sources.Base = basePath
+		sources.cleanups = append(sources.cleanups, cleanup)
+	}
+
+	sources.BaseValues = valuesFiles
+	sources.CurrentValues = valuesFiles
+	if config.ValuesFromRef && valuesFiles != "" {
+		baseValues, cleanup, err := extractValuesFiles(valuesFiles, sources.BaseRef)
+		if err != nil {
+			cleanupChartSources(sources)
+			return nil, withReason(reasonValuesFailed, fmt.Errorf("extracting base values files: %w", err))
+		}
+		sources.BaseValues = baseValues
+		sources.cleanups = append(sources.cleanups, cleanup)
+	}
+
+	if config.Current == "HEAD" {
+		if currentExists {
+			sources.Current = workdirPath
+			sources.inWorkdir = true
+		}
+	} else if currentExists {
+		currentPath, cleanup, err := extractChartAtRef(chartPath, config.Current)
+		if err != nil {
+			cleanupChartSources(sources)
+			return nil, withReason(reasonExtractFailed, fmt.Errorf("extracting current chart: %w", err))
+		}
+		sources.Current = currentPath
+		sources.cleanups = append(sources.cleanups, cleanup)
+
+		if config.ValuesFromRef && valuesFiles != "" {
+			currentValues, cleanup, err := extractValuesFiles(valuesFiles, config.Current)
+			if err != nil {
+				cleanupChartSources(sources)
+				return nil, withReason(reasonValuesFailed, fmt.Errorf("extracting current values files: %w", err))
+			}
+			sources.CurrentValues = currentValues
+			sources.cleanups = append(sources.cleanups, cleanup)
+		}
+	}
+
+	if !inWorkdir {
+		metaPath := sources.Current
+		if metaPath == "" {
+			metaPath = sources.Base
+		}
+		reason, err := chartSkipReason(metaPath)
+		if err != nil {
+			cleanupChartSources(sources)
+			return nil, err
+		}
+		if reason != "" {
+			sources.SkipReason = reason
+			return sources, nil
+		}
+	}
+
+	if err := removeChartExcludes(sources, chartPath, chartExcludeDirs(config), config.Envs); err != nil {
+		cleanupChartSources(sources)
+		return nil, withReason(reasonExtractFailed, fmt.Errorf("removing excluded directories: %w", err))
+	}
+
+	if config.RiskyFunctions {
+		sources.RiskyFunctions, err = riskyFunctionChanges(sources.Base, sources.Current)
+		if err != nil {
+			cleanupChartSources(sources)
+			return nil, withReason(reasonInvalidChart, fmt.Errorf("scanning template functions: %w", err))
+		}
+	}
+
+	if config.lookupHelper != "" {
+		if err := stubChartLookups(config, sources, chartPath); err != nil {
+			cleanupChartSources(sources)
+			return nil, withReason(reasonInvalidChart, fmt.Errorf("stubbing lookup calls: %w", err))
+		}
+	}
+
+	return sources, nil
+}
+
+func stubChartLookups(config *Config, sources *chartSources, chartPath string) error {
+	if err := detachWorkdirChart(sources, chartPath); err != nil {
+		return err
+	}
+
+	for _, path := range []string{sources.Base, sources.Current} {
+		if path == "" {
+			continue
+		}
+		if err := render.StubLookups(path, config.lookupHelper); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func removeChartExcludes(sources *chartSources, chartPath string, excludes []string, envs []chartEnv) error {
+	if sources.inWorkdir {
+		for _, dir := range excludes {
+			if _, err := os.Stat(filepath.Join(sources.Current, dir)); err == nil {
+				if err := detachWorkdirChart(sources, chartPath); err != nil {
+					return err
+				}
+				break
+			}
+		}
+	}
+
+	for _, path := range []string{sources.Base, sources.Current} {
+		if path == "" || (sources.inWorkdir && path == sources.Current) {
+			continue
+		}
+		annotations, err := readChartAnnotations(path)
+		if err != nil {
+			return err
+		}
+		keep := chartValuesReferences(annotations, envs)
+		for _, dir := range excludes {
+			if err := removeExcludedDir(path, dir, keep); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func removeExcludedDir(chartPath, dir string, keep map[string]bool) error {
+	root := filepath.Join(chartPath, dir)
+	keepsFiles := false
+	for file := range keep {
+		keepsFiles = keepsFiles || strings.HasPrefix(file, dir+"/")
+	}
+	if !keepsFiles {
+		return os.RemoveAll(root)
+	}
+	if _, err := os.Stat(root); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(chartPath, file)
+		if err != nil {
+			return err
+		}
+		if keep[filepath.ToSlash(rel)] {
+			return nil
+		}
+		return os.Remove(file)
+	})
+}
+
+func detachWorkdirChart(sources *chartSources, chartPath string) error {
+	if !sources.inWorkdir {
+		return nil
+	}
+	copyPath, cleanup, err := copyWorkdirChart(chartPath)
+	if err != nil {
+		return err
+	}
+	sources.Current = copyPath
+	sources.inWorkdir = false
+	sources.cleanups = append(sources.cleanups, cleanup)
+	return nil
+}
+
+func copyWorkdirChart(chartPath string) (string, func(), error) {
+	gitRoot, err := getGitRoot()
+	if err != nil {
+		return "", nil, fmt.Errorf("getting git root: %w", err)
+	}
+	workdirPath, err := getWorkdirChartPath(chartPath)
+	if err != nil {
+		return "", nil, err
+	}
+	relPath, err := filepath.Rel(gitRoot, workdirPath)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tmpDir, err := os.MkdirTemp("", "helm-git-diff-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(tmpDir)
+	}
+
+	paths := []string{relPath}
+	deps, err := readChartDependencies(workdirPath)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+	for _, dep := range deps {
+		if strings.HasPrefix(dep.Repository, "file://") {
+			paths = append(paths, filepath.Join(relPath, strings.TrimPrefix(dep.Repository, "file://")))
+		}
+	}
+	for _, path := range paths {
+		if err := copyDir(filepath.Join(gitRoot, path), filepath.Join(tmpDir, path)); err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("copying %s: %w", path, err)
+		}
+	}
+
+	return filepath.Join(tmpDir, relPath), cleanup, nil
+}
+
+func chartSkipReason(chartPath string) (string, error) {
+	isLibrary, err := isLibraryChart(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return "", withReason(reasonInvalidChart, fmt.Errorf("checking chart type: %w", err))
+	}
+	if isLibrary {
+		return "library chart", nil
+	}
+
+	annotations, err := readChartAnnotations(chartPath)
+	if err != nil {
+		return "", withReason(reasonInvalidChart, fmt.Errorf("reading chart annotations: %w", err))
+	}
+	if annotations[annotationSkip] == "true" {
+		return annotationSkip + " annotation", nil
+	}
+	return "", nil
+}
+
+func chartExistsAtRef(chartPath, ref string) (bool, error) {
+	return repoVCS.exists(ref, filepath.ToSlash(filepath.Join(chartPath, "Chart.yaml")))
+}
+
+func renamedChartPath(chartPath, base, current string) (string, error) {
+	gitRootPath, err := getGitRoot()
+	if err != nil {
+		return "", fmt.Errorf("getting git root: %w", err)
+	}
+
+	args := []string{"diff", "-M", "--name-status", "-z", "--diff-filter=R", base}
+	if current != "HEAD" {
+		args = append(args, current)
+	}
+	cmd := gitCommand(args...)
+	cmd.Dir = gitRootPath
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("detecting renames between %s and %s: %w", base, current, err)
+	}
+
+	return renameSource(output, filepath.ToSlash(filepath.Clean(chartPath))), nil
+}
+
+// renameSource parses `git diff --name-status -z` output, where renames and
+// copies are followed by two paths and every other status by one.
+func renameSource(nameStatus []byte, chartPath string) string {
+	fields := splitNul(nameStatus)
+	for i := 0; i < len(fields); i++ {
+		status := fields[i]
+		if !strings.HasPrefix(status, "R") && !strings.HasPrefix(status, "C") {
+			i++
+			continue
+		}
+		if i+2 >= len(fields) {
+			break
+		}
+		oldPath, newPath := fields[i+1], fields[i+2]
+		i += 2
+		if strings.HasPrefix(status, "R") && path.Base(oldPath) == "Chart.yaml" && newPath == chartPath+"/Chart.yaml" {
+			return path.Dir(oldPath)
+		}
+	}
+	return ""
+}
+
+func splitNul(output []byte) []string {
+	var fields []string
+	for _, field := range strings.Split(string(output), "\x00") {
+		if field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+// gitCommand runs git with a pinned locale and unquoted paths so its output
+// can be parsed regardless of the user's environment.
+func gitCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command("git", append([]string{"-c", "core.quotePath=false"}, args...)...)
+	cmd.Env = append(os.Environ(), "LC_ALL=C", "LANGUAGE=", "GIT_TERMINAL_PROMPT=0", "GIT_PAGER=cat")
+	return cmd
+}
+
+func cleanupChartSources(sources *chartSources) {
+	for _, cleanup := range sources.cleanups {
+		cleanup()
+	}
+}
+
+func diffChart(config *Config, chartName string, sources *chartSources) error {
+	out := streams.section(textOutput(config))
+	matched := config.resourceFilter == nil
+	defer func() {
+		if matched {
+			out.commit()
+		}
+	}()
+	if config.Anchors {
+		fmt.Fprintf(out, "##[chart:%s]\n", anchorEscaper.Replace(chartName))
+	}
+
+	if sources.SkipReason != "" {
+		fmt.Fprintf(out, "%s: skipped (%s)\n", chartName, sources.SkipReason)
+		config.skipped++
+		config.results = append(config.results, chartResult{Chart: chartName, Status: statusSkipped, Summary: sources.SkipReason})
+		return nil
+	}
+
+	baseManifest, currentManifest := sources.BaseManifest, sources.CurrentManifest
+
+	if config.Inventory != "" {
+		if err := collectInventory(config, chartName, currentManifest); err != nil {
+			return err
+		}
+	}
+
+	bumps, err := dependencyBumps(sources.Base, sources.Current)
+	if err != nil {
+		return withReason(reasonInvalidChart, fmt.Errorf("comparing dependencies: %w", err))
+	}
+	var notes []string
+	if sources.Lifecycle != "" {
+		fmt.Fprintf(out, "%s: %s\n", chartName, sources.Lifecycle)
+		notes = append(notes, sources.Lifecycle)
+	}
+	notes = append(notes, bumps...)
+	for _, bump := range bumps {
+		fmt.Fprintf(out, "%s: %s\n", chartName, bump)
+	}
+	for _, line := range sources.DependencyNotes {
+		fmt.Fprintf(out, "%s: %s\n", chartName, line)
+	}
+	notes = append(notes, sources.DependencyNotes...)
+
+	for _, line := range sources.RiskyFunctions {
+		fmt.Fprintf(out, "%s: %s\n", chartName, line)
+	}
+	notes = append(notes, sources.RiskyFunctions...)
+
+	for _, line := range sources.Coverage {
+		fmt.Fprintf(out, "%s: %s\n", chartName, line)
+		notes = append(notes, line)
+	}
+	for _, line := range sources.ValuesImpact {
+		fmt.Fprintf(out, "%s: %s\n", chartName, line)
+		notes = append(notes, line)
+	}
+	for _, line := range sources.ValuesDrift {
+		fmt.Fprintf(out, "%s: warning: %s\n", chartName, line)
+		notes = append(notes, "warning: "+line)
+	}
+	for _, line := range sources.SizeChanges {
+		fmt.Fprintf(out, "%s: %s\n", chartName, line)
+		notes = append(notes, line)
+	}
+	for _, line := range sources.PackageDiffs {
+		fmt.Fprintf(out, "%s: package %s\n", chartName, line)
+		notes = append(notes, "package "+line)
+	}
+	if len(sources.PackageDiffs) > 0 {
+		config.hasDifferences = true
+	}
+
+	if baseManifest == currentManifest {
+		fmt.Fprintf(out, "%s: no changes\n", chartName)
+		notes = append(notes, unchangedSinceLastRun(config, out, chartName)...)
+		config.unchanged++
+		config.results = append(config.results, chartResult{Chart: chartName, Status: statusUnchanged, Summary: "no changes", Notes: notes})
+		return nil
+	}
+
+	baseResources, err := parseManifest(baseManifest)
+	if err != nil {
+		return withReason(reasonParseFailed, fmt.Errorf("parsing base manifest: %w", err))
+	}
+	currentResources, err := parseManifest(currentManifest)
+	if err != nil {
+		return withReason(reasonParseFailed, fmt.Errorf("parsing current manifest: %w", err))
+	}
+	if config.InjectOwnership {
+		if err := injectReleaseOwnership(config, sources, baseResources, currentResources); err != nil {
+			return withReason(reasonInvalidChart, err)
+		}
+	}
+	hooks := hookChanges(baseResources, currentResources)
+	if err := checkPolicies(config, chartName, baseResources, currentResources); err != nil {
+		return withReason(reasonParseFailed, err)
+	}
+	restarts, restarting := rolloutRestarts(compareChartResources(config, baseResources, currentResources))
+	secrets := secretFingerprintContents(config, baseResources, currentResources)
+	normalizeResources(config, baseResources)
+	normalizeResources(config, currentResources)
+
+	changes, suppressed := suppressIgnoredChanges(compareChartResources(config, baseResources, currentResources))
+	for _, name := range suppressed {
+		fmt.Fprintf(out, "%s: %s changed (suppressed)\n", chartName, name)
+		notes = append(notes, name+" changed (suppressed)")
+	}
+
+	changes, reordered := dropReorderedChanges(changes)
+	if config.resourceFilter != nil {
+		changes = config.resourceFilter.filter(changes)
+		matched = len(changes) > 0
+		if !matched {
+			notes := unchangedSinceLastRun(config, out, chartName)
+			config.unchanged++
+			config.results = append(config.results, chartResult{Chart: chartName, Status: statusUnchanged, Summary: "no changes to " + config.GrepResource, Notes: notes})
+			return nil
+		}
+	}
+	if len(changes) == 0 {
+		summary := "no changes"
+		if len(reordered) > 0 || documentOrderChanged(baseResources, currentResources, config.identityRules) {
+			summary = "no semantic changes"
+			note := "only document order changed"
+			if len(reordered) > 0 {
+				note = "only ordering changed (keys reordered in " + strings.Join(reordered, ", ") + ")"
+			}
+			fmt.Fprintf(out, "%s: %s\n", chartName, note)
+			notes = append(notes, note)
+		}
+		if len(suppressed) == 0 {
+			fmt.Fprintf(out, "%s: %s\n", chartName, summary)
+		}
+		if len(restarting) > 0 {
+			note := fmt.Sprintf("%s will restart: %s", workloadCount(len(restarting)), strings.Join(restarting, ", "))
+			fmt.Fprintf(out, "%s: %s\n", chartName, note)
+			notes = append(notes, note)
+			config.restarts += len(restarting)
+		}
+		notes = append(notes, unchangedSinceLastRun(config, out, chartName)...)
+		config.unchanged++
+		config.results = append(config.results, chartResult{Chart: chartName, Status: statusUnchanged, Summary: summary, Notes: notes, Restarts: restarting})
+		return nil
+	}
+
+	checkRequiredMetadata(config, chartName, baseResources, currentResources)
+	config.routes = append(config.routes, chartRoute{Chart: chartName, Categories: changeCategories(changes)})
+
+	sortChanges(changes)
+	shown, sinceLastRun := changesSinceLastRun(config, chartName, changes, secrets)
+	notes = append(notes, sinceLastRun...)
+
+	result := chartResult{Chart: chartName, Status: statusChanged, Summary: changeCounts(changes), Notes: notes, Kinds: kindCounts(changes), Hooks: hooks, Highlights: releaseNoteItems(changes)}
+	var details strings.Builder
+	destructive := destructiveChanges(chartName, changes)
+	result.RiskScore, result.Risks = riskScore(changes, destructive, riskWeights(config))
+	if result.RiskScore > 0 {
+		fmt.Fprintf(&details, "%s: risk score %d (%s)\n", chartName, result.RiskScore, strings.Join(result.Risks, ", "))
+	}
+	result.Restarts = restarting
+	config.restarts += len(result.Restarts)
+	if len(result.Restarts) > 0 {
+		fmt.Fprintf(&details, "%s: %s will restart: %s\n", chartName, workloadCount(len(result.Restarts)), strings.Join(result.Restarts, ", "))
+	}
+	for _, line := range sinceLastRun {
+		fmt.Fprintf(&details, "%s: %s\n", chartName, line)
+	}
+	if len(hooks) > 0 {
+		fmt.Fprintf(&details, "%s: hook changes:\n", chartName)
+		for _, line := range hooks {
+			fmt.Fprintf(&details, "  %s\n", line)
+		}
+	}
+	for _, change := range changes {
+		if dryRunRejection(sources, change) != "" {
+			config.dryRunRejected++
+		}
+	}
+
+	for _, change := range shown {
+		diffText, err := resourceDiff(chartName, change, baseLabel(config, sources), config.Current, config.Context)
+		if err != nil {
+			return fmt.Errorf("generating diff: %w", err)
+		}
+		res := changedResource(change)
+		result.Resources = append(result.Resources, resourceResult{
+			Kind:        res.Kind,
+			Namespace:   res.Namespace,
+			Name:        res.Name,
+			Change:      change.Change,
+			Diff:        diffText,
+			DryRunError: dryRunRejection(sources, change),
+			Restart:     restarts[change.Key],
+		})
+	}
+
+	var output strings.Builder
+	if config.Summary {
+		fmt.Fprintf(&output, "%s: %s\n", chartName, formatKindCounts(result.Kinds))
+		output.WriteString(details.String())
+		for _, change := range changes {
+			if dryRunError := dryRunRejection(sources, change); dryRunError != "" {
+				fmt.Fprintf(&output, "%s: %s rejected by server-side dry run: %s\n", chartName, resourceName(changedResource(change)), dryRunError)
+			}
+		}
+	} else {
+		fmt.Fprintf(&output, "%s: %s\n", chartName, result.Summary)
+		output.WriteString(details.String())
+		for i, change := range shown {
+			entry := result.Resources[i]
+			display := entry.Diff
+			if config.SideBySide {
+				display = sideBySideDiff(chartName, change, baseLabel(config, sources), config.Current, config.Context, terminalWidth(), config.useColor)
+			}
+			if config.Anchors {
+				output.WriteString(resourceAnchor(changedResource(change)))
+			}
+			output.WriteString(resourceHeader(chartName, change))
+			name := resourceName(changedResource(change))
+			if restart, ok := restarts[change.Key]; ok {
+				if restart {
+					fmt.Fprintf(&output, "%s: %s rolls out new pods (pod template changed)\n", chartName, name)
+				} else {
+					fmt.Fprintf(&output, "%s: %s keeps its pods (metadata or scaling only)\n", chartName, name)
+				}
+			}
+			if entry.DryRunError != "" {
+				fmt.Fprintf(&output, "%s: %s rejected by server-side dry run: %s\n", chartName, name, entry.DryRunError)
+			}
+			output.WriteString(display)
+		}
+	}
+	config.results = append(config.results, result)
+
+	config.hasDifferences = true
+	config.changed++
+	config.changedCharts = append(config.changedCharts, chartName)
+	config.destructive += len(destructive)
+	config.destructiveChanges = append(config.destructiveChanges, destructive...)
+	rollupTeams(config, chartName, chartTemplateOptions(config, sources).Namespace, changes, destructive)
+	config.pruned = append(config.pruned, prunedResources(chartName, changes, destructive)...)
+
+	if config.useColor && !config.SideBySide {
+		fmt.Fprint(out, colorizeDiff(output.String()))
+	} else {
+		fmt.Fprint(out, output.String())
+	}
+
+	return nil
+}
+
+type hookInfo struct {
+	Events       []string
+	Weight       string
+	DeletePolicy string
+}
+
+func hookResources(resources []resource) map[string]hookInfo {
+	hooks := make(map[string]hookInfo)
+	for _, res := range resources {
+		if res.Annotations[annotationHook] == "" {
+			continue
+		}
+		events := splitList([]string{res.Annotations[annotationHook]})
+		sort.Strings(events)
+		weight := strings.TrimSpace(res.Annotations[annotationHookWeight])
+		if weight == "" {
+			weight = "0"
+		}
+		policies := splitList([]string{res.Annotations[annotationHookDeletePolicy]})
+		sort.Strings(policies)
+		hooks[resourceName(res)] = hookInfo{Events: events, Weight: weight, DeletePolicy: strings.Join(policies, ",")}
+	}
+	return hooks
+}
+
+func (h hookInfo) String() string {
+	description := strings.Join(h.Events, ",") + ", weight " + h.Weight
+	if h.DeletePolicy != "" {
+		description += ", delete policy " + h.DeletePolicy
+	}
+	return description
+}
+
+func hookChanges(baseResources, currentResources []resource) []string {
+	base, current := hookResources(baseResources), hookResources(currentResources)
+
+	names := make(map[string]bool)
+	for name := range base {
+		names[name] = true
+	}
+	for name := range current {
+		names[name] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+
+	var lines []string
+	events := make(map[string]bool)
+	for _, name := range sorted {
+		before, inBase := base[name]
+		after, inCurrent := current[name]
+		for _, event := range append(append([]string{}, before.Events...), after.Events...) {
+			events[event] = true
+		}
+
+		switch {
+		case !inBase:
+			lines = append(lines, fmt.Sprintf("%s added (%s)", name, after))
+		case !inCurrent:
+			lines = append(lines, fmt.Sprintf("%s removed (%s)", name, before))
+		default:
+			var changes []string
+			if strings.Join(before.Events, ",") != strings.Join(after.Events, ",") {
+				changes = append(changes, fmt.Sprintf("events %s -> %s", strings.Join(before.Events, ","), strings.Join(after.Events, ",")))
+			}
+			if before.Weight != after.Weight {
+				changes = append(changes, fmt.Sprintf("weight %s -> %s", before.Weight, after.Weight))
+			}
+			if before.DeletePolicy != after.DeletePolicy {
+				changes = append(changes, fmt.Sprintf("delete policy %s -> %s", orNone(before.DeletePolicy), orNone(after.DeletePolicy)))
+			}
+			if len(changes) > 0 {
+				lines = append(lines, fmt.Sprintf("%s: %s", name, strings.Join(changes, "; ")))
+			}
+		}
+	}
+
+	eventNames := make([]string, 0, len(events))
+	for event := range events {
+		eventNames = append(eventNames, event)
+	}
+	sort.Strings(eventNames)
+	for _, event := range eventNames {
+		before, after := hookOrder(base, current, event), hookOrder(current, base, event)
+		if strings.Join(before, ",") != strings.Join(after, ",") {
+			lines = append(lines, fmt.Sprintf("%s order: %s -> %s", event, strings.Join(before, ", "), strings.Join(after, ", ")))
+		}
+	}
+	return lines
+}
+
+func hookOrder(hooks, other map[string]hookInfo, event string) []string {
+	var names []string
+	for name, hook := range hooks {
+		otherHook, ok := other[name]
+		if ok && slices.Contains(hook.Events, event) && slices.Contains(otherHook.Events, event) {
+			names = append(names, name)
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		wi, _ := strconv.Atoi(hooks[names[i]].Weight)
+		wj, _ := strconv.Atoi(hooks[names[j]].Weight)
+		if wi != wj {
+			return wi < wj
+		}
+		return names[i] < names[j]
+	})
+	return names
+}
+
+func orNone(value string) string {
+	if value == "" {
+		return "none"
+	}
+	return value
+}
+
+func suppressIgnoredChanges(changes []resourceChange) ([]resourceChange, []string) {
+	var kept []resourceChange
+	var suppressed []string
+	for _, change := range changes {
+		if (change.Base != nil && change.Base.Annotations[annotationIgnore] == "true") ||
+			(change.Current != nil && change.Current.Annotations[annotationIgnore] == "true") {
+			suppressed = append(suppressed, resourceName(changedResource(change)))
+			continue
+		}
+		kept = append(kept, change)
+	}
+	return kept, suppressed
+}
+
+type resourceSelector struct {
+	Kind      string
+	Namespace string
+	Name      string
+}
+
+func parseResourceSelector(spec string) (resourceSelector, error) {
+	parts := strings.Split(spec, "/")
+	var selector resourceSelector
+	switch len(parts) {
+	case 2:
+		selector = resourceSelector{Kind: parts[0], Name: parts[1]}
+	case 3:
+		selector = resourceSelector{Kind: parts[0], Namespace: parts[1], Name: parts[2]}
+	default:
+		return selector, fmt.Errorf("invalid --grep-resource %q (expected kind/name or kind/namespace/name)", spec)
+	}
+	if selector.Kind == "" || selector.Name == "" {
+		return selector, fmt.Errorf("invalid --grep-resource %q (expected kind/name or kind/namespace/name)", spec)
+	}
+	if _, err := path.Match(selector.Name, ""); err != nil {
+		return selector, fmt.Errorf("invalid --grep-resource name pattern %q: %w", selector.Name, err)
+	}
+	return selector, nil
+}
+
+func (s resourceSelector) matches(res *resource) bool {
+	if res == nil || !strings.EqualFold(res.Kind, s.Kind) {
+		return false
+	}
+	if s.Namespace != "" && res.Namespace != s.Namespace {
+		return false
+	}
+	matched, _ := path.Match(s.Name, res.Name)
+	return matched
+}
+
+func (s resourceSelector) filter(changes []resourceChange) []resourceChange {
+	var kept []resourceChange
+	for _, change := range changes {
+		if s.matches(change.Base) || s.matches(change.Current) {
+			kept = append(kept, change)
+		}
+	}
+	return kept
+}
+
+func dropReorderedChanges(changes []resourceChange) ([]resourceChange, []string) {
+	var kept []resourceChange
+	var reordered []string
+	for _, change := range changes {
+		if change.Change == changeModified && semanticallyEqual(change.Base.Content, change.Current.Content) {
+			reordered = append(reordered, resourceName(*change.Current))
+			continue
+		}
+		kept = append(kept, change)
+	}
+	return kept, reordered
+}
+
+func semanticallyEqual(a, b string) bool {
+	var left, right any
+	if yaml.Unmarshal([]byte(a), &left) != nil || yaml.Unmarshal([]byte(b), &right) != nil {
+		return false
+	}
+	return reflect.DeepEqual(left, right)
+}
+
+func documentOrderChanged(base, current []resource, rules []identityRule) bool {
+	if len(base) != len(current) {
+		return false
+	}
+	for i := range base {
+		if identityKey(base[i], rules) != identityKey(current[i], rules) {
+			return true
+		}
+	}
+	return false
+}
+
+func checkRequiredMetadata(config *Config, chartName string, baseResources, currentResources []resource) {
+	if len(config.RequiredLabels) == 0 && len(config.RequiredAnnotations) == 0 {
+		return
+	}
+
+	for _, res := range addedResources(baseResources, currentResources) {
+		missing := missingMetadata(res, config.RequiredLabels, config.RequiredAnnotations)
+		if len(missing) > 0 {
+			config.violations = append(config.violations, fmt.Sprintf("%s: %s missing %s", chartName, resourceName(res), strings.Join(missing, ", ")))
+		}
+	}
+}
+
+func validatePolicies(policies []string) error {
+	for _, policy := range policies {
+		if !slices.Contains(policyNames, policy) {
+			return fmt.Errorf("unknown policy %q (supported: %s)", policy, strings.Join(policyNames, ", "))
+		}
+	}
+	return nil
+}
+
+func checkPolicies(config *Config, chartName string, baseResources, currentResources []resource) error {
+	if len(config.Policies) == 0 {
+		return nil
+	}
+
+	existing, err := policyViolations(config.Policies, baseResources)
+	if err != nil {
+		return fmt.Errorf("checking base policies: %w", err)
+	}
+	introduced, err := policyViolations(config.Policies, currentResources)
+	if err != nil {
+		return fmt.Errorf("checking current policies: %w", err)
+	}
+
+	known := make(map[string]bool, len(existing))
+	for _, violation := range existing {
+		known[violation] = true
+	}
+	for _, violation := range introduced {
+		if !known[violation] {
+			config.violations = append(config.violations, chartName+": "+violation)
+		}
+	}
+	return nil
+}
+
+func policyViolations(policies []string, resources []resource) ([]string, error) {
+	type workload struct {
+		res      resource
+		spec     map[string]any
+		labels   map[string]any
+		replicas int
+	}
+
+	var workloads []workload
+	var budgets []map[string]any
+	for _, res := range resources {
+		var obj map[string]any
+		if err := yaml.Unmarshal([]byte(res.Content), &obj); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", resourceName(res), err)
+		}
+		if res.Kind == "PodDisruptionBudget" {
+			budgets = append(budgets, obj)
+			continue
+		}
+
+		templatePath := []string{"spec", "template"}
+		switch res.Kind {
+		case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Job":
+		case "CronJob":
+			templatePath = []string{"spec", "jobTemplate", "spec", "template"}
+		default:
+			continue
+		}
+		spec, _ := lookupValue(obj, append(templatePath, "spec"))
+		labels, _ := lookupValue(obj, append(templatePath, "metadata", "labels"))
+		replicas := 1
+		if value, ok := lookupValue(obj, []string{"spec", "replicas"}); ok && value != nil {
+			n, err := replicasValue(value)
+			if err != nil {
+				return nil, fmt.Errorf("reading spec.replicas of %s: %w", resourceName(res), err)
+			}
+			replicas = n
+		}
+		specMap, _ := spec.(map[string]any)
+		labelMap, _ := labels.(map[string]any)
+		workloads = append(workloads, workload{res: res, spec: specMap, labels: labelMap, replicas: replicas})
+	}
+
+	var violations []string
+	for _, w := range workloads {
+		name := resourceName(w.res)
+		for _, container := range podContainers(w.spec) {
+			containerName, _ := container.spec["name"].(string)
+			if slices.Contains(policies, policyResourceLimits) {
+				for _, resourceType := range []string{"cpu", "memory"} {
+					if _, ok := lookupValue(container.spec, []string{"resources", "limits", resourceType}); !ok {
+						violations = append(violations, fmt.Sprintf("%s container %s has no %s limit (%s)", name, containerName, resourceType, policyResourceLimits))
+					}
+				}
+			}
+			if slices.Contains(policies, policyProbes) && w.res.Kind != "Job" && w.res.Kind != "CronJob" && !container.init {
+				for _, probe := range []string{"readinessProbe", "livenessProbe"} {
+					if _, ok := container.spec[probe]; !ok {
+						violations = append(violations, fmt.Sprintf("%s container %s has no %s (%s)", name, containerName, probe, policyProbes))
+					}
+				}
+			}
+		}
+		if slices.Contains(policies, policyPDB) && w.res.Kind == "Deployment" && w.replicas > 1 && !hasDisruptionBudget(budgets, w.res.Namespace, w.labels) {
+			violations = append(violations, fmt.Sprintf("%s has %d replicas but no PodDisruptionBudget (%s)", name, w.replicas, policyPDB))
+		}
+	}
+	return violations, nil
+}
+
+// replicasValue converts a decoded spec.replicas value to an int. Values
+// that are not whole numbers are an error rather than being read as zero.
+func replicasValue(value any) (int, error) {
+	switch n := value.(type) {
+	case int:
+		return n, nil
+	case int8:
+		return int(n), nil
+	case int16:
+		return int(n), nil
+	case int32:
+		return int(n), nil
+	case int64:
+		if n < math.MinInt || n > math.MaxInt {
+			return 0, fmt.Errorf("%d is out of range", n)
+		}
+		return int(n), nil
+	case uint:
+		if n > math.MaxInt {
+			return 0, fmt.Errorf("%d is out of range", n)
+		}
+		return int(n), nil
+	case uint8:
+		return int(n), nil
+	case uint16:
+		return int(n), nil
+	case uint32:
+		return int(n), nil
+	case uint64:
+		if n > math.MaxInt {
+			return 0, fmt.Errorf("%d is out of range", n)
+		}
+		return int(n), nil
+	case float32:
+		return replicasValue(float64(n))
+	case float64:
+		if n != math.Trunc(n) || n < math.MinInt || n >= math.MaxInt {
+			return 0, fmt.Errorf("%v is not a whole number", n)
+		}
+		return int(n), nil
+	}
+	return 0, fmt.Errorf("%v is not a number", value)
+}
+
+type podContainer struct {
+	spec map[string]any
+	init bool
+}
+
+func podContainers(spec map[string]any) []podContainer {
+	var containers []podContainer
+	for _, field := range []string{"initContainers", "containers"} {
+		list, _ := spec[field].([]any)
+		for _, item := range list {
+			if container, ok := item.(map[string]any); ok {
+				containers = append(containers, podContainer{spec: container, init: field == "initContainers"})
+			}
+		}
+	}
+	return containers
+}
+
+func hasDisruptionBudget(budgets []map[string]any, namespace string, podLabels map[string]any) bool {
+	for _, budget := range budgets {
+		budgetNamespace, _ := lookupValue(budget, []string{"metadata", "namespace"})
+		if ns, _ := budgetNamespace.(string); ns != namespace {
+			continue
+		}
+		selector, ok := lookupValue(budget, []string{"spec", "selector", "matchLabels"})
+		matchLabels, _ := selector.(map[string]any)
+		if !ok || len(matchLabels) == 0 {
+			continue
+		}
+		matches := true
+		for key, value := range matchLabels {
+			if podLabels[key] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return true
+		}
+	}
+	return false
+}
+
+func addedResources(base, current []resource) []resource {
+	baseKeys := make(map[string]bool, len(base))
+	for _, res := range base {
+		baseKeys[resourceKey(res)] = true
+	}
+
+	var added []resource
+	for _, res := range current {
+		if !baseKeys[resourceKey(res)] {
+			added = append(added, res)
+		}
+	}
+	return added
+}
+
+func missingMetadata(res resource, labels, annotations []string) []string {
+	var missing []string
+	for _, label := range labels {
+		if _, ok := res.Labels[label]; !ok {
+			missing = append(missing, "label "+label)
+		}
+	}
+	for _, annotation := range annotations {
+		if _, ok := res.Annotations[annotation]; !ok {
+			missing = append(missing, "annotation "+annotation)
+		}
+	}
+	return missing
+}
+
+func baseLabel(config *Config, sources *chartSources) string {
+	if sources.Release != "" {
+		return "release " + sources.Release
+	}
+	if config.pins == nil {
+		return config.Base
+	}
+	return fmt.Sprintf("%s@%s", config.Base, shortCommit(sources.BaseRef))
+}
+
+func compareResources(base, current []resource, rules []identityRule) []resourceChange {
+	baseKeys, currentKeys := identityKeys(base, current, rules)
+	baseByKey := make(map[string]*resource, len(base))
+	for i := range base {
+		baseByKey[baseKeys[i]] = &base[i]
+	}
+	seen := make(map[string]bool, len(current))
+
+	var changes []resourceChange
+	for i := range current {
+		key := currentKeys[i]
+		seen[key] = true
+
+		baseRes, ok := baseByKey[key]
+		switch {
+		case !ok:
+			changes = append(changes, resourceChange{Key: key, Change: changeAdded, Current: &current[i]})
+		case baseRes.Content != current[i].Content:
+			changes = append(changes, resourceChange{Key: key, Change: changeModified, Base: baseRes, Current: &current[i]})
+		}
+	}
+
+	for i := range base {
+		key := baseKeys[i]
+		if !seen[key] {
+			changes = append(changes, resourceChange{Key: key, Change: changeRemoved, Base: &base[i]})
+		}
+	}
+
+	return changes
+}
+
+// compareChartResources compares resources like compareResources and then
+// pairs generated names unless --exact-names is set.
+func compareChartResources(config *Config, base, current []resource) []resourceChange {
+	changes := compareResources(base, current, config.identityRules)
+	if config.ExactNames {
+		return changes
+	}
+	return matchGeneratedNames(changes)
+}
+
+// identityKeys returns the identity keys of the base and current resources. An
+// identity rule that matches several resources on either side cannot pair
+// them, so those resources are matched by name instead.
+func identityKeys(base, current []resource, rules []identityRule) ([]string, []string) {
+	ambiguous := make(map[string]bool)
+	keys := func(resources []resource) []string {
+		keys := make([]string, len(resources))
+		seen := make(map[string]bool, len(resources))
+		for i := range resources {
+			keys[i] = identityKey(resources[i], rules)
+			if seen[keys[i]] {
+				ambiguous[keys[i]] = true
+			}
+			seen[keys[i]] = true
+		}
+		return keys
+	}
+	baseKeys, currentKeys := keys(base), keys(current)
+	for _, side := range []struct {
+		keys      []string
+		resources []resource
+	}{{baseKeys, base}, {currentKeys, current}} {
+		for i, key := range side.keys {
+			if ambiguous[key] {
+				side.keys[i] = resourceKey(side.resources[i])
+			}
+		}
+	}
+	return baseKeys, currentKeys
+}
+
+var generatedNameSuffix = regexp.MustCompile(`-[a-z0-9]{5,}$`)
+
+func generatedNameKey(res resource) (string, bool) {
+	suffix := generatedNameSuffix.FindString(res.Name)
+	if suffix == "" || !strings.ContainsAny(suffix, "0123456789") {
+		return "", false
+	}
+	return fmt.Sprintf("%s/%s/%s/%s", res.APIVersion, res.Kind, res.Namespace, strings.TrimSuffix(res.Name, suffix)), true
+}
+
+func matchGeneratedNames(changes []resourceChange) []resourceChange {
+	added := make(map[string][]int)
+	removed := make(map[string][]int)
+	for i, change := range changes {
+		switch change.Change {
+		case changeAdded:
+			if key, ok := generatedNameKey(*change.Current); ok {
+				added[key] = append(added[key], i)
+			}
+		case changeRemoved:
+			if key, ok := generatedNameKey(*change.Base); ok {
+				removed[key] = append(removed[key], i)
+			}
+		}
+	}
+
+	drop := make(map[int]bool)
+	for key, addedIdx := range added {
+		removedIdx := removed[key]
+		if len(addedIdx) != 1 || len(removedIdx) != 1 {
+			continue
+		}
+		change := &changes[addedIdx[0]]
+		change.Base = changes[removedIdx[0]].Base
+		change.Change = changeModified
+		drop[removedIdx[0]] = true
+	}
+	if len(drop) == 0 {
+		return changes
+	}
+
+	kept := make([]resourceChange, 0, len(changes)-len(drop))
+	for i, change := range changes {
+		if !drop[i] {
+			kept = append(kept, change)
+		}
+	}
+	return kept
+}
+
+func sortChanges(changes []resourceChange) {
+	rank := map[string]int{changeAdded: 0, changeModified: 1, changeRemoved: 2}
+	sort.SliceStable(changes, func(i, j int) bool {
+		return rank[changes[i].Change] < rank[changes[j].Change]
+	})
+}
+
+func kindCounts(changes []resourceChange) []kindCount {
+	index := make(map[string]int)
+	var kinds []kindCount
+	for _, change := range changes {
+		kind := changedResource(change).Kind
+		i, ok := index[kind]
+		if !ok {
+			i = len(kinds)
+			index[kind] = i
+			kinds = append(kinds, kindCount{Kind: kind})
+		}
+		kinds[i].add(change.Change, 1)
+	}
+	sort.Slice(kinds, func(i, j int) bool {
+		return kinds[i].Kind < kinds[j].Kind
+	})
+	return kinds
+}
+
+func (t *changeTotals) add(change string, n int) {
+	switch change {
+	case changeAdded:
+		t.Added += n
+	case changeModified:
+		t.Modified += n
+	case changeRemoved:
+		t.Removed += n
+	}
+}
+
+func (t changeTotals) String() string {
+	var parts []string
+	for _, count := range []struct {
+		n      int
+		change string
+	}{{t.Added, changeAdded}, {t.Modified, changeModified}, {t.Removed, changeRemoved}} {
+		if count.n > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", count.n, count.change))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+func formatKindCounts(kinds []kindCount) string {
+	parts := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		parts = append(parts, kind.Kind+": "+kind.changeTotals.String())
+	}
+	return strings.Join(parts, "; ")
+}
+
+func resourceTotals(results []chartResult) changeTotals {
+	var totals changeTotals
+	for _, result := range results {
+		for _, kind := range result.Kinds {
+			totals.Added += kind.Added
+			totals.Modified += kind.Modified
+			totals.Removed += kind.Removed
+		}
+	}
+	return totals
+}
+
+func formatTotals(totals changeTotals, charts int) string {
+	if totals == (changeTotals{}) {
+		return "no resource changes"
+	}
+	noun := "charts"
+	if charts == 1 {
+		noun = "chart"
+	}
+	return fmt.Sprintf("%s in %d %s", totals, charts, noun)
+}
+
+func changeCounts(changes []resourceChange) string {
+	counts := make(map[string]int)
+	for _, change := range changes {
+		counts[change.Change]++
+	}
+
+	var parts []string
+	for _, change := range []string{changeAdded, changeModified, changeRemoved} {
+		if counts[change] > 0 {
+			parts = append(parts, fmt.Sprintf("%d %s", counts[change], change))
+		}
+	}
+	return strings.Join(parts, ", ")
+}
+
+// rolloutRestarts reports for each modified workload whether its pod template
+// changed, and lists the workloads that restart. It must see the rendered
+// resources before normalization: a label dropped by --ignore-helm-labels or
+// --ignore-field still rolls out new pods.
+func rolloutRestarts(changes []resourceChange) (map[string]bool, []string) {
+	restarts := make(map[string]bool)
+	var restarting []string
+	for _, change := range changes {
+		if change.Change != changeModified || !slices.Contains([]string{"Deployment", "StatefulSet", "DaemonSet"}, change.Current.Kind) {
+			continue
+		}
+		var base, current map[string]any
+		if yaml.Unmarshal([]byte(change.Base.Content), &base) != nil || yaml.Unmarshal([]byte(change.Current.Content), &current) != nil {
+			restarts[change.Key] = true
+			continue
+		}
+		baseTemplate, _ := lookupValue(base, []string{"spec", "template"})
+		currentTemplate, _ := lookupValue(current, []string{"spec", "template"})
+		restarts[change.Key] = !reflect.DeepEqual(baseTemplate, currentTemplate)
+	}
+	for _, change := range changes {
+		if restarts[change.Key] {
+			restarting = append(restarting, resourceName(*change.Current))
+		}
+	}
+	return restarts, restarting
+}
+
+func workloadCount(n int) string {
+	return countNoun(n, "workload")
+}
+
+func countNoun(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+	return fmt.Sprintf("%d %ss", n, noun)
+}
+
+// anchorEscaper percent-encodes the characters that delimit anchor fields, so
+// a chart such as charts/app[prod] cannot end an anchor early.
+var anchorEscaper = strings.NewReplacer("%", "%25", ":", "%3A", "[", "%5B", "]", "%5D", "\n", "%0A", "\r", "%0D")
+
+func resourceAnchor(res resource) string {
+	return fmt.Sprintf("##[resource:%s:%s:%s:%s]\n", anchorEscaper.Replace(res.APIVersion), anchorEscaper.Replace(res.Kind),
+		anchorEscaper.Replace(res.Namespace), anchorEscaper.Replace(res.Name))
+}
+
+func resourceHeader(chartName string, change resourceChange) string {
+	return fmt.Sprintf("%s: %s %s\n", chartName, resourceName(changedResource(change)), change.Change)
+}
+
+func resourceDiff(chartName string, change resourceChange, baseRef, currentRef string, context int) (string, error) {
+	fromFile, toFile := diffLabels(chartName, change, baseRef, currentRef)
+	diff := difflib.UnifiedDiff{
+		FromFile: fromFile,
+		ToFile:   toFile,
+		Context:  context,
+	}
+	if change.Base != nil {
+		diff.A = difflib.SplitLines(strings.TrimSuffix(change.Base.Content, "\n"))
+	}
+	if change.Current != nil {
+		diff.B = difflib.SplitLines(strings.TrimSuffix(change.Current.Content, "\n"))
+	}
+
+	return difflib.GetUnifiedDiffString(diff)
+}
+
+func diffLabels(chartName string, change resourceChange, baseRef, currentRef string) (string, string) {
+	res := changedResource(change)
+	label := fmt.Sprintf("%s/%s/%s", chartName, res.Kind, res.Name)
+	if res.Namespace != "" {
+		label = fmt.Sprintf("%s/%s/%s/%s", chartName, res.Kind, res.Namespace, res.Name)
+	}
+
+	fromFile, toFile := "/dev/null", "/dev/null"
+	if change.Base != nil {
+		fromFile = fmt.Sprintf("%s (%s)", label, baseRef)
+	}
+	if change.Current != nil {
+		toFile = fmt.Sprintf("%s (%s)", label, currentRef)
+	}
+	return fromFile, toFile
+}
+
+func sideBySideDiff(chartName string, change resourceChange, baseRef, currentRef string, context, width int, color bool) string {
+	const (
+		red   = "\033[31m"
+		green = "\033[32m"
+		cyan  = "\033[36m"
+		reset = "\033[0m"
+	)
+
+	var a, b []string
+	if change.Base != nil {
+		a = strings.Split(strings.TrimSuffix(change.Base.Content, "\n"), "\n")
+	}
+	if change.Current != nil {
+		b = strings.Split(strings.TrimSuffix(change.Current.Content, "\n"), "\n")
+	}
+
+	column := max((width-3)/2, 20)
+	var out strings.Builder
+	row := func(left string, marker byte, right string) {
+		leftCell, rightCell := fitColumn(left, column), fitColumn(right, column)
+		if color && (marker == '|' || marker == '<') {
+			leftCell = red + leftCell + reset
+		}
+		if color && (marker == '|' || marker == '>') {
+			rightCell = green + rightCell + reset
+		}
+		fmt.Fprintf(&out, "%s %c %s\n", leftCell, marker, strings.TrimRight(rightCell, " "))
+	}
+	line := func(text string) {
+		if color {
+			text = cyan + text + reset
+		}
+		out.WriteString(text + "\n")
+	}
+
+	fromFile, toFile := diffLabels(chartName, change, baseRef, currentRef)
+	line(fitColumn(fromFile, column) + "   " + toFile)
+
+	for _, group := range difflib.NewMatcher(a, b).GetGroupedOpCodes(context) {
+		first, last := group[0], group[len(group)-1]
+		line(fmt.Sprintf("@@ -%s +%s @@", hunkRange(first.I1, last.I2), hunkRange(first.J1, last.J2)))
+		for _, op := range group {
+			switch op.Tag {
+			case 'e':
+				for i := range op.I2 - op.I1 {
+					row(a[op.I1+i], ' ', b[op.J1+i])
+				}
+			case 'd':
+				for _, text := range a[op.I1:op.I2] {
+					row(text, '<', "")
+				}
+			case 'i':
+				for _, text := range b[op.J1:op.J2] {
+					row("", '>', text)
+				}
+			case 'r':
+				for i := range max(op.I2-op.I1, op.J2-op.J1) {
+					left, right, marker := "", "", byte('|')
+					if op.I1+i < op.I2 {
+						left = a[op.I1+i]
+					} else {
+						marker = '>'
+					}
+					if op.J1+i < op.J2 {
+						right = b[op.J1+i]
+					} else {
+						marker = '<'
+					}
+					row(left, marker, right)
+				}
+			}
+		}
+	}
+	return out.String()
+}
+
+func hunkRange(start, stop int) string {
+	if start == stop {
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, stop-start)
+}
+
+func fitColumn(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) > width {
+		return string(runes[:width-1]) + "…"
+	}
+	return text + strings.Repeat(" ", width-len(runes))
+}
+
+func terminalWidth() int {
+	if isTerminal(os.Stdout) {
+		if width, _, err := term.GetSize(int(os.Stdout.Fd())); err == nil && width > 0 {
+			return width
+		}
+	}
+	if width, err := strconv.Atoi(os.Getenv("COLUMNS")); err == nil && width > 0 {
+		return width
+	}
+	return 160
+}
+
+func startPager(config *Config) {
+	if config.NoPager || textOutput(config) != io.Writer(os.Stdout) || !isTerminal(os.Stdout) || isCI() {
+		return
+	}
+	config.pagerBuffer = &bytes.Buffer{}
+}
+
+func flushPager(config *Config) error {
+	buffer := config.pagerBuffer
+	if buffer == nil {
+		return nil
+	}
+	config.pagerBuffer = nil
+
+	_, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil || strings.Count(buffer.String(), "\n") < height {
+		_, err := os.Stdout.Write(buffer.Bytes())
+		return err
+	}
+
+	pager := strings.Fields(os.Getenv("PAGER"))
+	if len(pager) == 0 {
+		pager = []string{"less", "-R"}
+	}
+	cmd := exec.Command(pager[0], pager[1:]...)
+	cmd.Stdin = buffer
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if os.Getenv("LESS") == "" {
+		cmd.Env = append(os.Environ(), "LESS=FRX")
+	}
+	if err := cmd.Start(); err != nil {
+		_, err := os.Stdout.Write(buffer.Bytes())
+		return err
+	}
+	return cmd.Wait()
+}
+
+func pruneDisabled(res resource) bool {
+	if res.Annotations[annotationFluxPrune] == "disabled" {
+		return true
+	}
+	for _, option := range strings.Split(res.Annotations[annotationArgoSyncOptions], ",") {
+		if strings.TrimSpace(option) == "Prune=false" {
+			return true
+		}
+	}
+	return false
+}
+
+func rollupTeams(config *Config, chartName, namespace string, changes []resourceChange, destructive []destructiveChange) {
+	if config.repoConfig == nil || len(config.repoConfig.Teams) == 0 {
+		return
+	}
+	chart, _, _ := strings.Cut(chartName, "[")
+	team := func(resourceNamespace string) *teamRollup {
+		if resourceNamespace == "" {
+			resourceNamespace = namespace
+		}
+		name := teamFor(config.repoConfig.Teams, chart, resourceNamespace)
+		i := slices.IndexFunc(config.teams, func(t teamRollup) bool { return t.Team == name })
+		if i < 0 {
+			config.teams = append(config.teams, teamRollup{Team: name})
+			i = len(config.teams) - 1
+		}
+		if !slices.Contains(config.teams[i].Charts, chartName) {
+			config.teams[i].Charts = append(config.teams[i].Charts, chartName)
+		}
+		return &config.teams[i]
+	}
+	for _, change := range changes {
+		team(changedResource(change).Namespace).Resources++
+	}
+	for _, change := range destructive {
+		team(change.Namespace).Destructive++
+	}
+	sort.SliceStable(config.teams, func(i, j int) bool {
+		if (config.teams[i].Team == teamUnassigned) != (config.teams[j].Team == teamUnassigned) {
+			return config.teams[j].Team == teamUnassigned
+		}
+		return config.teams[i].Team < config.teams[j].Team
+	})
+}
+
+func teamFor(teams map[string]teamConfig, chart, namespace string) string {
+	names := slices.Sorted(maps.Keys(teams))
+	for _, name := range names {
+		for _, pattern := range teams[name].Charts {
+			if matched, _ := path.Match(pattern, chart); matched {
+				return name
+			}
+		}
+	}
+	for _, name := range names {
+		for _, pattern := range teams[name].Namespaces {
+			if matched, _ := path.Match(pattern, namespace); matched && namespace != "" {
+				return name
+			}
+		}
+	}
+	return teamUnassigned
+}
+
+func (t teamRollup) summary() string {
+	summary := fmt.Sprintf("%s changed, %s", countNoun(len(t.Charts), "chart"), countNoun(t.Resources, "resource"))
+	if t.Destructive > 0 {
+		summary += fmt.Sprintf(", %d destructive", t.Destructive)
+	}
+	return summary
+}
+
+func formatTeamSection(teams []teamRollup) string {
+	var b strings.Builder
+	b.WriteString("\nChanges by team:\n")
+	for _, team := range teams {
+		fmt.Fprintf(&b, "  %s: %s (%s)\n", team.Team, team.summary(), strings.Join(team.Charts, ", "))
+	}
+	return b.String()
+}
+
+func formatPruneSection(pruned []prunedResource) string {
+	var b strings.Builder
+	b.WriteString("\nWill be pruned:\n")
+	for _, p := range pruned {
+		if p.Kept {
+			fmt.Fprintf(&b, "  %s: %s (pruning disabled, kept)\n", p.Chart, p.Resource)
+			continue
+		}
+		fmt.Fprintf(&b, "  %s: %s\n", p.Chart, p.Resource)
+	}
+	return b.String()
+}
+
+type outputStreams struct {
+	mu     sync.Mutex
+	stderr io.Writer
+}
+
+type outputSection struct {
+	streams *outputStreams
+	target  io.Writer
+	buffer  bytes.Buffer
+}
+
+type lockedWriter struct {
+	streams *outputStreams
+	target  io.Writer
+}
+
+func (s *outputStreams) section(target io.Writer) *outputSection {
+	return &outputSection{streams: s, target: target}
+}
+
+func (s *outputStreams) locked(target io.Writer) io.Writer {
+	return lockedWriter{streams: s, target: target}
+}
+
+func (s *outputStreams) diagnosticf(format string, args ...any) {
+	message := fmt.Sprintf(format, args...)
+	if !strings.HasSuffix(message, "\n") {
+		message += "\n"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _ = io.WriteString(s.stderr, message)
+}
+
+func (o *outputSection) Write(p []byte) (int, error) {
+	return o.buffer.Write(p)
+}
+
+func (o *outputSection) commit() {
+	if o.buffer.Len() == 0 {
+		return
+	}
+	o.streams.mu.Lock()
+	defer o.streams.mu.Unlock()
+	_, _ = o.target.Write(o.buffer.Bytes())
+	o.buffer.Reset()
+}
+
+func (w lockedWriter) Write(p []byte) (int, error) {
+	w.streams.mu.Lock()
+	defer w.streams.mu.Unlock()
+	return w.target.Write(p)
+}
+
+func textOutput(config *Config) io.Writer {
+	if (config.Output != "" && config.Output != outputText) || config.ReleaseNotes != "" {
+		return io.Discard
+	}
+	if config.pagerBuffer != nil {
+		return config.pagerBuffer
+	}
+	return os.Stdout
+}
+
+func writeReport(config *Config, w io.Writer) error {
+	r := report{
+		Charts:     config.results,
+		Changed:    config.changed,
+		Unchanged:  config.unchanged,
+		Skipped:    config.skipped,
+		Errors:     len(config.failures),
+		Violations: config.violations,
+		Pruned:     config.pruned,
+		Teams:      config.teams,
+		Totals:     resourceTotals(config.results),
+		summary:    config.Summary,
+	}
+	if r.Charts == nil {
+		r.Charts = []chartResult{}
+	}
+
+	if config.ReleaseNotes != "" {
+		_, err := io.WriteString(w, formatReleaseNotes(r))
+		return err
+	}
+
+	switch config.Output {
+	case outputJSON:
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		if config.reportSigner != nil {
+			t := runTrailer(config)
+			r.Provenance = &reportProvenance{Base: t.Base, Current: t.Current, Charts: t.Charts}
+			signed, err := signReport(r, config.reportSigner)
+			if err != nil {
+				return fmt.Errorf("signing report: %w", err)
+			}
+			return encoder.Encode(signed)
+		}
+		return encoder.Encode(r)
+	case outputMarkdown:
+		_, err := io.WriteString(w, formatMarkdownReport(r))
+		return err
+	}
+	return nil
+}
+
+func formatMarkdownReport(r report) string {
+	var b strings.Builder
+	b.WriteString("## helm-git-diff\n\n")
+	fmt.Fprintf(&b, "**%d changed**, %d unchanged, %d skipped, %d errors\n", r.Changed, r.Unchanged, r.Skipped, r.Errors)
+
+	for _, result := range r.Charts {
+		b.WriteString("\n")
+		if result.Status != statusChanged {
+			fmt.Fprintf(&b, "- `%s`: %s", result.Chart, result.Status)
+			if result.Summary != "" && result.Summary != "no changes" {
+				fmt.Fprintf(&b, " (%s)", result.Summary)
+			}
+			b.WriteString("\n")
+			for _, note := range result.Notes {
+				fmt.Fprintf(&b, "  - %s\n", note)
+			}
+			continue
+		}
+
+		summary := result.Summary
+		if result.RiskScore > 0 {
+			summary += fmt.Sprintf(" (risk %d)", result.RiskScore)
+		}
+		fmt.Fprintf(&b, "<details>\n<summary><code>%s</code>: %s</summary>\n\n", result.Chart, summary)
+		for _, note := range result.Notes {
+			fmt.Fprintf(&b, "- %s\n", note)
+		}
+		if len(result.Notes) > 0 {
+			b.WriteString("\n")
+		}
+		if len(result.Restarts) > 0 {
+			fmt.Fprintf(&b, "**%s will restart:** %s\n\n", workloadCount(len(result.Restarts)), strings.Join(result.Restarts, ", "))
+		}
+		if len(result.Hooks) > 0 {
+			b.WriteString("**Hook changes**\n\n")
+			for _, line := range result.Hooks {
+				fmt.Fprintf(&b, "- %s\n", line)
+			}
+			b.WriteString("\n")
+		}
+		if r.summary || len(result.Resources) == 0 {
+			for _, kind := range result.Kinds {
+				fmt.Fprintf(&b, "- %s: %s\n", kind.Kind, kind.changeTotals)
+			}
+			if len(result.Kinds) > 0 {
+				b.WriteString("\n")
+			}
+		} else {
+			for _, res := range result.Resources {
+				fmt.Fprintf(&b, "**%s %s** %s\n\n", res.Kind, res.Name, res.Change)
+				if res.DryRunError != "" {
+					fmt.Fprintf(&b, "> rejected by server-side dry run: %s\n\n", res.DryRunError)
+				}
+				fmt.Fprintf(&b, "```diff\n%s```\n\n", res.Diff)
+			}
+		}
+		b.WriteString("</details>\n")
+	}
+
+	if len(r.Pruned) > 0 {
+		b.WriteString("\n### Will be pruned\n\n")
+		for _, p := range r.Pruned {
+			if p.Kept {
+				fmt.Fprintf(&b, "- `%s`: %s (pruning disabled, kept)\n", p.Chart, p.Resource)
+				continue
+			}
+			fmt.Fprintf(&b, "- `%s`: %s\n", p.Chart, p.Resource)
+		}
+	}
+
+	if len(r.Teams) > 0 {
+		b.WriteString("\n### Changes by team\n\n")
+		for _, team := range r.Teams {
+			fmt.Fprintf(&b, "- **%s**: %s\n", team.Team, team.summary())
+		}
+	}
+
+	if len(r.Violations) > 0 {
+		b.WriteString("\n### Policy violations\n\n")
+		for _, violation := range r.Violations {
+			fmt.Fprintf(&b, "- %s\n", violation)
+		}
+	}
+
+	return b.String()
+}
+
+func formatReleaseNotes(r report) string {
+	var b strings.Builder
+	b.WriteString("## Release notes\n\n")
+
+	var written bool
+	for _, result := range r.Charts {
+		if result.Status != statusChanged {
+			continue
+		}
+		fmt.Fprintf(&b, "- **%s**: %s\n", result.Chart, strings.Join(result.Highlights, ", "))
+		written = true
+	}
+	if !written {
+		b.WriteString("No chart changes.\n")
+	}
+
+	return b.String()
+}
+
+func releaseNoteItems(changes []resourceChange) []string {
+	var items []string
+	for _, change := range changes {
+		res := changedResource(change)
+		name := res.Kind + " " + res.Name
+		switch change.Change {
+		case changeAdded:
+			items = append(items, "added "+name)
+		case changeRemoved:
+			items = append(items, "removed "+name)
+		case changeModified:
+			images := imageChanges(containerImages(change.Base.Content), containerImages(change.Current.Content))
+			if len(images) == 0 {
+				items = append(items, "updated "+name)
+			}
+			items = append(items, images...)
+		}
+	}
+	return items
+}
+
+func imageChanges(base, current map[string]string) []string {
+	containers := make([]string, 0, len(current))
+	for container := range current {
+		containers = append(containers, container)
+	}
+	sort.Strings(containers)
+
+	var changes []string
+	for _, container := range containers {
+		oldImage, ok := base[container]
+		newImage := current[container]
+		if !ok || oldImage == newImage {
+			continue
+		}
+		oldRepo, oldTag := splitImage(oldImage)
+		newRepo, newTag := splitImage(newImage)
+		if oldRepo == newRepo {
+			changes = append(changes, fmt.Sprintf("image %s %s→%s", newRepo, oldTag, newTag))
+		} else {
+			changes = append(changes, fmt.Sprintf("image %s→%s", oldImage, newImage))
+		}
+	}
+	return changes
+}
+
+func splitImage(image string) (string, string) {
+	if idx := strings.LastIndex(image, "@"); idx >= 0 {
+		return image[:idx], image[idx+1:]
+	}
+	if idx := strings.LastIndex(image, ":"); idx > strings.LastIndex(image, "/") {
+		return image[:idx], image[idx+1:]
+	}
+	return image, "latest"
+}
+
+func containerImages(content string) map[string]string {
+	var doc any
+	images := make(map[string]string)
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return images
+	}
+
+	var walk func(node any)
+	walk = func(node any) {
+		switch n := node.(type) {
+		case map[string]any:
+			image, hasImage := n["image"].(string)
+			name, hasName := n["name"].(string)
+			if hasImage && hasName {
+				images[name] = image
+			}
+			for _, value := range n {
+				walk(value)
+			}
+		case []any:
+			for _, value := range n {
+				walk(value)
+			}
+		}
+	}
+	walk(doc)
+	return images
+}
+
+func changedResource(change resourceChange) resource {
+	if change.Current != nil {
+		return *change.Current
+	}
+	return *change.Base
+}
+
+func resourceCategory(kind string) string {
+	switch kind {
+	case "Deployment", "StatefulSet", "DaemonSet", "ReplicaSet", "Pod", "Job", "CronJob", "HorizontalPodAutoscaler", "PodDisruptionBudget":
+		return "workload"
+	case "ConfigMap", "Secret":
+		return "config"
+	case "Role", "ClusterRole", "RoleBinding", "ClusterRoleBinding", "ServiceAccount":
+		return "rbac"
+	case "Service", "Ingress", "IngressClass", "NetworkPolicy", "Gateway", "HTTPRoute", "GRPCRoute", "Endpoints", "EndpointSlice":
+		return "networking"
+	case "CustomResourceDefinition":
+		return "crd"
+	}
+	return "other"
+}
+
+func changeCategories(changes []resourceChange) []string {
+	seen := make(map[string]bool)
+	var categories []string
+	for _, change := range changes {
+		category := resourceCategory(changedResource(change).Kind)
+		if !seen[category] {
+			seen[category] = true
+			categories = append(categories, category)
+		}
+	}
+	sort.Strings(categories)
+	return categories
+}
+
+func riskWeights(config *Config) map[string]int {
+	weights := maps.Clone(defaultRiskWeights)
+	if config.repoConfig != nil {
+		maps.Copy(weights, config.repoConfig.RiskWeights)
+	}
+	return weights
+}
+
+func riskScore(changes []resourceChange, destructive []destructiveChange, weights map[string]int) (int, []string) {
+	counts := map[string]int{riskDestructive: len(destructive)}
+	for _, change := range changes {
+		res := changedResource(change)
+		switch resourceCategory(res.Kind) {
+		case "rbac":
+			counts[riskRBAC]++
+		case "crd":
+			counts[riskCRD]++
+		}
+		if change.Change == changeModified && replicaCount(*change.Current) < replicaCount(*change.Base) {
+			counts[riskReplicaDrop]++
+		}
+	}
+
+	score := 0
+	var factors []string
+	for _, factor := range []string{riskDestructive, riskRBAC, riskCRD, riskReplicaDrop} {
+		if counts[factor] == 0 || weights[factor] == 0 {
+			continue
+		}
+		score += counts[factor] * weights[factor]
+		factors = append(factors, fmt.Sprintf("%d %s x%d", counts[factor], factor, weights[factor]))
+	}
+	return score, factors
+}
+
+func replicaCount(res resource) int {
+	var obj struct {
+		Spec struct {
+			Replicas *int `yaml:"replicas"`
+		} `yaml:"spec"`
+	}
+	if err := yaml.Unmarshal([]byte(res.Content), &obj); err != nil || obj.Spec.Replicas == nil {
+		return 1
+	}
+	return *obj.Spec.Replicas
+}
+
+func destructiveChanges(chartName string, changes []resourceChange) []destructiveChange {
+	migrated := make(map[string]bool)
+	for _, change := range changes {
+		if change.Change == changeAdded {
+			migrated[fmt.Sprintf("%s/%s/%s", change.Current.Kind, change.Current.Namespace, change.Current.Name)] = true
+		}
+	}
+
+	var destructive []destructiveChange
+	for _, change := range changes {
+		var res resource
+		var action, reason string
+		switch change.Change {
+		case changeRemoved:
+			res = *change.Base
+			if pruneDisabled(res) || res.Annotations[annotationResourcePolicy] == "keep" || migrated[fmt.Sprintf("%s/%s/%s", res.Kind, res.Namespace, res.Name)] {
+				continue
+			}
+			action, reason = actionDelete, "no longer rendered"
+		case changeModified:
+			res = *change.Base
+			if change.Base.Name != change.Current.Name {
+				if pruneDisabled(res) || res.Annotations[annotationResourcePolicy] == "keep" {
+					continue
+				}
+				action, reason = actionRecreate, "name changed to "+change.Current.Name
+			} else if field := changedImmutableField(*change.Base, *change.Current); field != "" {
+				action, reason = actionRecreate, "immutable field "+field+" changed"
+			}
+		}
+		if action == "" {
+			continue
+		}
+		destructive = append(destructive, destructiveChange{
+			Chart:      chartName,
+			APIVersion: res.APIVersion,
+			Kind:       res.Kind,
+			Namespace:  res.Namespace,
+			Name:       res.Name,
+			Action:     action,
+			Reason:     reason,
+		})
+	}
+	return destructive
+}
+
+func changedImmutableField(base, current resource) string {
+	fields := immutableFields[base.Kind]
+	if len(fields) == 0 {
+		return ""
+	}
+	var baseDoc, currentDoc map[string]any
+	if yaml.Unmarshal([]byte(base.Content), &baseDoc) != nil || yaml.Unmarshal([]byte(current.Content), &currentDoc) != nil {
+		return ""
+	}
+	for _, field := range fields {
+		key := strings.Split(field, ".")
+		baseValue, inBase := lookupValue(baseDoc, key)
+		currentValue, inCurrent := lookupValue(currentDoc, key)
+		if (inBase || inCurrent) && !reflect.DeepEqual(baseValue, currentValue) {
+			return field
+		}
+	}
+	return ""
+}
+
+// prunedResources lists the resources the change deletes, including the old
+// objects of resources matched by generated name, along with those kept
+// because pruning is disabled for them. Resources that only moved to another
+// API version are not pruned.
+func prunedResources(chartName string, changes []resourceChange, destructive []destructiveChange) []prunedResource {
+	deleted := make(map[string]bool)
+	for _, change := range destructive {
+		deleted[change.APIVersion+"/"+change.Kind+"/"+change.Namespace+"/"+change.Name] = true
+	}
+
+	var pruned []prunedResource
+	for _, change := range changes {
+		renamed := change.Change == changeModified && change.Base.Name != change.Current.Name
+		if change.Change != changeRemoved && !renamed {
+			continue
+		}
+		res := *change.Base
+		kept := pruneDisabled(res) || res.Annotations[annotationResourcePolicy] == "keep"
+		if !kept && !deleted[res.APIVersion+"/"+res.Kind+"/"+res.Namespace+"/"+res.Name] {
+			continue
+		}
+		pruned = append(pruned, prunedResource{Chart: chartName, Resource: resourceName(res), Kept: kept})
+	}
+	return pruned
+}
+
+// writeDestructiveChanges writes the destructive-change document. Charts
+// that failed are listed under errors and mark it incomplete, so a gate
+// does not mistake a failed run for one that deletes nothing.
+func writeDestructiveChanges(path string, changes []destructiveChange, failures []chartFailure) error {
+	if changes == nil {
+		changes = []destructiveChange{}
+	}
+	errs := []string{}
+	for _, failure := range failures {
+		errs = append(errs, fmt.Sprintf("%s [%s]: %v", failure.Chart, failure.Reason, failure.Err))
+	}
+	content, err := json.MarshalIndent(struct {
+		Count     int                 `json:"count"`
+		Complete  bool                `json:"complete"`
+		Errors    []string            `json:"errors"`
+		Resources []destructiveChange `json:"resources"`
+	}{len(changes), len(failures) == 0, errs, changes}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append(content, '\n'), 0644)
+}
+
+func writeInventory(path string, items []inventoryItem) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if strings.EqualFold(filepath.Ext(path), ".csv") {
+		w := csv.NewWriter(f)
+		_ = w.Write([]string{"chart", "apiVersion", "kind", "namespace", "name", "source"})
+		for _, item := range items {
+			_ = w.Write([]string{item.Chart, item.APIVersion, item.Kind, item.Namespace, item.Name, item.Source})
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			_ = f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	if items == nil {
+		items = []inventoryItem{}
+	}
+	encoder := json.NewEncoder(f)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(items); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func writeGitHubOutputs(config *Config) error {
+	outputPath := os.Getenv("GITHUB_OUTPUT")
+	if outputPath == "" {
+		return fmt.Errorf("GITHUB_OUTPUT is not set (is this running in GitHub Actions?)")
+	}
+
+	changedCharts := config.changedCharts
+	if changedCharts == nil {
+		changedCharts = []string{}
+	}
+	chartsJSON, err := json.Marshal(changedCharts)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	maxRisk := 0
+	for _, result := range config.results {
+		maxRisk = max(maxRisk, result.RiskScore)
+	}
+
+	_, err = fmt.Fprintf(f, "changed_charts=%s\nhas_diff=%t\ndestructive_count=%d\nmax_risk_score=%d\n", chartsJSON, config.hasDifferences, config.destructive, maxRisk)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+type commentTarget struct {
+	CommentsURL  string
+	CommentURL   func(id int64) string
+	UpdateMethod string
+	Header       string
+	Token        string
+	MaxSize      int
+	LogURL       string
+}
+
+type postedComment struct {
+	ID   int64  `json:"id"`
+	Body string `json:"body"`
+}
+
+func postComment(config *Config) error {
+	target, err := resolveCommentTarget(config)
+	if err != nil {
+		return err
+	}
+
+	r := report{
+		Charts:    config.results,
+		Changed:   config.changed,
+		Unchanged: config.unchanged,
+		Skipped:   config.skipped,
+		Errors:    len(config.failures),
+		Pruned:    config.pruned,
+		summary:   config.Summary,
+	}
+	marker, err := runMarker(config.fingerprints)
+	if err != nil {
+		return err
+	}
+	body := commentBody(r, target.MaxSize-len(marker), target.LogURL) + marker
+
+	existing, err := findComment(target)
+	if err != nil {
+		return err
+	}
+	if existing.ID == 0 && r.Changed == 0 && r.Errors == 0 {
+		return nil
+	}
+
+	method, endpoint := http.MethodPost, target.CommentsURL
+	if existing.ID != 0 {
+		method, endpoint = target.UpdateMethod, target.CommentURL(existing.ID)
+	}
+	payload, err := json.Marshal(map[string]string{"body": body})
+	if err != nil {
+		return err
+	}
+	_, err = commentRequest(target, method, endpoint, bytes.NewReader(payload))
+	return err
+}
+
+func resolveCommentTarget(config *Config) (commentTarget, error) {
+	if config.Comment == commentGitLab {
+		return gitlabCommentTarget()
+	}
+	return githubCommentTarget()
+}
+
+func githubCommentTarget() (commentTarget, error) {
+	token := os.Getenv("GITHUB_TOKEN")
+	if token == "" {
+		token = os.Getenv("GH_TOKEN")
+	}
+	repo := os.Getenv("GITHUB_REPOSITORY")
+	if token == "" || repo == "" {
+		return commentTarget{}, fmt.Errorf("GITHUB_TOKEN and GITHUB_REPOSITORY must be set")
+	}
+	number, err := githubPullRequestNumber()
+	if err != nil {
+		return commentTarget{}, err
+	}
+
+	api := strings.TrimSuffix(os.Getenv("GITHUB_API_URL"), "/")
+	if api == "" {
+		api = "https://api.github.com"
+	}
+	target := commentTarget{
+		CommentsURL: fmt.Sprintf("%s/repos/%s/issues/%d/comments", api, repo, number),
+		CommentURL: func(id int64) string {
+			return fmt.Sprintf("%s/repos/%s/issues/comments/%d", api, repo, id)
+		},
+		UpdateMethod: http.MethodPatch,
+		Header:       "Authorization",
+		Token:        "Bearer " + token,
+		MaxSize:      65536,
+	}
+	if server, runID := os.Getenv("GITHUB_SERVER_URL"), os.Getenv("GITHUB_RUN_ID"); server != "" && runID != "" {
+		target.LogURL = fmt.Sprintf("%s/%s/actions/runs/%s", server, repo, runID)
+	}
+	return target, nil
+}
+
+var pullRequestRefPattern = regexp.MustCompile(`^refs/pull/(\d+)/`)
+
+func githubPullRequestNumber() (int, error) {
+	if eventPath := os.Getenv("GITHUB_EVENT_PATH"); eventPath != "" {
+		content, err := os.ReadFile(eventPath)
+		if err != nil {
+			return 0, fmt.Errorf("reading GitHub event: %w", err)
+		}
+		var event struct {
+			Number      int `json:"number"`
+			PullRequest struct {
+				Number int `json:"number"`
+			} `json:"pull_request"`
+		}
+		if err := json.Unmarshal(content, &event); err != nil {
+			return 0, fmt.Errorf("parsing GitHub event: %w", err)
+		}
+		if event.PullRequest.Number != 0 {
+			return event.PullRequest.Number, nil
+		}
+		if event.Number != 0 {
+			return event.Number, nil
+		}
+	}
+	if match := pullRequestRefPattern.FindStringSubmatch(os.Getenv("GITHUB_REF")); match != nil {
+		return strconv.Atoi(match[1])
+	}
+	return 0, fmt.Errorf("no pull request number found in GITHUB_EVENT_PATH or GITHUB_REF (is this a pull_request workflow?)")
+}
+
+func gitlabCommentTarget() (commentTarget, error) {
+	token := os.Getenv("GITLAB_TOKEN")
+	project := os.Getenv("CI_PROJECT_ID")
+	mergeRequest := os.Getenv("CI_MERGE_REQUEST_IID")
+	if token == "" || project == "" {
+		return commentTarget{}, fmt.Errorf("GITLAB_TOKEN and CI_PROJECT_ID must be set")
+	}
+	if mergeRequest == "" {
+		return commentTarget{}, fmt.Errorf("CI_MERGE_REQUEST_IID is not set (is this a merge request pipeline?)")
+	}
+
+	api := strings.TrimSuffix(os.Getenv("CI_API_V4_URL"), "/")
+	if api == "" {
+		api = "https://gitlab.com/api/v4"
+	}
+	notes := fmt.Sprintf("%s/projects/%s/merge_requests/%s/notes", api, url.PathEscape(project), mergeRequest)
+	return commentTarget{
+		CommentsURL: notes,
+		CommentURL: func(id int64) string {
+			return fmt.Sprintf("%s/%d", notes, id)
+		},
+		UpdateMethod: http.MethodPut,
+		Header:       "PRIVATE-TOKEN",
+		Token:        token,
+		MaxSize:      1000000,
+		LogURL:       os.Getenv("CI_JOB_URL"),
+	}, nil
+}
+
+func findComment(target commentTarget) (postedComment, error) {
+	for page := 1; ; page++ {
+		content, err := commentRequest(target, http.MethodGet, fmt.Sprintf("%s?per_page=100&page=%d", target.CommentsURL, page), nil)
+		if err != nil {
+			return postedComment{}, err
+		}
+		var comments []postedComment
+		if err := json.Unmarshal(content, &comments); err != nil {
+			return postedComment{}, fmt.Errorf("parsing comments: %w", err)
+		}
+		for _, comment := range comments {
+			if strings.HasPrefix(comment.Body, commentMarker) {
+				return comment, nil
+			}
+		}
+		if len(comments) < 100 {
+			return postedComment{}, nil
+		}
+	}
+}
+
+func commentRequest(target commentTarget, method, endpoint string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, endpoint, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set(target.Header, target.Token)
+	req.Header.Set("Accept", "application/json")
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("%s %s: %s: %s", method, endpoint, resp.Status, strings.TrimSpace(string(content)))
+	}
+	return content, nil
+}
+
+// minCommentDiff is the length below which diffs in a comment are not
+// shortened any further; whole resources are left out instead.
+const minCommentDiff = 200
+
+func commentBody(r report, maxSize int, logURL string) string {
+	hint := "run helm-git-diff locally for the full output"
+	if logURL != "" {
+		hint = fmt.Sprintf("see the [CI log](%s) for the full output", logURL)
+	}
+	note := "diff truncated, " + hint
+
+	limit := 0
+	for _, result := range r.Charts {
+		for _, res := range result.Resources {
+			limit = max(limit, len(res.Diff))
+		}
+	}
+
+	omitted := 0
+	for {
+		trimmed, droppedCharts := omitResources(r, omitted, note)
+		body := commentMarker + "\n" + formatMarkdownReport(truncateDiffs(trimmed, limit, note))
+		if droppedCharts > 0 {
+			body += fmt.Sprintf("\n_%s omitted, %s_\n", countNoun(droppedCharts, "more chart"), hint)
+		}
+		if len(body) <= maxSize {
+			return body
+		}
+
+		switch {
+		case limit > minCommentDiff:
+			limit = max(limit/2, minCommentDiff)
+		case droppedCharts < len(r.Charts):
+			omitted++
+		default:
+			cut := strings.LastIndex(body[:maxSize-len("…\n")], "\n") + 1
+			return body[:cut] + "…\n"
+		}
+	}
+}
+
+// omitResources leaves out the last n resources of the report, and each
+// chart itself once none of its resources are left, so that a shortened
+// comment never ends inside a diff block. It returns the number of charts
+// left out.
+func omitResources(r report, n int, note string) (report, int) {
+	charts := slices.Clone(r.Charts)
+	dropped := 0
+	for n > 0 && len(charts) > 0 {
+		last := &charts[len(charts)-1]
+		if len(last.Resources) == 0 {
+			charts = charts[:len(charts)-1]
+			dropped++
+			n--
+			continue
+		}
+		keep := max(len(last.Resources)-n, 0)
+		n -= len(last.Resources) - keep
+		last.Resources = last.Resources[:keep]
+		if !slices.Contains(last.Notes, note) {
+			last.Notes = append(slices.Clone(last.Notes), note)
+		}
+	}
+	r.Charts = charts
+	return r, dropped
+}
+
+func truncateDiffs(r report, limit int, note string) report {
+	charts := make([]chartResult, len(r.Charts))
+	for i, result := range r.Charts {
+		truncated := false
+		resources := make([]resourceResult, 0, len(result.Resources))
+		for _, res := range result.Resources {
+			if len(res.Diff) > limit {
+				truncated = true
+				cut := strings.LastIndex(res.Diff[:limit], "\n") + 1
+				omitted := strings.Count(res.Diff[cut:], "\n")
+				res.Diff = res.Diff[:cut] + fmt.Sprintf("... %d more lines truncated\n", omitted)
+			}
+			resources = append(resources, res)
+		}
+		result.Resources = resources
+		if truncated && !slices.Contains(result.Notes, note) {
+			result.Notes = append(slices.Clone(result.Notes), note)
+		}
+		charts[i] = result
+	}
+	r.Charts = charts
+	return r
+}
+
+type runFingerprints map[string]map[string]string
+
+// changeFingerprint hashes a change so it can be recognized in later runs.
+// Secrets are hashed from secrets, their content redacted under the stable
+// fingerprintKey: the per-run redaction key would change every fingerprint,
+// and fingerprints end up in files and comments. A Secret missing from
+// secrets is hashed with its values masked.
+func changeFingerprint(change resourceChange, secrets map[*resource]string) string {
+	hash := sha256.New()
+	hash.Write([]byte(change.Change))
+	for _, res := range []*resource{change.Base, change.Current} {
+		hash.Write([]byte{0})
+		if res == nil {
+			continue
+		}
+		content := res.Content
+		if secret, ok := secrets[res]; ok {
+			content = secret
+		} else if res.Kind == "Secret" {
+			content = manifest.RedactSecret(content, nil)
+		}
+		hash.Write([]byte(content))
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+// fingerprintKey keys the Secret value hashes inside fingerprints. It is the
+// signing key when one is set, so fingerprints in trailers and reports cannot
+// be checked against guessed values without it.
+func fingerprintKey() []byte {
+	if key := os.Getenv(signingKeyEnv); key != "" {
+		return []byte(key)
+	}
+	return []byte("helm-git-diff fingerprint")
+}
+
+// secretFingerprintContents redacts and normalizes the Secrets of both sides
+// under fingerprintKey. It must run before normalizeResources replaces their
+// values with per-run hashes.
+func secretFingerprintContents(config *Config, sides ...[]resource) map[*resource]string {
+	secrets := make(map[*resource]string)
+	for _, resources := range sides {
+		for i := range resources {
+			if resources[i].Kind == "Secret" {
+				content := manifest.RedactSecret(resources[i].Content, fingerprintKey())
+				secrets[&resources[i]] = normalizeContent(content, normalizeFields(config), config.SortKeys)
+			}
+		}
+	}
+	return secrets
+}
+
+func changesSinceLastRun(config *Config, chartName string, changes []resourceChange, secrets map[*resource]string) ([]resourceChange, []string) {
+	current := make(map[string]string, len(changes))
+	for _, change := range changes {
+		current[change.Key] = changeFingerprint(change, secrets)
+	}
+	if config.fingerprints == nil {
+		config.fingerprints = make(runFingerprints)
+	}
+	config.fingerprints[chartName] = current
+
+	previous, ok := config.previousRun[chartName]
+	if !ok {
+		return changes, nil
+	}
+
+	var shown []resourceChange
+	for _, change := range changes {
+		if previous[change.Key] != current[change.Key] {
+			shown = append(shown, change)
+		}
+	}
+	var notes []string
+	if len(changes) > 0 {
+		notes = append(notes, fmt.Sprintf("since last run: %d new or updated, %d already reviewed", len(shown), len(changes)-len(shown)))
+	}
+
+	var reverted []string
+	for key := range previous {
+		if _, ok := current[key]; !ok {
+			reverted = append(reverted, key)
+		}
+	}
+	sort.Strings(reverted)
+	for _, key := range reverted {
+		notes = append(notes, fmt.Sprintf("since last run: %s no longer changed", key))
+	}
+	return shown, notes
+}
+
+// unchangedSinceLastRun records that a chart has no changes, so the saved run
+// covers it and changes reviewed in the previous run are reported as gone.
+func unchangedSinceLastRun(config *Config, out io.Writer, chartName string) []string {
+	_, notes := changesSinceLastRun(config, chartName, nil, nil)
+	for _, note := range notes {
+		fmt.Fprintf(out, "%s: %s\n", chartName, note)
+	}
+	return notes
+}
+
+func loadPreviousRun(config *Config) (runFingerprints, error) {
+	if config.SinceLastRun != lastRunComment {
+		content, err := os.ReadFile(config.SinceLastRun)
+		if err != nil {
+			return nil, err
+		}
+		var fingerprints runFingerprints
+		if err := json.Unmarshal(content, &fingerprints); err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", config.SinceLastRun, err)
+		}
+		return fingerprints, nil
+	}
+
+	target, err := resolveCommentTarget(config)
+	if err != nil {
+		return nil, err
+	}
+	comment, err := findComment(target)
+	if err != nil {
+		return nil, err
+	}
+	start := strings.LastIndex(comment.Body, runMarkerPrefix)
+	if start < 0 {
+		return runFingerprints{}, nil
+	}
+	encoded, _, _ := strings.Cut(comment.Body[start+len(runMarkerPrefix):], runMarkerSuffix)
+	content, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("decoding comment fingerprints: %w", err)
+	}
+	var fingerprints runFingerprints
+	if err := json.Unmarshal(content, &fingerprints); err != nil {
+		return nil, fmt.Errorf("parsing comment fingerprints: %w", err)
+	}
+	return fingerprints, nil
+}
+
+func runMarker(fingerprints runFingerprints) (string, error) {
+	content, err := json.Marshal(fingerprints)
+	if err != nil {
+		return "", err
+	}
+	return "\n" + runMarkerPrefix + base64.StdEncoding.EncodeToString(content) + runMarkerSuffix + "\n", nil
+}
+
+func writeRunFingerprints(file string, fingerprints runFingerprints) error {
+	if fingerprints == nil {
+		fingerprints = runFingerprints{}
+	}
+	content, err := json.MarshalIndent(fingerprints, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(file, append(content, '\n'), 0644)
+}
+
+type trailer struct {
+	Base      string
+	Current   string
+	Charts    map[string]string
+	Signature string
+}
+
+func chartDigest(fingerprints map[string]string) string {
+	keys := make([]string, 0, len(fingerprints))
+	for key := range fingerprints {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	hash := sha256.New()
+	for _, key := range keys {
+		fmt.Fprintf(hash, "%s %s\n", key, fingerprints[key])
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil))
+}
+
+func runTrailer(config *Config) trailer {
+	t := trailer{Base: resolveCommit(config.Base), Current: resolveCommit(config.Current), Charts: make(map[string]string)}
+	if config.Since != "" {
+		t.Base = resolveCommit(config.Since)
+	}
+	for chart, fingerprints := range config.fingerprints {
+		if len(fingerprints) > 0 {
+			t.Charts[chart] = chartDigest(fingerprints)
+		}
+	}
+	return t
+}
+
+const reportPayloadType = "application/vnd.helm-git-diff.report+json"
+
+func loadReportSigner(path string) (crypto.Signer, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM block found", path)
+	}
+
+	var key any
+	switch block.Type {
+	case "PRIVATE KEY":
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "EC PRIVATE KEY":
+		key, err = x509.ParseECPrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("%s: unsupported PEM block %q (expected a private key)", path, block.Type)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("%s: unsupported key type %T", path, key)
+	}
+	return signer, nil
+}
+
+func signReport(r report, signer crypto.Signer) (signedReport, error) {
+	payload, err := json.Marshal(r)
+	if err != nil {
+		return signedReport{}, err
+	}
+
+	message := dssePAE(reportPayloadType, payload)
+	var opts crypto.SignerOpts = crypto.SHA256
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		opts = crypto.Hash(0)
+	} else {
+		sum := sha256.Sum256(message)
+		message = sum[:]
+	}
+	sig, err := signer.Sign(rand.Reader, message, opts)
+	if err != nil {
+		return signedReport{}, err
+	}
+
+	publicKey, err := x509.MarshalPKIXPublicKey(signer.Public())
+	if err != nil {
+		return signedReport{}, err
+	}
+	keyID := sha256.Sum256(publicKey)
+	return signedReport{
+		PayloadType: reportPayloadType,
+		Payload:     base64.StdEncoding.EncodeToString(payload),
+		Signatures:  []reportSignature{{KeyID: hex.EncodeToString(keyID[:]), Sig: base64.StdEncoding.EncodeToString(sig)}},
+	}, nil
+}
+
+func dssePAE(payloadType string, payload []byte) []byte {
+	return fmt.Appendf(nil, "DSSEv1 %d %s %d %s", len(payloadType), payloadType, len(payload), payload)
+}
+
+func resolveCommit(ref string) string {
+	commit, err := gitCommand("rev-parse", "--verify", "--quiet", ref+"^{commit}").Output()
+	if err != nil {
+		return ref
+	}
+	return strings.TrimSpace(string(commit))
+}
+
+func (t trailer) payload() string {
+	charts := make([]string, 0, len(t.Charts))
+	for chart := range t.Charts {
+		charts = append(charts, chart)
+	}
+	sort.Strings(charts)
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%sBase: %s\n", trailerPrefix, t.Base)
+	fmt.Fprintf(&b, "%sCurrent: %s\n", trailerPrefix, t.Current)
+	for _, chart := range charts {
+		fmt.Fprintf(&b, "%sChart: %s %s\n", trailerPrefix, chart, t.Charts[chart])
+	}
+	return b.String()
+}
+
+func (t trailer) sign(key []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(t.payload()))
+	return trailerSignedWith + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (t trailer) String() string {
+	return t.payload() + fmt.Sprintf("%sSignature: %s\n", trailerPrefix, t.Signature)
+}
+
+func parseTrailer(content string) (trailer, error) {
+	t := trailer{Charts: make(map[string]string)}
+	for _, line := range strings.Split(content, "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), ": ")
+		if !ok || !strings.HasPrefix(key, trailerPrefix) {
+			continue
+		}
+		switch strings.TrimPrefix(key, trailerPrefix) {
+		case "Base":
+			t.Base = value
+		case "Current":
+			t.Current = value
+		case "Chart":
+			chart, digest, ok := strings.Cut(value, " ")
+			if !ok {
+				return trailer{}, fmt.Errorf("malformed chart line %q", line)
+			}
+			t.Charts[chart] = digest
+		case "Signature":
+			t.Signature = value
+		}
+	}
+	if t.Signature == "" {
+		return trailer{}, fmt.Errorf("no %sSignature found", trailerPrefix)
+	}
+	return t, nil
+}
+
+func writeTrailer(config *Config) error {
+	t := runTrailer(config)
+	t.Signature = t.sign([]byte(os.Getenv(signingKeyEnv)))
+	if config.Trailer == "-" {
+		_, err := fmt.Fprint(streams.locked(textOutput(config)), t)
+		return err
+	}
+	return os.WriteFile(config.Trailer, []byte(t.String()), 0644)
+}
+
+func verifyTrailer(config *Config) error {
+	content, err := os.ReadFile(config.VerifyTrailer)
+	if os.IsNotExist(err) {
+		content, err = gitCommand("log", "-1", "--format=%B", config.VerifyTrailer).Output()
+		if err != nil {
+			return fmt.Errorf("%s is neither a file nor a commit", config.VerifyTrailer)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	reviewed, err := parseTrailer(string(content))
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(reviewed.Signature), []byte(reviewed.sign([]byte(os.Getenv(signingKeyEnv))))) {
+		return fmt.Errorf("signature does not match; the block was changed or signed with another key")
+	}
+
+	current := runTrailer(config)
+	if reviewed.Base != current.Base || reviewed.Current != current.Current {
+		return fmt.Errorf("the review covers %s..%s, but this run compares %s..%s", shortCommit(reviewed.Base), shortCommit(reviewed.Current), shortCommit(current.Base), shortCommit(current.Current))
+	}
+	charts := make(map[string]bool)
+	for chart := range reviewed.Charts {
+		charts[chart] = true
+	}
+	for chart := range current.Charts {
+		charts[chart] = true
+	}
+	var mismatches []string
+	for chart := range charts {
+		switch {
+		case current.Charts[chart] == "":
+			mismatches = append(mismatches, chart+": reviewed changes are missing")
+		case reviewed.Charts[chart] == "":
+			mismatches = append(mismatches, chart+": changes were not reviewed")
+		case current.Charts[chart] != reviewed.Charts[chart]:
+			mismatches = append(mismatches, chart+": diff differs from the reviewed one")
+		}
+	}
+	sort.Strings(mismatches)
+	if len(mismatches) > 0 {
+		return fmt.Errorf("diff does not match the review of %s..%s:\n  %s", shortCommit(reviewed.Base), shortCommit(reviewed.Current), strings.Join(mismatches, "\n  "))
+	}
+
+	streams.diagnosticf("Verified: %d charts match the review of %s..%s", len(reviewed.Charts), shortCommit(reviewed.Base), shortCommit(reviewed.Current))
+	return nil
+}
+
+func writeRouting(config *Config) error {
+	reviewers, err := loadReviewers(config.ReviewersFile)
+	if err != nil {
+		return fmt.Errorf("loading reviewers: %w", err)
+	}
+
+	type categoryRoute struct {
+		Charts    []string `json:"charts"`
+		Reviewers []string `json:"reviewers"`
+	}
+	routing := struct {
+		Charts     []chartRoute              `json:"charts"`
+		Categories map[string]*categoryRoute `json:"categories"`
+		Reviewers  []string                  `json:"reviewers"`
+	}{
+		Charts:     config.routes,
+		Categories: make(map[string]*categoryRoute),
+		Reviewers:  []string{},
+	}
+	if routing.Charts == nil {
+		routing.Charts = []chartRoute{}
+	}
+
+	seenReviewers := make(map[string]bool)
+	for _, route := range config.routes {
+		for _, category := range route.Categories {
+			entry, ok := routing.Categories[category]
+			if !ok {
+				entry = &categoryRoute{Reviewers: reviewers[category]}
+				if len(entry.Reviewers) == 0 {
+					entry.Reviewers = reviewers["*"]
+				}
+				if entry.Reviewers == nil {
+					entry.Reviewers = []string{}
+				}
+				routing.Categories[category] = entry
+				for _, reviewer := range entry.Reviewers {
+					if !seenReviewers[reviewer] {
+						seenReviewers[reviewer] = true
+						routing.Reviewers = append(routing.Reviewers, reviewer)
+					}
+				}
+			}
+			entry.Charts = append(entry.Charts, route.Chart)
+		}
+	}
+
+	content, err := json.MarshalIndent(routing, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(config.RoutingOutput, append(content, '\n'), 0644)
+}
+
+func loadReviewers(reviewersFile string) (map[string][]string, error) {
+	if !filepath.IsAbs(reviewersFile) {
+		gitRootPath, err := getGitRoot()
+		if err != nil {
+			return nil, err
+		}
+		reviewersFile = filepath.Join(gitRootPath, reviewersFile)
+	}
+
+	content, err := os.ReadFile(reviewersFile)
+	if os.IsNotExist(err) {
+		return map[string][]string{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return parseReviewers(string(content)), nil
+}
+
+func parseReviewers(content string) map[string][]string {
+	reviewers := make(map[string][]string)
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		reviewers[fields[0]] = append(reviewers[fields[0]], fields[1:]...)
+	}
+	return reviewers
+}
+
+func colorizeDiff(diff string) string {
+	const (
+		red   = "\033[31m"
+		green = "\033[32m"
+		cyan  = "\033[36m"
+		reset = "\033[0m"
+	)
+
+	lines := strings.Split(diff, "\n")
+	for i, line := range lines {
+		if len(line) == 0 {
+			continue
+		}
+		switch line[0] {
+		case '-':
+			if strings.HasPrefix(line, "---") {
+				lines[i] = cyan + line + reset
+			} else {
+				lines[i] = red + line + reset
+			}
+		case '+':
+			if strings.HasPrefix(line, "+++") {
+				lines[i] = cyan + line + reset
+			} else {
+				lines[i] = green + line + reset
+			}
+		case '@':
+			lines[i] = cyan + line + reset
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+func resolveChartPath(chartDir, chart string) (string, error) {
+	if !strings.ContainsAny(chart, "/"+string(filepath.Separator)) {
+		return filepath.Join(chartDir, chart), nil
+	}
+
+	if !filepath.IsAbs(chart) && !strings.HasPrefix(chart, ".") {
+		return filepath.Clean(chart), nil
+	}
+
+	gitRootPath, err := getGitRoot()
+	if err != nil {
+		return "", err
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(cwd); err == nil {
+		cwd = resolved
+	}
+
+	absPath := chart
+	if !filepath.IsAbs(absPath) {
+		absPath = filepath.Join(cwd, chart)
+	}
+
+	relPath, err := filepath.Rel(gitRootPath, absPath)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(relPath, "..") {
+		return "", fmt.Errorf("%s is outside the git repository", chart)
+	}
+
+	return relPath, nil
+}
+
+func runApprove(args []string) error {
+	flags := flag.NewFlagSet("approve", flag.ExitOnError)
+	ref := flags.String("ref", "HEAD", "Git reference to approve")
+	chartDir := flags.String("chart-dir", ".", "Directory containing Helm charts")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: helm git-diff approve [flags] CHART...\n\n")
+		fmt.Fprintf(os.Stderr, "Pin charts to a commit in %s for use with --base %s.\n\n", pinFileName, baseApproved)
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return fmt.Errorf("no charts to approve")
+	}
+
+	commit, err := gitCommand("rev-parse", "--verify", *ref+"^{commit}").Output()
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", *ref, err)
+	}
+	commitHash := strings.TrimSpace(string(commit))
+
+	pins, err := loadPins()
+	if err != nil {
+		return fmt.Errorf("loading approved pins: %w", err)
+	}
+
+	for _, chart := range flags.Args() {
+		chartPath, err := resolveChartPath(*chartDir, chart)
+		if err != nil {
+			return fmt.Errorf("resolving chart path: %w", err)
+		}
+		pins[filepath.ToSlash(chartPath)] = commitHash
+		fmt.Printf("%s: approved at %s\n", filepath.ToSlash(chartPath), shortCommit(commitHash))
+	}
+
+	return savePins(pins)
+}
+
+func runAudit(args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ExitOnError)
+	ref := flags.String("ref", "HEAD", "Git reference to audit up to")
+	chartDir := flags.String("chart-dir", ".", "Directory containing Helm charts")
+	stateFile := flags.String("state", auditStateFileName, "State file recording the last audited commit per chart, relative to the repository root")
+	logFile := flags.String("log", auditLogFileName, "Append-only JSON lines log of audit results")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: helm git-diff audit [flags] [CHART...]\n\n")
+		fmt.Fprintf(os.Stderr, "Diff charts since their last audited commit, log the results and advance the state.\n\n")
+		fmt.Fprintf(os.Stderr, "Flags:\n")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	commit, err := gitCommand("rev-parse", "--verify", *ref+"^{commit}").Output()
+	if err != nil {
+		return fmt.Errorf("resolving %s: %w", *ref, err)
+	}
+	commitHash := strings.TrimSpace(string(commit))
+
+	charts := flags.Args()
+	if len(charts) == 0 {
+		chartDirs, err := listChartDirs(commitHash)
+		if err != nil {
+			return fmt.Errorf("listing charts: %w", err)
+		}
+		for _, dir := range topLevelCharts(chartDirs) {
+			if underAnyRoot(dir+"/Chart.yaml", []string{*chartDir}) {
+				charts = append(charts, chartArgument(*chartDir, dir))
+			}
+		}
+		sort.Strings(charts)
+	}
+
+	state, err := loadPinFile(*stateFile)
+	if err != nil {
+		return fmt.Errorf("loading audit state: %w", err)
+	}
+
+	config := &Config{
+		Base:        "audited",
+		Current:     commitHash,
+		ChartDir:    *chartDir,
+		Concurrency: runtime.NumCPU(),
+		Context:     defaultContextLines,
+		Output:      outputText,
+		SortKeys:    true,
+		pins:        make(map[string]string),
+	}
+	for _, chart := range charts {
+		chartPath, err := resolveChartPath(*chartDir, chart)
+		if err != nil {
+			return fmt.Errorf("resolving chart path: %w", err)
+		}
+		chartPath = filepath.ToSlash(chartPath)
+		if last, ok := state[chartPath]; ok {
+			config.pins[chartPath] = last
+			continue
+		}
+		state[chartPath] = commitHash
+		fmt.Printf("%s: audit baseline at %s\n", chartPath, shortCommit(commitHash))
+	}
+
+	config.Charts, err = detectChangedApprovedCharts(config)
+	if err != nil {
+		return fmt.Errorf("detecting changed charts: %w", err)
+	}
+	if err := diffCharts(config); err != nil {
+		return err
+	}
+	fmt.Printf("RESULT: changed=%d unchanged=%d skipped=%d errors=%d\n", config.changed, config.unchanged, config.skipped, len(config.failures))
+
+	if err := appendAuditLog(*logFile, config, commitHash); err != nil {
+		return fmt.Errorf("writing audit log: %w", err)
+	}
+
+	failed := make(map[string]bool, len(config.failures))
+	for _, failure := range config.failures {
+		failed[failure.Chart] = true
+	}
+	for chartPath := range config.pins {
+		if !failed[chartPath] {
+			state[chartPath] = commitHash
+		}
+	}
+	if err := savePinFile(*stateFile, state); err != nil {
+		return fmt.Errorf("saving audit state: %w", err)
+	}
+
+	if len(config.failures) > 0 {
+		return errChartsFailed
+	}
+	return nil
+}
+
+func appendAuditLog(logFile string, config *Config, commitHash string) error {
+	if len(config.results) == 0 {
+		return nil
+	}
+
+	f, err := os.OpenFile(logFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	auditedAt := time.Now().UTC().Format(time.RFC3339)
+	encoder := json.NewEncoder(f)
+	for _, result := range config.results {
+		entry := auditEntry{
+			Time:        auditedAt,
+			From:        config.pins[result.Chart],
+			To:          commitHash,
+			chartResult: result,
+		}
+		if err := encoder.Encode(entry); err != nil {
+			_ = f.Close()
+			return err
+		}
+	}
+
+	return f.Close()
+}
+
+func loadPins() (map[string]string, error) {
+	return loadPinFile(pinFileName)
+}
+
+func savePins(pins map[string]string) error {
+	return savePinFile(pinFileName, pins)
+}
+
+func loadPinFile(name string) (map[string]string, error) {
+	gitRootPath, err := getGitRoot()
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := os.ReadFile(filepath.Join(gitRootPath, name))
+	if os.IsNotExist(err) {
+		return make(map[string]string), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var pinFile struct {
+		Charts map[string]string `yaml:"charts"`
+	}
+	if err := yaml.Unmarshal(content, &pinFile); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", name, err)
+	}
+	if pinFile.Charts == nil {
+		pinFile.Charts = make(map[string]string)
+	}
+
+	return pinFile.Charts, nil
+}
+
+func savePinFile(name string, pins map[string]string) error {
+	gitRootPath, err := getGitRoot()
+	if err != nil {
+		return err
+	}
+
+	pinFile := struct {
+		Charts map[string]string `yaml:"charts"`
+	}{Charts: pins}
+
+	var content bytes.Buffer
+	encoder := yaml.NewEncoder(&content)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(pinFile); err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Join(gitRootPath, name), content.Bytes(), 0644)
+}
+
+func shortCommit(commit string) string {
+	if len(commit) > 12 {
+		return commit[:12]
+	}
+	return commit
+}
+
+func getGitRoot() (string, error) {
+	output, err := gitCommand("rev-parse", "--show-toplevel").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func getWorkdirChartPath(gitRelativePath string) (string, error) {
+	gitRootPath, err := getGitRoot()
+	if err != nil {
+		return "", err
+	}
+
+	if filepath.IsAbs(gitRelativePath) {
+		return gitRelativePath, nil
+	}
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(gitRelativePath, ".") {
+		cwdRelativeToGit, err := filepath.Rel(gitRootPath, cwd)
+		if err != nil {
+			return "", err
+		}
+		fullRelativePath := filepath.Join(cwdRelativeToGit, gitRelativePath)
+		return filepath.Join(gitRootPath, fullRelativePath), nil
+	}
+
+	return filepath.Join(gitRootPath, gitRelativePath), nil
+}
+
+func extractChartAtRef(chartPath, ref string) (string, func(), error) {
+	tmpDir, err := os.MkdirTemp("", "helm-git-diff-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(tmpDir)
+	}
+
+	pathsToExtract := getChartPathsToExtract(ref, chartPath)
+
+	archive, err := repoVCS.archive(ref, pathsToExtract)
+	if err != nil {
+		cleanup()
+		return "", nil, err
+	}
+
+	if len(archive) == 0 {
+		return "", cleanup, nil
+	}
+
+	if err := extractTar(bytes.NewReader(archive), tmpDir); err != nil {
+		cleanup()
+		return "", nil, fmt.Errorf("extracting archive: %w", err)
+	}
+
+	return filepath.Join(tmpDir, chartPath), cleanup, nil
+}
+
+func extractTar(r io.Reader, dest string) error {
+	reader := tar.NewReader(r)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := filepath.FromSlash(header.Name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("archive entry %q escapes the destination", header.Name)
+		}
+		target := filepath.Join(dest, name)
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, 0755); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			file, err := os.OpenFile(target, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm()|0600)
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(file, reader); err != nil {
+				_ = file.Close()
+				return err
+			}
+			if err := file.Close(); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Symlink(header.Linkname, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (gitVCS) archive(ref string, paths []string) ([]byte, error) {
+	gitRootPath, err := getGitRoot()
+	if err != nil {
+		return nil, fmt.Errorf("getting git root: %w", err)
+	}
+
+	args := append([]string{"archive", ref}, paths...)
+	cmd := gitCommand(args...)
+	cmd.Dir = gitRootPath
+	archive, err := cmd.Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return nil, fmt.Errorf("archiving chart paths at %s (stderr: %s): %w", ref, string(exitErr.Stderr), err)
+		}
+		return nil, fmt.Errorf("archiving chart paths at %s: %w", ref, err)
+	}
+	return archive, nil
+}
+
+func (gitVCS) show(ref, path string) ([]byte, error) {
+	gitRootPath, err := getGitRoot()
+	if err != nil {
+		return nil, fmt.Errorf("getting git root: %w", err)
+	}
+
+	cmd := gitCommand("show", ref+":"+path)
+	cmd.Dir = gitRootPath
+	return cmd.Output()
+}
+
+func (gitVCS) exists(ref, path string) (bool, error) {
+	gitRootPath, err := getGitRoot()
+	if err != nil {
+		return false, fmt.Errorf("getting git root: %w", err)
+	}
+
+	object := ref + ":" + path
+	cmd := gitCommand("cat-file", "-e", object)
+	cmd.Dir = gitRootPath
+	if err := cmd.Run(); err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return false, nil
+		}
+		return false, fmt.Errorf("checking %s: %w", object, err)
+	}
+	return true, nil
+}
+
+func templateOptionsFrom(config *Config) templateOptions {
+	return templateOptions{
+		ReleaseName:  config.ReleaseName,
+		Namespace:    config.Namespace,
+		KubeVersion:  config.KubeVersion,
+		APIVersions:  config.APIVersions,
+		IncludeCRDs:  config.IncludeCRDs,
+		PostRenderer: config.PostRenderer,
+		NoHooks:      config.AgainstRelease,
+		AllowLookup:  config.AllowLookup,
+	}
+}
+
+func chartTemplateOptions(config *Config, sources *chartSources) templateOptions {
+	opts := templateOptionsFrom(config)
+	if opts.ReleaseName == "" {
+		opts.ReleaseName = sources.ReleaseName
+	}
+	if opts.Namespace == "" {
+		opts.Namespace = sources.Namespace
+	}
+	return opts
+}
+
+func chartSetValues(config *Config, sources *chartSources) []string {
+	return append(append(append([]string{}, sources.SetValues...), config.SetValues...), sources.Permutation...)
+}
+
+func serverDryRun(baseManifest, currentManifest, namespace string) (map[string]string, error) {
+	baseResources, err := parseManifest(baseManifest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing base manifest: %w", err)
+	}
+	currentResources, err := parseManifest(currentManifest)
+	if err != nil {
+		return nil, fmt.Errorf("parsing current manifest: %w", err)
+	}
+
+	baseContent := make(map[string]string, len(baseResources))
+	for _, res := range baseResources {
+		baseContent[resourceKey(res)] = res.Content
+	}
+
+	rejections := make(map[string]string)
+	for _, res := range currentResources {
+		if content, ok := baseContent[resourceKey(res)]; ok && content == res.Content {
+			continue
+		}
+
+		args := []string{"apply", "--dry-run=server", "--filename", "-", "--output", "name"}
+		if res.Namespace == "" && namespace != "" {
+			args = append(args, "--namespace", namespace)
+		}
+		cmd := exec.Command(kubectlBinary, args...)
+		cmd.Stdin = strings.NewReader(res.Content)
+		if _, err := cmd.Output(); err != nil {
+			exitErr, ok := err.(*exec.ExitError)
+			if !ok {
+				return nil, fmt.Errorf("running kubectl apply: %w", err)
+			}
+			message := strings.Join(strings.Fields(string(exitErr.Stderr)), " ")
+			if !serverRejection(message) {
+				return nil, withReason(reasonRenderFailed, fmt.Errorf("kubectl apply for %s failed: %s", resourceName(res), message))
+			}
+			rejections[resourceKey(res)] = message
+		}
+	}
+	return rejections, nil
+}
+
+var (
+	rbacDeniedPattern    = regexp.MustCompile(`is forbidden: User "[^"]*" cannot`)
+	invalidObjectPattern = regexp.MustCompile(`^The \S+ "[^"]*" is invalid:`)
+)
+
+// serverRejection reports whether kubectl failed because the API server
+// rejected the object in admission or validation. Failing to reach or
+// authenticate with the server, or a kind the server does not know, says
+// nothing about the change and fails the chart instead.
+func serverRejection(message string) bool {
+	if strings.Contains(message, "(Unauthorized)") || rbacDeniedPattern.MatchString(message) {
+		return false
+	}
+	return strings.HasPrefix(message, "Error from server") || invalidObjectPattern.MatchString(message)
+}
+
+func dryRunRejection(sources *chartSources, change resourceChange) string {
+	if change.Current == nil {
+		return ""
+	}
+	return sources.DryRunErrors[resourceKey(*change.Current)]
+}
+
+func fetchReleaseManifest(release, namespace string) (string, error) {
+	args := []string{"get", "manifest", release}
+	if namespace != "" {
+		args = append(args, "--namespace", namespace)
+	}
+
+	output, err := exec.Command(helmBinary, args...).Output()
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if strings.Contains(string(exitErr.Stderr), "release: not found") {
+				return "", nil
+			}
+			return "", fmt.Errorf("helm get manifest failed: %s", string(exitErr.Stderr))
+		}
+		return "", fmt.Errorf("running helm get manifest: %w", err)
+	}
+	return string(output), nil
+}
+
+func renderChart(chartPath, valuesFiles string, setValues []string, opts templateOptions) (string, error) {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("getting current directory: %w", err)
+	}
+
+	var files []string
+	if valuesFiles != "" {
+		for _, vf := range strings.Split(valuesFiles, ",") {
+			valuesPath := strings.TrimSpace(vf)
+			if !filepath.IsAbs(valuesPath) {
+				valuesPath = filepath.Join(cwd, valuesPath)
+			}
+			files = append(files, valuesPath)
+		}
+	}
+	return render.Chart(helmBinary, chartPath, files, setValues, opts)
+}
+
+func sourceValuesFiles(sources *chartSources, chartPath, valuesFiles string) (string, error) {
+	var files []string
+	for _, envFile := range sources.EnvValues {
+		envPath, err := filepath.Abs(filepath.Join(chartPath, envFile))
+		if err != nil {
+			return "", err
+		}
+		if _, err := os.Stat(envPath); os.IsNotExist(err) {
+			if addedEnvValues(sources, chartPath, envFile) {
+				continue
+			}
+			return "", fmt.Errorf("values file %s of environment %s not found in the chart", envFile, sources.Env)
+		}
+		files = append(files, envPath)
+	}
+	if valuesFiles != "" {
+		files = append(files, valuesFiles)
+	}
+	return chartValuesFiles(chartPath, strings.Join(files, ","))
+}
+
+// addedEnvValues reports whether an environment values file missing from the
+// base chart is added by the change, so the base renders without it.
+func addedEnvValues(sources *chartSources, chartPath, envFile string) bool {
+	if chartPath != sources.Base || sources.Current == "" {
+		return false
+	}
+	_, err := os.Stat(filepath.Join(sources.Current, envFile))
+	return err == nil
+}
+
+func extractValuesFiles(valuesFiles, ref string) (string, func(), error) {
+	gitRoot, err := getGitRoot()
+	if err != nil {
+		return "", nil, fmt.Errorf("getting git root: %w", err)
+	}
+
+	tmpDir, err := os.MkdirTemp("", "helm-git-diff-values-*")
+	if err != nil {
+		return "", nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+	cleanup := func() {
+		_ = os.RemoveAll(tmpDir)
+	}
+
+	var files []string
+	for i, valuesFile := range splitList([]string{valuesFiles}) {
+		gitPath, ok := valuesGitPath(gitRoot, valuesFile)
+		if !ok {
+			files = append(files, valuesFile)
+			continue
+		}
+
+		if err := gitCommand("cat-file", "-e", ref+":"+gitPath).Run(); err != nil {
+			continue
+		}
+		content, err := gitCommand("show", ref+":"+gitPath).Output()
+		if err != nil {
+			cleanup()
+			return "", nil, fmt.Errorf("reading %s at %s: %w", valuesFile, ref, err)
+		}
+
+		extracted := filepath.Join(tmpDir, fmt.Sprintf("%d-%s", i, filepath.Base(valuesFile)))
+		if err := os.WriteFile(extracted, content, 0644); err != nil {
+			cleanup()
+			return "", nil, err
+		}
+		files = append(files, extracted)
+	}
+
+	return strings.Join(files, ","), cleanup, nil
+}
+
+func chartValuesFiles(chartPath, valuesFiles string) (string, error) {
+	annotations, err := readChartAnnotations(chartPath)
+	if err != nil {
+		return "", err
+	}
+
+	var files []string
+	for _, extra := range splitList([]string{annotations[annotationExtraValues]}) {
+		extraPath, err := filepath.Abs(filepath.Join(chartPath, extra))
+		if err != nil {
+			return "", err
+		}
+		files = append(files, extraPath)
+	}
+	if valuesFiles != "" {
+		files = append(files, valuesFiles)
+	}
+
+	return strings.Join(files, ","), nil
+}
+
+func readChartAnnotations(chartPath string) (map[string]string, error) {
+	content, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	return parseChartAnnotations(content)
+}
+
+func parseChartAnnotations(content []byte) (map[string]string, error) {
+	var chart struct {
+		Annotations map[string]string `yaml:"annotations"`
+	}
+	if err := yaml.Unmarshal(content, &chart); err != nil {
+		return nil, fmt.Errorf("parsing Chart.yaml: %w", err)
+	}
+
+	return chart.Annotations, nil
+}
+
+func valuesImpact(config *Config, sources *chartSources) ([]string, error) {
+	onlyValues, err := onlyValuesChanged(sources.Base, sources.Current)
+	if err != nil || !onlyValues {
+		return nil, err
+	}
+
+	baseValues, err := readValues(filepath.Join(sources.Base, "values.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	currentValues, err := readValues(filepath.Join(sources.Current, "values.yaml"))
+	if err != nil {
+		return nil, err
+	}
+	currentResources, err := parseManifest(sources.CurrentManifest)
+	if err != nil {
+		return nil, err
+	}
+	normalizeResources(config, currentResources)
+
+	valuesFiles, err := sourceValuesFiles(sources, sources.Current, sources.CurrentValues)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, key := range changedValueKeys(baseValues, currentValues) {
+		baseValue, _ := lookupValue(baseValues, key)
+		reverted, err := renderWithValue(sources.Current, valuesFiles, chartSetValues(config, sources), chartTemplateOptions(config, sources), key, baseValue)
+		if err != nil {
+			return nil, err
+		}
+		revertedResources, err := parseManifest(reverted)
+		if err != nil {
+			return nil, err
+		}
+		normalizeResources(config, revertedResources)
+
+		var affected []string
+		for _, change := range compareChartResources(config, revertedResources, currentResources) {
+			affected = append(affected, resourceName(changedResource(change)))
+		}
+		if len(affected) == 0 {
+			lines = append(lines, fmt.Sprintf("values key %s affects no resources", strings.Join(key, ".")))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("values key %s affects %s", strings.Join(key, "."), strings.Join(affected, ", ")))
+	}
+	return lines, nil
+}
+
+var valuesReferencePattern = regexp.MustCompile(`\.Values((?:\.[A-Za-z_][A-Za-z0-9_]*)+)`)
+
+func valuesCoverage(config *Config, sources *chartSources) ([]string, error) {
+	currentKeys, err := templateValueKeys(sources.Current)
+	if err != nil {
+		return nil, err
+	}
+	baseKeys := map[string]bool{}
+	if sources.Base != "" {
+		baseKeys, err = templateValueKeys(sources.Base)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	valuesFiles, err := sourceValuesFiles(sources, sources.Current, sources.CurrentValues)
+	if err != nil {
+		return nil, err
+	}
+	var provided []map[string]any
+	for _, valuesFile := range splitList([]string{valuesFiles}) {
+		values, err := readValues(valuesFile)
+		if err != nil {
+			return nil, err
+		}
+		provided = append(provided, values)
+	}
+	for _, setValue := range splitList(chartSetValues(config, sources)) {
+		name, _, _ := strings.Cut(setValue, "=")
+		provided = append(provided, nestedValue(strings.Split(name, "."), true))
+	}
+
+	defaults, err := readValues(filepath.Join(sources.Current, "values.yaml"))
+	if os.IsNotExist(err) {
+		defaults, err = map[string]any{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(currentKeys))
+	for name := range currentKeys {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		key := strings.Split(name, ".")
+		if valueProvided(provided, key) {
+			continue
+		}
+		fallback := "chart default"
+		if !valueProvided([]map[string]any{defaults}, key) {
+			fallback = "unset"
+		}
+		if !baseKeys[name] {
+			lines = append(lines, fmt.Sprintf("values key %s newly referenced, not set by values files (%s)", name, fallback))
+			continue
+		}
+		lines = append(lines, fmt.Sprintf("values key %s not set by values files (%s)", name, fallback))
+	}
+	return lines, nil
+}
+
+func valuesDrift(basePath, currentPath string) ([]string, error) {
+	baseDefaults, err := chartDefaults(basePath)
+	if err != nil {
+		return nil, err
+	}
+	currentDefaults, err := chartDefaults(currentPath)
+	if err != nil {
+		return nil, err
+	}
+	baseKeys, err := templateValueKeys(basePath)
+	if err != nil {
+		return nil, err
+	}
+	currentKeys, err := templateValueKeys(currentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	for _, name := range slices.Sorted(maps.Keys(currentKeys)) {
+		key := strings.Split(name, ".")
+		if valueProvided([]map[string]any{baseDefaults}, key) && !valueProvided([]map[string]any{currentDefaults}, key) {
+			lines = append(lines, fmt.Sprintf("values key %s removed from values.yaml but still referenced by templates", name))
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(baseKeys)) {
+		if currentKeys[name] || referencedByPrefix(currentKeys, name) {
+			continue
+		}
+		if valueProvided([]map[string]any{currentDefaults}, strings.Split(name, ".")) {
+			lines = append(lines, fmt.Sprintf("values key %s no longer referenced by templates but still set in values.yaml", name))
+		}
+	}
+	return lines, nil
+}
+
+func chartDefaults(chartPath string) (map[string]any, error) {
+	values, err := readValues(filepath.Join(chartPath, "values.yaml"))
+	if os.IsNotExist(err) {
+		return map[string]any{}, nil
+	}
+	return values, err
+}
+
+func referencedByPrefix(keys map[string]bool, name string) bool {
+	for key := range keys {
+		if strings.HasPrefix(name, key+".") || strings.HasPrefix(key, name+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func templateValueKeys(chartPath string) (map[string]bool, error) {
+	keys := make(map[string]bool)
+	err := filepath.WalkDir(filepath.Join(chartPath, "templates"), func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		for _, match := range valuesReferencePattern.FindAllStringSubmatch(string(content), -1) {
+			keys[strings.TrimPrefix(match[1], ".")] = true
+		}
+		return nil
+	})
+	if os.IsNotExist(err) {
+		return keys, nil
+	}
+	return keys, err
+}
+
+func valueProvided(provided []map[string]any, key []string) bool {
+	for _, values := range provided {
+		var current any = values
+		found := true
+		for _, part := range key {
+			nested, ok := current.(map[string]any)
+			if !ok {
+				found = false
+				break
+			}
+			if current, ok = nested[part]; !ok {
+				found = false
+				break
+			}
+		}
+		if found {
+			return true
+		}
+	}
+	return false
+}
+
+func nestedValue(key []string, value any) map[string]any {
+	nested := map[string]any{key[len(key)-1]: value}
+	for i := len(key) - 2; i >= 0; i-- {
+		nested = map[string]any{key[i]: nested}
+	}
+	return nested
+}
+
+type chartFile struct {
+	size   int64
+	binary bool
+}
+
+func chartSizeChanges(basePath, currentPath string) ([]string, error) {
+	baseFiles, err := chartFileSizes(basePath)
+	if err != nil {
+		return nil, err
+	}
+	currentFiles, err := chartFileSizes(currentPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseSize, currentSize int64
+	for _, file := range baseFiles {
+		baseSize += file.size
+	}
+	for _, file := range currentFiles {
+		currentSize += file.size
+	}
+
+	var lines []string
+	if baseSize != currentSize || len(baseFiles) != len(currentFiles) {
+		lines = append(lines, fmt.Sprintf("chart size %s -> %s (%s), %d -> %d files (%+d)",
+			formatSize(baseSize), formatSize(currentSize), formatSizeDelta(currentSize-baseSize), len(baseFiles), len(currentFiles), len(currentFiles)-len(baseFiles)))
+	}
+	for _, name := range slices.Sorted(maps.Keys(currentFiles)) {
+		file := currentFiles[name]
+		previous, existed := baseFiles[name]
+		switch {
+		case file.binary && !existed:
+			lines = append(lines, fmt.Sprintf("binary file added: %s (%s)", name, formatSize(file.size)))
+		case file.size >= largeFileSize && !existed:
+			lines = append(lines, fmt.Sprintf("large file added: %s (%s)", name, formatSize(file.size)))
+		case file.size >= largeFileSize && file.size > previous.size:
+			lines = append(lines, fmt.Sprintf("large file grew: %s (%s -> %s)", name, formatSize(previous.size), formatSize(file.size)))
+		}
+	}
+	return lines, nil
+}
+
+func chartFileSizes(chartPath string) (map[string]chartFile, error) {
+	files := make(map[string]chartFile)
+	if chartPath == "" {
+		return files, nil
+	}
+	ignore, err := loadHelmignore(chartPath)
+	if err != nil {
+		return nil, err
+	}
+	err = filepath.WalkDir(chartPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if rel == "tmpcharts" || ignore.ignores(rel, true) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(rel, "charts/") && strings.HasSuffix(rel, ".tgz") || ignore.ignores(rel, false) {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		binary, err := isBinaryFile(path)
+		if err != nil {
+			return err
+		}
+		files[rel] = chartFile{size: info.Size(), binary: binary}
+		return nil
+	})
+	return files, err
+}
+
+func isBinaryFile(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	head := make([]byte, 8000)
+	n, err := io.ReadFull(file, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return bytes.IndexByte(head[:n], 0) >= 0, nil
+}
+
+type helmignoreRule struct {
+	pattern  string
+	negate   bool
+	dirOnly  bool
+	anchored bool
+}
+
+type helmignore []helmignoreRule
+
+// loadHelmignore reads the chart's .helmignore with the rules helm package
+// applies: patterns without a slash match the base name, a trailing slash
+// matches directories only, ! negates and dotfiles in templates/ are always
+// left out.
+func loadHelmignore(chartPath string) (helmignore, error) {
+	content, err := os.ReadFile(filepath.Join(chartPath, ".helmignore"))
+	if os.IsNotExist(err) {
+		content, err = nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rules helmignore
+	for line := range strings.SplitSeq(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.Contains(line, "**") {
+			return nil, fmt.Errorf("parsing .helmignore: %q: double-star (**) syntax is not supported", line)
+		}
+		if _, err := path.Match(line, "abc"); err != nil {
+			return nil, fmt.Errorf("parsing .helmignore: %q: %w", line, err)
+		}
+
+		rule := helmignoreRule{}
+		line, rule.negate = strings.CutPrefix(line, "!")
+		line, rule.dirOnly = strings.CutSuffix(line, "/")
+		rule.anchored = strings.Contains(line, "/")
+		rule.pattern = strings.TrimPrefix(line, "/")
+		rules = append(rules, rule)
+	}
+	return append(rules, helmignoreRule{pattern: "templates/.?*", anchored: true}), nil
+}
+
+func (rules helmignore) ignores(rel string, isDir bool) bool {
+	for _, rule := range rules {
+		name := rel
+		if !rule.anchored {
+			name = path.Base(rel)
+		}
+		matched, _ := path.Match(rule.pattern, name)
+		if rule.negate {
+			if rule.dirOnly && !isDir || !matched {
+				return true
+			}
+			continue
+		}
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func formatSize(size int64) string {
+	switch {
+	case size >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(size)/(1<<20))
+	case size >= 1<<10:
+		return fmt.Sprintf("%.1f KiB", float64(size)/(1<<10))
+	default:
+		return fmt.Sprintf("%d B", size)
+	}
+}
+
+func formatSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + formatSize(-delta)
+	}
+	return "+" + formatSize(delta)
+}
+
+func onlyValuesChanged(basePath, currentPath string) (bool, error) {
+	baseFiles, err := chartFileHashes(basePath)
+	if err != nil {
+		return false, err
+	}
+	currentFiles, err := chartFileHashes(currentPath)
+	if err != nil {
+		return false, err
+	}
+
+	changed := comparePackageFiles(baseFiles, currentFiles)
+	return len(changed) == 1 && changed[0] == "file changed: values.yaml", nil
+}
+
+func chartFileHashes(chartPath string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(chartPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == "tmpcharts" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if strings.HasPrefix(rel, "charts/") && strings.HasSuffix(rel, ".tgz") {
+			return nil
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(content)
+		files[rel] = hex.EncodeToString(sum[:])
+		return nil
+	})
+	return files, err
+}
+
+func readValues(valuesPath string) (map[string]any, error) {
+	content, err := os.ReadFile(valuesPath)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]any)
+	if err := yaml.Unmarshal(content, &values); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", filepath.Base(valuesPath), err)
+	}
+	return values, nil
+}
+
+func changedValueKeys(base, current map[string]any) [][]string {
+	baseLeaves := make(map[string]any)
+	currentLeaves := make(map[string]any)
+	paths := make(map[string][]string)
+	flattenValues(base, nil, baseLeaves, paths)
+	flattenValues(current, nil, currentLeaves, paths)
+
+	var names []string
+	for name := range paths {
+		baseValue, inBase := baseLeaves[name]
+		currentValue, inCurrent := currentLeaves[name]
+		if inBase != inCurrent || !reflect.DeepEqual(baseValue, currentValue) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	keys := make([][]string, 0, len(names))
+	for _, name := range names {
+		keys = append(keys, paths[name])
+	}
+	return keys
+}
+
+func flattenValues(values map[string]any, prefix []string, leaves map[string]any, paths map[string][]string) {
+	for key, value := range values {
+		path := append(append([]string{}, prefix...), key)
+		if nested, ok := value.(map[string]any); ok && len(nested) > 0 {
+			flattenValues(nested, path, leaves, paths)
+			continue
+		}
+		name := strings.Join(path, ".")
+		leaves[name] = value
+		paths[name] = path
+	}
+}
+
+func lookupValue(values map[string]any, key []string) (any, bool) {
+	var current any = values
+	for _, part := range key {
+		nested, ok := current.(map[string]any)
+		if !ok {
+			return nil, false
+		}
+		current, ok = nested[part]
+		if !ok {
+			return nil, false
+		}
+	}
+	return current, true
+}
+
+func renderWithValue(chartPath, valuesFiles string, setValues []string, opts templateOptions, key []string, value any) (string, error) {
+	content, err := yaml.Marshal(nestedValue(key, value))
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.CreateTemp("", "helm-git-diff-values-*.yaml")
+	if err != nil {
+		return "", fmt.Errorf("creating temp values file: %w", err)
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return "", err
+	}
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	files := f.Name()
+	if valuesFiles != "" {
+		files += "," + valuesFiles
+	}
+	return renderChart(chartPath, files, setValues, opts)
+}
+
+func packageChanges(basePath, currentPath string) ([]string, error) {
+	baseFiles, err := packageFiles(basePath)
+	if err != nil {
+		return nil, fmt.Errorf("packaging base chart: %w", err)
+	}
+	currentFiles, err := packageFiles(currentPath)
+	if err != nil {
+		return nil, fmt.Errorf("packaging current chart: %w", err)
+	}
+	return comparePackageFiles(baseFiles, currentFiles), nil
+}
+
+func packageFiles(chartPath string) (map[string]string, error) {
+	if chartPath == "" {
+		return map[string]string{}, nil
+	}
+
+	tmpDir, err := os.MkdirTemp("", "helm-git-diff-package-*")
+	if err != nil {
+		return nil, fmt.Errorf("creating temp dir: %w", err)
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	cmd := exec.Command(helmBinary, "package", chartPath, "--destination", tmpDir)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("helm package failed: %s", string(output))
+	}
+
+	packages, err := filepath.Glob(filepath.Join(tmpDir, "*.tgz"))
+	if err != nil {
+		return nil, err
+	}
+	if len(packages) != 1 {
+		return nil, fmt.Errorf("expected one package, found %d", len(packages))
+	}
+
+	return readPackageFiles(packages[0])
+}
+
+func readPackageFiles(packagePath string) (map[string]string, error) {
+	f, err := os.Open(packagePath)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, err
+	}
+
+	files := make(map[string]string)
+	reader := tar.NewReader(gz)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		hash := sha256.New()
+		if _, err := io.Copy(hash, reader); err != nil {
+			return nil, err
+		}
+		name := header.Name
+		if idx := strings.Index(name, "/"); idx >= 0 {
+			name = name[idx+1:]
+		}
+		files[name] = hex.EncodeToString(hash.Sum(nil))
+	}
+
+	return files, nil
+}
+
+func comparePackageFiles(base, current map[string]string) []string {
+	names := make([]string, 0, len(base)+len(current))
+	for name := range base {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := base[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	var lines []string
+	for _, name := range names {
+		baseHash, inBase := base[name]
+		currentHash, inCurrent := current[name]
+		switch {
+		case !inBase:
+			lines = append(lines, "file added: "+name)
+		case !inCurrent:
+			lines = append(lines, "file removed: "+name)
+		case baseHash != currentHash:
+			lines = append(lines, "file changed: "+name)
+		}
+	}
+	return lines
+}
+
+func isLibraryChart(chartYamlPath string) (bool, error) {
+	content, err := os.ReadFile(chartYamlPath)
+	if err != nil {
+		return false, err
+	}
+
+	lines := strings.Split(string(content), "\n")
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "type:") {
+			typeValue := strings.TrimSpace(strings.TrimPrefix(line, "type:"))
+			return typeValue == "library", nil
+		}
+	}
+	return false, nil
+}
+
+func getChartPathsToExtract(ref, chartPath string) []string {
+	paths := []string{chartPath}
+
+	output, err := repoVCS.show(ref, chartPath+"/Chart.yaml")
+	if err != nil {
+		return paths
+	}
+
+	lines := strings.Split(string(output), "\n")
+	inDependencies := false
+	for _, line := range lines {
+		trimmed := strings.TrimSpace(line)
+
+		if trimmed == "dependencies:" {
+			inDependencies = true
+			continue
+		}
+
+		if inDependencies {
+			if len(trimmed) > 0 && !strings.HasPrefix(trimmed, "-") && !strings.HasPrefix(trimmed, "name:") && !strings.HasPrefix(trimmed, "version:") && !strings.HasPrefix(trimmed, "repository:") {
+				break
+			}
+
+			if strings.HasPrefix(trimmed, "repository:") {
+				repo := strings.TrimSpace(strings.TrimPrefix(trimmed, "repository:"))
+				repo = strings.Trim(repo, "\"'")
+
+				if strings.HasPrefix(repo, "file://") {
+					depPath := strings.TrimPrefix(repo, "file://")
+
+					fullPath := filepath.Join(chartPath, depPath)
+
+					cleanedPath := filepath.Clean(fullPath)
+
+					paths = append(paths, cleanedPath)
+				}
+			}
+		}
+	}
+
+	return paths
+}
+
+func buildDependencies(chartPath string, skipBuild bool) error {
+	chartYaml := filepath.Join(chartPath, "Chart.yaml")
+	if _, err := os.Stat(chartYaml); os.IsNotExist(err) {
+		return nil
+	}
+
+	if skipBuild {
+		return nil
+	}
+
+	if areDependenciesUpToDate(chartPath) {
+		return nil
+	}
+
+	cmd := exec.Command(helmBinary, "dependency", "build", chartPath)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("helm dependency build failed: %s", string(output))
+	}
+
+	return nil
+}
+
+func prebuildDependencies(prepared []*chartSources, skipBuild bool, concurrency int, cacheDir string) {
+	if skipBuild {
+		return
+	}
+
+	type dependencyTarget struct {
+		path    string
+		sources *chartSources
+	}
+
+	groups := make(map[string][]dependencyTarget)
+	cachePaths := make(map[string]string)
+	var order []string
+	for _, sources := range prepared {
+		if sources.SkipReason != "" || sources.Err != nil {
+			continue
+		}
+		for _, chartPath := range []string{sources.Base, sources.Current} {
+			if chartPath == "" || areDependenciesUpToDate(chartPath) {
+				continue
+			}
+
+			deps, err := readChartDependencies(chartPath)
+			if err != nil {
+				sources.Err = withReason(reasonInvalidChart, fmt.Errorf("reading dependencies: %w", err))
+				break
+			}
+			if len(deps) == 0 {
+				continue
+			}
+			if err := checkDependencyPlugins(deps); err != nil {
+				sources.Err = withReason(reasonPluginMissing, err)
+				break
+			}
+
+			key, err := dependencyFingerprint(chartPath, deps)
+			if err != nil {
+				sources.Err = withReason(reasonDependencyBuild, fmt.Errorf("fingerprinting dependencies: %w", err))
+				break
+			}
+			if _, ok := groups[key]; !ok {
+				order = append(order, key)
+				if cacheKey, ok := dependencyCacheKey(chartPath, deps); ok && cacheDir != "" {
+					cachePaths[key] = filepath.Join(cacheDir, cacheKey)
+				}
+			}
+			groups[key] = append(groups[key], dependencyTarget{path: chartPath, sources: sources})
+		}
+	}
+
+	errs := make([]error, len(order))
+	slots := make(chan struct{}, max(concurrency, 1))
+	var wg sync.WaitGroup
+	for i, key := range order {
+		paths := make([]string, 0, len(groups[key]))
+		for _, target := range groups[key] {
+			paths = append(paths, target.path)
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+			errs[i] = buildDependencyGroup(paths, cachePaths[key])
+		}()
+	}
+	wg.Wait()
+
+	for i, key := range order {
+		if errs[i] == nil {
+			continue
+		}
+		for _, target := range groups[key] {
+			if target.sources.Err == nil {
+				target.sources.Err = withReason(reasonDependencyBuild, fmt.Errorf("building dependencies: %w", errs[i]))
+			}
+		}
+	}
+}
+
+func buildDependencyGroup(chartPaths []string, cachePath string) error {
+	if cachePath != "" && restoreDependencyCache(cachePath, chartPaths) {
+		return nil
+	}
+
+	if err := buildDependencies(chartPaths[0], false); err != nil {
+		return err
+	}
+
+	builtCharts := filepath.Join(chartPaths[0], "charts")
+	for _, chartPath := range chartPaths[1:] {
+		if err := copyDir(builtCharts, filepath.Join(chartPath, "charts")); err != nil {
+			return fmt.Errorf("copying built dependencies: %w", err)
+		}
+	}
+
+	if cachePath != "" {
+		if err := storeDependencyCache(cachePath, builtCharts); err != nil {
+			streams.diagnosticf("Warning: caching dependencies: %v", err)
+		}
+	}
 
-	return config
+	return nil
 }
 
-func shouldUseColor(noColor bool) bool {
-	if noColor {
-		return false
+func dependencyCacheDir(config *Config) string {
+	if config.NoCache {
+		return ""
 	}
-	if os.Getenv("NO_COLOR") != "" {
-		return false
+	cacheDir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
 	}
-	return isTerminal(os.Stdout)
+	return filepath.Join(cacheDir, "helm-git-diff", "dependencies")
 }
 
-func isTerminal(f *os.File) bool {
-	fileInfo, err := f.Stat()
+func dependencyCacheKey(chartPath string, deps []chartDependency) (string, bool) {
+	for _, dep := range deps {
+		if strings.HasPrefix(dep.Repository, "file://") {
+			return "", false
+		}
+	}
+
+	lock, err := os.ReadFile(filepath.Join(chartPath, "Chart.lock"))
 	if err != nil {
-		return false
+		return "", false
 	}
-	return (fileInfo.Mode() & os.ModeCharDevice) != 0
+	// A Chart.lock left behind after editing the dependencies in Chart.yaml
+	// must not restore the archives of the old dependencies.
+	hash := sha256.New()
+	for _, dep := range deps {
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\x00%s\n", dep.Name, dep.Version, dep.Repository, dep.Alias)
+	}
+	hash.Write(lock)
+	return hex.EncodeToString(hash.Sum(nil)), true
 }
 
-func detectChartContext(config *Config) error {
-	if len(config.Charts) > 0 {
-		return nil
+func restoreDependencyCache(cachePath string, chartPaths []string) bool {
+	archives, err := filepath.Glob(filepath.Join(cachePath, "*.tgz"))
+	if err != nil || len(archives) == 0 {
+		return false
 	}
 
-	if _, err := os.Stat("Chart.yaml"); err == nil {
-		cwd, err := os.Getwd()
+	for _, chartPath := range chartPaths {
+		chartsDir := filepath.Join(chartPath, "charts")
+		stale, err := filepath.Glob(filepath.Join(chartsDir, "*.tgz"))
 		if err != nil {
-			return err
+			return false
+		}
+		for _, archive := range stale {
+			if err := os.Remove(archive); err != nil {
+				return false
+			}
 		}
+		if err := copyArchives(cachePath, chartsDir); err != nil {
+			return false
+		}
+	}
+	return true
+}
 
-		gitRoot, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
-		if err != nil {
-			return err
+func storeDependencyCache(cachePath, chartsDir string) error {
+	archives, err := filepath.Glob(filepath.Join(chartsDir, "*.tgz"))
+	if err != nil || len(archives) == 0 {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return err
+	}
+	tmpDir, err := os.MkdirTemp(filepath.Dir(cachePath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.RemoveAll(tmpDir)
+	}()
+
+	if err := copyArchives(chartsDir, tmpDir); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpDir, cachePath); err != nil {
+		if _, statErr := os.Stat(cachePath); statErr == nil {
+			return nil
 		}
-		gitRootPath := strings.TrimSpace(string(gitRoot))
+		return err
+	}
+	return nil
+}
 
-		relPath, err := filepath.Rel(gitRootPath, cwd)
+func copyArchives(src, dst string) error {
+	archives, err := filepath.Glob(filepath.Join(src, "*.tgz"))
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0755); err != nil {
+		return err
+	}
+	for _, archive := range archives {
+		content, err := os.ReadFile(archive)
 		if err != nil {
 			return err
 		}
+		if err := os.WriteFile(filepath.Join(dst, filepath.Base(archive)), content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-		parentPath := filepath.Dir(relPath)
-		chartName := filepath.Base(relPath)
+func readChartDependencies(chartPath string) ([]chartDependency, error) {
+	content, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return nil, err
+	}
 
-		config.ChartDir = parentPath
-		config.Charts = []string{chartName}
+	var chart struct {
+		Dependencies []chartDependency `yaml:"dependencies"`
+	}
+	if err := yaml.Unmarshal(content, &chart); err != nil {
+		return nil, fmt.Errorf("parsing Chart.yaml: %w", err)
 	}
 
-	return nil
+	return chart.Dependencies, nil
 }
 
-func run(config *Config) error {
-	if len(config.Charts) == 0 {
-		changedCharts, err := detectChangedCharts(config)
-		if err != nil {
-			return fmt.Errorf("detecting changed charts: %w", err)
+func checkDependencyPlugins(deps []chartDependency) error {
+	var missing []string
+	for _, dep := range deps {
+		scheme := pluginRepositoryScheme(dep.Repository)
+		if scheme == "" {
+			continue
 		}
-		config.Charts = changedCharts
 
-		if len(config.Charts) == 0 {
-			fmt.Println("No chart changes detected")
-			return nil
+		protocols, err := installedDownloaderProtocols()
+		if err != nil {
+			return fmt.Errorf("listing helm plugins: %w", err)
+		}
+		if !protocols[scheme] {
+			missing = append(missing, fmt.Sprintf("%s (%s://)", dep.Name, scheme))
 		}
-
-		fmt.Printf("Detected changed charts: %s\n\n", strings.Join(config.Charts, ", "))
 	}
 
-	for _, chart := range config.Charts {
-		if err := diffChart(config, chart); err != nil {
-			return fmt.Errorf("diffing chart %s: %w", chart, err)
+	if len(missing) > 0 {
+		err := fmt.Errorf("no installed helm plugin handles the repository of dependencies %s", strings.Join(missing, ", "))
+		if slices.ContainsFunc(missing, func(dep string) bool { return strings.Contains(dep, "(git+") }) {
+			err = withHints(err, errorHint{Problem: "git+https:// and git+ssh:// repositories need the helm-git plugin", Command: "helm plugin install https://github.com/aslafy-z/helm-git"})
 		}
+		return err
 	}
+	return nil
+}
 
-	if config.FailOnDiff && config.hasDifferences {
-		os.Exit(1)
+func pluginRepositoryScheme(repository string) string {
+	idx := strings.Index(repository, "://")
+	if idx <= 0 {
+		return ""
 	}
 
-	return nil
+	scheme := repository[:idx]
+	switch scheme {
+	case "http", "https", "oci", "file":
+		return ""
+	}
+	return scheme
 }
 
-func detectChangedCharts(config *Config) ([]string, error) {
-	cmd := exec.Command("git", "diff", "--name-only", config.Base, config.Current)
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("running git diff: %w", err)
-	}
+var downloaderProtocols struct {
+	once      sync.Once
+	protocols map[string]bool
+	err       error
+}
 
-	changedFiles := strings.Split(strings.TrimSpace(string(output)), "\n")
-	chartSet := make(map[string]bool)
+func installedDownloaderProtocols() (map[string]bool, error) {
+	downloaderProtocols.once.Do(func() {
+		pluginDirs, err := helmEnv("HELM_PLUGINS")
+		if err != nil {
+			downloaderProtocols.err = err
+			return
+		}
+		downloaderProtocols.protocols, downloaderProtocols.err = readDownloaderProtocols(filepath.SplitList(pluginDirs))
+	})
+	return downloaderProtocols.protocols, downloaderProtocols.err
+}
 
-	for _, file := range changedFiles {
-		if file == "" {
-			continue
+func readDownloaderProtocols(pluginDirs []string) (map[string]bool, error) {
+	protocols := make(map[string]bool)
+	for _, dir := range pluginDirs {
+		manifests, err := filepath.Glob(filepath.Join(dir, "*", "plugin.yaml"))
+		if err != nil {
+			return nil, err
 		}
 
-		if strings.HasPrefix(file, config.ChartDir+"/") {
-			parts := strings.Split(file, "/")
-			if len(parts) >= 2 {
-				chartName := parts[1]
-				chartSet[chartName] = true
+		for _, manifest := range manifests {
+			content, err := os.ReadFile(manifest)
+			if err != nil {
+				return nil, err
 			}
-		}
-	}
 
-	charts := make([]string, 0, len(chartSet))
-	for chart := range chartSet {
-		charts = append(charts, chart)
-	}
+			var plugin struct {
+				Downloaders []struct {
+					Protocols []string `yaml:"protocols"`
+				} `yaml:"downloaders"`
+				Config struct {
+					Protocols []string `yaml:"protocols"`
+				} `yaml:"config"`
+			}
+			if err := yaml.Unmarshal(content, &plugin); err != nil {
+				continue
+			}
 
-	return charts, nil
+			for _, downloader := range plugin.Downloaders {
+				for _, protocol := range downloader.Protocols {
+					protocols[protocol] = true
+				}
+			}
+			for _, protocol := range plugin.Config.Protocols {
+				protocols[protocol] = true
+			}
+		}
+	}
+	return protocols, nil
 }
 
-func diffChart(config *Config, chartName string) error {
-	chartPath := filepath.Join(config.ChartDir, chartName)
+var riskyTemplateFunctions = []struct {
+	Name   string
+	Reason string
+}{
+	{"lookup", "reads cluster state"},
+	{"getHostByName", "depends on DNS"},
+	{"now", "depends on the current time"},
+	{"randAlphaNum", "is random"},
+	{"randAlpha", "is random"},
+	{"randNumeric", "is random"},
+	{"randAscii", "is random"},
+	{"uuidv4", "is random"},
+}
 
-	workdirPath, err := getWorkdirChartPath(chartPath)
-	if err != nil {
-		return fmt.Errorf("getting workdir chart path: %w", err)
-	}
+var (
+	templateActionPattern     = regexp.MustCompile(`(?s)\{\{(.*?)\}\}`)
+	templateIdentifierPattern = regexp.MustCompile(`(?:^|[^\w.$])([A-Za-z][A-Za-z0-9]*)\b`)
+)
 
-	chartYaml := filepath.Join(workdirPath, "Chart.yaml")
-	if _, err := os.Stat(chartYaml); os.IsNotExist(err) {
-		return fmt.Errorf("no Chart.yaml found in %s - not a valid Helm chart", chartPath)
+func riskyFunctionChanges(basePath, currentPath string) ([]string, error) {
+	if currentPath == "" {
+		return nil, nil
 	}
 
-	isLibrary, err := isLibraryChart(chartYaml)
+	currentUses, err := templateFunctionUses(currentPath)
 	if err != nil {
-		return fmt.Errorf("checking chart type: %w", err)
+		return nil, err
 	}
-	if isLibrary {
-		fmt.Printf("%s: skipped (library chart)\n", chartName)
-		return nil
+	baseUses := map[string]map[string]int{}
+	if basePath != "" {
+		baseUses, err = templateFunctionUses(basePath)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	baseManifest, err := renderChartAtRef(chartPath, config.Base, config.ValuesFiles, config.SetValues, config.SkipDependencyBuild)
-	if err != nil {
-		return fmt.Errorf("rendering base manifest: %w", err)
+	var changes []string
+	for _, fn := range riskyTemplateFunctions {
+		var files []string
+		for file, count := range currentUses[fn.Name] {
+			if count > baseUses[fn.Name][file] {
+				files = append(files, file)
+			}
+		}
+		if len(files) == 0 {
+			continue
+		}
+		sort.Strings(files)
+		changes = append(changes, fmt.Sprintf("new %s call in %s (%s)", fn.Name, strings.Join(files, ", "), fn.Reason))
 	}
+	return changes, nil
+}
 
-	var currentManifest string
-	if config.Current == "HEAD" {
-		currentManifest, err = renderChartFromWorkdir(workdirPath, config.ValuesFiles, config.SetValues, config.SkipDependencyBuild)
+func templateFunctionUses(chartPath string) (map[string]map[string]int, error) {
+	risky := make(map[string]bool, len(riskyTemplateFunctions))
+	for _, fn := range riskyTemplateFunctions {
+		risky[fn.Name] = true
+	}
+
+	uses := make(map[string]map[string]int)
+	err := filepath.WalkDir(filepath.Join(chartPath, "templates"), func(path string, d os.DirEntry, err error) error {
 		if err != nil {
-			return fmt.Errorf("rendering current manifest: %w", err)
+			return err
 		}
-	} else {
-		currentManifest, err = renderChartAtRef(chartPath, config.Current, config.ValuesFiles, config.SetValues, config.SkipDependencyBuild)
+		if d.IsDir() {
+			return nil
+		}
+		content, err := os.ReadFile(path)
 		if err != nil {
-			return fmt.Errorf("rendering current manifest: %w", err)
+			return err
+		}
+		rel, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		for _, action := range templateActionPattern.FindAllStringSubmatch(string(content), -1) {
+			for _, match := range templateIdentifierPattern.FindAllStringSubmatch(action[1], -1) {
+				if !risky[match[1]] {
+					continue
+				}
+				if uses[match[1]] == nil {
+					uses[match[1]] = make(map[string]int)
+				}
+				uses[match[1]][filepath.ToSlash(rel)]++
+			}
 		}
-	}
-
-	if baseManifest == currentManifest {
-		fmt.Printf("%s: no changes\n", chartName)
 		return nil
+	})
+	if os.IsNotExist(err) {
+		return uses, nil
 	}
+	return uses, err
+}
 
-	config.hasDifferences = true
-
-	diff := difflib.UnifiedDiff{
-		A:        difflib.SplitLines(baseManifest),
-		B:        difflib.SplitLines(currentManifest),
-		FromFile: fmt.Sprintf("%s (%s)", chartName, config.Base),
-		ToFile:   fmt.Sprintf("%s (%s)", chartName, config.Current),
-		Context:  3,
+func dependencyBumps(basePath, currentPath string) ([]string, error) {
+	if basePath == "" || currentPath == "" {
+		return nil, nil
 	}
 
-	diffText, err := difflib.GetUnifiedDiffString(diff)
+	baseDeps, err := readChartDependencies(basePath)
 	if err != nil {
-		return fmt.Errorf("generating diff: %w", err)
+		return nil, err
 	}
-
-	if config.useColor {
-		fmt.Print(colorizeDiff(diffText))
-	} else {
-		fmt.Print(diffText)
+	currentDeps, err := readChartDependencies(currentPath)
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
-}
-
-func colorizeDiff(diff string) string {
-	const (
-		red   = "\033[31m"
-		green = "\033[32m"
-		cyan  = "\033[36m"
-		reset = "\033[0m"
-	)
+	baseVersions := make(map[string]string, len(baseDeps))
+	for _, dep := range baseDeps {
+		baseVersions[dep.Name] = dep.Version
+	}
 
-	lines := strings.Split(diff, "\n")
-	for i, line := range lines {
-		if len(line) == 0 {
+	var bumps []string
+	for _, dep := range currentDeps {
+		oldVersion, ok := baseVersions[dep.Name]
+		if !ok || oldVersion == dep.Version {
 			continue
 		}
-		switch line[0] {
-		case '-':
-			if strings.HasPrefix(line, "---") {
-				lines[i] = cyan + line + reset
-			} else {
-				lines[i] = red + line + reset
-			}
-		case '+':
-			if strings.HasPrefix(line, "+++") {
-				lines[i] = cyan + line + reset
-			} else {
-				lines[i] = green + line + reset
-			}
-		case '@':
-			lines[i] = cyan + line + reset
-		}
+		bumps = append(bumps, fmt.Sprintf("dependency %s %s -> %s (%s)", dep.Name, oldVersion, dep.Version, dependencyProvenance(dep)))
 	}
-	return strings.Join(lines, "\n")
+	return bumps, nil
 }
 
-func getWorkdirChartPath(gitRelativePath string) (string, error) {
-	gitRoot, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
+func dependencyTemplateChanges(sources *chartSources, setValues []string, opts templateOptions) ([]string, error) {
+	baseDeps, err := readChartDependencies(sources.Base)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	currentDeps, err := readChartDependencies(sources.Current)
+	if err != nil {
+		return nil, err
 	}
-	gitRootPath := strings.TrimSpace(string(gitRoot))
 
-	if filepath.IsAbs(gitRelativePath) {
-		return gitRelativePath, nil
+	baseByName := make(map[string]chartDependency, len(baseDeps))
+	for _, dep := range baseDeps {
+		baseByName[dependencyName(dep)] = dep
+	}
+	var bumped []chartDependency
+	for _, dep := range currentDeps {
+		if old, ok := baseByName[dependencyName(dep)]; ok && old.Version != dep.Version {
+			bumped = append(bumped, dep)
+		}
+	}
+	if len(bumped) == 0 {
+		return nil, nil
+	}
+	if only, err := dependencyOnlyChange(sources.Base, sources.Current); err != nil || !only {
+		return nil, err
 	}
 
-	cwd, err := os.Getwd()
+	release, err := render.ReleaseName(sources.Current, opts)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	opts.ReleaseName = release
 
-	if strings.HasPrefix(gitRelativePath, ".") {
-		cwdRelativeToGit, err := filepath.Rel(gitRootPath, cwd)
+	baseValues, err := sourceValuesFiles(sources, sources.Base, sources.BaseValues)
+	if err != nil {
+		return nil, err
+	}
+	currentValues, err := sourceValuesFiles(sources, sources.Current, sources.CurrentValues)
+	if err != nil {
+		return nil, err
+	}
+
+	var notes []string
+	for _, dep := range bumped {
+		name := dependencyName(dep)
+		old := baseByName[name]
+		baseManifest, baseOK, err := renderDependency(sources.Base, old, baseValues, setValues, opts)
 		if err != nil {
-			return "", err
+			notes = append(notes, fmt.Sprintf("dependency %s: standalone render of %s failed: %v", name, old.Version, err))
+			continue
+		}
+		currentManifest, currentOK, err := renderDependency(sources.Current, dep, currentValues, setValues, opts)
+		if err != nil {
+			notes = append(notes, fmt.Sprintf("dependency %s: standalone render of %s failed: %v", name, dep.Version, err))
+			continue
+		}
+		if !baseOK || !currentOK {
+			notes = append(notes, fmt.Sprintf("dependency %s: not built, skipped standalone render", name))
+			continue
 		}
-		fullRelativePath := filepath.Join(cwdRelativeToGit, gitRelativePath)
-		return filepath.Join(gitRootPath, fullRelativePath), nil
-	}
 
-	return filepath.Join(gitRootPath, gitRelativePath), nil
+		changes, err := templateChanges(baseManifest, currentManifest)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		if len(changes) == 0 {
+			notes = append(notes, fmt.Sprintf("dependency %s: templates render identically standalone", name))
+			continue
+		}
+		for _, change := range changes {
+			notes = append(notes, fmt.Sprintf("dependency %s: %s", name, change))
+		}
+	}
+	return notes, nil
 }
 
-func renderChartFromWorkdir(chartPath, valuesFiles string, setValues []string, skipDependencyBuild bool) (string, error) {
-	if err := buildDependencies(chartPath, skipDependencyBuild); err != nil {
-		return "", fmt.Errorf("building dependencies: %w", err)
+func dependencyName(dep chartDependency) string {
+	if dep.Alias != "" {
+		return dep.Alias
 	}
+	return dep.Name
+}
 
-	releaseName, err := getChartName(chartPath)
+func dependencyOnlyChange(basePath, currentPath string) (bool, error) {
+	baseFiles, err := chartFilesWithoutDependencies(basePath)
+	if err != nil {
+		return false, err
+	}
+	currentFiles, err := chartFilesWithoutDependencies(currentPath)
 	if err != nil {
-		return "", fmt.Errorf("getting chart name: %w", err)
+		return false, err
+	}
+	if !maps.Equal(baseFiles, currentFiles) {
+		return false, nil
 	}
 
-	cwd, err := os.Getwd()
+	baseMetadata, err := chartMetadataWithoutDependencies(basePath)
 	if err != nil {
-		return "", fmt.Errorf("getting current directory: %w", err)
+		return false, err
+	}
+	currentMetadata, err := chartMetadataWithoutDependencies(currentPath)
+	if err != nil {
+		return false, err
 	}
+	return reflect.DeepEqual(baseMetadata, currentMetadata), nil
+}
 
-	args := []string{"template", releaseName, chartPath}
-	if valuesFiles != "" {
-		for _, vf := range strings.Split(valuesFiles, ",") {
-			valuesPath := strings.TrimSpace(vf)
-			if !filepath.IsAbs(valuesPath) {
-				valuesPath = filepath.Join(cwd, valuesPath)
+func chartFilesWithoutDependencies(chartPath string) (map[string]string, error) {
+	files := make(map[string]string)
+	err := filepath.WalkDir(chartPath, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() {
+			if rel == "charts" || rel == "tmpcharts" {
+				return filepath.SkipDir
 			}
-			args = append(args, "-f", valuesPath)
+			return nil
+		}
+		if rel == "Chart.yaml" || rel == "Chart.lock" {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
 		}
+		files[rel] = string(content)
+		return nil
+	})
+	return files, err
+}
+
+func chartMetadataWithoutDependencies(chartPath string) (map[string]any, error) {
+	content, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return nil, err
 	}
-	for _, sv := range setValues {
-		args = append(args, "--set", sv)
+	var metadata map[string]any
+	if err := yaml.Unmarshal(content, &metadata); err != nil {
+		return nil, fmt.Errorf("parsing Chart.yaml: %w", err)
 	}
+	// Umbrella charts usually bump their own version along with a dependency.
+	for _, key := range []string{"dependencies", "version", "appVersion"} {
+		delete(metadata, key)
+	}
+	return metadata, nil
+}
 
-	helmCmd := exec.Command("helm", args...)
-	output, err := helmCmd.Output()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("helm template failed: %s", string(exitErr.Stderr))
+func dependencyArchive(chartPath string, dep chartDependency) (string, bool) {
+	candidates := []string{
+		filepath.Join(chartPath, "charts", dep.Name+"-"+dep.Version+".tgz"),
+		filepath.Join(chartPath, "charts", dep.Name),
+	}
+	for _, candidate := range candidates {
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, true
 		}
-		return "", fmt.Errorf("running helm template: %w", err)
 	}
-
-	return string(output), nil
+	matches, _ := filepath.Glob(filepath.Join(chartPath, "charts", dep.Name+"-*.tgz"))
+	if len(matches) == 1 {
+		return matches[0], true
+	}
+	return "", false
 }
 
-func renderChartAtRef(chartPath, ref, valuesFiles string, setValues []string, skipDependencyBuild bool) (string, error) {
-	tmpDir, err := os.MkdirTemp("", "helm-git-diff-*")
+func renderDependency(chartPath string, dep chartDependency, valuesFiles string, setValues []string, opts templateOptions) (string, bool, error) {
+	archive, ok := dependencyArchive(chartPath, dep)
+	if !ok {
+		return "", false, nil
+	}
+
+	name := dependencyName(dep)
+	values, err := dependencyValues(chartPath, name, valuesFiles)
+	if err != nil {
+		return "", false, err
+	}
+	tmpDir, err := os.MkdirTemp("", "helm-git-diff-dependency-*")
 	if err != nil {
-		return "", fmt.Errorf("creating temp dir: %w", err)
+		return "", false, fmt.Errorf("creating temp dir: %w", err)
 	}
 	defer func() {
 		_ = os.RemoveAll(tmpDir)
 	}()
-
-	gitRoot, err := exec.Command("git", "rev-parse", "--show-toplevel").Output()
-	if err != nil {
-		return "", fmt.Errorf("getting git root: %w", err)
+	valuesFile := filepath.Join(tmpDir, "values.yaml")
+	if err := os.WriteFile(valuesFile, values, 0644); err != nil {
+		return "", false, fmt.Errorf("writing values: %w", err)
 	}
-	gitRootPath := strings.TrimSpace(string(gitRoot))
 
-	pathsToExtract, err := getChartPathsToExtract(gitRootPath, ref, chartPath)
+	manifest, err := renderChart(archive, valuesFile, dependencySetValues(setValues, name), opts)
 	if err != nil {
-		return "", fmt.Errorf("determining paths to extract: %w", err)
+		return "", false, err
 	}
+	return manifest, true, nil
+}
 
-	args := []string{"archive", ref}
-	args = append(args, pathsToExtract...)
-	cmd := exec.Command("git", args...)
-	cmd.Dir = gitRootPath
-	archive, err := cmd.Output()
+// dependencyValues returns the values a dependency receives from its
+// umbrella chart: the dependency's subtree and global, merged from the
+// umbrella's values.yaml and the values files it is rendered with.
+func dependencyValues(chartPath, name, valuesFiles string) ([]byte, error) {
+	merged, err := chartDefaults(chartPath)
 	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("archiving chart paths at %s (stderr: %s): %w", ref, string(exitErr.Stderr), err)
+		return nil, err
+	}
+	for _, valuesFile := range splitList([]string{valuesFiles}) {
+		values, err := readValues(valuesFile)
+		if err != nil {
+			return nil, err
 		}
-		return "", fmt.Errorf("archiving chart paths at %s: %w", ref, err)
+		mergeValues(merged, values)
 	}
 
-	if len(archive) == 0 {
-		return "", nil
+	scoped := map[string]any{}
+	if sub, ok := merged[name].(map[string]any); ok {
+		maps.Copy(scoped, sub)
 	}
-
-	extractCmd := exec.Command("tar", "x", "-C", tmpDir)
-	extractCmd.Stdin = strings.NewReader(string(archive))
-	if err := extractCmd.Run(); err != nil {
-		return "", fmt.Errorf("extracting archive: %w", err)
+	if global, ok := merged["global"]; ok {
+		scoped["global"] = global
 	}
+	return yaml.Marshal(scoped)
+}
 
-	extractedChartPath := filepath.Join(tmpDir, chartPath)
+// mergeValues merges src into dst the way helm layers values files: maps
+// are merged key by key and any other value replaces the previous one.
+func mergeValues(dst, src map[string]any) {
+	for key, value := range src {
+		if sub, ok := value.(map[string]any); ok {
+			if existing, ok := dst[key].(map[string]any); ok {
+				mergeValues(existing, sub)
+				continue
+			}
+		}
+		dst[key] = value
+	}
+}
 
-	if err := buildDependencies(extractedChartPath, skipDependencyBuild); err != nil {
-		return "", fmt.Errorf("building dependencies: %w", err)
+// dependencySetValues scopes the umbrella's --set values to a dependency,
+// keeping global ones as they are.
+func dependencySetValues(setValues []string, name string) []string {
+	var scoped []string
+	for _, setValue := range splitList(setValues) {
+		if rest, ok := strings.CutPrefix(setValue, name+"."); ok {
+			scoped = append(scoped, rest)
+		} else if strings.HasPrefix(setValue, "global.") {
+			scoped = append(scoped, setValue)
+		}
 	}
+	return scoped
+}
 
-	releaseName, err := getChartName(extractedChartPath)
+func templateChanges(baseManifest, currentManifest string) ([]string, error) {
+	baseTemplates, err := templateOutputs(baseManifest)
 	if err != nil {
-		return "", fmt.Errorf("getting chart name: %w", err)
+		return nil, fmt.Errorf("parsing base render: %w", err)
 	}
-
-	cwd, err := os.Getwd()
+	currentTemplates, err := templateOutputs(currentManifest)
 	if err != nil {
-		return "", fmt.Errorf("getting current directory: %w", err)
+		return nil, fmt.Errorf("parsing current render: %w", err)
 	}
 
-	helmArgs := []string{"template", releaseName, extractedChartPath}
-	if valuesFiles != "" {
-		for _, vf := range strings.Split(valuesFiles, ",") {
-			valuesPath := strings.TrimSpace(vf)
-			if !filepath.IsAbs(valuesPath) {
-				valuesPath = filepath.Join(cwd, valuesPath)
-			}
-			helmArgs = append(helmArgs, "-f", valuesPath)
+	var added, removed, changed []string
+	for source, content := range currentTemplates {
+		previous, ok := baseTemplates[source]
+		switch {
+		case !ok:
+			added = append(added, source)
+		case previous != content:
+			changed = append(changed, source)
 		}
 	}
-	for _, sv := range setValues {
-		helmArgs = append(helmArgs, "--set", sv)
+	for source := range baseTemplates {
+		if _, ok := currentTemplates[source]; !ok {
+			removed = append(removed, source)
+		}
 	}
 
-	helmCmd := exec.Command("helm", helmArgs...)
-	output, err := helmCmd.Output()
-	if err != nil {
-		if exitErr, ok := err.(*exec.ExitError); ok {
-			return "", fmt.Errorf("helm template failed: %s", string(exitErr.Stderr))
+	var changes []string
+	for _, group := range []struct {
+		label   string
+		sources []string
+	}{{"changed", changed}, {"added", added}, {"removed", removed}} {
+		if len(group.sources) > 0 {
+			sort.Strings(group.sources)
+			changes = append(changes, fmt.Sprintf("templates %s: %s", group.label, strings.Join(group.sources, ", ")))
 		}
-		return "", fmt.Errorf("running helm template: %w", err)
 	}
-
-	return string(output), nil
+	return changes, nil
 }
 
-func isLibraryChart(chartYamlPath string) (bool, error) {
-	content, err := os.ReadFile(chartYamlPath)
+func templateOutputs(manifest string) (map[string]string, error) {
+	resources, err := parseManifest(manifest)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "type:") {
-			typeValue := strings.TrimSpace(strings.TrimPrefix(line, "type:"))
-			return typeValue == "library", nil
+	outputs := make(map[string]string)
+	for _, res := range resources {
+		source := res.Source
+		if _, rest, ok := strings.Cut(source, "/"); ok {
+			source = rest
 		}
+		outputs[source] += res.Content
 	}
-	return false, nil
+	return outputs, nil
 }
 
-func getChartName(chartPath string) (string, error) {
-	chartYamlPath := filepath.Join(chartPath, "Chart.yaml")
-	content, err := os.ReadFile(chartYamlPath)
-	if err != nil {
-		return "", fmt.Errorf("reading Chart.yaml: %w", err)
-	}
-
-	lines := strings.Split(string(content), "\n")
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if strings.HasPrefix(line, "name:") {
-			name := strings.TrimSpace(strings.TrimPrefix(line, "name:"))
-			name = strings.Trim(name, "\"'")
-			if name != "" {
-				return name, nil
-			}
+func dependencyProvenance(dep chartDependency) string {
+	if entry, ok := findIndexEntry(dep); ok {
+		if link := entry.Annotations["artifacthub.io/changes"]; link != "" && strings.HasPrefix(link, "http") {
+			return link
+		}
+		if len(entry.Sources) > 0 {
+			return entry.Sources[0]
+		}
+		if entry.Home != "" {
+			return entry.Home
 		}
 	}
-	return "", fmt.Errorf("chart name not found in Chart.yaml")
+	return "https://artifacthub.io/packages/search?ts_query_web=" + url.QueryEscape(dep.Name)
 }
 
-func getChartPathsToExtract(gitRoot, ref, chartPath string) ([]string, error) {
-	paths := []string{chartPath}
+type indexEntry struct {
+	Version     string            `yaml:"version"`
+	Home        string            `yaml:"home"`
+	Sources     []string          `yaml:"sources"`
+	Annotations map[string]string `yaml:"annotations"`
+}
 
-	cmd := exec.Command("git", "show", fmt.Sprintf("%s:%s/Chart.yaml", ref, chartPath))
-	cmd.Dir = gitRoot
-	output, err := cmd.Output()
+func findIndexEntry(dep chartDependency) (indexEntry, bool) {
+	if !strings.HasPrefix(dep.Repository, "http://") && !strings.HasPrefix(dep.Repository, "https://") {
+		return indexEntry{}, false
+	}
+
+	repositoryConfig, err := helmEnv("HELM_REPOSITORY_CONFIG")
+	if err != nil {
+		return indexEntry{}, false
+	}
+	repositoryCache, err := helmEnv("HELM_REPOSITORY_CACHE")
 	if err != nil {
-		return paths, nil
+		return indexEntry{}, false
 	}
 
-	lines := strings.Split(string(output), "\n")
-	inDependencies := false
-	for _, line := range lines {
-		trimmed := strings.TrimSpace(line)
+	content, err := os.ReadFile(repositoryConfig)
+	if err != nil {
+		return indexEntry{}, false
+	}
+	var repositories struct {
+		Repositories []struct {
+			Name string `yaml:"name"`
+			URL  string `yaml:"url"`
+		} `yaml:"repositories"`
+	}
+	if err := yaml.Unmarshal(content, &repositories); err != nil {
+		return indexEntry{}, false
+	}
 
-		if trimmed == "dependencies:" {
-			inDependencies = true
+	for _, repo := range repositories.Repositories {
+		if strings.TrimSuffix(repo.URL, "/") != strings.TrimSuffix(dep.Repository, "/") {
 			continue
 		}
 
-		if inDependencies {
-			if len(trimmed) > 0 && !strings.HasPrefix(trimmed, "-") && !strings.HasPrefix(trimmed, "name:") && !strings.HasPrefix(trimmed, "version:") && !strings.HasPrefix(trimmed, "repository:") {
-				break
-			}
-
-			if strings.HasPrefix(trimmed, "repository:") {
-				repo := strings.TrimSpace(strings.TrimPrefix(trimmed, "repository:"))
-				repo = strings.Trim(repo, "\"'")
-
-				if strings.HasPrefix(repo, "file://") {
-					depPath := strings.TrimPrefix(repo, "file://")
-
-					fullPath := filepath.Join(chartPath, depPath)
-
-					cleanedPath := filepath.Clean(fullPath)
-
-					paths = append(paths, cleanedPath)
-				}
+		index, err := os.ReadFile(filepath.Join(repositoryCache, repo.Name+"-index.yaml"))
+		if err != nil {
+			return indexEntry{}, false
+		}
+		var parsed struct {
+			Entries map[string][]indexEntry `yaml:"entries"`
+		}
+		if err := yaml.Unmarshal(index, &parsed); err != nil {
+			return indexEntry{}, false
+		}
+		for _, entry := range parsed.Entries[dep.Name] {
+			if entry.Version == dep.Version {
+				return entry, true
 			}
 		}
 	}
 
-	return paths, nil
+	return indexEntry{}, false
 }
 
-func buildDependencies(chartPath string, skipBuild bool) error {
-	chartYaml := filepath.Join(chartPath, "Chart.yaml")
-	if _, err := os.Stat(chartYaml); os.IsNotExist(err) {
-		return nil
+func helmEnv(name string) (string, error) {
+	output, err := exec.Command(helmBinary, "env", name).Output()
+	if err != nil {
+		return "", fmt.Errorf("running helm env: %w", err)
 	}
+	return strings.TrimSpace(string(output)), nil
+}
 
-	if skipBuild {
-		return nil
+func dependencyFingerprint(chartPath string, deps []chartDependency) (string, error) {
+	hash := sha256.New()
+	for _, dep := range deps {
+		repository := dep.Repository
+		if strings.HasPrefix(repository, "file://") {
+			absPath, err := filepath.Abs(filepath.Join(chartPath, strings.TrimPrefix(repository, "file://")))
+			if err != nil {
+				return "", err
+			}
+			repository = "file://" + absPath
+		}
+		fmt.Fprintf(hash, "%s\x00%s\x00%s\n", dep.Name, dep.Version, repository)
 	}
 
-	if areDependenciesUpToDate(chartPath) {
-		return nil
+	lock, err := os.ReadFile(filepath.Join(chartPath, "Chart.lock"))
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
 	}
+	hash.Write(lock)
 
-	cmd := exec.Command("helm", "dependency", "build", chartPath)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return fmt.Errorf("helm dependency build failed: %s", string(output))
-	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
 
-	return nil
+func copyDir(src, dst string) error {
+	return filepath.WalkDir(src, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		relPath, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, relPath)
+
+		if entry.IsDir() {
+			return os.MkdirAll(target, 0755)
+		}
+
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(target, content, 0644)
+	})
 }
 
 func areDependenciesUpToDate(chartPath string) bool {
@@ -616,3 +7789,337 @@ func areDependenciesUpToDate(chartPath string) bool {
 
 	return true
 }
+
+func injectReleaseOwnership(config *Config, sources *chartSources, baseResources, currentResources []resource) error {
+	namespace := chartTemplateOptions(config, sources).Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+
+	for _, side := range []struct {
+		chartPath string
+		resources []resource
+	}{
+		{sources.Base, baseResources},
+		{sources.Current, currentResources},
+	} {
+		release := sources.Release
+		if release == "" {
+			if side.chartPath == "" {
+				continue
+			}
+			var err error
+			release, err = render.ReleaseName(side.chartPath, chartTemplateOptions(config, sources))
+			if err != nil {
+				return err
+			}
+		}
+		for i := range side.resources {
+			injectOwnership(&side.resources[i], release, namespace)
+		}
+	}
+	return nil
+}
+
+func injectOwnership(res *resource, release, namespace string) {
+	labels := map[string]string{"app.kubernetes.io/managed-by": "Helm"}
+	annotations := map[string]string{
+		"meta.helm.sh/release-name":      release,
+		"meta.helm.sh/release-namespace": namespace,
+	}
+
+	if res.Labels == nil {
+		res.Labels = make(map[string]string)
+	}
+	if res.Annotations == nil {
+		res.Annotations = make(map[string]string)
+	}
+	for key, value := range labels {
+		res.Labels[key] = value
+	}
+	for key, value := range annotations {
+		res.Annotations[key] = value
+	}
+
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(res.Content), &doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return
+	}
+	metadata := mappingChild(doc.Content[0], "metadata")
+	setMappingValues(mappingChild(metadata, "labels"), labels)
+	setMappingValues(mappingChild(metadata, "annotations"), annotations)
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return
+	}
+	res.Content = out.String()
+}
+
+func mappingChild(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			child := node.Content[i+1]
+			if child.Kind != yaml.MappingNode {
+				*child = yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			return child
+		}
+	}
+	child := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, child)
+	return child
+}
+
+func setMappingValues(node *yaml.Node, values map[string]string) {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		found := false
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i].Value == key {
+				node.Content[i+1] = &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: values[key]}
+				found = true
+				break
+			}
+		}
+		if !found {
+			node.Content = append(node.Content,
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key},
+				&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: values[key]},
+			)
+		}
+	}
+}
+
+func normalizeFields(config *Config) []string {
+	if !config.IgnoreHelmLabels {
+		return config.IgnoreFields
+	}
+	return append(append([]string{}, config.IgnoreFields...), manifest.HelmLabelFields...)
+}
+
+func normalizeResources(config *Config, resources []resource) {
+	fields := normalizeFields(config)
+	for i := range resources {
+		if !config.ShowSecrets && resources[i].Kind == "Secret" {
+			resources[i].Content = redactSecret(resources[i].Content)
+		}
+		if config.SortKeys || len(fields) > 0 {
+			resources[i].Content = normalizeContent(resources[i].Content, fields, config.SortKeys)
+		}
+	}
+}
+
+// redactionKey keys the Secret value hashes of one run, so changes stay
+// visible while printed hashes cannot be checked against guessed values.
+var redactionKey = []byte(rand.Text())
+
+func redactSecret(content string) string {
+	return manifest.RedactSecret(content, redactionKey)
+}
+
+func normalizeContent(content string, ignoreFields []string, sortKeys bool) string {
+	return manifest.Normalize(content, ignoreFields, sortKeys)
+}
+
+func parseManifest(content string) ([]resource, error) {
+	return manifest.Parse(content)
+}
+
+func resourceKey(res resource) string {
+	return fmt.Sprintf("%s/%s/%s/%s", res.APIVersion, res.Kind, res.Namespace, res.Name)
+}
+
+func identityKey(res resource, rules []identityRule) string {
+	for _, rule := range rules {
+		if rule.Kind != res.Kind || (rule.APIVersion != "" && rule.APIVersion != res.APIVersion) {
+			continue
+		}
+		if rule.nameSuffix != nil {
+			return fmt.Sprintf("%s/%s/%s/%s", res.APIVersion, res.Kind, res.Namespace, rule.nameSuffix.ReplaceAllString(res.Name, ""))
+		}
+
+		var doc map[string]any
+		if err := yaml.Unmarshal([]byte(res.Content), &doc); err != nil {
+			continue
+		}
+		if value, ok := lookupValue(doc, strings.Split(rule.Field, ".")); ok && value != nil {
+			return fmt.Sprintf("%s/%s/%s/%s=%v", res.APIVersion, res.Kind, res.Namespace, rule.Field, value)
+		}
+	}
+	return resourceKey(res)
+}
+
+func loadRepoConfig(file string) (*repoConfig, error) {
+	if file == "" {
+		gitRoot, err := getGitRoot()
+		if err != nil {
+			return nil, err
+		}
+		file = filepath.Join(gitRoot, repoConfigFileName)
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			return nil, nil
+		}
+	}
+
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg repoConfig
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&cfg); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+
+	dir, err := filepath.Abs(filepath.Dir(file))
+	if err != nil {
+		return nil, err
+	}
+	cfg.Values = configValuesPaths(dir, cfg.Values)
+	for name, chart := range cfg.Charts {
+		chart.Values = configValuesPaths(dir, chart.Values)
+		cfg.Charts[name] = chart
+	}
+	for _, pattern := range cfg.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid exclude pattern %q: %w", pattern, err)
+		}
+	}
+	if err := validatePolicies(cfg.Policies); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", file, err)
+	}
+	for factor := range cfg.RiskWeights {
+		if _, ok := defaultRiskWeights[factor]; !ok {
+			return nil, fmt.Errorf("parsing %s: unknown risk weight %q", file, factor)
+		}
+	}
+	for _, name := range slices.Sorted(maps.Keys(cfg.Teams)) {
+		if name == teamUnassigned {
+			return nil, fmt.Errorf("parsing %s: team name %q is reserved for changes no team owns", file, name)
+		}
+		for _, pattern := range slices.Concat(cfg.Teams[name].Charts, cfg.Teams[name].Namespaces) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("parsing %s: team %s: invalid pattern %q: %w", file, name, pattern, err)
+			}
+		}
+	}
+
+	return &cfg, nil
+}
+
+func configValuesPaths(dir string, valuesFiles []string) []string {
+	var paths []string
+	for _, valuesFile := range splitList(valuesFiles) {
+		if !filepath.IsAbs(valuesFile) {
+			valuesFile = filepath.Join(dir, valuesFile)
+		}
+		paths = append(paths, valuesFile)
+	}
+	return paths
+}
+
+func chartSettings(config *Config, chartName, chartPath string) chartConfig {
+	var settings chartConfig
+	if cfg := config.repoConfig; cfg != nil {
+		chart, ok := cfg.Charts[chartName]
+		if !ok {
+			chart = cfg.Charts[filepath.ToSlash(chartPath)]
+		}
+
+		settings.Values = cfg.Values
+		if len(chart.Values) > 0 {
+			settings.Values = chart.Values
+		}
+		settings.Set = append(append([]string{}, cfg.Set...), chart.Set...)
+		settings.ReleaseName = chart.ReleaseName
+		settings.Namespace = cfg.Namespace
+		if chart.Namespace != "" {
+			settings.Namespace = chart.Namespace
+		}
+	}
+
+	if config.ValuesFiles != "" {
+		settings.Values = splitList([]string{config.ValuesFiles})
+	}
+	return settings
+}
+
+func excludeCharts(charts []string, cfg *repoConfig) []string {
+	if cfg == nil || len(cfg.Exclude) == 0 {
+		return charts
+	}
+
+	var kept []string
+	for _, chart := range charts {
+		excluded := false
+		for _, pattern := range cfg.Exclude {
+			if matched, _ := path.Match(pattern, chart); matched {
+				excluded = true
+				break
+			}
+		}
+		if !excluded {
+			kept = append(kept, chart)
+		}
+	}
+	return kept
+}
+
+func loadIdentityRules(path string) ([]identityRule, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var rulesFile struct {
+		Rules []identityRule `yaml:"rules"`
+	}
+	if err := yaml.Unmarshal(content, &rulesFile); err != nil {
+		return nil, fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for i := range rulesFile.Rules {
+		rule := &rulesFile.Rules[i]
+		if rule.Kind == "" || (rule.Field == "") == (rule.NameSuffix == "") {
+			return nil, fmt.Errorf("rule %d: kind and exactly one of field or nameSuffix are required", i+1)
+		}
+		if rule.NameSuffix != "" {
+			suffix, err := regexp.Compile("(?:" + rule.NameSuffix + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("rule %d: invalid nameSuffix: %w", i+1, err)
+			}
+			rule.nameSuffix = suffix
+		}
+	}
+
+	return rulesFile.Rules, nil
+}
+
+func resourceName(res resource) string {
+	if res.Namespace != "" {
+		return fmt.Sprintf("%s %s/%s", res.Kind, res.Namespace, res.Name)
+	}
+	return fmt.Sprintf("%s %s", res.Kind, res.Name)
+}
+
+func splitList(values []string) []string {
+	var result []string
+	for _, value := range values {
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				result = append(result, item)
+			}
+		}
+	}
+	return result
+}
@@ -1,10 +1,38 @@
 package main
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
 	"testing"
+
+	"github.com/ihs7/helm-git-diff/pkg/manifest"
 )
 
 func TestParseFlags(t *testing.T) {
@@ -123,9 +151,20 @@ data:
 		t.Fatal(err)
 	}
 
-	manifest, err := renderChartAtRef("testchart", "HEAD", "", nil, false)
+	fakeHelm(t)
+	extracted, cleanup, err := extractChartAtRef("testchart", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sources := &chartSources{Current: extracted}
+	prebuildDependencies([]*chartSources{sources}, false, 1, "")
+	if sources.Err != nil {
+		t.Fatalf("building dependencies failed: %v", sources.Err)
+	}
+	manifest, err := renderChart(extracted, "", nil, templateOptions{})
 	if err != nil {
-		t.Fatalf("renderChartAtRef failed: %v", err)
+		t.Fatalf("renderChart failed: %v", err)
 	}
 
 	if manifest == "" {
@@ -408,9 +447,20 @@ data:
 		t.Fatal(err)
 	}
 
-	manifest, err := renderChartAtRef("testchart", "HEAD", "", nil, true)
+	fakeHelm(t)
+	extracted, cleanup, err := extractChartAtRef("testchart", "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+	sources := &chartSources{Current: extracted}
+	prebuildDependencies([]*chartSources{sources}, true, 1, "")
+	if sources.Err != nil {
+		t.Fatalf("building dependencies failed: %v", sources.Err)
+	}
+	manifest, err := renderChart(extracted, "", nil, templateOptions{})
 	if err != nil {
-		t.Fatalf("renderChartAtRef with skip=true failed: %v", err)
+		t.Fatalf("renderChart failed: %v", err)
 	}
 
 	if manifest == "" {
@@ -421,3 +471,4045 @@ data:
 		t.Error("expected manifest to contain 'ConfigMap'")
 	}
 }
+
+func TestParseManifest(t *testing.T) {
+	manifest := `---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app-config
+  namespace: prod
+  labels:
+    team: payments
+---
+# Source: app/templates/empty.yaml
+---
+# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+`
+
+	resources, err := parseManifest(manifest)
+	if err != nil {
+		t.Fatalf("parseManifest failed: %v", err)
+	}
+
+	if len(resources) != 2 {
+		t.Fatalf("expected 2 resources, got %d", len(resources))
+	}
+	if resourceKey(resources[0]) != "v1/ConfigMap/prod/app-config" {
+		t.Errorf("unexpected key %q", resourceKey(resources[0]))
+	}
+	if resources[0].Source != "app/templates/configmap.yaml" {
+		t.Errorf("unexpected source %q", resources[0].Source)
+	}
+	if resources[0].Labels["team"] != "payments" {
+		t.Errorf("expected team label, got %v", resources[0].Labels)
+	}
+	if resourceKey(resources[1]) != "apps/v1/Deployment//app" {
+		t.Errorf("unexpected key %q", resourceKey(resources[1]))
+	}
+}
+
+func TestCheckRequiredMetadata(t *testing.T) {
+	base := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: existing
+`
+	current := base + `---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: labelled
+  labels:
+    team: payments
+  annotations:
+    cost-center: "42"
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: unlabelled
+  labels:
+    team: payments
+`
+
+	config := &Config{
+		RequiredLabels:      []string{"team"},
+		RequiredAnnotations: []string{"cost-center"},
+	}
+
+	baseResources, err := parseManifest(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentResources, err := parseManifest(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkRequiredMetadata(config, "app", baseResources, currentResources)
+
+	if len(config.violations) != 1 {
+		t.Fatalf("expected 1 violation, got %v", config.violations)
+	}
+	if config.violations[0] != "app: Service unlabelled missing annotation cost-center" {
+		t.Errorf("unexpected violation %q", config.violations[0])
+	}
+}
+
+func TestCheckPolicies(t *testing.T) {
+	base := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: legacy
+spec:
+  template:
+    spec:
+      containers:
+        - name: app
+          image: legacy
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 1
+  template:
+    metadata:
+      labels:
+        app: api
+    spec:
+      containers:
+        - name: api
+          resources:
+            limits: {cpu: 500m, memory: 256Mi}
+          readinessProbe: {httpGet: {path: /ready, port: 8080}}
+          livenessProbe: {httpGet: {path: /live, port: 8080}}
+`
+	current := strings.Replace(base, "replicas: 1", "replicas: 3", 1) + `---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: web
+spec:
+  replicas: 2
+  template:
+    metadata:
+      labels:
+        app: web
+        tier: frontend
+    spec:
+      initContainers:
+        - name: migrate
+          resources:
+            limits: {cpu: 100m, memory: 64Mi}
+      containers:
+        - name: web
+          resources:
+            limits: {memory: 128Mi}
+          readinessProbe: {httpGet: {path: /ready, port: 80}}
+---
+apiVersion: policy/v1
+kind: PodDisruptionBudget
+metadata:
+  name: web
+spec:
+  minAvailable: 1
+  selector:
+    matchLabels:
+      app: web
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: once
+spec:
+  template:
+    spec:
+      containers:
+        - name: once
+          resources:
+            limits: {cpu: 100m, memory: 64Mi}
+`
+	baseResources, err := parseManifest(base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	currentResources, err := parseManifest(current)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{Policies: policyNames}
+	if err := checkPolicies(config, "app", baseResources, currentResources); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"app: Deployment api has 3 replicas but no PodDisruptionBudget (pdb)",
+		"app: Deployment web container web has no cpu limit (resource-limits)",
+		"app: Deployment web container web has no livenessProbe (probes)",
+	}
+	if strings.Join(config.violations, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected only newly introduced violations, got:\n%s", strings.Join(config.violations, "\n"))
+	}
+
+	config = &Config{Policies: []string{policyProbes}}
+	if err := checkPolicies(config, "app", nil, currentResources); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.violations) != 3 {
+		t.Errorf("expected every probe violation for an added chart, got %v", config.violations)
+	}
+
+	for _, replicas := range []string{"3.0", "!!float 3", "9223372036854775807"} {
+		scaled, err := parseManifest(strings.Replace(base, "replicas: 1", "replicas: "+replicas, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		violations, err := policyViolations([]string{policyPDB}, scaled)
+		if err != nil {
+			t.Fatalf("replicas %s: %v", replicas, err)
+		}
+		if len(violations) != 1 || !strings.Contains(violations[0], "Deployment api has") {
+			t.Errorf("replicas %s: expected a pdb violation, got %v", replicas, violations)
+		}
+	}
+	for _, replicas := range []string{`"3"`, "2.5"} {
+		scaled, err := parseManifest(strings.Replace(base, "replicas: 1", "replicas: "+replicas, 1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := policyViolations([]string{policyPDB}, scaled); err == nil || !strings.Contains(err.Error(), "reading spec.replicas of Deployment api") {
+			t.Errorf("replicas %s: expected an unreadable replicas error, got %v", replicas, err)
+		}
+	}
+
+	if err := validatePolicies([]string{"probes", "replicas"}); err == nil || !strings.Contains(err.Error(), `unknown policy "replicas"`) {
+		t.Errorf("expected an unknown policy error, got %v", err)
+	}
+}
+
+func TestShouldUseColor(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("CI", "")
+	t.Setenv("FORCE_COLOR", "")
+	t.Setenv("CLICOLOR_FORCE", "")
+	t.Setenv("CLICOLOR", "")
+
+	if shouldUseColor(colorNever, false) {
+		t.Error("expected no color with --color=never")
+	}
+	if shouldUseColor(colorAlways, true) {
+		t.Error("expected --no-color to win over --color=always")
+	}
+	if !shouldUseColor(colorAlways, false) {
+		t.Error("expected color with --color=always")
+	}
+
+	t.Setenv("CI", "true")
+	if shouldUseColor(colorAuto, false) {
+		t.Error("expected no color in CI with --color=auto")
+	}
+	if !shouldUseColor(colorAlways, false) {
+		t.Error("expected --color=always to override CI detection")
+	}
+
+	t.Setenv("CLICOLOR_FORCE", "1")
+	if !shouldUseColor(colorAuto, false) {
+		t.Error("expected CLICOLOR_FORCE to force color in CI")
+	}
+	if shouldUseColor(colorNever, false) {
+		t.Error("expected --color=never to win over CLICOLOR_FORCE")
+	}
+	t.Setenv("CLICOLOR_FORCE", "0")
+	if shouldUseColor(colorAuto, false) {
+		t.Error("expected CLICOLOR_FORCE=0 not to force color")
+	}
+
+	t.Setenv("FORCE_COLOR", "3")
+	if !shouldUseColor(colorAuto, false) {
+		t.Error("expected FORCE_COLOR to force color")
+	}
+	t.Setenv("NO_COLOR", "1")
+	if shouldUseColor(colorAuto, false) {
+		t.Error("expected NO_COLOR to win over FORCE_COLOR")
+	}
+	t.Setenv("NO_COLOR", "")
+	t.Setenv("CLICOLOR_FORCE", "1")
+	t.Setenv("FORCE_COLOR", "0")
+	if shouldUseColor(colorAuto, false) {
+		t.Error("expected FORCE_COLOR=0 to disable color even with CLICOLOR_FORCE")
+	}
+
+	t.Setenv("FORCE_COLOR", "")
+	t.Setenv("CLICOLOR_FORCE", "")
+	t.Setenv("CI", "")
+	t.Setenv("CLICOLOR", "0")
+	if shouldUseColor(colorAuto, false) {
+		t.Error("expected CLICOLOR=0 to disable color")
+	}
+}
+
+func TestDependencyFingerprint(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	writeChart := func(name, chartYAML string) string {
+		chartPath := filepath.Join(tmpDir, name)
+		if err := os.MkdirAll(chartPath, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(chartPath, "Chart.yaml"), []byte(chartYAML), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return chartPath
+	}
+
+	fingerprint := func(chartPath string) string {
+		deps, err := readChartDependencies(chartPath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		key, err := dependencyFingerprint(chartPath, deps)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return key
+	}
+
+	remoteYAML := `apiVersion: v2
+name: app
+dependencies:
+  - name: common
+    version: 1.0.0
+    repository: https://charts.example.com
+`
+	base := writeChart("base", remoteYAML)
+	current := writeChart("current", remoteYAML)
+	if fingerprint(base) != fingerprint(current) {
+		t.Error("expected identical remote dependencies to share a fingerprint")
+	}
+
+	localYAML := `apiVersion: v2
+name: app
+dependencies:
+  - name: lib
+    version: 0.1.0
+    repository: file://../lib
+`
+	localBase := writeChart("a/app", localYAML)
+	localCurrent := writeChart("b/app", localYAML)
+	if fingerprint(localBase) == fingerprint(localCurrent) {
+		t.Error("expected file:// dependencies at different locations to have different fingerprints")
+	}
+}
+
+func TestPluginRepositoryScheme(t *testing.T) {
+	tests := map[string]string{
+		"https://charts.example.com":                      "",
+		"oci://registry.example.com/charts":               "",
+		"file://../common":                                "",
+		"@stable":                                         "",
+		"git+https://github.com/org/charts@charts?ref=v1": "git+https",
+		"git+ssh://git@github.com/org/charts@charts":      "git+ssh",
+		"s3://bucket/charts":                              "s3",
+	}
+
+	for repository, expected := range tests {
+		if got := pluginRepositoryScheme(repository); got != expected {
+			t.Errorf("pluginRepositoryScheme(%q) = %q, expected %q", repository, got, expected)
+		}
+	}
+}
+
+func TestReadDownloaderProtocols(t *testing.T) {
+	pluginDir := t.TempDir()
+
+	helmGit := filepath.Join(pluginDir, "helm-git")
+	if err := os.MkdirAll(helmGit, 0755); err != nil {
+		t.Fatal(err)
+	}
+	pluginYAML := `name: helm-git
+downloaders:
+  - command: helm-git
+    protocols:
+      - git+https
+      - git+ssh
+`
+	if err := os.WriteFile(filepath.Join(helmGit, "plugin.yaml"), []byte(pluginYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	protocols, err := readDownloaderProtocols([]string{pluginDir})
+	if err != nil {
+		t.Fatalf("readDownloaderProtocols failed: %v", err)
+	}
+
+	if !protocols["git+https"] || !protocols["git+ssh"] {
+		t.Errorf("expected git protocols, got %v", protocols)
+	}
+	if protocols["s3"] {
+		t.Error("did not expect s3 protocol")
+	}
+}
+
+func TestResolveChartPath(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	cmd := exec.Command("git", "init")
+	cmd.Dir = tmpDir
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	subDir := filepath.Join(tmpDir, "services", "payments")
+	if err := os.MkdirAll(subDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(origDir)
+	}()
+
+	if err := os.Chdir(subDir); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		chartDir string
+		chart    string
+		expected string
+	}{
+		{chartDir: "charts", chart: "payments", expected: filepath.Join("charts", "payments")},
+		{chartDir: "charts", chart: "services/payments/chart", expected: filepath.Join("services", "payments", "chart")},
+		{chartDir: "charts", chart: "./chart", expected: filepath.Join("services", "payments", "chart")},
+		{chartDir: "charts", chart: "../billing/chart", expected: filepath.Join("services", "billing", "chart")},
+	}
+
+	for _, tt := range tests {
+		got, err := resolveChartPath(tt.chartDir, tt.chart)
+		if err != nil {
+			t.Errorf("resolveChartPath(%q, %q) failed: %v", tt.chartDir, tt.chart, err)
+			continue
+		}
+		if got != tt.expected {
+			t.Errorf("resolveChartPath(%q, %q) = %q, expected %q", tt.chartDir, tt.chart, got, tt.expected)
+		}
+	}
+
+	if _, err := resolveChartPath("charts", "../../../outside"); err == nil {
+		t.Error("expected error for chart path outside the repository")
+	}
+}
+
+func TestChartValuesFiles(t *testing.T) {
+	chartPath := t.TempDir()
+
+	chartYAML := `apiVersion: v2
+name: app
+annotations:
+  helm-git-diff.io/extra-values: ci/values-diff.yaml, ci/values-extra.yaml
+`
+	if err := os.WriteFile(filepath.Join(chartPath, "Chart.yaml"), []byte(chartYAML), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	valuesFiles, err := chartValuesFiles(chartPath, "custom.yaml")
+	if err != nil {
+		t.Fatalf("chartValuesFiles failed: %v", err)
+	}
+
+	expected := filepath.Join(chartPath, "ci", "values-diff.yaml") + "," + filepath.Join(chartPath, "ci", "values-extra.yaml") + ",custom.yaml"
+	if valuesFiles != expected {
+		t.Errorf("expected %q, got %q", expected, valuesFiles)
+	}
+}
+
+func TestHookChanges(t *testing.T) {
+	hook := func(name, events, weight, policy string) resource {
+		annotations := map[string]string{annotationHook: events}
+		if weight != "" {
+			annotations[annotationHookWeight] = weight
+		}
+		if policy != "" {
+			annotations[annotationHookDeletePolicy] = policy
+		}
+		return resource{Kind: "Job", Name: name, Annotations: annotations}
+	}
+
+	base := []resource{
+		hook("migrate", "pre-upgrade,pre-install", "-5", "before-hook-creation"),
+		hook("seed", "pre-upgrade", "0", ""),
+		hook("cleanup", "post-delete", "", ""),
+		{Kind: "Deployment", Name: "app"},
+	}
+	current := []resource{
+		hook("migrate", "pre-install, pre-upgrade", "10", "before-hook-creation,hook-succeeded"),
+		hook("seed", "pre-upgrade", "0", ""),
+		hook("smoke-test", "post-upgrade", "", "hook-succeeded"),
+		{Kind: "Deployment", Name: "app", Annotations: map[string]string{"checksum": "b"}},
+	}
+
+	expected := []string{
+		"Job cleanup removed (post-delete, weight 0)",
+		"Job migrate: weight -5 -> 10; delete policy before-hook-creation -> before-hook-creation,hook-succeeded",
+		"Job smoke-test added (post-upgrade, weight 0, delete policy hook-succeeded)",
+		"pre-upgrade order: Job migrate, Job seed -> Job seed, Job migrate",
+	}
+	if got := hookChanges(base, current); strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected hook changes:\n%s", strings.Join(got, "\n"))
+	}
+	if got := hookChanges(base, base); len(got) != 0 {
+		t.Errorf("expected no hook changes for identical resources, got %v", got)
+	}
+}
+
+func TestSuppressIgnoredChanges(t *testing.T) {
+	secret := func(value string) string {
+		return `apiVersion: v1
+kind: Secret
+metadata:
+  name: tls
+  annotations:
+    helm-git-diff.io/ignore-changes: "true"
+data:
+  tls.crt: ` + value + `
+`
+	}
+	configMap := func(value string) string {
+		return `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: ` + value + `
+`
+	}
+
+	base, err := parseManifest("---\n" + configMap("old") + "---\n" + secret("old"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := parseManifest("---\n" + configMap("new") + "---\n" + secret("new"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kept, suppressed := suppressIgnoredChanges(compareResources(base, current, nil))
+
+	if len(suppressed) != 1 || suppressed[0] != "Secret tls" {
+		t.Errorf("expected Secret tls to be suppressed, got %v", suppressed)
+	}
+	if len(kept) != 1 || kept[0].Key != "v1/ConfigMap//config" {
+		t.Errorf("expected only the ConfigMap change to be kept, got %v", kept)
+	}
+
+	kept, suppressed = suppressIgnoredChanges(compareResources(current, current, nil))
+	if len(kept) != 0 || len(suppressed) != 0 {
+		t.Errorf("expected nothing for unchanged resources, got %v %v", kept, suppressed)
+	}
+}
+
+func TestResourceDiff(t *testing.T) {
+	base, err := parseManifest(`# Source: app/templates/deployment.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  replicas: 1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := parseManifest(`# Source: app/templates/workload.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: app
+  namespace: prod
+spec:
+  replicas: 3
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: extra
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := compareResources(base, current, nil)
+	sortChanges(changes)
+	if changeCounts(changes) != "1 added, 1 modified" {
+		t.Errorf("unexpected counts %q", changeCounts(changes))
+	}
+
+	added, err := resourceDiff("app", changes[0], "main", "HEAD", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added = resourceHeader("app", changes[0]) + added
+	if !strings.HasPrefix(added, "app: ConfigMap extra added\n--- /dev/null\n+++ app/ConfigMap/extra (HEAD)\n") {
+		t.Errorf("unexpected added diff:\n%s", added)
+	}
+
+	modified, err := resourceDiff("app", changes[1], "main", "HEAD", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(modified, "--- app/Deployment/prod/app (main)") || !strings.Contains(modified, "+  replicas: 3") {
+		t.Errorf("unexpected modified diff:\n%s", modified)
+	}
+	if strings.Contains(modified, "Source:") {
+		t.Error("expected template source comments to be excluded from the diff")
+	}
+}
+
+func TestSideBySideDiff(t *testing.T) {
+	base, err := parseManifest(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  a: "1"
+  b: "2"
+  c: "3"
+  d: "4"
+  e: "5"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := parseManifest(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: app
+data:
+  a: "1"
+  b: "2"
+  c: "three"
+  d: "4"
+  e: "5"
+  f: "6"
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := compareResources(base, current, nil)
+	if len(changes) != 1 {
+		t.Fatalf("expected one change, got %d", len(changes))
+	}
+
+	narrow, err := resourceDiff("app", changes[0], "main", "HEAD", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(narrow, ` b: "2"`) || !strings.Contains(narrow, `+  c: "three"`) {
+		t.Errorf("expected no context lines with --context 0:\n%s", narrow)
+	}
+
+	got := sideBySideDiff("app", changes[0], "main", "HEAD", 1, 53, false)
+	row := func(left string, marker byte, right string) string {
+		return strings.TrimRight(fmt.Sprintf("%-25s %c %s", left, marker, right), " ")
+	}
+	want := strings.Join([]string{
+		row("app/ConfigMap/app (main)", ' ', "app/ConfigMap/app (HEAD)"),
+		"@@ -7,4 +7,5 @@",
+		row(`  b: "2"`, ' ', `  b: "2"`),
+		row(`  c: "3"`, '|', `  c: "three"`),
+		row(`  d: "4"`, ' ', `  d: "4"`),
+		row(`  e: "5"`, ' ', `  e: "5"`),
+		row("", '>', `  f: "6"`),
+	}, "\n") + "\n"
+	if got != want {
+		t.Errorf("unexpected side-by-side diff:\n%s\nwant:\n%s", got, want)
+	}
+
+	if fitColumn("abcdef", 4) != "abc…" || fitColumn("ab", 4) != "ab  " {
+		t.Errorf("unexpected column fitting: %q %q", fitColumn("abcdef", 4), fitColumn("ab", 4))
+	}
+}
+
+func TestPinsRoundTrip(t *testing.T) {
+	tmpDir := t.TempDir()
+
+	cmd := exec.Command("git", "init")
+	cmd.Dir = tmpDir
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		_ = os.Chdir(origDir)
+	}()
+
+	if err := os.Chdir(tmpDir); err != nil {
+		t.Fatal(err)
+	}
+
+	pins, err := loadPins()
+	if err != nil {
+		t.Fatalf("loadPins without pin file failed: %v", err)
+	}
+	if len(pins) != 0 {
+		t.Errorf("expected no pins, got %v", pins)
+	}
+
+	pins["charts/app"] = "0123456789abcdef0123456789abcdef01234567"
+	if err := savePins(pins); err != nil {
+		t.Fatalf("savePins failed: %v", err)
+	}
+
+	loaded, err := loadPins()
+	if err != nil {
+		t.Fatalf("loadPins failed: %v", err)
+	}
+	if loaded["charts/app"] != pins["charts/app"] {
+		t.Errorf("expected pin to round trip, got %v", loaded)
+	}
+}
+
+func TestCompareResources(t *testing.T) {
+	base, err := parseManifest(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: old
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: removed
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: unchanged
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := parseManifest(`apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: config
+data:
+  key: new
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: added
+---
+apiVersion: v1
+kind: Service
+metadata:
+  name: unchanged
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := compareResources(base, current, nil)
+
+	expected := []struct {
+		key    string
+		change string
+	}{
+		{key: "v1/ConfigMap//config", change: changeModified},
+		{key: "apps/v1/Deployment//added", change: changeAdded},
+		{key: "rbac.authorization.k8s.io/v1/Role//removed", change: changeRemoved},
+	}
+	if len(changes) != len(expected) {
+		t.Fatalf("expected %d changes, got %d", len(expected), len(changes))
+	}
+	for i, exp := range expected {
+		if changes[i].Key != exp.key || changes[i].Change != exp.change {
+			t.Errorf("change %d: expected %s %s, got %s %s", i, exp.key, exp.change, changes[i].Key, changes[i].Change)
+		}
+	}
+
+	categories := changeCategories(changes)
+	if strings.Join(categories, ",") != "config,rbac,workload" {
+		t.Errorf("unexpected categories %v", categories)
+	}
+}
+
+func TestParseReviewers(t *testing.T) {
+	reviewers := parseReviewers(`# category reviewers
+rbac       @org/security
+workload   @org/platform @alice
+rbac       @bob
+*          @org/helm
+invalid
+`)
+
+	if strings.Join(reviewers["rbac"], ",") != "@org/security,@bob" {
+		t.Errorf("unexpected rbac reviewers %v", reviewers["rbac"])
+	}
+	if strings.Join(reviewers["workload"], ",") != "@org/platform,@alice" {
+		t.Errorf("unexpected workload reviewers %v", reviewers["workload"])
+	}
+	if strings.Join(reviewers["*"], ",") != "@org/helm" {
+		t.Errorf("unexpected default reviewers %v", reviewers["*"])
+	}
+	if _, ok := reviewers["invalid"]; ok {
+		t.Error("expected line without reviewers to be ignored")
+	}
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	t.Helper()
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %v\n%s", strings.Join(args, " "), err, output)
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func initTestRepo(t *testing.T) string {
+	t.Helper()
+	tmpDir := t.TempDir()
+	runGit(t, tmpDir, "init", "-q")
+	runGit(t, tmpDir, "config", "user.email", "test@example.com")
+	runGit(t, tmpDir, "config", "user.name", "Test User")
+	return tmpDir
+}
+
+func writeTestFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func chdir(t *testing.T, dir string) {
+	t.Helper()
+	origDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.Chdir(origDir)
+	})
+}
+
+func TestDetectChangedChartsSince(t *testing.T) {
+	repo := initTestRepo(t)
+	for _, name := range []string{"a", "b"} {
+		writeTestFile(t, filepath.Join(repo, "charts", name, "Chart.yaml"), "apiVersion: v2\nname: "+name+"\n")
+		writeTestFile(t, filepath.Join(repo, "charts", name, "values.yaml"), "replicas: 1\n")
+	}
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	start := runGit(t, repo, "rev-parse", "HEAD")
+
+	writeTestFile(t, filepath.Join(repo, "charts", "a", "values.yaml"), "replicas: 2\n")
+	runGit(t, repo, "commit", "-q", "-am", "change a")
+	writeTestFile(t, filepath.Join(repo, "charts", "a", "values.yaml"), "replicas: 1\n")
+	writeTestFile(t, filepath.Join(repo, "charts", "b", "values.yaml"), "replicas: 2\n")
+	runGit(t, repo, "commit", "-q", "-am", "revert a, change b")
+
+	chdir(t, repo)
+
+	config := &Config{Base: start, Current: "HEAD", ChartDir: "charts"}
+	charts, err := detectChangedCharts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(charts) != 1 || charts[0] != "b" {
+		t.Errorf("expected only b between endpoints, got %v", charts)
+	}
+
+	config.Since = start
+	charts, err = detectChangedCharts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(charts)
+	if strings.Join(charts, ",") != "a,b" {
+		t.Errorf("expected a and b since %s, got %v", start, charts)
+	}
+}
+
+func TestDependencyBumps(t *testing.T) {
+	tmpDir := t.TempDir()
+	basePath := filepath.Join(tmpDir, "base")
+	currentPath := filepath.Join(tmpDir, "current")
+
+	writeTestFile(t, filepath.Join(basePath, "Chart.yaml"), `apiVersion: v2
+name: app
+dependencies:
+  - name: redis
+    version: 17.0.0
+    repository: oci://registry.example.com/charts
+  - name: common
+    version: 1.0.0
+    repository: file://../common
+`)
+	writeTestFile(t, filepath.Join(currentPath, "Chart.yaml"), `apiVersion: v2
+name: app
+dependencies:
+  - name: redis
+    version: 18.1.0
+    repository: oci://registry.example.com/charts
+  - name: common
+    version: 1.0.0
+    repository: file://../common
+`)
+
+	bumps, err := dependencyBumps(basePath, currentPath)
+	if err != nil {
+		t.Fatalf("dependencyBumps failed: %v", err)
+	}
+
+	expected := "dependency redis 17.0.0 -> 18.1.0 (https://artifacthub.io/packages/search?ts_query_web=redis)"
+	if len(bumps) != 1 || bumps[0] != expected {
+		t.Errorf("expected [%s], got %v", expected, bumps)
+	}
+
+	bumps, err = dependencyBumps("", currentPath)
+	if err != nil || len(bumps) != 0 {
+		t.Errorf("expected no bumps for a new chart, got %v (%v)", bumps, err)
+	}
+}
+
+func TestStartProfiling(t *testing.T) {
+	tmpDir := t.TempDir()
+	config := &Config{
+		CPUProfile: filepath.Join(tmpDir, "cpu.out"),
+		MemProfile: filepath.Join(tmpDir, "mem.out"),
+		Trace:      filepath.Join(tmpDir, "trace.out"),
+	}
+
+	stop, err := startProfiling(config)
+	if err != nil {
+		t.Fatalf("startProfiling failed: %v", err)
+	}
+	if err := stop(); err != nil {
+		t.Fatalf("stopping profiling failed: %v", err)
+	}
+
+	for _, path := range []string{config.CPUProfile, config.MemProfile, config.Trace} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Errorf("expected %s to exist: %v", path, err)
+			continue
+		}
+		if info.Size() == 0 {
+			t.Errorf("expected %s to be non-empty", path)
+		}
+	}
+}
+
+func TestDiffChartsRecordsFailures(t *testing.T) {
+	repo := initTestRepo(t)
+	writeTestFile(t, filepath.Join(repo, "charts", "lib", "Chart.yaml"), "apiVersion: v2\nname: lib\ntype: library\nversion: 0.1.0\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+
+	chdir(t, repo)
+
+	config := &Config{
+		Base:     "HEAD",
+		Current:  "HEAD",
+		ChartDir: "charts",
+		Charts:   []string{"missing", "lib"},
+	}
+	if err := diffCharts(config); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(config.failures) != 1 {
+		t.Fatalf("expected 1 failure, got %v", config.failures)
+	}
+	if config.failures[0].Chart != "missing" || config.failures[0].Reason != reasonInvalidChart {
+		t.Errorf("unexpected failure %+v", config.failures[0])
+	}
+	if config.skipped != 1 {
+		t.Errorf("expected library chart to be skipped, got skipped=%d", config.skipped)
+	}
+}
+
+func TestMissingValuesFiles(t *testing.T) {
+	repo := initTestRepo(t)
+	writeTestFile(t, filepath.Join(repo, "charts", "app", "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 0.1.0\nannotations:\n  helm-git-diff.io/extra-values: extra.yaml\n")
+	writeTestFile(t, filepath.Join(repo, "charts", "app", "extra.yaml"), "replicas: 2\n")
+	writeTestFile(t, filepath.Join(repo, "charts", "web", "Chart.yaml"), "apiVersion: v2\nname: web\nversion: 0.1.0\n")
+	writeTestFile(t, filepath.Join(repo, "shared.yaml"), "replicas: 1\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	start := runGit(t, repo, "rev-parse", "HEAD")
+	runGit(t, repo, "rm", "-q", "charts/app/extra.yaml")
+	runGit(t, repo, "commit", "-q", "-m", "drop extra values")
+
+	chdir(t, repo)
+
+	config := &Config{Base: start, Current: "HEAD", ChartDir: "charts", ValuesFiles: "shared.yaml", Charts: []string{"app", "web"}}
+	var prepared []*chartSources
+	for _, chart := range config.Charts {
+		sources, err := prepareChart(config, chart)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cleanupChartSources(sources)
+		prepared = append(prepared, sources)
+	}
+
+	if missing := missingValuesFiles(config, config.Charts, prepared); strings.Join(missing, "\n") != "app: charts/app/extra.yaml (in the working tree)" {
+		t.Errorf("expected only the removed extra values file to be reported, got %q", missing)
+	}
+
+	if err := os.Remove(filepath.Join(repo, "shared.yaml")); err != nil {
+		t.Fatal(err)
+	}
+	err := diffCharts(config)
+	if err == nil {
+		t.Fatal("expected an error for missing values files")
+	}
+	expected := "2 values files not found:\n  app: charts/app/extra.yaml (in the working tree)\n  shared.yaml (in the working tree)"
+	if err.Error() != expected {
+		t.Errorf("expected each missing file once with its source:\n%s\ngot:\n%v", expected, err)
+	}
+	if len(config.results) != 0 {
+		t.Errorf("expected nothing to be rendered, got %v", config.results)
+	}
+
+	head := runGit(t, repo, "rev-parse", "HEAD")
+	writeTestFile(t, filepath.Join(repo, "local.yaml"), "replicas: 3\n")
+	writeTestFile(t, filepath.Join(repo, "charts", "web", "values-prod.yaml"), "replicas: 3\n")
+	config = &Config{Base: start, Current: "HEAD", ChartDir: "charts", Charts: []string{"web"}, Envs: []chartEnv{{Name: "prod", ValuesFiles: []string{"values-prod.yaml"}}}}
+	sources, err := prepareChart(config, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupChartSources(sources)
+	if missing := missingValuesFiles(config, config.Charts, []*chartSources{sources}); len(missing) != 0 {
+		t.Errorf("expected an environment file added in the working tree to be accepted, got %q", missing)
+	}
+
+	config = &Config{Base: start, Current: head, ChartDir: "charts", ValuesFiles: "local.yaml", ValuesFromRef: true, Charts: []string{"web"}}
+	sources, err = prepareChart(config, "web")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupChartSources(sources)
+	missing := missingValuesFiles(config, config.Charts, []*chartSources{sources})
+	if strings.Join(missing, "\n") != "local.yaml (at "+head+")\nlocal.yaml (at "+start+")" {
+		t.Errorf("expected a values file missing at both refs to be reported for each ref, got %q", missing)
+	}
+}
+
+func TestErrorReason(t *testing.T) {
+	err := fmt.Errorf("diffing: %w", withReason(reasonRenderFailed, errors.New("helm template failed")))
+	if errorReason(err) != reasonRenderFailed {
+		t.Errorf("expected %s, got %s", reasonRenderFailed, errorReason(err))
+	}
+	if errorReason(errors.New("plain")) != reasonUnknown {
+		t.Error("expected unknown reason for plain errors")
+	}
+}
+
+func TestWriteGitHubOutputs(t *testing.T) {
+	outputPath := filepath.Join(t.TempDir(), "github_output")
+	writeTestFile(t, outputPath, "previous=value\n")
+	t.Setenv("GITHUB_OUTPUT", outputPath)
+
+	config := &Config{
+		changedCharts:  []string{"payments", "api"},
+		hasDifferences: true,
+		destructive:    2,
+		results:        []chartResult{{Chart: "payments", RiskScore: 20}, {Chart: "api", RiskScore: 5}},
+	}
+	if err := writeGitHubOutputs(config); err != nil {
+		t.Fatalf("writeGitHubOutputs failed: %v", err)
+	}
+
+	content, err := os.ReadFile(outputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "previous=value\nchanged_charts=[\"payments\",\"api\"]\nhas_diff=true\ndestructive_count=2\nmax_risk_score=20\n"
+	if string(content) != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, content)
+	}
+}
+
+func TestRiskScore(t *testing.T) {
+	base, err := parseManifest(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 3
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: api
+---
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: old
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := parseManifest(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 1
+---
+apiVersion: rbac.authorization.k8s.io/v1
+kind: Role
+metadata:
+  name: api
+rules: []
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes := compareResources(base, current, nil)
+
+	destructive := destructiveChanges("app", changes)
+	score, risks := riskScore(changes, destructive, riskWeights(&Config{}))
+	if score != 18 || strings.Join(risks, ", ") != "1 destructive x10, 1 rbac x5, 1 replica-drop x3" {
+		t.Errorf("unexpected risk score %d (%v)", score, risks)
+	}
+
+	config := &Config{repoConfig: &repoConfig{RiskWeights: map[string]int{riskDestructive: 0, riskRBAC: 20}}}
+	score, risks = riskScore(changes, destructive, riskWeights(config))
+	if score != 23 || strings.Join(risks, ", ") != "1 rbac x20, 1 replica-drop x3" {
+		t.Errorf("unexpected risk score with custom weights %d (%v)", score, risks)
+	}
+}
+
+func TestReadPackageFiles(t *testing.T) {
+	packagePath := filepath.Join(t.TempDir(), "app-0.1.0.tgz")
+
+	f, err := os.Create(packagePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for name, content := range map[string]string{
+		"app/Chart.yaml":                "name: app\n",
+		"app/templates/deployment.yaml": "kind: Deployment\n",
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := readPackageFiles(packagePath)
+	if err != nil {
+		t.Fatalf("readPackageFiles failed: %v", err)
+	}
+	if len(files) != 2 || files["Chart.yaml"] == "" || files["templates/deployment.yaml"] == "" {
+		t.Errorf("unexpected package files %v", files)
+	}
+}
+
+func TestComparePackageFiles(t *testing.T) {
+	base := map[string]string{
+		"Chart.yaml":          "a",
+		"templates/old.yaml":  "b",
+		"templates/same.yaml": "c",
+		"templates/edit.yaml": "d",
+	}
+	current := map[string]string{
+		"Chart.yaml":          "a",
+		"templates/same.yaml": "c",
+		"templates/edit.yaml": "e",
+		"secrets.bin":         "f",
+	}
+
+	lines := comparePackageFiles(base, current)
+	expected := []string{
+		"file added: secrets.bin",
+		"file changed: templates/edit.yaml",
+		"file removed: templates/old.yaml",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+}
+
+func TestWriteReport(t *testing.T) {
+	config := &Config{
+		changed:   1,
+		unchanged: 1,
+		results: []chartResult{
+			{
+				Chart:   "app",
+				Status:  statusChanged,
+				Summary: "1 added",
+				Notes:   []string{"dependency redis: 17.0.0 -> 17.1.0"},
+				Resources: []resourceResult{
+					{Kind: "ConfigMap", Name: "extra", Change: changeAdded, Diff: "--- /dev/null\n+++ app/ConfigMap/extra (HEAD)\n"},
+				},
+			},
+			{Chart: "api", Status: statusUnchanged, Summary: "no changes"},
+		},
+	}
+
+	var out bytes.Buffer
+	config.Output = outputText
+	if err := writeReport(config, &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Errorf("expected no report for text output, got %q", out.String())
+	}
+
+	config.Output = outputJSON
+	if err := writeReport(config, &out); err != nil {
+		t.Fatal(err)
+	}
+	var decoded report
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatalf("invalid JSON report: %v\n%s", err, out.String())
+	}
+	if len(decoded.Charts) != 2 || decoded.Changed != 1 || decoded.Charts[0].Resources[0].Change != changeAdded {
+		t.Errorf("unexpected JSON report %+v", decoded)
+	}
+
+	out.Reset()
+	config.Output = outputMarkdown
+	if err := writeReport(config, &out); err != nil {
+		t.Fatal(err)
+	}
+	markdown := out.String()
+	for _, want := range []string{
+		"<summary><code>app</code>: 1 added</summary>",
+		"```diff\n--- /dev/null\n",
+		"- dependency redis: 17.0.0 -> 17.1.0",
+		"- `api`: unchanged\n",
+	} {
+		if !strings.Contains(markdown, want) {
+			t.Errorf("markdown report missing %q:\n%s", want, markdown)
+		}
+	}
+}
+
+func TestRenderChartsConcurrently(t *testing.T) {
+	fakeHelm(t)
+	tmpDir := t.TempDir()
+
+	var prepared []*chartSources
+	for _, name := range []string{"alpha", "beta", "gamma", "delta"} {
+		chartPath := filepath.Join(tmpDir, name)
+		writeTestFile(t, filepath.Join(chartPath, "Chart.yaml"), "apiVersion: v2\nname: "+name+"\nversion: 0.1.0\n")
+		writeTestFile(t, filepath.Join(chartPath, "templates", "configmap.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: "+name+"\n")
+		prepared = append(prepared, &chartSources{Base: chartPath, Current: chartPath})
+	}
+	prepared = append(prepared, &chartSources{SkipReason: "library chart"})
+
+	renderCharts(&Config{Concurrency: 3}, prepared)
+
+	for i, name := range []string{"alpha", "beta", "gamma", "delta"} {
+		if prepared[i].Err != nil {
+			t.Fatalf("rendering %s failed: %v", name, prepared[i].Err)
+		}
+		if !strings.Contains(prepared[i].CurrentManifest, "name: "+name) || prepared[i].BaseManifest != prepared[i].CurrentManifest {
+			t.Errorf("unexpected manifests for %s:\n%s", name, prepared[i].CurrentManifest)
+		}
+	}
+	if prepared[4].CurrentManifest != "" {
+		t.Error("expected skipped chart not to be rendered")
+	}
+}
+
+func TestChangedValueKeys(t *testing.T) {
+	base := map[string]any{
+		"replicaCount": 1,
+		"image":        map[string]any{"repository": "nginx", "tag": "1.25"},
+		"removed":      true,
+		"resources":    map[string]any{},
+	}
+	current := map[string]any{
+		"replicaCount": 1,
+		"image":        map[string]any{"repository": "nginx", "tag": "1.26"},
+		"resources":    map[string]any{},
+		"added":        []any{"a"},
+	}
+
+	var keys []string
+	for _, key := range changedValueKeys(base, current) {
+		keys = append(keys, strings.Join(key, "."))
+	}
+	expected := []string{"added", "image.tag", "removed"}
+	if strings.Join(keys, ",") != strings.Join(expected, ",") {
+		t.Errorf("expected %v, got %v", expected, keys)
+	}
+
+	if value, ok := lookupValue(base, []string{"image", "tag"}); !ok || value != "1.25" {
+		t.Errorf("expected image.tag 1.25, got %v (found=%v)", value, ok)
+	}
+	if _, ok := lookupValue(base, []string{"added"}); ok {
+		t.Error("expected added key to be missing from base values")
+	}
+}
+
+func TestOnlyValuesChanged(t *testing.T) {
+	tmpDir := t.TempDir()
+	base := filepath.Join(tmpDir, "base")
+	current := filepath.Join(tmpDir, "current")
+	for _, dir := range []string{base, current} {
+		writeTestFile(t, filepath.Join(dir, "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 0.1.0\n")
+		writeTestFile(t, filepath.Join(dir, "templates", "deployment.yaml"), "kind: Deployment\n")
+	}
+	writeTestFile(t, filepath.Join(base, "values.yaml"), "replicaCount: 1\n")
+	writeTestFile(t, filepath.Join(current, "values.yaml"), "replicaCount: 2\n")
+	writeTestFile(t, filepath.Join(current, "charts", "redis-17.0.0.tgz"), "built dependency")
+
+	onlyValues, err := onlyValuesChanged(base, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !onlyValues {
+		t.Error("expected only values.yaml to have changed")
+	}
+
+	writeTestFile(t, filepath.Join(current, "templates", "deployment.yaml"), "kind: StatefulSet\n")
+	onlyValues, err = onlyValuesChanged(base, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if onlyValues {
+		t.Error("expected template change to disable the values impact report")
+	}
+}
+
+func TestEnvFlag(t *testing.T) {
+	var envs envFlag
+	if err := envs.Set("dev=values-dev.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := envs.Set("prod=values-common.yaml, values-prod.yaml"); err != nil {
+		t.Fatal(err)
+	}
+	if len(envs) != 2 || envs[1].Name != "prod" || strings.Join(envs[1].ValuesFiles, ",") != "values-common.yaml,values-prod.yaml" {
+		t.Errorf("unexpected environments %+v", envs)
+	}
+
+	for _, invalid := range []string{"values-dev.yaml", "=values.yaml", "dev=", "dev=other.yaml"} {
+		if err := envs.Set(invalid); err == nil {
+			t.Errorf("expected %q to be rejected", invalid)
+		}
+	}
+}
+
+func TestExpandEnvironments(t *testing.T) {
+	prepared := []*chartSources{
+		{Base: "/tmp/base", Current: "/tmp/current", cleanups: []func(){func() {}}},
+		{SkipReason: "library chart"},
+	}
+	envs := []chartEnv{
+		{Name: "dev", ValuesFiles: []string{"values-dev.yaml"}},
+		{Name: "prod", ValuesFiles: []string{"values-prod.yaml"}},
+	}
+
+	names, targets := expandEnvironments([]string{"app", "lib"}, prepared, envs)
+
+	if strings.Join(names, ",") != "app[dev],app[prod],lib" {
+		t.Errorf("unexpected names %v", names)
+	}
+	if targets[1].Env != "prod" || targets[1].Current != "/tmp/current" || targets[1].EnvValues[0] != "values-prod.yaml" {
+		t.Errorf("unexpected target %+v", targets[1])
+	}
+	if targets[0].cleanups != nil {
+		t.Error("expected expanded targets not to own cleanups")
+	}
+	if targets[2] != prepared[1] {
+		t.Error("expected skipped chart to be passed through once")
+	}
+}
+
+func TestSourceValuesFiles(t *testing.T) {
+	basePath, chartPath := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(basePath, "Chart.yaml"), "apiVersion: v2\nname: app\n")
+	writeTestFile(t, filepath.Join(chartPath, "Chart.yaml"), "apiVersion: v2\nname: app\n")
+	writeTestFile(t, filepath.Join(chartPath, "values-common.yaml"), "debug: false\n")
+	writeTestFile(t, filepath.Join(chartPath, "values-prod.yaml"), "replicaCount: 3\n")
+	writeTestFile(t, filepath.Join(basePath, "values-prod.yaml"), "replicaCount: 2\n")
+
+	sources := &chartSources{Base: basePath, Current: chartPath, Env: "prod", EnvValues: []string{"values-common.yaml", "values-prod.yaml"}}
+	valuesFiles, err := sourceValuesFiles(sources, chartPath, "custom.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := filepath.Join(chartPath, "values-common.yaml") + "," + filepath.Join(chartPath, "values-prod.yaml") + ",custom.yaml"
+	if valuesFiles != expected {
+		t.Errorf("expected %q, got %q", expected, valuesFiles)
+	}
+
+	valuesFiles, err = sourceValuesFiles(sources, basePath, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := filepath.Join(basePath, "values-prod.yaml"); valuesFiles != expected {
+		t.Errorf("expected base without the added file %q, got %q", expected, valuesFiles)
+	}
+
+	sources.EnvValues = []string{"valuse-prod.yaml"}
+	if _, err := sourceValuesFiles(sources, chartPath, ""); err == nil || err.Error() != "values file valuse-prod.yaml of environment prod not found in the chart" {
+		t.Errorf("expected missing environment values file error, got %v", err)
+	}
+}
+
+func TestReleaseNoteItems(t *testing.T) {
+	deployment := func(image string, replicas int) string {
+		return fmt.Sprintf(`apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: payments
+spec:
+  replicas: %d
+  template:
+    spec:
+      containers:
+        - name: app
+          image: %s
+`, replicas, image)
+	}
+	base, err := parseManifest(deployment("registry.example.com:5000/payments:1.2.3", 2) + "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: legacy\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: payments\nspec:\n  port: 80\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := parseManifest(deployment("registry.example.com:5000/payments:1.2.4", 2) + "---\napiVersion: autoscaling/v2\nkind: HorizontalPodAutoscaler\nmetadata:\n  name: payments\n---\napiVersion: v1\nkind: Service\nmetadata:\n  name: payments\nspec:\n  port: 8080\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := compareResources(base, current, nil)
+	sortChanges(changes)
+	items := releaseNoteItems(changes)
+
+	expected := []string{
+		"added HorizontalPodAutoscaler payments",
+		"image registry.example.com:5000/payments 1.2.3→1.2.4",
+		"updated Service payments",
+		"removed ConfigMap legacy",
+	}
+	if strings.Join(items, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v, got %v", expected, items)
+	}
+
+	notes := formatReleaseNotes(report{Charts: []chartResult{
+		{Chart: "payments", Status: statusChanged, Highlights: items},
+		{Chart: "api", Status: statusUnchanged},
+	}})
+	if !strings.Contains(notes, "- **payments**: added HorizontalPodAutoscaler payments, image registry.example.com:5000/payments 1.2.3→1.2.4, ") || strings.Contains(notes, "api") {
+		t.Errorf("unexpected release notes:\n%s", notes)
+	}
+}
+
+func TestPruneSection(t *testing.T) {
+	kept := []resource{
+		{Annotations: map[string]string{"argocd.argoproj.io/sync-options": "ServerSideApply=true, Prune=false"}},
+		{Annotations: map[string]string{"kustomize.toolkit.fluxcd.io/prune": "disabled"}},
+	}
+	for _, res := range kept {
+		if !pruneDisabled(res) {
+			t.Errorf("expected pruning to be disabled for %v", res.Annotations)
+		}
+	}
+	if pruneDisabled(resource{Annotations: map[string]string{"argocd.argoproj.io/sync-options": "Prune=true"}}) {
+		t.Error("expected Prune=true to allow pruning")
+	}
+
+	section := formatPruneSection([]prunedResource{
+		{Chart: "payments", Resource: "ConfigMap prod/legacy"},
+		{Chart: "api", Resource: "Secret keys", Kept: true},
+	})
+	expected := "\nWill be pruned:\n  payments: ConfigMap prod/legacy\n  api: Secret keys (pruning disabled, kept)\n"
+	if section != expected {
+		t.Errorf("expected %q, got %q", expected, section)
+	}
+}
+
+func TestExtractValuesFiles(t *testing.T) {
+	repo := initTestRepo(t)
+	writeTestFile(t, filepath.Join(repo, "env", "prod.yaml"), "replicaCount: 1\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	writeTestFile(t, filepath.Join(repo, "env", "prod.yaml"), "replicaCount: 3\n")
+	writeTestFile(t, filepath.Join(repo, "env", "new.yaml"), "debug: true\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "update")
+
+	chdir(t, repo)
+
+	valuesFiles, cleanup, err := extractValuesFiles("env/prod.yaml,env/new.yaml", "HEAD~1")
+	if err != nil {
+		t.Fatalf("extractValuesFiles failed: %v", err)
+	}
+	defer cleanup()
+
+	files := strings.Split(valuesFiles, ",")
+	if len(files) != 1 {
+		t.Fatalf("expected only the values file present at the ref, got %v", files)
+	}
+	content, err := os.ReadFile(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "replicaCount: 1\n" {
+		t.Errorf("expected values from the base ref, got %q", string(content))
+	}
+}
+
+func TestLoadBatch(t *testing.T) {
+	batchPath := filepath.Join(t.TempDir(), "batch.yaml")
+	writeTestFile(t, batchPath, `repositories:
+  - path: ../platform-charts
+    base: origin/main
+    charts: ["charts/*"]
+  - url: https://example.com/acme/payments.git
+    name: payments
+`)
+
+	batch, err := loadBatch(batchPath)
+	if err != nil {
+		t.Fatalf("loadBatch failed: %v", err)
+	}
+	if len(batch.Repositories) != 2 || batch.Repositories[0].Name != "platform-charts" || batch.Repositories[1].URL == "" {
+		t.Errorf("unexpected batch %+v", batch)
+	}
+
+	writeTestFile(t, batchPath, "repositories:\n  - name: broken\n")
+	if _, err := loadBatch(batchPath); err == nil {
+		t.Error("expected repository without path or url to be rejected")
+	}
+}
+
+func TestRunBatch(t *testing.T) {
+	fakeHelm(t)
+	root := t.TempDir()
+	for _, name := range []string{"one", "two"} {
+		repo := filepath.Join(root, name)
+		runGit(t, root, "init", "-q", name)
+		runGit(t, repo, "config", "user.email", "test@example.com")
+		runGit(t, repo, "config", "user.name", "Test User")
+		writeTestFile(t, filepath.Join(repo, "charts", "app", "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 0.1.0\n")
+		writeTestFile(t, filepath.Join(repo, "charts", "app", "templates", "configmap.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  key: old\n")
+		runGit(t, repo, "add", ".")
+		runGit(t, repo, "commit", "-q", "-m", "initial")
+		writeTestFile(t, filepath.Join(repo, "charts", "app", "templates", "configmap.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  key: new\n")
+		runGit(t, repo, "commit", "-q", "-am", "update")
+	}
+	batchPath := filepath.Join(root, "batch.yaml")
+	writeTestFile(t, batchPath, `repositories:
+  - path: one
+    base: HEAD~1
+    charts: ["charts/*"]
+  - path: two
+    base: HEAD~1
+    chart-dir: charts
+  - path: missing
+`)
+
+	chdir(t, root)
+
+	config := &Config{Batch: batchPath, Current: "HEAD", Concurrency: 1, Output: outputJSON}
+	if err := runBatch(config, io.Discard); err != nil {
+		t.Fatalf("runBatch failed: %v", err)
+	}
+
+	var charts []string
+	for _, result := range config.results {
+		charts = append(charts, result.Chart+"="+result.Status)
+	}
+	if strings.Join(charts, ",") != "one/charts/app=changed,two/app=changed,missing=failed" {
+		t.Errorf("unexpected batch results %v", charts)
+	}
+	if config.changed != 2 || len(config.failures) != 1 {
+		t.Errorf("expected 2 changed charts and 1 failure, got changed=%d failures=%v", config.changed, config.failures)
+	}
+}
+
+func TestTemplateOptionsArgs(t *testing.T) {
+	opts := templateOptionsFrom(&Config{
+		ReleaseName:  "payments-prod",
+		Namespace:    "payments",
+		KubeVersion:  "1.29.0",
+		APIVersions:  []string{"monitoring.coreos.com/v1", "policy/v1"},
+		IncludeCRDs:  true,
+		PostRenderer: "./kustomize.sh",
+		AllowLookup:  true,
+	})
+
+	expected := []string{
+		"--namespace", "payments",
+		"--kube-version", "1.29.0",
+		"--api-versions", "monitoring.coreos.com/v1",
+		"--api-versions", "policy/v1",
+		"--include-crds",
+		"--post-renderer", "./kustomize.sh",
+		"--dry-run=server",
+	}
+	if strings.Join(opts.Args(), " ") != strings.Join(expected, " ") {
+		t.Errorf("expected %v, got %v", expected, opts.Args())
+	}
+	if opts.ReleaseName != "payments-prod" {
+		t.Errorf("expected release name to be passed through, got %q", opts.ReleaseName)
+	}
+	if len(templateOptions{}.Args()) != 0 {
+		t.Error("expected no extra arguments by default")
+	}
+}
+
+func TestRunAudit(t *testing.T) {
+	fakeHelm(t)
+	repo := initTestRepo(t)
+	writeTestFile(t, filepath.Join(repo, "charts", "app", "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 0.1.0\n")
+	writeTestFile(t, filepath.Join(repo, "charts", "team", "billing", "Chart.yaml"), "apiVersion: v2\nname: billing\nversion: 0.1.0\n")
+	writeTestFile(t, filepath.Join(repo, "charts", "team", "billing", "charts", "db", "Chart.yaml"), "apiVersion: v2\nname: db\nversion: 0.1.0\n")
+	writeTestFile(t, filepath.Join(repo, "charts", "app", "templates", "configmap.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  key: old\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	first := runGit(t, repo, "rev-parse", "HEAD")
+
+	chdir(t, repo)
+	logPath := filepath.Join(t.TempDir(), "audit.log")
+	args := []string{"--chart-dir", "charts", "--log", logPath}
+
+	if err := runAudit(args); err != nil {
+		t.Fatalf("baseline audit failed: %v", err)
+	}
+	state, err := loadPinFile(auditStateFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["charts/app"] != first || state["charts/team/billing"] != first || len(state) != 2 {
+		t.Fatalf("expected baselines for the top-level charts at %s, got %v", first, state)
+	}
+
+	writeTestFile(t, filepath.Join(repo, "charts", "app", "templates", "configmap.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\ndata:\n  key: new\n")
+	runGit(t, repo, "commit", "-q", "-am", "update")
+	second := runGit(t, repo, "rev-parse", "HEAD")
+
+	if err := runAudit(args); err != nil {
+		t.Fatalf("audit failed: %v", err)
+	}
+	if err := runAudit(args); err != nil {
+		t.Fatalf("repeated audit failed: %v", err)
+	}
+
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(content)), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one audit log entry, got %d:\n%s", len(lines), content)
+	}
+	var entry auditEntry
+	if err := json.Unmarshal([]byte(lines[0]), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry.Chart != "charts/app" || entry.Status != statusChanged || entry.From != first || entry.To != second {
+		t.Errorf("unexpected audit entry %+v", entry)
+	}
+
+	state, err = loadPinFile(auditStateFileName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state["charts/app"] != second {
+		t.Errorf("expected state to advance to %s, got %v", second, state)
+	}
+}
+
+func TestValuesCoverage(t *testing.T) {
+	tmpDir := t.TempDir()
+	base := filepath.Join(tmpDir, "base")
+	current := filepath.Join(tmpDir, "current")
+	writeTestFile(t, filepath.Join(base, "Chart.yaml"), "apiVersion: v2\nname: app\n")
+	writeTestFile(t, filepath.Join(base, "templates", "deployment.yaml"), "replicas: {{ .Values.replicaCount }}\nimage: {{ .Values.image.repository }}:{{ .Values.image.tag }}\n")
+	writeTestFile(t, filepath.Join(current, "Chart.yaml"), "apiVersion: v2\nname: app\n")
+	writeTestFile(t, filepath.Join(current, "values.yaml"), "replicaCount: 1\nimage:\n  repository: nginx\n  tag: latest\n")
+	writeTestFile(t, filepath.Join(current, "templates", "deployment.yaml"), "replicas: {{ .Values.replicaCount }}\nimage: {{ .Values.image.repository }}:{{ .Values.image.tag }}\n{{- with $.Values.podLabels }}labels: {{ . }}{{ end }}\n{{ .Values.resources.limits.memory }}\n")
+
+	valuesPath := filepath.Join(tmpDir, "prod.yaml")
+	writeTestFile(t, valuesPath, "image:\n  tag: 1.2.3\nresources: []\n")
+
+	sources := &chartSources{Base: base, Current: current, CurrentValues: valuesPath}
+	lines, err := valuesCoverage(&Config{SetValues: []string{"image.repository=registry.example.com/app"}}, sources)
+	if err != nil {
+		t.Fatalf("valuesCoverage failed: %v", err)
+	}
+
+	expected := []string{
+		"values key podLabels newly referenced, not set by values files (unset)",
+		"values key replicaCount not set by values files (chart default)",
+		"values key resources.limits.memory newly referenced, not set by values files (unset)",
+	}
+	if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v, got %v", expected, lines)
+	}
+}
+
+func TestFetchReleaseManifest(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake helm script requires a POSIX shell")
+	}
+
+	binDir := t.TempDir()
+	writeTestFile(t, filepath.Join(binDir, "helm"), `#!/bin/sh
+if [ "$3" = "missing" ]; then
+  echo "Error: release: not found" >&2
+  exit 1
+fi
+echo "---"
+echo "# args: $*"
+`)
+	if err := os.Chmod(filepath.Join(binDir, "helm"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", binDir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	manifest, err := fetchReleaseManifest("payments", "prod")
+	if err != nil {
+		t.Fatalf("fetchReleaseManifest failed: %v", err)
+	}
+	if !strings.Contains(manifest, "# args: get manifest payments --namespace prod") {
+		t.Errorf("unexpected manifest %q", manifest)
+	}
+
+	manifest, err = fetchReleaseManifest("missing", "")
+	if err != nil || manifest != "" {
+		t.Errorf("expected missing release to render as empty, got %q, %v", manifest, err)
+	}
+
+	if label := baseLabel(&Config{Base: "origin/main"}, &chartSources{Release: "payments"}); label != "release payments" {
+		t.Errorf("unexpected base label %q", label)
+	}
+	if args := templateOptionsFrom(&Config{AgainstRelease: true}).Args(); strings.Join(args, " ") != "--no-hooks" {
+		t.Errorf("expected hooks to be excluded when diffing against a release, got %v", args)
+	}
+}
+
+func TestServerDryRun(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake kubectl script requires a POSIX shell")
+	}
+
+	binDir := t.TempDir()
+	logFile := filepath.Join(binDir, "calls.log")
+	writeTestFile(t, filepath.Join(binDir, "kubectl"), `#!/bin/sh
+input=$(cat)
+echo "$*" >> `+logFile+`
+case "$input" in
+  *privileged*)
+    echo 'Error from server (Forbidden): admission webhook "policy.example.com" denied the request:' >&2
+    echo '  privileged containers are not allowed' >&2
+    exit 1 ;;
+esac
+echo "deployment.apps/api"
+`)
+	if err := os.Chmod(filepath.Join(binDir, "kubectl"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := kubectlBinary
+	kubectlBinary = filepath.Join(binDir, "kubectl")
+	t.Cleanup(func() { kubectlBinary = previous })
+
+	base := `apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: unchanged
+---
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 1
+`
+	current := strings.Replace(base, "replicas: 1", "replicas: 2", 1) + `---
+apiVersion: apps/v1
+kind: DaemonSet
+metadata:
+  name: agent
+  namespace: kube-system
+spec:
+  privileged: true
+`
+
+	config := &Config{ServerDryRun: true, Output: outputJSON}
+	sources := &chartSources{BaseManifest: base, CurrentManifest: current}
+	var err error
+	sources.DryRunErrors, err = serverDryRun(base, current, "prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	calls, err := os.ReadFile(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedCalls := "apply --dry-run=server --filename - --output name --namespace prod\napply --dry-run=server --filename - --output name\n"
+	if string(calls) != expectedCalls {
+		t.Errorf("expected only changed resources to be submitted, got:\n%s", calls)
+	}
+
+	if err := diffChart(config, "app", sources); err != nil {
+		t.Fatal(err)
+	}
+	if config.dryRunRejected != 1 {
+		t.Errorf("expected one rejection, got %d", config.dryRunRejected)
+	}
+	for _, res := range config.results[0].Resources {
+		want := ""
+		if res.Kind == "DaemonSet" {
+			want = `Error from server (Forbidden): admission webhook "policy.example.com" denied the request: privileged containers are not allowed`
+		}
+		if res.DryRunError != want {
+			t.Errorf("unexpected dry run error for %s: %q", res.Kind, res.DryRunError)
+		}
+	}
+
+	for _, stderr := range []string{
+		"The connection to the server localhost:8080 was refused - did you specify the right host or port?",
+		"error: You must be logged in to the server (Unauthorized)",
+		`Error from server (Forbidden): error when creating "STDIN": deployments.apps "api" is forbidden: User "ci" cannot create resource "deployments"`,
+		`error: resource mapping not found for name: "api" namespace: "" from "STDIN": no matches for kind "Rollout" in version "argoproj.io/v1alpha1"`,
+	} {
+		writeTestFile(t, filepath.Join(binDir, "kubectl"), "#!/bin/sh\necho '"+stderr+"' >&2\nexit 1\n")
+		_, err := serverDryRun(base, current, "prod")
+		if err == nil || !strings.Contains(err.Error(), stderr) || errorReason(err) != reasonRenderFailed {
+			t.Errorf("expected %q to fail the chart instead of rejecting the resource, got %v", stderr, err)
+		}
+	}
+	if !serverRejection(`The Deployment "api" is invalid: spec.replicas: Invalid value: -1`) {
+		t.Error("expected a validation error to be a rejection")
+	}
+}
+
+func TestIdentityRules(t *testing.T) {
+	rulesPath := filepath.Join(t.TempDir(), "identity.yaml")
+	writeTestFile(t, rulesPath, `rules:
+  - kind: ExternalSecret
+    field: spec.target.name
+  - kind: Job
+    nameSuffix: "-[a-z0-9]{5}"
+`)
+	rules, err := loadIdentityRules(rulesPath)
+	if err != nil {
+		t.Fatalf("loadIdentityRules failed: %v", err)
+	}
+
+	base, err := parseManifest(`apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db-v1
+spec:
+  target:
+    name: db
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate-a1b2c
+spec:
+  image: app:1
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := parseManifest(`apiVersion: external-secrets.io/v1beta1
+kind: ExternalSecret
+metadata:
+  name: db-v2
+spec:
+  target:
+    name: db
+---
+apiVersion: batch/v1
+kind: Job
+metadata:
+  name: migrate-x9y8z
+spec:
+  image: app:2
+`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	changes := compareResources(base, current, rules)
+	if len(changes) != 2 || changes[0].Change != changeModified || changes[1].Change != changeModified {
+		t.Errorf("expected two modifications, got %+v", changes)
+	}
+	if len(compareChartResources(&Config{}, base, current)) != 3 {
+		t.Error("expected the ExternalSecret to be a delete and add pair without identity rules")
+	}
+
+	writeTestFile(t, rulesPath, "rules:\n  - kind: Job\n    field: metadata.name\n    nameSuffix: \"-[a-z]+\"\n")
+	if _, err := loadIdentityRules(rulesPath); err == nil {
+		t.Error("expected rule with both field and nameSuffix to be rejected")
+	}
+
+	externalSecret := func(name, data string) string {
+		return "---\napiVersion: external-secrets.io/v1beta1\nkind: ExternalSecret\nmetadata:\n  name: " + name + "\nspec:\n  target:\n    name: db\n  data: " + data + "\n"
+	}
+	base, err = parseManifest(externalSecret("db-primary", "a") + externalSecret("db-replica", "b"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err = parseManifest(externalSecret("db-primary", "a") + externalSecret("db-replica", "c"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	changes = compareResources(base, current, rules)
+	if len(changes) != 1 || changes[0].Change != changeModified || changes[0].Current.Name != "db-replica" {
+		t.Errorf("expected resources sharing an identity to be matched by name, got %+v", changes)
+	}
+}
+
+func TestNormalizeContent(t *testing.T) {
+	content := `kind: Deployment
+apiVersion: apps/v1
+metadata:
+  name: app
+  labels:
+    helm.sh/chart: app-1.2.3
+    app: web
+spec:
+  template:
+    metadata:
+      annotations:
+        checksum/config: abc123
+    spec:
+      containers:
+        - name: app
+          image: "app:1"
+          env:
+            - name: A
+              value: b
+`
+	normalized := normalizeContent(content, []string{
+		"metadata.labels.helm.sh/chart",
+		"spec.template.metadata.annotations.checksum/config",
+		"spec.template.spec.containers.*.env",
+	}, true)
+
+	expected := `apiVersion: apps/v1
+kind: Deployment
+metadata:
+  labels:
+    app: web
+  name: app
+spec:
+  template:
+    metadata:
+      annotations: {}
+    spec:
+      containers:
+        - image: "app:1"
+          name: app
+`
+	if normalized != expected {
+		t.Errorf("expected:\n%s\ngot:\n%s", expected, normalized)
+	}
+
+	if normalizeContent("not: [valid", nil, true) != "not: [valid" {
+		t.Error("expected invalid YAML to be left unchanged")
+	}
+}
+
+func TestNormalizeResourcesIgnoreHelmLabels(t *testing.T) {
+	resources, err := parseManifest("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  labels:\n    helm.sh/chart: app-0.1.0\n    app.kubernetes.io/version: 1.0.0\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalizeResources(&Config{IgnoreHelmLabels: true}, resources)
+
+	if strings.Contains(resources[0].Content, "helm.sh/chart") || strings.Contains(resources[0].Content, "app.kubernetes.io/version") {
+		t.Errorf("expected helm labels to be removed:\n%s", resources[0].Content)
+	}
+	if resources[0].Labels["helm.sh/chart"] != "app-0.1.0" {
+		t.Error("expected parsed labels to be left intact")
+	}
+}
+
+func TestMatchGeneratedNames(t *testing.T) {
+	configMap := func(name, value string) string {
+		return fmt.Sprintf("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: %s\ndata:\n  key: %s\n", name, value)
+	}
+	base, err := parseManifest(configMap("app-config-7f9c2b", "old") + "---\n" + configMap("app-server", "a") + "---\n" + configMap("cache-5d8f1a", "x") + "---\n" + configMap("cache-6e9a2b", "y"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := parseManifest(configMap("app-config-a41d3e", "new") + "---\n" + configMap("app-client", "a") + "---\n" + configMap("cache-7f0b3c", "z"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, change := range compareChartResources(&Config{}, base, current) {
+		got = append(got, resourceName(changedResource(change))+" "+change.Change)
+	}
+	sort.Strings(got)
+
+	expected := []string{
+		"ConfigMap app-client added",
+		"ConfigMap app-config-a41d3e modified",
+		"ConfigMap app-server removed",
+		"ConfigMap cache-5d8f1a removed",
+		"ConfigMap cache-6e9a2b removed",
+		"ConfigMap cache-7f0b3c added",
+	}
+	if strings.Join(got, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+
+	for _, change := range compareChartResources(&Config{ExactNames: true}, base, current) {
+		if change.Change == changeModified {
+			t.Errorf("expected --exact-names to leave %s unmatched", resourceName(changedResource(change)))
+		}
+	}
+}
+
+func TestRedactSecret(t *testing.T) {
+	secret := func(password string) string {
+		return "apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\ndata:\n  password: " + password + "\nstringData:\n  user: admin\n"
+	}
+
+	redacted := redactSecret(secret("c2VjcmV0"))
+	if strings.Contains(redacted, "c2VjcmV0") || strings.Contains(redacted, "admin") {
+		t.Errorf("expected secret values to be redacted:\n%s", redacted)
+	}
+	if !strings.Contains(redacted, "password: redacted-hmac:") || !strings.Contains(redacted, "name: db") {
+		t.Errorf("unexpected redacted secret:\n%s", redacted)
+	}
+	if redactSecret(secret("c2VjcmV0")) != redacted {
+		t.Error("expected redaction to be stable")
+	}
+	if redactSecret(secret("b3RoZXI=")) == redacted {
+		t.Error("expected changed values to produce a different hash")
+	}
+	unkeyed := sha256.Sum256([]byte("c2VjcmV0"))
+	if strings.Contains(redacted, hex.EncodeToString(unkeyed[:])[:16]) {
+		t.Error("expected the hash to depend on the run's redaction key")
+	}
+	if manifest.RedactSecret(secret("c2VjcmV0"), nil) != manifest.RedactSecret(secret("b3RoZXI="), nil) {
+		t.Error("expected redaction without a key to hide changes")
+	}
+
+	fingerprint := func(password string) string {
+		resources, err := parseManifest(secret(password))
+		if err != nil {
+			t.Fatal(err)
+		}
+		config := &Config{SortKeys: true}
+		secrets := secretFingerprintContents(config, resources)
+		normalizeResources(config, resources)
+		return changeFingerprint(resourceChange{Change: changeAdded, Current: &resources[0]}, secrets)
+	}
+	previousKey := redactionKey
+	first := fingerprint("c2VjcmV0")
+	redactionKey = []byte("another run")
+	defer func() { redactionKey = previousKey }()
+	if fingerprint("c2VjcmV0") != first {
+		t.Error("expected fingerprints to be stable across redaction keys")
+	}
+	if fingerprint("b3RoZXI=") == first {
+		t.Error("expected Secrets that differ in one data value to have different fingerprints")
+	}
+	t.Setenv(signingKeyEnv, "review key")
+	if fingerprint("c2VjcmV0") == first {
+		t.Error("expected the signing key to key the Secret value hashes in fingerprints")
+	}
+
+	resources, err := parseManifest(secret("c2VjcmV0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	normalizeResources(&Config{ShowSecrets: true}, resources)
+	if !strings.Contains(resources[0].Content, "c2VjcmV0") {
+		t.Error("expected --show-secrets to keep secret values")
+	}
+}
+
+func TestInventory(t *testing.T) {
+	manifest := "---\n# Source: app/templates/service.yaml\napiVersion: v1\nkind: Service\nmetadata:\n  name: app\n  namespace: prod\n"
+	config := &Config{Inventory: "inventory.csv", Output: outputJSON}
+	if err := diffChart(config, "app", &chartSources{BaseManifest: manifest, CurrentManifest: manifest}); err != nil {
+		t.Fatal(err)
+	}
+	if len(config.inventory) != 1 || config.inventory[0].Source != "app/templates/service.yaml" {
+		t.Fatalf("unexpected inventory %+v", config.inventory)
+	}
+
+	tmpDir := t.TempDir()
+	csvPath := filepath.Join(tmpDir, "inventory.csv")
+	if err := writeInventory(csvPath, config.inventory); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "chart,apiVersion,kind,namespace,name,source\napp,v1,Service,prod,app,app/templates/service.yaml\n"
+	if string(content) != expected {
+		t.Errorf("expected %q, got %q", expected, string(content))
+	}
+
+	jsonPath := filepath.Join(tmpDir, "inventory.json")
+	if err := writeInventory(jsonPath, config.inventory); err != nil {
+		t.Fatal(err)
+	}
+	content, err = os.ReadFile(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []inventoryItem
+	if err := json.Unmarshal(content, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Kind != "Service" || items[0].Namespace != "prod" {
+		t.Errorf("unexpected JSON inventory %+v", items)
+	}
+}
+
+func TestDetectChangedChartsNested(t *testing.T) {
+	repo := initTestRepo(t)
+	for _, dir := range []string{
+		"charts/simple",
+		"services/payments/api/chart",
+		"services/payments/api/chart/charts/common",
+		"services/search/indexer/chart",
+		"platform/ingress",
+	} {
+		writeTestFile(t, filepath.Join(repo, dir, "Chart.yaml"), "apiVersion: v2\nname: "+filepath.Base(dir)+"\n")
+		writeTestFile(t, filepath.Join(repo, dir, "values.yaml"), "replicas: 1\n")
+	}
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	start := runGit(t, repo, "rev-parse", "HEAD")
+
+	for _, dir := range []string{
+		"charts/simple",
+		"services/payments/api/chart/charts/common",
+		"services/search/indexer/chart",
+		"platform/ingress",
+	} {
+		writeTestFile(t, filepath.Join(repo, dir, "values.yaml"), "replicas: 2\n")
+	}
+	writeTestFile(t, filepath.Join(repo, "services", "README.md"), "docs\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "update")
+
+	chdir(t, repo)
+
+	config := &Config{Base: start, Current: "HEAD", ChartDir: "charts", ChartDirs: []string{"charts", "services"}}
+	charts, err := detectChangedCharts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "services/payments/api/chart,services/search/indexer/chart,simple"
+	if strings.Join(charts, ",") != expected {
+		t.Errorf("expected %s, got %v", expected, charts)
+	}
+
+	config = &Config{Base: start, Current: "HEAD", ChartDir: "."}
+	charts, err = detectChangedCharts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(charts) != 4 {
+		t.Errorf("expected all four top-level charts from the repository root, got %v", charts)
+	}
+
+	writeTestFile(t, filepath.Join(repo, "services", "billing", "chart", "Chart.yaml"), "apiVersion: v2\nname: billing\n")
+	writeTestFile(t, filepath.Join(repo, "services", "ledger", "chart", "Chart.yaml"), "apiVersion: v2\nname: ledger\n")
+	runGit(t, repo, "add", "services/ledger")
+	config = &Config{Base: "HEAD", Current: "HEAD", ChartDir: "charts", ChartDirs: []string{"charts", "services"}}
+	charts, err = detectChangedCharts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = "services/billing/chart,services/ledger/chart"
+	if strings.Join(charts, ",") != expected {
+		t.Errorf("expected untracked and staged charts %s, got %v", expected, charts)
+	}
+}
+
+func TestPrepareChartLifecycle(t *testing.T) {
+	repo := initTestRepo(t)
+	for _, name := range []string{"kept", "removed", "old-name"} {
+		writeTestFile(t, filepath.Join(repo, "charts", name, "Chart.yaml"), "apiVersion: v2\nname: "+name+"\nversion: 0.1.0\n")
+		writeTestFile(t, filepath.Join(repo, "charts", name, "values.yaml"), "replicas: 1\n")
+	}
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	start := runGit(t, repo, "rev-parse", "HEAD")
+
+	writeTestFile(t, filepath.Join(repo, "charts", "added", "Chart.yaml"), "apiVersion: v2\nname: added\ndescription: A brand new chart\ntype: application\nversion: 1.0.0\nappVersion: \"2.0\"\n")
+	runGit(t, repo, "rm", "-q", "-r", "charts/removed")
+	runGit(t, repo, "mv", "charts/old-name", "charts/new-name")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "lifecycle")
+
+	chdir(t, repo)
+
+	config := &Config{Base: start, Current: "HEAD", ChartDir: "charts"}
+	charts, err := detectChangedCharts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := "added,new-name,removed"; strings.Join(charts, ",") != expected {
+		t.Errorf("expected %s, got %v", expected, charts)
+	}
+
+	tests := []struct {
+		chart     string
+		lifecycle string
+		base      bool
+		current   bool
+	}{
+		{"kept", "", true, true},
+		{"added", "chart added", false, true},
+		{"removed", "chart removed", true, false},
+		{"new-name", "renamed from charts/old-name", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chart, func(t *testing.T) {
+			sources, err := prepareChart(config, tt.chart)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer cleanupChartSources(sources)
+			if sources.Lifecycle != tt.lifecycle {
+				t.Errorf("expected lifecycle %q, got %q", tt.lifecycle, sources.Lifecycle)
+			}
+			if (sources.Base != "") != tt.base || (sources.Current != "") != tt.current {
+				t.Errorf("unexpected sources base=%q current=%q", sources.Base, sources.Current)
+			}
+		})
+	}
+
+	if _, err := prepareChart(config, "missing"); err == nil {
+		t.Error("expected an error for a chart missing at both refs")
+	}
+}
+
+func TestRenameSource(t *testing.T) {
+	output := []byte("M\x00charts/other/values.yaml\x00R100\x00charts/old/templates/a.yaml\x00charts/new/templates/a.yaml\x00R097\x00charts/old/Chart.yaml\x00charts/new/Chart.yaml\x00R100\x00charts/my old/Chart.yaml\x00charts/nüe chart/Chart.yaml\x00")
+	if got := renameSource(output, "charts/new"); got != "charts/old" {
+		t.Errorf("expected charts/old, got %q", got)
+	}
+	if got := renameSource(output, "charts/nüe chart"); got != "charts/my old" {
+		t.Errorf("expected charts/my old, got %q", got)
+	}
+	if got := renameSource(output, "charts/other"); got != "" {
+		t.Errorf("expected no rename, got %q", got)
+	}
+}
+
+func TestInjectOwnership(t *testing.T) {
+	res := resource{
+		Kind:    "ConfigMap",
+		Name:    "app",
+		Labels:  map[string]string{"app": "web"},
+		Content: "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  labels:\n    app: web\n    app.kubernetes.io/managed-by: Tiller\n",
+	}
+	injectOwnership(&res, "web", "prod")
+
+	expected := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n  labels:\n    app: web\n    app.kubernetes.io/managed-by: Helm\n  annotations:\n    meta.helm.sh/release-name: web\n    meta.helm.sh/release-namespace: prod\n"
+	if res.Content != expected {
+		t.Errorf("unexpected content:\n%s", res.Content)
+	}
+	if res.Labels["app.kubernetes.io/managed-by"] != "Helm" || res.Annotations["meta.helm.sh/release-name"] != "web" {
+		t.Errorf("expected labels and annotations maps to be updated, got %v %v", res.Labels, res.Annotations)
+	}
+}
+
+func TestRepoConfig(t *testing.T) {
+	dir := t.TempDir()
+	configPath := filepath.Join(dir, repoConfigFileName)
+	writeTestFile(t, configPath, `values: [values/common.yaml]
+set: [global.env=ci]
+namespace: apps
+exclude: [legacy-*]
+charts:
+  payments:
+    values: [values/payments.yaml]
+    set: [replicas=2]
+    release-name: payments-prod
+    namespace: payments
+`)
+
+	cfg, err := loadRepoConfig(configPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	absDir, _ := filepath.Abs(dir)
+	config := &Config{repoConfig: cfg}
+
+	settings := chartSettings(config, "payments", "charts/payments")
+	if len(settings.Values) != 1 || settings.Values[0] != filepath.Join(absDir, "values", "payments.yaml") {
+		t.Errorf("expected chart values resolved relative to the config file, got %v", settings.Values)
+	}
+	if strings.Join(settings.Set, ",") != "global.env=ci,replicas=2" {
+		t.Errorf("expected repo and chart set values, got %v", settings.Set)
+	}
+	if settings.ReleaseName != "payments-prod" || settings.Namespace != "payments" {
+		t.Errorf("unexpected release settings: %+v", settings)
+	}
+
+	settings = chartSettings(config, "search", "charts/search")
+	if settings.Values[0] != filepath.Join(absDir, "values", "common.yaml") || settings.Namespace != "apps" {
+		t.Errorf("expected repo defaults, got %+v", settings)
+	}
+
+	config.ValuesFiles = "cli.yaml"
+	config.ReleaseName = "cli-release"
+	settings = chartSettings(config, "payments", "charts/payments")
+	if strings.Join(settings.Values, ",") != "cli.yaml" {
+		t.Errorf("expected --values to win, got %v", settings.Values)
+	}
+	if opts := chartTemplateOptions(config, &chartSources{ReleaseName: settings.ReleaseName, Namespace: settings.Namespace}); opts.ReleaseName != "cli-release" || opts.Namespace != "payments" {
+		t.Errorf("expected --release-name to win, got %+v", opts)
+	}
+
+	charts := excludeCharts([]string{"legacy-api", "payments"}, cfg)
+	if strings.Join(charts, ",") != "payments" {
+		t.Errorf("expected legacy chart to be excluded, got %v", charts)
+	}
+
+	writeTestFile(t, configPath, "chart:\n  payments: {}\n")
+	if _, err := loadRepoConfig(configPath); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+
+	writeTestFile(t, configPath, "teams:\n  payments: {namespaces: [\"payments-[\"]}\n")
+	if _, err := loadRepoConfig(configPath); err == nil || !strings.Contains(err.Error(), `team payments: invalid pattern "payments-["`) {
+		t.Errorf("expected an error for an invalid team pattern, got %v", err)
+	}
+	writeTestFile(t, configPath, "teams:\n  unassigned: {charts: [legacy-*]}\n")
+	if _, err := loadRepoConfig(configPath); err == nil || !strings.Contains(err.Error(), `team name "unassigned" is reserved`) {
+		t.Errorf("expected an error for the reserved team name, got %v", err)
+	}
+}
+
+func TestRiskyFunctionChanges(t *testing.T) {
+	base := t.TempDir()
+	current := t.TempDir()
+	writeTestFile(t, filepath.Join(base, "templates", "secret.yaml"), "password: {{ randAlphaNum 16 }}\n")
+	writeTestFile(t, filepath.Join(current, "templates", "secret.yaml"), "password: {{ randAlphaNum 16 }}\n{{- $existing := lookup \"v1\" \"Secret\" .Release.Namespace \"db\" }}\n")
+	writeTestFile(t, filepath.Join(current, "templates", "job.yaml"), "started: {{ now | date \"2006\" }}\nhost: {{ .Values.now }}\nnote: lookup outside actions\n")
+
+	changes, err := riskyFunctionChanges(base, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"new lookup call in templates/secret.yaml (reads cluster state)",
+		"new now call in templates/job.yaml (depends on the current time)",
+	}
+	if strings.Join(changes, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("unexpected changes:\n%s", strings.Join(changes, "\n"))
+	}
+
+	changes, err = riskyFunctionChanges("", current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 3 {
+		t.Errorf("expected all uses to be new for an added chart, got %v", changes)
+	}
+}
+
+func TestDependencyCache(t *testing.T) {
+	cacheDir := t.TempDir()
+	built := t.TempDir()
+	writeTestFile(t, filepath.Join(built, "Chart.lock"), "dependencies:\n- name: redis\n  version: 18.1.0\n")
+	writeTestFile(t, filepath.Join(built, "charts", "redis-18.1.0.tgz"), "archive")
+
+	deps := []chartDependency{{Name: "redis", Version: "18.1.0", Repository: "https://charts.example.com"}}
+	key, ok := dependencyCacheKey(built, deps)
+	if !ok {
+		t.Fatal("expected remote dependencies with a Chart.lock to be cacheable")
+	}
+	if _, ok := dependencyCacheKey(built, append(deps, chartDependency{Name: "common", Repository: "file://../common"})); ok {
+		t.Error("expected file:// dependencies not to be cacheable")
+	}
+	if _, ok := dependencyCacheKey(t.TempDir(), deps); ok {
+		t.Error("expected charts without Chart.lock not to be cacheable")
+	}
+	if bumped, _ := dependencyCacheKey(built, []chartDependency{{Name: "redis", Version: "18.2.0", Repository: "https://charts.example.com"}}); bumped == key {
+		t.Error("expected a dependency change in Chart.yaml to change the cache key despite an unchanged Chart.lock")
+	}
+
+	cachePath := filepath.Join(cacheDir, key)
+	if restoreDependencyCache(cachePath, []string{t.TempDir()}) {
+		t.Fatal("expected an empty cache not to restore anything")
+	}
+	if err := storeDependencyCache(cachePath, filepath.Join(built, "charts")); err != nil {
+		t.Fatal(err)
+	}
+
+	targets := []string{t.TempDir(), t.TempDir()}
+	writeTestFile(t, filepath.Join(targets[0], "charts", "redis-17.0.0.tgz"), "stale")
+	if err := buildDependencyGroup(targets, cachePath); err != nil {
+		t.Fatalf("expected cached dependencies to be restored without running helm: %v", err)
+	}
+	for _, target := range targets {
+		content, err := os.ReadFile(filepath.Join(target, "charts", "redis-18.1.0.tgz"))
+		if err != nil || string(content) != "archive" {
+			t.Errorf("expected archive to be restored into %s, got %q (%v)", target, content, err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(targets[0], "charts", "redis-17.0.0.tgz")); !os.IsNotExist(err) {
+		t.Errorf("expected stale archive to be removed before restoring, got %v", err)
+	}
+
+	if dir := dependencyCacheDir(&Config{NoCache: true}); dir != "" {
+		t.Errorf("expected --no-cache to disable the cache, got %s", dir)
+	}
+}
+
+func TestResolveTool(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake tools require a POSIX shell")
+	}
+
+	binDir := t.TempDir()
+	writeTestFile(t, filepath.Join(binDir, "helm"), "#!/bin/sh\necho v3.19.0\n")
+	writeTestFile(t, filepath.Join(binDir, "broken-helm"), "#!/bin/sh\necho 'cannot execute binary file' >&2\nexit 126\n")
+	for _, name := range []string{"helm", "broken-helm"} {
+		if err := os.Chmod(filepath.Join(binDir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	t.Setenv("PATH", binDir)
+
+	path, err := resolveTool("helm", "--helm-binary", "", "version")
+	if err != nil || path != filepath.Join(binDir, "helm") {
+		t.Errorf("expected helm from PATH, got %q (%v)", path, err)
+	}
+
+	if _, err := resolveTool("kubectl", "--kubectl-binary", "", "version"); err == nil || !strings.Contains(err.Error(), "--kubectl-binary") || !strings.Contains(err.Error(), binDir) {
+		t.Errorf("expected a PATH diagnostic mentioning the override flag, got %v", err)
+	}
+
+	if _, err := resolveTool("helm", "--helm-binary", filepath.Join(binDir, "missing"), "version"); err == nil || !strings.Contains(err.Error(), "--helm-binary") {
+		t.Errorf("expected an error for a missing override, got %v", err)
+	}
+
+	if _, err := resolveTool("helm", "--helm-binary", "broken-helm", "version"); err == nil || !strings.Contains(err.Error(), runtime.GOARCH) {
+		t.Errorf("expected a platform hint for a binary that fails to run, got %v", err)
+	}
+}
+
+type fakeVCS struct {
+	files    map[string]string
+	archived []string
+}
+
+func (f *fakeVCS) archive(ref string, paths []string) ([]byte, error) {
+	f.archived = append(f.archived, paths...)
+
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	for name, content := range f.files {
+		for _, p := range paths {
+			if strings.HasPrefix(name, p+"/") {
+				if err := writer.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+					return nil, err
+				}
+				if _, err := writer.Write([]byte(content)); err != nil {
+					return nil, err
+				}
+				break
+			}
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (f *fakeVCS) show(ref, path string) ([]byte, error) {
+	content, ok := f.files[path]
+	if !ok {
+		return nil, fmt.Errorf("%s does not exist at %s", path, ref)
+	}
+	return []byte(content), nil
+}
+
+func (f *fakeVCS) exists(ref, path string) (bool, error) {
+	_, ok := f.files[path]
+	return ok, nil
+}
+
+func TestExtractChartAtRefWithFakeVCS(t *testing.T) {
+	fake := &fakeVCS{files: map[string]string{
+		"charts/app/Chart.yaml":               "apiVersion: v2\nname: app\ndependencies:\n  - name: common\n    repository: file://../common\n",
+		"charts/app/templates/configmap.yaml": "kind: ConfigMap\n",
+		"charts/common/Chart.yaml":            "apiVersion: v2\nname: common\n",
+	}}
+	previous := repoVCS
+	repoVCS = fake
+	t.Cleanup(func() { repoVCS = previous })
+
+	exists, err := chartExistsAtRef("charts/app", "main")
+	if err != nil || !exists {
+		t.Fatalf("expected chart to exist, got %v (%v)", exists, err)
+	}
+
+	chartPath, cleanup, err := extractChartAtRef("charts/app", "main")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanup()
+
+	if archived := filepath.ToSlash(strings.Join(fake.archived, ",")); archived != "charts/app,charts/common" {
+		t.Errorf("expected chart and file:// dependency to be archived, got %v", fake.archived)
+	}
+	if _, err := os.Stat(filepath.Join(chartPath, "templates", "configmap.yaml")); err != nil {
+		t.Errorf("expected template to be extracted: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(chartPath, "..", "common", "Chart.yaml")); err != nil {
+		t.Errorf("expected dependency to be extracted next to the chart: %v", err)
+	}
+}
+
+func TestExtractTarRejectsEscapingPaths(t *testing.T) {
+	var buf bytes.Buffer
+	writer := tar.NewWriter(&buf)
+	if err := writer.WriteHeader(&tar.Header{Name: "../outside.yaml", Mode: 0644, Typeflag: tar.TypeReg}); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	dest := t.TempDir()
+	if err := extractTar(&buf, dest); err == nil {
+		t.Error("expected an error for an entry outside the destination")
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dest), "outside.yaml")); err == nil {
+		t.Error("expected nothing to be written outside the destination")
+	}
+}
+
+func TestDetectChangedChartsUnusualNames(t *testing.T) {
+	repo := initTestRepo(t)
+	chartDir := filepath.Join(repo, "charts", "zahlungs dienst")
+	writeTestFile(t, filepath.Join(chartDir, "Chart.yaml"), "apiVersion: v2\nname: zahlungs-dienst\n")
+	writeTestFile(t, filepath.Join(chartDir, "values größe.yaml"), "replicas: 1\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	start := runGit(t, repo, "rev-parse", "HEAD")
+
+	writeTestFile(t, filepath.Join(chartDir, "values größe.yaml"), "replicas: 2\n")
+	runGit(t, repo, "commit", "-q", "-am", "update")
+
+	chdir(t, repo)
+
+	for _, config := range []*Config{
+		{Base: start, Current: "HEAD", ChartDir: "charts"},
+		{Since: start, Current: "HEAD", ChartDir: "charts"},
+	} {
+		charts, err := detectChangedCharts(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(charts, ",") != "zahlungs dienst" {
+			t.Errorf("expected the chart with a space in its name, got %q", charts)
+		}
+	}
+}
+
+func TestChartExcludes(t *testing.T) {
+	repo := initTestRepo(t)
+	chartDir := filepath.Join(repo, "charts", "app")
+	writeTestFile(t, filepath.Join(chartDir, "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 0.1.0\n")
+	writeTestFile(t, filepath.Join(chartDir, "ci", "default-values.yaml"), "replicas: 1\n")
+	writeTestFile(t, filepath.Join(chartDir, "examples", "basic.yaml"), "replicas: 1\n")
+	writeTestFile(t, filepath.Join(chartDir, "templates", "ci", "configmap.yaml"), "kind: ConfigMap\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	start := runGit(t, repo, "rev-parse", "HEAD")
+
+	writeTestFile(t, filepath.Join(chartDir, "ci", "default-values.yaml"), "replicas: 2\n")
+	writeTestFile(t, filepath.Join(chartDir, "examples", "basic.yaml"), "replicas: 2\n")
+	runGit(t, repo, "commit", "-q", "-am", "fixtures")
+
+	chdir(t, repo)
+
+	config := &Config{Base: start, Current: "HEAD", ChartDir: "charts", ChartExcludes: defaultChartExcludes}
+	charts, err := detectChangedCharts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(charts) != 0 {
+		t.Errorf("expected fixture-only changes to be ignored, got %v", charts)
+	}
+
+	config.ChartExcludes = ""
+	charts, err = detectChangedCharts(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(charts, ",") != "app" {
+		t.Errorf("expected the chart to be detected without excludes, got %v", charts)
+	}
+
+	config.ChartExcludes = defaultChartExcludes
+	sources, err := prepareChart(config, "app")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cleanupChartSources(sources)
+
+	for _, path := range []string{sources.Base, sources.Current} {
+		for _, dir := range []string{"ci", "examples"} {
+			if _, err := os.Stat(filepath.Join(path, dir)); err == nil {
+				t.Errorf("expected %s to be excluded from %s", dir, path)
+			}
+		}
+		if _, err := os.Stat(filepath.Join(path, "templates", "ci", "configmap.yaml")); err != nil {
+			t.Errorf("expected nested directories to be kept: %v", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(chartDir, "ci", "default-values.yaml")); err != nil {
+		t.Errorf("expected the working tree to be left untouched: %v", err)
+	}
+
+	writeTestFile(t, filepath.Join(chartDir, "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 0.1.0\nannotations:\n  helm-git-diff.io/extra-values: ci/default-values.yaml\n")
+	runGit(t, repo, "commit", "-q", "-am", "use ci values")
+	annotated := runGit(t, repo, "rev-parse", "HEAD")
+	writeTestFile(t, filepath.Join(chartDir, "ci", "default-values.yaml"), "replicas: 3\n")
+	runGit(t, repo, "commit", "-q", "-am", "tune ci values")
+	charts, err = detectChangedCharts(&Config{Base: annotated, Current: "HEAD", ChartDir: "charts", ChartExcludes: defaultChartExcludes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(charts, ",") != "app" {
+		t.Errorf("expected a change to an extra values file to be detected, got %v", charts)
+	}
+
+	keep := chartValuesReferences(map[string]string{annotationExtraValues: "ci/default-values.yaml"}, nil)
+	if !referencedChartFile(config, "charts/app/ci/default-values.yaml", "charts/app", start) || referencedChartFile(config, "charts/app/ci/other.yaml", "charts/app", start) {
+		t.Error("expected only extra values files to count as referenced")
+	}
+	copyDir := t.TempDir()
+	writeTestFile(t, filepath.Join(copyDir, "ci", "default-values.yaml"), "replicas: 2\n")
+	writeTestFile(t, filepath.Join(copyDir, "ci", "other-values.yaml"), "replicas: 3\n")
+	if err := removeExcludedDir(copyDir, "ci", keep); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(copyDir, "ci", "default-values.yaml")); err != nil {
+		t.Errorf("expected the extra values file to be kept: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(copyDir, "ci", "other-values.yaml")); err == nil {
+		t.Error("expected unreferenced fixtures to be removed")
+	}
+}
+
+func TestSummaryMode(t *testing.T) {
+	base := `---
+# Source: app/templates/deploy.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: api
+spec:
+  replicas: 1
+---
+# Source: app/templates/deploy.yaml
+apiVersion: apps/v1
+kind: Deployment
+metadata:
+  name: worker
+spec:
+  replicas: 1
+`
+	current := strings.ReplaceAll(base, "replicas: 1", "replicas: 2") + `---
+# Source: app/templates/configmap.yaml
+apiVersion: v1
+kind: ConfigMap
+metadata:
+  name: settings
+`
+
+	config := &Config{Summary: true, Output: outputJSON, FailOnDiff: true}
+	sources := &chartSources{BaseManifest: base, CurrentManifest: current}
+	if err := diffChart(config, "app", sources); err != nil {
+		t.Fatal(err)
+	}
+
+	result := config.results[0]
+	if len(result.Resources) != 3 {
+		t.Errorf("expected per-resource entries in summary mode, got %d", len(result.Resources))
+	}
+	if got := formatKindCounts(result.Kinds); got != "ConfigMap: 1 added; Deployment: 2 modified" {
+		t.Errorf("unexpected kind counts %q", got)
+	}
+	if !config.hasDifferences {
+		t.Error("expected --fail-on-diff to see differences in summary mode")
+	}
+
+	totals := resourceTotals(config.results)
+	if got := formatTotals(totals, config.changed); got != "1 added, 2 modified in 1 chart" {
+		t.Errorf("unexpected totals %q", got)
+	}
+	if got := formatTotals(changeTotals{}, 0); got != "no resource changes" {
+		t.Errorf("unexpected empty totals %q", got)
+	}
+
+	var out bytes.Buffer
+	if err := writeReport(config, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), `"kinds": [`) || !strings.Contains(out.String(), `"totals": {`) {
+		t.Errorf("expected kinds and totals in JSON output, got %s", out.String())
+	}
+	var decoded report
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, res := range decoded.Charts[0].Resources {
+		if res.Diff == "" {
+			t.Errorf("expected a diff for %s/%s in summary JSON output", res.Kind, res.Name)
+		}
+		names = append(names, res.Kind+"/"+res.Name)
+	}
+	if got := strings.Join(names, ","); got != "ConfigMap/settings,Deployment/api,Deployment/worker" {
+		t.Errorf("unexpected resources in summary JSON output %q", got)
+	}
+
+	markdown := formatMarkdownReport(report{Charts: config.results, Changed: 1, summary: true})
+	if !strings.Contains(markdown, "- Deployment: 2 modified\n") || strings.Contains(markdown, "```diff") {
+		t.Errorf("expected kind counts in place of diffs in markdown output, got %s", markdown)
+	}
+}
+
+func TestPostComment(t *testing.T) {
+	var comments []postedComment
+	var methods []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		methods = append(methods, r.Method+" "+r.URL.Path)
+		switch r.Method {
+		case http.MethodGet:
+			_ = json.NewEncoder(w).Encode(append([]postedComment{{ID: 1, Body: "looks good"}}, comments...))
+		case http.MethodPost, http.MethodPatch:
+			var payload postedComment
+			if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			if r.Method == http.MethodPost {
+				comments = append(comments, postedComment{ID: 42, Body: payload.Body})
+			} else {
+				comments[0].Body = payload.Body
+			}
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	t.Setenv("GITHUB_TOKEN", "secret")
+	t.Setenv("GITHUB_REPOSITORY", "org/charts")
+	t.Setenv("GITHUB_API_URL", server.URL)
+	t.Setenv("GITHUB_EVENT_PATH", "")
+	t.Setenv("GITHUB_REF", "refs/pull/7/merge")
+
+	config := &Config{Comment: commentGitHub}
+	if err := postComment(config); err != nil {
+		t.Fatal(err)
+	}
+	if len(comments) != 0 {
+		t.Errorf("expected no comment for a change-free first run, got %v", comments)
+	}
+
+	config.changed = 1
+	config.results = []chartResult{{Chart: "app", Status: statusChanged, Summary: "1 modified", Resources: []resourceResult{{Kind: "ConfigMap", Name: "app", Change: changeModified, Diff: "-a\n+b\n"}}}}
+	for range 2 {
+		if err := postComment(config); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expected := "GET /repos/org/charts/issues/7/comments,GET /repos/org/charts/issues/7/comments,POST /repos/org/charts/issues/7/comments,GET /repos/org/charts/issues/7/comments,PATCH /repos/org/charts/issues/comments/42"
+	if strings.Join(methods, ",") != expected {
+		t.Errorf("unexpected requests:\n%s", strings.Join(methods, "\n"))
+	}
+	if len(comments) != 1 || !strings.HasPrefix(comments[0].Body, commentMarker) || !strings.Contains(comments[0].Body, "<details>") {
+		t.Errorf("expected a single sticky comment, got %v", comments)
+	}
+}
+
+func TestSinceLastRun(t *testing.T) {
+	parse := func(manifest string) []resource {
+		resources, err := parseManifest(manifest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return resources
+	}
+	base := parse("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\ndata:\n  key: one\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\ndata:\n  key: one\n")
+	first := parse("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\ndata:\n  key: two\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\ndata:\n  key: two\n")
+	second := parse("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\ndata:\n  key: two\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\ndata:\n  key: three\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: c\n")
+
+	config := &Config{}
+	shown, notes := changesSinceLastRun(config, "app", compareResources(base, first, nil), nil)
+	if len(shown) != 2 || len(notes) != 0 {
+		t.Errorf("expected everything to be shown without a previous run, got %d %v", len(shown), notes)
+	}
+
+	runFile := filepath.Join(t.TempDir(), "run.json")
+	if err := writeRunFingerprints(runFile, config.fingerprints); err != nil {
+		t.Fatal(err)
+	}
+	config = &Config{SinceLastRun: runFile}
+	previous, err := loadPreviousRun(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.previousRun = previous
+
+	shown, notes = changesSinceLastRun(config, "app", compareResources(base, second, nil), nil)
+	var keys []string
+	for _, change := range shown {
+		keys = append(keys, change.Key)
+	}
+	if strings.Join(keys, ",") != "v1/ConfigMap//b,v1/ConfigMap//c" {
+		t.Errorf("expected only new or updated changes, got %v", keys)
+	}
+	if strings.Join(notes, "\n") != "since last run: 2 new or updated, 1 already reviewed" {
+		t.Errorf("unexpected notes %v", notes)
+	}
+
+	shown, notes = changesSinceLastRun(config, "app", compareResources(base, parse("apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\ndata:\n  key: two\n---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: b\ndata:\n  key: one\n"), nil), nil)
+	if len(shown) != 0 || notes[len(notes)-1] != "since last run: v1/ConfigMap//b no longer changed" {
+		t.Errorf("expected a reverted change to be reported, got %d %v", len(shown), notes)
+	}
+
+	unchanged := "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: a\n"
+	config.Output = outputJSON
+	if err := diffChart(config, "app", &chartSources{BaseManifest: unchanged, CurrentManifest: unchanged}); err != nil {
+		t.Fatal(err)
+	}
+	result := config.results[len(config.results)-1]
+	if result.Status != statusUnchanged || strings.Join(result.Notes, "\n") != "since last run: v1/ConfigMap//a no longer changed\nsince last run: v1/ConfigMap//b no longer changed" {
+		t.Errorf("expected reviewed changes of a now unchanged chart to be reported, got %+v", result)
+	}
+	if fingerprints, ok := config.fingerprints["app"]; !ok || len(fingerprints) != 0 {
+		t.Errorf("expected the unchanged chart to be recorded without changes, got %v", config.fingerprints)
+	}
+
+	marker, err := runMarker(runFingerprints{"app": {"v1/ConfigMap//a": "abc"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode([]postedComment{{ID: 3, Body: commentMarker + "\n## helm-git-diff\n" + marker}})
+	}))
+	defer server.Close()
+	t.Setenv("GITHUB_TOKEN", "secret")
+	t.Setenv("GITHUB_REPOSITORY", "org/charts")
+	t.Setenv("GITHUB_API_URL", server.URL)
+	t.Setenv("GITHUB_EVENT_PATH", "")
+	t.Setenv("GITHUB_REF", "refs/pull/7/merge")
+
+	previous, err = loadPreviousRun(&Config{SinceLastRun: lastRunComment, Comment: commentGitHub})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if previous["app"]["v1/ConfigMap//a"] != "abc" {
+		t.Errorf("expected fingerprints from the comment, got %v", previous)
+	}
+}
+
+func TestTrailer(t *testing.T) {
+	repo := initTestRepo(t)
+	writeTestFile(t, filepath.Join(repo, "README.md"), "docs\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "initial")
+	head := runGit(t, repo, "rev-parse", "HEAD")
+	chdir(t, repo)
+	t.Setenv(signingKeyEnv, "review-key")
+
+	config := &Config{Base: "HEAD", Current: "HEAD", fingerprints: runFingerprints{
+		"api":      {"v1/ConfigMap//api": "1111"},
+		"payments": {"apps/v1/Deployment//payments": "2222", "v1/Service//payments": "3333"},
+		"web":      {},
+	}}
+	trailerFile := filepath.Join(t.TempDir(), "trailer.txt")
+	config.Trailer = trailerFile
+	if err := writeTrailer(config); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(trailerFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	if len(lines) != 5 || lines[0] != "Helm-Git-Diff-Base: "+head || !strings.HasPrefix(lines[2], "Helm-Git-Diff-Chart: api sha256:") || !strings.HasPrefix(lines[4], "Helm-Git-Diff-Signature: hmac-sha256:") {
+		t.Fatalf("unexpected trailer:\n%s", content)
+	}
+
+	config.VerifyTrailer = trailerFile
+	if err := verifyTrailer(config); err != nil {
+		t.Errorf("expected the reviewed diff to verify: %v", err)
+	}
+
+	runGit(t, repo, "commit", "-q", "--allow-empty", "-m", "deploy\n\n"+string(content))
+	config.VerifyTrailer = "HEAD"
+	if err := verifyTrailer(config); err == nil || !strings.Contains(err.Error(), "the review covers "+shortCommit(head)+".."+shortCommit(head)+", but this run compares") {
+		t.Errorf("expected a review of other commits to be rejected, got %v", err)
+	}
+	config.Base, config.Current = head, head
+	if err := verifyTrailer(config); err != nil {
+		t.Errorf("expected the trailer to be read from the commit message: %v", err)
+	}
+
+	config.VerifyTrailer = trailerFile
+	reviewedFingerprints := config.fingerprints
+	config.fingerprints = runFingerprints{"api": {}, "payments": {}, "web": {}}
+	if err := verifyTrailer(config); err == nil || !strings.Contains(err.Error(), "api: reviewed changes are missing") || !strings.Contains(err.Error(), "payments: reviewed changes are missing") {
+		t.Errorf("expected charts that no longer change to fail verification, got %v", err)
+	}
+	config.fingerprints = reviewedFingerprints
+
+	config.VerifyTrailer = trailerFile
+	config.fingerprints["payments"]["v1/Service//payments"] = "4444"
+	config.fingerprints["web"] = map[string]string{"v1/Service//web": "5555"}
+	err = verifyTrailer(config)
+	if err == nil || !strings.Contains(err.Error(), "payments: diff differs from the reviewed one") || !strings.Contains(err.Error(), "web: changes were not reviewed") {
+		t.Errorf("expected changed and unreviewed charts to be reported, got %v", err)
+	}
+
+	tampered := strings.Replace(string(content), "Chart: api sha256:", "Chart: api sha256:0", 1)
+	writeTestFile(t, trailerFile, tampered)
+	if err := verifyTrailer(config); err == nil || !strings.Contains(err.Error(), "signature does not match") {
+		t.Errorf("expected a signature error for a modified block, got %v", err)
+	}
+
+	if err := run(&Config{Trailer: "-", Output: outputJSON}); err == nil || !strings.Contains(err.Error(), "--trailer - requires text output") {
+		t.Errorf("expected --trailer - to be rejected with JSON output, got %v", err)
+	}
+}
+
+func TestCommentBodyTruncation(t *testing.T) {
+	large := strings.Repeat("+  key: value\n", 500)
+	r := report{Changed: 1, Charts: []chartResult{{Chart: "app", Status: statusChanged, Summary: "2 modified", Resources: []resourceResult{
+		{Kind: "ConfigMap", Name: "small", Change: changeModified, Diff: "-a\n+b\n"},
+		{Kind: "ConfigMap", Name: "large", Change: changeModified, Diff: large},
+	}}}}
+
+	body := commentBody(r, 4000, "https://ci.example.com/run/1")
+	if len(body) > 4000 {
+		t.Errorf("expected the body to fit in 4000 bytes, got %d", len(body))
+	}
+	if !strings.Contains(body, "more lines truncated") || !strings.Contains(body, "[CI log](https://ci.example.com/run/1)") {
+		t.Errorf("expected a truncation marker and log link:\n%s", body)
+	}
+	if !strings.Contains(body, "-a\n+b\n") {
+		t.Errorf("expected small diffs to be kept intact:\n%s", body)
+	}
+	if len(r.Charts[0].Resources[1].Diff) != len(large) || len(r.Charts[0].Notes) != 0 {
+		t.Error("expected the report to be left unmodified")
+	}
+
+	if body := commentBody(r, 1<<20, ""); strings.Contains(body, "truncated") {
+		t.Errorf("expected no truncation when the body fits:\n%s", body)
+	}
+
+	var many []resourceResult
+	for i := range 40 {
+		many = append(many, resourceResult{Kind: "ConfigMap", Name: fmt.Sprintf("config-%d", i), Change: changeModified, Diff: strings.Repeat("+  key: value\n", 20)})
+	}
+	r = report{Changed: 3, Charts: []chartResult{
+		{Chart: "app", Status: statusChanged, Summary: "40 modified", Resources: many},
+		{Chart: "web", Status: statusChanged, Summary: "40 modified", Resources: many},
+		{Chart: "api", Status: statusChanged, Summary: "40 modified", Resources: many},
+	}}
+	for _, size := range []int{1000, 3000, 6000} {
+		body := commentBody(r, size, "")
+		if len(body) > size {
+			t.Errorf("expected the body to fit in %d bytes, got %d", size, len(body))
+		}
+		if strings.Count(body, "```")%2 != 0 {
+			t.Errorf("expected the body not to end inside a diff block:\n%s", body)
+		}
+		if !strings.Contains(body, "<code>app</code>") || !strings.Contains(body, "diff truncated") {
+			t.Errorf("expected the first chart to be kept with a truncation note:\n%s", body)
+		}
+	}
+	if body := commentBody(r, 1000, ""); !strings.Contains(body, "_2 more charts omitted, run helm-git-diff locally for the full output_") {
+		t.Errorf("expected omitted charts to be reported:\n%s", body)
+	}
+}
+
+func TestOutputStreams(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	s := &outputStreams{stderr: &stderr}
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			section := s.section(&stdout)
+			for line := range 50 {
+				fmt.Fprintf(section, "chart-%02d line %02d\n", i, line)
+				if line%10 == 0 {
+					s.diagnosticf("Warning: chart-%02d step %d", i, line)
+				}
+			}
+			section.commit()
+		}()
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSuffix(stdout.String(), "\n"), "\n")
+	if len(lines) != 20*50 {
+		t.Fatalf("got %d stdout lines, want %d", len(lines), 20*50)
+	}
+	for start := 0; start < len(lines); start += 50 {
+		chart := strings.Fields(lines[start])[0]
+		for line := range 50 {
+			if want := fmt.Sprintf("%s line %02d", chart, line); lines[start+line] != want {
+				t.Fatalf("stdout line %d = %q, want %q (sections interleaved)", start+line, lines[start+line], want)
+			}
+		}
+	}
+
+	diagnostics := strings.Split(strings.TrimSuffix(stderr.String(), "\n"), "\n")
+	if len(diagnostics) != 20*5 {
+		t.Fatalf("got %d stderr lines, want %d", len(diagnostics), 20*5)
+	}
+	for _, line := range diagnostics {
+		if !regexp.MustCompile(`^Warning: chart-\d{2} step \d+$`).MatchString(line) {
+			t.Errorf("stderr line %q is not a whole diagnostic", line)
+		}
+	}
+	if strings.Contains(stdout.String(), "Warning:") {
+		t.Error("diagnostics leaked into stdout")
+	}
+}
+
+func TestDependencyTemplateChanges(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake helm script requires a POSIX shell")
+	}
+
+	binDir := t.TempDir()
+	writeTestFile(t, filepath.Join(binDir, "helm"), `#!/bin/sh
+[ "$1" = template ] || exit 0
+for arg in "$@"; do
+  if [ -f "$arg" ] && grep -q 'fail: true' "$arg"; then
+    echo "Error: template: redis/templates/statefulset.yaml: fail" >&2
+    exit 1
+  fi
+done
+name=$(grep '^name:' "$3/Chart.yaml" | awk '{print $2}')
+for f in "$3"/templates/*.yaml; do
+  [ -e "$f" ] || continue
+  echo "---"
+  echo "# Source: $name/templates/$(basename "$f")"
+  cat "$f"
+done
+`)
+	if err := os.Chmod(filepath.Join(binDir, "helm"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := helmBinary
+	helmBinary = filepath.Join(binDir, "helm")
+	t.Cleanup(func() { helmBinary = previous })
+
+	writeChart := func(dir, version string, templates map[string]string) {
+		writeTestFile(t, filepath.Join(dir, "Chart.yaml"), "apiVersion: v2\nname: umbrella\nversion: "+version+"\nappVersion: \""+version+"\"\ndependencies:\n  - name: redis\n    alias: cache\n    version: "+version+"\n    repository: https://charts.example.com\n")
+		writeTestFile(t, filepath.Join(dir, "values.yaml"), "cache:\n  replicas: 2\n")
+		writeTestFile(t, filepath.Join(dir, "templates", "app.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app\n")
+		writeTestFile(t, filepath.Join(dir, "charts", "redis", "Chart.yaml"), "apiVersion: v2\nname: redis\nversion: "+version+"\n")
+		for name, content := range templates {
+			writeTestFile(t, filepath.Join(dir, "charts", "redis", "templates", name), content)
+		}
+	}
+
+	statefulSet := "apiVersion: apps/v1\nkind: StatefulSet\nmetadata:\n  name: redis\n"
+	service := "apiVersion: v1\nkind: Service\nmetadata:\n  name: redis\n"
+	base, current := t.TempDir(), t.TempDir()
+	writeChart(base, "1.0.0", map[string]string{"statefulset.yaml": statefulSet, "service.yaml": service})
+	writeChart(current, "1.1.0", map[string]string{
+		"statefulset.yaml": statefulSet + "spec:\n  serviceName: redis\n",
+		"service.yaml":     service,
+		"pdb.yaml":         "apiVersion: policy/v1\nkind: PodDisruptionBudget\nmetadata:\n  name: redis\n",
+	})
+
+	sources := &chartSources{Base: base, Current: current}
+	notes, err := dependencyTemplateChanges(sources, nil, templateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"dependency cache: templates changed: templates/statefulset.yaml",
+		"dependency cache: templates added: templates/pdb.yaml",
+	}
+	if !reflect.DeepEqual(notes, expected) {
+		t.Errorf("notes = %q, want %q", notes, expected)
+	}
+
+	values, err := dependencyValues(current, "cache", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values) != "replicas: 2\n" {
+		t.Errorf("dependency values = %q, want the umbrella's cache subtree", values)
+	}
+
+	override := filepath.Join(t.TempDir(), "prod.yaml")
+	writeTestFile(t, override, "cache:\n  port: 6379\nglobal:\n  region: eu\nother: true\n")
+	values, err = dependencyValues(current, "cache", override)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(values) != "global:\n    region: eu\nport: 6379\nreplicas: 2\n" {
+		t.Errorf("dependency values = %q, want the cache subtree merged with --values", values)
+	}
+	if set := dependencySetValues([]string{"cache.replicas=3,other=1", "global.env=prod"}, "cache"); !reflect.DeepEqual(set, []string{"replicas=3", "global.env=prod"}) {
+		t.Errorf("dependency --set values = %q", set)
+	}
+
+	failing := filepath.Join(t.TempDir(), "failing.yaml")
+	writeTestFile(t, failing, "cache:\n  fail: true\n")
+	sources.CurrentValues = failing
+	notes, err = dependencyTemplateChanges(sources, nil, templateOptions{})
+	if err != nil {
+		t.Fatalf("expected a failing standalone render to be a note, got %v", err)
+	}
+	if len(notes) != 1 || !strings.HasPrefix(notes[0], "dependency cache: standalone render of 1.1.0 failed: ") {
+		t.Errorf("notes = %q, want a render failure note", notes)
+	}
+	sources.CurrentValues = ""
+
+	writeTestFile(t, filepath.Join(current, "templates", "app.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: app-v2\n")
+	notes, err = dependencyTemplateChanges(sources, nil, templateOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if notes != nil {
+		t.Errorf("notes = %q, want none when the umbrella's own templates changed too", notes)
+	}
+}
+
+func TestCheckRefs(t *testing.T) {
+	repo := initTestRepo(t)
+	chdir(t, repo)
+	writeTestFile(t, filepath.Join(repo, "README.md"), "one\n")
+	runGit(t, repo, "add", ".")
+	runGit(t, repo, "commit", "-q", "-m", "one")
+	runGit(t, repo, "branch", "-M", "main")
+	runGit(t, repo, "update-ref", "refs/remotes/origin/release", "HEAD")
+	writeTestFile(t, filepath.Join(repo, "README.md"), "two\n")
+	runGit(t, repo, "commit", "-q", "-am", "two")
+
+	var stderr bytes.Buffer
+	previous := streams
+	streams = &outputStreams{stderr: &stderr}
+	t.Cleanup(func() { streams = previous })
+
+	_, err := verifyRef("--base", "release")
+	if err == nil || err.Error() != "--base release not found, did you mean origin/release?" {
+		t.Errorf("verifyRef(release) error = %v", err)
+	}
+	if hints := errorHints(err); len(hints) != 1 || !strings.HasSuffix(hints[0].Command, " --base origin/release") {
+		t.Errorf("verifyRef(release) hints = %+v", hints)
+	}
+	_, err = verifyRef("--base", "origin/missing")
+	if err == nil || err.Error() != "--base origin/missing not found" {
+		t.Errorf("verifyRef(origin/missing) error = %v", err)
+	}
+
+	var out bytes.Buffer
+	comparable, err := checkRefs(&Config{Base: "main", Current: "HEAD"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if comparable || !strings.Contains(out.String(), "Base main equals current HEAD") {
+		t.Errorf("identical refs: comparable = %v, output %q", comparable, out.String())
+	}
+
+	writeTestFile(t, filepath.Join(repo, "README.md"), "three\n")
+	out.Reset()
+	comparable, err = checkRefs(&Config{Base: "main", Current: "HEAD"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !comparable || out.Len() != 0 {
+		t.Errorf("identical refs with uncommitted changes: comparable = %v, output %q", comparable, out.String())
+	}
+
+	comparable, err = checkRefs(&Config{Base: "main", Current: "origin/release"}, &out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !comparable || !strings.Contains(stderr.String(), "Warning: --base main is ahead of --current origin/release") {
+		t.Errorf("reversed refs: comparable = %v, stderr %q", comparable, stderr.String())
+	}
+
+	if _, err := checkRefs(&Config{Base: "main", Current: "feature"}, &out); err == nil || !strings.HasPrefix(err.Error(), "--current feature not found") {
+		t.Errorf("missing current ref error = %v", err)
+	}
+}
+
+func TestOrderingOnlyChanges(t *testing.T) {
+	configMap := "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\ndata:\n  a: \"1\"\n  b: \"2\"\n"
+	reorderedConfigMap := "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\ndata:\n  b: \"2\"\n  a: \"1\"\n"
+	service := "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: app\n"
+
+	tests := []struct {
+		name    string
+		base    string
+		current string
+		status  string
+		summary string
+		notes   []string
+	}{
+		{
+			name:    "key order",
+			base:    configMap + service,
+			current: reorderedConfigMap + service,
+			status:  statusUnchanged,
+			summary: "no semantic changes",
+			notes:   []string{"only ordering changed (keys reordered in ConfigMap settings)"},
+		},
+		{
+			name:    "document order",
+			base:    configMap + service,
+			current: service + configMap,
+			status:  statusUnchanged,
+			summary: "no semantic changes",
+			notes:   []string{"only document order changed"},
+		},
+		{
+			name:    "list order",
+			base:    configMap + "  list: [a, b]\n",
+			current: configMap + "  list: [b, a]\n",
+			status:  statusChanged,
+			summary: "1 modified",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &Config{Output: outputJSON, FailOnDiff: true}
+			if err := diffChart(config, "app", &chartSources{BaseManifest: tt.base, CurrentManifest: tt.current}); err != nil {
+				t.Fatal(err)
+			}
+			result := config.results[0]
+			if result.Status != tt.status || result.Summary != tt.summary || !reflect.DeepEqual(result.Notes, tt.notes) {
+				t.Errorf("got status %q summary %q notes %q, want %q %q %q", result.Status, result.Summary, result.Notes, tt.status, tt.summary, tt.notes)
+			}
+			if config.hasDifferences != (tt.status == statusChanged) {
+				t.Errorf("hasDifferences = %v for status %q", config.hasDifferences, tt.status)
+			}
+		})
+	}
+}
+
+func TestValuesDrift(t *testing.T) {
+	base, current := t.TempDir(), t.TempDir()
+	writeTestFile(t, filepath.Join(base, "values.yaml"), "image:\n  repository: app\n  tag: v1\nlegacy:\n  enabled: true\nresources: {}\nreplicas: 1\n")
+	writeTestFile(t, filepath.Join(base, "templates", "deployment.yaml"), "image: {{ .Values.image.repository }}:{{ .Values.image.tag }}\nlegacy: {{ .Values.legacy.enabled }}\nreplicas: {{ .Values.replicas }}\n{{ toYaml .Values.resources }}\n")
+
+	writeTestFile(t, filepath.Join(current, "values.yaml"), "image:\n  repository: app\nlegacy:\n  enabled: true\nresources: {}\n")
+	writeTestFile(t, filepath.Join(current, "templates", "deployment.yaml"), "image: {{ .Values.image.repository }}:{{ .Values.image.tag }}\nreplicas: {{ .Values.replicas }}\n{{ toYaml .Values.resources.limits }}\n")
+
+	drift, err := valuesDrift(base, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"values key image.tag removed from values.yaml but still referenced by templates",
+		"values key replicas removed from values.yaml but still referenced by templates",
+		"values key legacy.enabled no longer referenced by templates but still set in values.yaml",
+	}
+	if !reflect.DeepEqual(drift, expected) {
+		t.Errorf("drift = %q, want %q", drift, expected)
+	}
+
+	drift, err = valuesDrift(base, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drift) != 0 {
+		t.Errorf("expected no drift for identical charts, got %q", drift)
+	}
+
+	writeTestFile(t, filepath.Join(current, "values.yaml"), "image: \"\"\nlegacy:\n  enabled: true\nresources: {}\nreplicas: 1\n")
+	drift, err = valuesDrift(base, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Contains(drift, "values key image.repository removed from values.yaml but still referenced by templates") {
+		t.Errorf("expected a scalar parent not to provide image.repository, got %q", drift)
+	}
+}
+
+func TestGrepResource(t *testing.T) {
+	ingress := func(namespace, host string) string {
+		return "---\napiVersion: networking.k8s.io/v1\nkind: Ingress\nmetadata:\n  name: payments\n  namespace: " + namespace + "\nspec:\n  host: " + host + "\n"
+	}
+	service := func(port string) string {
+		return "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: payments\n  namespace: prod\nspec:\n  port: " + port + "\n"
+	}
+
+	selector, err := parseResourceSelector("ingress/prod/pay*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"Ingress", "Ingress/a/b/c", "/payments", "Ingress/["} {
+		if _, err := parseResourceSelector(spec); err == nil {
+			t.Errorf("expected %q to be rejected", spec)
+		}
+	}
+
+	var buffer bytes.Buffer
+	config := &Config{GrepResource: "ingress/prod/pay*", resourceFilter: &selector, pagerBuffer: &buffer, FailOnDiff: true}
+	charts := map[string]*chartSources{
+		"api":      {BaseManifest: service("80"), CurrentManifest: service("8080")},
+		"payments": {BaseManifest: ingress("prod", "a.example.com") + service("80"), CurrentManifest: ingress("prod", "b.example.com") + service("8080")},
+		"staging":  {BaseManifest: ingress("staging", "a.example.com"), CurrentManifest: ingress("staging", "b.example.com")},
+	}
+	for _, chart := range []string{"api", "payments", "staging"} {
+		if err := diffChart(config, chart, charts[chart]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	output := buffer.String()
+	if !strings.Contains(output, "payments: 1 modified") || !strings.Contains(output, "+  host: b.example.com") {
+		t.Errorf("expected the prod Ingress diff, got:\n%s", output)
+	}
+	if strings.Contains(output, "Service") || strings.Contains(output, "api:") || strings.Contains(output, "staging:") {
+		t.Errorf("expected only the matching resource, got:\n%s", output)
+	}
+	if config.changed != 1 || config.unchanged != 2 || !config.hasDifferences {
+		t.Errorf("changed=%d unchanged=%d hasDifferences=%v", config.changed, config.unchanged, config.hasDifferences)
+	}
+	if config.results[0].Summary != "no changes to ingress/prod/pay*" {
+		t.Errorf("unexpected summary for unmatched chart: %q", config.results[0].Summary)
+	}
+}
+
+func TestDestructiveChanges(t *testing.T) {
+	deployment := func(app string) string {
+		return "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: api\n  namespace: prod\nspec:\n  replicas: 2\n  selector:\n    matchLabels:\n      app: " + app + "\n"
+	}
+	configMap := func(name, value string) string {
+		return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: " + name + "\n  namespace: prod\ndata:\n  value: " + value + "\n"
+	}
+	kept := "---\napiVersion: v1\nkind: PersistentVolumeClaim\nmetadata:\n  name: data\n  namespace: prod\n  annotations:\n    helm.sh/resource-policy: keep\n"
+	ingress := func(apiVersion string) string {
+		return "---\napiVersion: " + apiVersion + "\nkind: Ingress\nmetadata:\n  name: api\n  namespace: prod\n"
+	}
+	worker := "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: worker\n  namespace: prod\nspec:\n  replicas: 1\n"
+
+	base := deployment("api") + configMap("settings-abc12", "1") + kept + ingress("networking.k8s.io/v1beta1") + worker
+	current := deployment("api-v2") + configMap("settings-def34", "2") + ingress("networking.k8s.io/v1") + strings.Replace(worker, "replicas: 1", "replicas: 3", 1)
+
+	config := &Config{Output: outputJSON}
+	if err := diffChart(config, "app", &chartSources{BaseManifest: base, CurrentManifest: current}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []destructiveChange{
+		{Chart: "app", APIVersion: "apps/v1", Kind: "Deployment", Namespace: "prod", Name: "api", Action: actionRecreate, Reason: "immutable field spec.selector changed"},
+		{Chart: "app", APIVersion: "v1", Kind: "ConfigMap", Namespace: "prod", Name: "settings-abc12", Action: actionRecreate, Reason: "name changed to settings-def34"},
+	}
+	sort.Slice(config.destructiveChanges, func(i, j int) bool {
+		return config.destructiveChanges[i].Kind > config.destructiveChanges[j].Kind
+	})
+	if !reflect.DeepEqual(config.destructiveChanges, expected) {
+		t.Errorf("destructive changes = %+v, want %+v", config.destructiveChanges, expected)
+	}
+	if config.destructive != 2 || !strings.HasPrefix(strings.Join(config.results[0].Risks, ", "), "2 destructive x10") {
+		t.Errorf("expected the destructive count and risk to follow the destructive changes, got %d (%v)", config.destructive, config.results[0].Risks)
+	}
+	expectedPruned := []prunedResource{
+		{Chart: "app", Resource: "ConfigMap prod/settings-abc12"},
+		{Chart: "app", Resource: "PersistentVolumeClaim prod/data", Kept: true},
+	}
+	if !reflect.DeepEqual(config.pruned, expectedPruned) {
+		t.Errorf("expected the replaced ConfigMap and the kept volume claim in the prune section, got %+v", config.pruned)
+	}
+
+	removed := destructiveChanges("app", []resourceChange{{Change: changeRemoved, Base: &resource{APIVersion: "v1", Kind: "Service", Namespace: "prod", Name: "legacy"}}})
+	path := filepath.Join(t.TempDir(), "destructive.json")
+	if err := writeDestructiveChanges(path, removed, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var document struct {
+		Count     int                 `json:"count"`
+		Complete  bool                `json:"complete"`
+		Resources []destructiveChange `json:"resources"`
+	}
+	if err := json.Unmarshal(content, &document); err != nil {
+		t.Fatal(err)
+	}
+	if document.Count != 1 || !document.Complete || document.Resources[0].Action != actionDelete || document.Resources[0].Reason != "no longer rendered" {
+		t.Errorf("unexpected document %s", content)
+	}
+
+	if err := writeDestructiveChanges(path, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	content, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(content) != "{\n  \"count\": 0,\n  \"complete\": true,\n  \"errors\": [],\n  \"resources\": []\n}\n" {
+		t.Errorf("unexpected empty document %q", content)
+	}
+
+	failures := []chartFailure{{Chart: "web", Reason: reasonRenderFailed, Err: errors.New("helm template failed")}}
+	if err := writeDestructiveChanges(path, nil, failures); err != nil {
+		t.Fatal(err)
+	}
+	content, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(content), "\"complete\": false,\n  \"errors\": [\n    \"web [render-failed]: helm template failed\"\n  ]") {
+		t.Errorf("expected failed charts to mark the document incomplete, got %s", content)
+	}
+}
+
+func TestChartSizeChanges(t *testing.T) {
+	base, current := t.TempDir(), t.TempDir()
+	for _, dir := range []string{base, current} {
+		writeTestFile(t, filepath.Join(dir, "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 1.0.0\n")
+		writeTestFile(t, filepath.Join(dir, "charts", "redis-1.0.0.tgz"), strings.Repeat("x", 4096))
+	}
+	writeTestFile(t, filepath.Join(base, "files", "data.json"), strings.Repeat("a", 2<<20))
+	writeTestFile(t, filepath.Join(current, "files", "data.json"), strings.Repeat("a", 3<<20))
+	writeTestFile(t, filepath.Join(current, "files", "tool"), "\x7fELF\x00\x01")
+	writeTestFile(t, filepath.Join(current, "files", "dump.sql"), strings.Repeat("b", 1<<20))
+
+	lines, err := chartSizeChanges(base, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{
+		"chart size 2.0 MiB -> 4.0 MiB (+2.0 MiB), 2 -> 4 files (+2)",
+		"large file grew: files/data.json (2.0 MiB -> 3.0 MiB)",
+		"large file added: files/dump.sql (1.0 MiB)",
+		"binary file added: files/tool (6 B)",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("size changes = %q, want %q", lines, expected)
+	}
+
+	lines, err = chartSizeChanges(base, base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 0 {
+		t.Errorf("expected no size changes, got %q", lines)
+	}
+
+	lines, err = chartSizeChanges("", filepath.Join(base, "files"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lines) != 2 || lines[0] != "chart size 0 B -> 2.0 MiB (+2.0 MiB), 0 -> 1 files (+1)" {
+		t.Errorf("unexpected size changes for a new chart: %q", lines)
+	}
+
+	writeTestFile(t, filepath.Join(current, ".helmignore"), "# local files\n*.sql\n/files/tool\nbuild/\n")
+	writeTestFile(t, filepath.Join(current, "build", "out.bin"), "\x00")
+	writeTestFile(t, filepath.Join(current, "templates", ".notes.yaml"), "notes")
+	writeTestFile(t, filepath.Join(current, "files", "late.txt"), strings.Repeat("c", 8000)+"\x00")
+	lines, err = chartSizeChanges(base, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []string{
+		"chart size 2.0 MiB -> 3.0 MiB (+1.0 MiB), 2 -> 4 files (+2)",
+		"large file grew: files/data.json (2.0 MiB -> 3.0 MiB)",
+	}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("size changes with .helmignore = %q, want %q", lines, expected)
+	}
+
+	writeTestFile(t, filepath.Join(current, ".helmignore"), "files/[\n")
+	if _, err := chartSizeChanges(base, current); err == nil || !strings.Contains(err.Error(), "parsing .helmignore") {
+		t.Errorf("expected an invalid .helmignore pattern to fail, got %v", err)
+	}
+}
+
+func TestAnchors(t *testing.T) {
+	deployment := func(replicas string) string {
+		return "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: api\n  namespace: prod\nspec:\n  replicas: " + replicas + "\n"
+	}
+	service := "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: api\n"
+
+	var buffer bytes.Buffer
+	config := &Config{Anchors: true, pagerBuffer: &buffer}
+	if err := diffChart(config, "api", &chartSources{BaseManifest: deployment("1"), CurrentManifest: deployment("2") + service}); err != nil {
+		t.Fatal(err)
+	}
+	if err := diffChart(config, "web", &chartSources{SkipReason: "library chart"}); err != nil {
+		t.Fatal(err)
+	}
+	configMap := "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: \"db:primary]\"\n"
+	if err := diffChart(config, "charts/app[prod]", &chartSources{CurrentManifest: configMap}); err != nil {
+		t.Fatal(err)
+	}
+
+	var anchors []string
+	for _, line := range strings.Split(buffer.String(), "\n") {
+		if strings.HasPrefix(line, "##[") {
+			anchors = append(anchors, line)
+		}
+	}
+	expected := []string{
+		"##[chart:api]",
+		"##[resource:v1:Service::api]",
+		"##[resource:apps/v1:Deployment:prod:api]",
+		"##[chart:web]",
+		"##[chart:charts/app%5Bprod%5D]",
+		"##[resource:v1:ConfigMap::db%3Aprimary%5D]",
+	}
+	if !reflect.DeepEqual(anchors, expected) {
+		t.Errorf("anchors = %q, want %q\n%s", anchors, expected, buffer.String())
+	}
+	if !strings.Contains(buffer.String(), "##[resource:apps/v1:Deployment:prod:api]\napi: Deployment prod/api modified\n") {
+		t.Errorf("expected the resource anchor right before its header:\n%s", buffer.String())
+	}
+}
+
+func TestRolloutRestarts(t *testing.T) {
+	deployment := func(name, replicas, image string) string {
+		return "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: " + name + "\nspec:\n  replicas: " + replicas + "\n  template:\n    spec:\n      containers:\n        - name: app\n          image: " + image + "\n"
+	}
+	configMap := func(value string) string {
+		return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\ndata:\n  value: " + value + "\n"
+	}
+	base := deployment("api", "1", "api:1") + deployment("worker", "1", "worker:1") + configMap("a")
+	current := deployment("api", "1", "api:2") + deployment("worker", "3", "worker:1") + configMap("b")
+
+	var buffer bytes.Buffer
+	config := &Config{pagerBuffer: &buffer}
+	if err := diffChart(config, "app", &chartSources{BaseManifest: base, CurrentManifest: current}); err != nil {
+		t.Fatal(err)
+	}
+	output := buffer.String()
+	for _, line := range []string{
+		"app: 1 workload will restart: Deployment api\n",
+		"app: Deployment api rolls out new pods (pod template changed)\n",
+		"app: Deployment worker keeps its pods (metadata or scaling only)\n",
+	} {
+		if !strings.Contains(output, line) {
+			t.Errorf("expected %q in output:\n%s", line, output)
+		}
+	}
+	if strings.Contains(output, "ConfigMap settings rolls out") || strings.Contains(output, "ConfigMap settings keeps") {
+		t.Errorf("expected no rollout note for a ConfigMap:\n%s", output)
+	}
+	if config.restarts != 1 || !reflect.DeepEqual(config.results[0].Restarts, []string{"Deployment api"}) {
+		t.Errorf("restarts = %d %q", config.restarts, config.results[0].Restarts)
+	}
+	for _, res := range config.results[0].Resources {
+		if res.Restart != (res.Name == "api") {
+			t.Errorf("%s %s restart = %v", res.Kind, res.Name, res.Restart)
+		}
+	}
+
+	labelled := func(name, replicas, chart string) string {
+		return "---\napiVersion: apps/v1\nkind: Deployment\nmetadata:\n  name: " + name + "\nspec:\n  replicas: " + replicas +
+			"\n  template:\n    metadata:\n      labels:\n        helm.sh/chart: " + chart + "\n"
+	}
+	buffer.Reset()
+	config = &Config{pagerBuffer: &buffer, IgnoreHelmLabels: true}
+	if err := diffChart(config, "app", &chartSources{BaseManifest: labelled("api", "1", "app-1.0.0"), CurrentManifest: labelled("api", "2", "app-1.1.0")}); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buffer.String(), "app: Deployment api rolls out new pods (pod template changed)\n") {
+		t.Errorf("expected an ignored pod template label to still restart the workload:\n%s", buffer.String())
+	}
+
+	buffer.Reset()
+	config = &Config{pagerBuffer: &buffer, IgnoreHelmLabels: true}
+	if err := diffChart(config, "app", &chartSources{BaseManifest: labelled("api", "1", "app-1.0.0"), CurrentManifest: labelled("api", "1", "app-1.1.0")}); err != nil {
+		t.Fatal(err)
+	}
+	if config.restarts != 1 || !strings.Contains(buffer.String(), "app: no changes\napp: 1 workload will restart: Deployment api\n") {
+		t.Errorf("expected a restart for a chart whose only change is ignored, got %d:\n%s", config.restarts, buffer.String())
+	}
+}
+
+func TestPermutations(t *testing.T) {
+	var permutations permuteFlag
+	for _, value := range []string{"featureX=true,false", "tier=a"} {
+		if err := permutations.Set(value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, value := range []string{"featureX=on", "novalue", "=true"} {
+		if err := permutations.Set(value); err == nil {
+			t.Errorf("expected %q to be rejected", value)
+		}
+	}
+
+	prepared := []*chartSources{{SetValues: []string{"image.tag=v1"}}, {SkipReason: "library chart"}}
+	charts, targets := expandPermutations([]string{"app", "lib"}, prepared, permutations)
+	expectedCharts := []string{"app[featureX=true,tier=a]", "app[featureX=false,tier=a]", "lib"}
+	if !reflect.DeepEqual(charts, expectedCharts) {
+		t.Fatalf("charts = %q, want %q", charts, expectedCharts)
+	}
+	config := &Config{SetValues: []string{"replicas=2"}}
+	if got := chartSetValues(config, targets[1]); !reflect.DeepEqual(got, []string{"image.tag=v1", "replicas=2", "featureX=false", "tier=a"}) {
+		t.Errorf("set values = %q", got)
+	}
+
+	results := []chartResult{
+		{Chart: "app[featureX=true,tier=a]", Status: statusChanged},
+		{Chart: "app[featureX=false,tier=a]", Status: statusUnchanged},
+		{Chart: "lib", Status: statusSkipped},
+	}
+	expected := "\nPermutations:\n  app: changed under [featureX=true,tier=a]; unchanged under [featureX=false,tier=a]\n"
+	if got := formatPermutationSummary(results, charts, targets); got != expected {
+		t.Errorf("summary = %q, want %q", got, expected)
+	}
+}
+
+func TestSignReport(t *testing.T) {
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []crypto.Signer{edKey, ecKey} {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keyFile := filepath.Join(t.TempDir(), "key.pem")
+		writeTestFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})))
+		signer, err := loadReportSigner(keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		config := &Config{
+			Output:       outputJSON,
+			Base:         "base-ref",
+			Current:      "current-ref",
+			reportSigner: signer,
+			results:      []chartResult{{Chart: "app", Status: statusChanged, Summary: "1 modified"}},
+			fingerprints: runFingerprints{"app": {"v1/ConfigMap//app": "0123456789abcdef"}},
+			changed:      1,
+		}
+		var out bytes.Buffer
+		if err := writeReport(config, &out); err != nil {
+			t.Fatal(err)
+		}
+
+		var envelope signedReport
+		if err := json.Unmarshal(out.Bytes(), &envelope); err != nil {
+			t.Fatal(err)
+		}
+		if envelope.PayloadType != reportPayloadType || len(envelope.Signatures) != 1 {
+			t.Fatalf("unexpected envelope %+v", envelope)
+		}
+		payload, err := base64.StdEncoding.DecodeString(envelope.Payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig, err := base64.StdEncoding.DecodeString(envelope.Signatures[0].Sig)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		message := dssePAE(reportPayloadType, payload)
+		var verified bool
+		switch public := signer.Public().(type) {
+		case ed25519.PublicKey:
+			verified = ed25519.Verify(public, message, sig)
+		case *ecdsa.PublicKey:
+			sum := sha256.Sum256(message)
+			verified = ecdsa.VerifyASN1(public, sum[:], sig)
+		}
+		if !verified {
+			t.Errorf("%T signature does not verify", signer)
+		}
+
+		var r report
+		if err := json.Unmarshal(payload, &r); err != nil {
+			t.Fatal(err)
+		}
+		if r.Provenance == nil || r.Provenance.Base != "base-ref" || r.Provenance.Current != "current-ref" || !strings.HasPrefix(r.Provenance.Charts["app"], "sha256:") {
+			t.Errorf("unexpected provenance %+v", r.Provenance)
+		}
+		if r.Changed != 1 || r.Charts[0].Chart != "app" {
+			t.Errorf("unexpected report payload %s", payload)
+		}
+	}
+
+	keyFile := filepath.Join(t.TempDir(), "cert.pem")
+	writeTestFile(t, keyFile, string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("x")})))
+	if _, err := loadReportSigner(keyFile); err == nil || !strings.Contains(err.Error(), `unsupported PEM block "CERTIFICATE"`) {
+		t.Errorf("expected unsupported PEM block error, got %v", err)
+	}
+}
+
+func TestTeamRollup(t *testing.T) {
+	configMap := func(namespace, value string) string {
+		return "---\napiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: settings\n  namespace: " + namespace + "\ndata:\n  value: " + value + "\n"
+	}
+	service := "---\napiVersion: v1\nkind: Service\nmetadata:\n  name: legacy\n  namespace: payments\n"
+
+	var buffer bytes.Buffer
+	config := &Config{pagerBuffer: &buffer, repoConfig: &repoConfig{Teams: map[string]teamConfig{
+		"payments": {Namespaces: []string{"payments*"}},
+		"platform": {Charts: []string{"ingress-*", "cert-manager"}},
+	}}}
+	charts := []struct {
+		name    string
+		sources *chartSources
+	}{
+		{"api", &chartSources{BaseManifest: configMap("payments", "1") + service, CurrentManifest: configMap("payments", "2")}},
+		{"ingress-nginx", &chartSources{BaseManifest: configMap("", "1"), CurrentManifest: configMap("", "2")}},
+		{"ingress-nginx[env=prod]", &chartSources{BaseManifest: configMap("payments-prod", "1"), CurrentManifest: configMap("payments-prod", "2")}},
+		{"search", &chartSources{BaseManifest: configMap("search", "1"), CurrentManifest: configMap("search", "2")}},
+	}
+	for _, chart := range charts {
+		if err := diffChart(config, chart.name, chart.sources); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected := []teamRollup{
+		{Team: "payments", Charts: []string{"api"}, Resources: 2, Destructive: 1},
+		{Team: "platform", Charts: []string{"ingress-nginx", "ingress-nginx[env=prod]"}, Resources: 2},
+		{Team: teamUnassigned, Charts: []string{"search"}, Resources: 1},
+	}
+	if !reflect.DeepEqual(config.teams, expected) {
+		t.Errorf("teams = %+v, want %+v", config.teams, expected)
+	}
+
+	section := formatTeamSection(config.teams)
+	for _, line := range []string{
+		"  payments: 1 chart changed, 2 resources, 1 destructive (api)\n",
+		"  platform: 2 charts changed, 2 resources (ingress-nginx, ingress-nginx[env=prod])\n",
+		"  unassigned: 1 chart changed, 1 resource (search)\n",
+	} {
+		if !strings.Contains(section, line) {
+			t.Errorf("team section missing %q:\n%s", line, section)
+		}
+	}
+	if strings.Index(section, "platform") > strings.Index(section, "unassigned") {
+		t.Errorf("unassigned should be listed last:\n%s", section)
+	}
+
+	markdown := formatMarkdownReport(report{Teams: config.teams})
+	if !strings.Contains(markdown, "### Changes by team") || !strings.Contains(markdown, "- **payments**: 1 chart changed, 2 resources, 1 destructive") {
+		t.Errorf("markdown report missing team rollup:\n%s", markdown)
+	}
+}
+
+func TestErrorHints(t *testing.T) {
+	defer func(args []string) { invocationArgs = args }(invocationArgs)
+	invocationArgs = []string{"--base", "main", "--values=a b.yaml", "--helm-binary=/usr/bin/helm", "charts/api"}
+
+	tests := []struct {
+		name string
+		err  error
+		want []errorHint
+	}{
+		{
+			name: "missing repository",
+			err:  withReason(reasonDependencyBuild, fmt.Errorf("building dependencies: %w", errors.New("helm dependency build failed: Error: no repository definition for https://charts.bitnami.com/bitnami, oci://ghcr.io/acme/charts. Please add the missing repos via 'helm repo add'\n"))),
+			want: []errorHint{
+				{Problem: "dependency repository https://charts.bitnami.com/bitnami is not configured", Command: "helm repo add bitnami https://charts.bitnami.com/bitnami"},
+			},
+		},
+		{
+			name: "registry credentials",
+			err:  errors.New("helm dependency build failed: Error: failed to authorize: oci://registry.example.com/charts/db: 401 Unauthorized"),
+			want: []errorHint{{Problem: "registry registry.example.com rejected the credentials", Command: "helm registry login registry.example.com --username <user> --password-stdin"}},
+		},
+		{
+			name: "repository credentials",
+			err:  errors.New(`Error: looks like "https://charts.example.com/private" is not a valid chart repository or cannot be reached: failed to fetch https://charts.example.com/private/index.yaml : 403 Forbidden`),
+			want: []errorHint{{Problem: "repository https://charts.example.com/private rejected the credentials", Command: "helm repo add private https://charts.example.com/private --force-update --username <user> --password-stdin"}},
+		},
+		{
+			name: "old helm",
+			err:  errors.New("helm template failed: Error: unknown flag: --take-ownership"),
+			want: []errorHint{{Problem: "helm does not support --take-ownership, Helm 3.18+ is required", Command: "helm git-diff --base main '--values=a b.yaml' charts/api --helm-binary /path/to/newer/helm"}},
+		},
+		{
+			name: "structured",
+			err:  fmt.Errorf("preparing chart: %w", withHints(errors.New("--base origin/main not found"), errorHint{Problem: "origin/main has not been fetched", Command: "git fetch origin main"})),
+			want: []errorHint{{Problem: "origin/main has not been fetched", Command: "git fetch origin main"}},
+		},
+		{
+			name: "no hint",
+			err:  errors.New("parsing base manifest: yaml: line 3: mapping values are not allowed in this context"),
+		},
+		{
+			name: "status codes outside an auth failure",
+			err:  errors.New("helm template failed: Error: template: app/templates/ingress.yaml:401:12: executing at https://charts.example.com/app: port 403 is reserved"),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := errorHints(tt.err); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("errorHints() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+
+	var stderr bytes.Buffer
+	defer func(s *outputStreams) { streams = s }(streams)
+	streams = &outputStreams{stderr: &stderr}
+	config := &Config{}
+	recordChartError(config, "api", tests[0].err)
+	if !strings.Contains(stderr.String(), "\nHint: dependency repository https://charts.bitnami.com/bitnami is not configured\n  helm repo add bitnami https://charts.bitnami.com/bitnami\n") {
+		t.Errorf("chart error output missing hint:\n%s", stderr.String())
+	}
+	if len(config.results) != 1 || len(config.results[0].Hints) != 1 {
+		t.Errorf("chart result hints = %+v", config.results)
+	}
+
+	stderr.Reset()
+	recordChartError(config, "web", withReason(reasonRenderFailed, errors.New("helm template failed: Error: parse error\n")))
+	if stderr.String() != "Error: web [render-failed]: helm template failed: Error: parse error\n" {
+		t.Errorf("chart error without hints = %q", stderr.String())
+	}
+
+	var out bytes.Buffer
+	printError(&out, errors.New("not a git repository (or any of the parent directories)\n"))
+	if out.String() != "Error: not a git repository (or any of the parent directories)\n" {
+		t.Errorf("printError without hints = %q", out.String())
+	}
+}
+
+// fakeHelm points helmBinary at a script that prints each chart's templates as
+// they are, fails to render the chart named broken and ignores every other
+// command. It returns the script's path.
+func fakeHelm(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake helm script requires a POSIX shell")
+	}
+
+	helm := filepath.Join(t.TempDir(), "helm")
+	writeTestFile(t, helm, `#!/bin/sh
+[ "$1" = template ] || exit 0
+name=$(grep '^name:' "$3/Chart.yaml" | awk '{print $2}')
+if [ "$name" = broken ]; then
+  echo "Error: parse error in broken/templates/app.yaml" >&2
+  exit 1
+fi
+for f in "$3"/templates/*.yaml; do
+  [ -e "$f" ] || continue
+  echo "---"
+  echo "# Source: $name/templates/$(basename "$f")"
+  cat "$f"
+done
+`)
+	if err := os.Chmod(helm, 0755); err != nil {
+		t.Fatal(err)
+	}
+	previous := helmBinary
+	helmBinary = helm
+	t.Cleanup(func() { helmBinary = previous })
+	return helm
+}
+
+// runTestRepo commits two charts at the tag base, changes both in a second
+// commit and returns a Config that runs against them with a fake helm that
+// fails to render the chart named broken.
+func runTestRepo(t *testing.T) (*Config, *bytes.Buffer, *bytes.Buffer) {
+	t.Helper()
+	helm := fakeHelm(t)
+
+	repo := initTestRepo(t)
+	for _, name := range []string{"app", "broken"} {
+		writeTestFile(t, filepath.Join(repo, "charts", name, "Chart.yaml"), "apiVersion: v2\nname: "+name+"\nversion: 1.0.0\n")
+		writeTestFile(t, filepath.Join(repo, "charts", name, "templates", "app.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: "+name+"\n  labels:\n    team: a\ndata:\n  value: \"1\"\n")
+	}
+	runGit(t, repo, "add", "-A")
+	runGit(t, repo, "commit", "-q", "-m", "base")
+	runGit(t, repo, "tag", "base")
+	for _, name := range []string{"app", "broken"} {
+		writeTestFile(t, filepath.Join(repo, "charts", name, "templates", "extra.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: "+name+"-extra\n")
+	}
+	runGit(t, repo, "add", "-A")
+	runGit(t, repo, "commit", "-q", "-m", "current")
+	chdir(t, repo)
+
+	var stdout, stderr bytes.Buffer
+	defer func(s *outputStreams) { t.Cleanup(func() { streams = s }) }(streams)
+	streams = &outputStreams{stderr: &stderr}
+	return &Config{
+		Base:          "base",
+		Current:       "HEAD",
+		ChartDir:      ".",
+		ChartExcludes: defaultChartExcludes,
+		Context:       defaultContextLines,
+		SortKeys:      true,
+		Concurrency:   1,
+		Output:        outputText,
+		ReviewersFile: defaultReviewersFile,
+		HelmBinary:    helm,
+		NoPager:       true,
+		pagerBuffer:   &stdout,
+	}, &stdout, &stderr
+}
+
+func TestRunGatesWithFailedCharts(t *testing.T) {
+	config, stdout, stderr := runTestRepo(t)
+	config.RequiredLabels = []string{"team"}
+	config.RiskThreshold = 1
+
+	if err := run(config); !errors.Is(err, errChartsFailed) {
+		t.Fatalf("run() error = %v, want %v", err, errChartsFailed)
+	}
+	if !strings.Contains(stdout.String(), "RESULT: changed=1 unchanged=0 skipped=0 errors=1\n") {
+		t.Errorf("missing RESULT line:\n%s", stdout.String())
+	}
+	if !strings.Contains(stderr.String(), "Policy violations:\n  charts/app: ConfigMap app-extra missing label team\n") {
+		t.Errorf("policy violations not reported alongside chart failures:\n%s", stderr.String())
+	}
+	if !strings.Contains(stderr.String(), "Error: 1 policy violations introduced by this change\n") {
+		t.Errorf("failed gate not reported alongside chart failures:\n%s", stderr.String())
+	}
+}
+
+func TestRunWithoutChanges(t *testing.T) {
+	config, stdout, _ := runTestRepo(t)
+	config.Base = "HEAD"
+	outDir := t.TempDir()
+	t.Setenv("GITHUB_OUTPUT", filepath.Join(outDir, "github-output"))
+	config.CI = "github"
+	config.SaveRun = filepath.Join(outDir, "run.json")
+	config.Inventory = filepath.Join(outDir, "inventory.json")
+	config.DestructiveOutput = filepath.Join(outDir, "destructive.json")
+	config.RoutingOutput = filepath.Join(outDir, "routing.json")
+	config.ChartDirs = []string{"charts/app"}
+
+	if err := run(config); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(stdout.String(), "nothing to compare\nRESULT: changed=0 unchanged=0 skipped=0 errors=0\n") {
+		t.Errorf("unexpected output:\n%s", stdout.String())
+	}
+	outputs, err := os.ReadFile(filepath.Join(outDir, "github-output"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(outputs) != "changed_charts=[]\nhas_diff=false\ndestructive_count=0\nmax_risk_score=0\n" {
+		t.Errorf("unexpected GitHub outputs %q", outputs)
+	}
+	for _, path := range []string{config.SaveRun, config.Inventory, config.DestructiveOutput, config.RoutingOutput} {
+		if _, err := os.Stat(path); err != nil {
+			t.Errorf("%s not written: %v", filepath.Base(path), err)
+		}
+	}
+	content, err := os.ReadFile(config.Inventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var items []inventoryItem
+	if err := json.Unmarshal(content, &items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || items[0].Chart != "charts/app" {
+		t.Errorf("unchanged chart missing from inventory: %+v", items)
+	}
+}
+
+func TestRunInventory(t *testing.T) {
+	config, _, _ := runTestRepo(t)
+	writeTestFile(t, filepath.Join("charts", "stable", "Chart.yaml"), "apiVersion: v2\nname: stable\nversion: 1.0.0\n")
+	writeTestFile(t, filepath.Join("charts", "stable", "templates", "app.yaml"), "apiVersion: v1\nkind: Service\nmetadata:\n  name: stable\n")
+	runGit(t, ".", "add", "-A")
+	runGit(t, ".", "commit", "-q", "-m", "stable")
+	runGit(t, ".", "tag", "-f", "base")
+	writeTestFile(t, filepath.Join("charts", "app", "templates", "more.yaml"), "apiVersion: v1\nkind: Secret\nmetadata:\n  name: app-more\n")
+	runGit(t, ".", "add", "-A")
+	runGit(t, ".", "commit", "-q", "-m", "more")
+	config.ChartDirs = []string{"charts/app", "charts/stable"}
+	config.Inventory = filepath.Join(t.TempDir(), "inventory.csv")
+
+	if err := run(config); err != nil {
+		t.Fatal(err)
+	}
+	content, err := os.ReadFile(config.Inventory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "chart,apiVersion,kind,namespace,name,source\n" +
+		"charts/app,v1,ConfigMap,,app,app/templates/app.yaml\n" +
+		"charts/app,v1,ConfigMap,,app-extra,app/templates/extra.yaml\n" +
+		"charts/app,v1,Secret,,app-more,app/templates/more.yaml\n" +
+		"charts/stable,v1,Service,,stable,stable/templates/app.yaml\n"
+	if string(content) != expected {
+		t.Errorf("expected inventory %q, got %q", expected, content)
+	}
+}
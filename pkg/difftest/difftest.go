@@ -0,0 +1,231 @@
+// Package difftest renders Helm charts for Go tests with the same parsing and
+// normalization helm-git-diff applies before diffing, so chart repositories can
+// keep regression tests next to their charts:
+//
+//	func TestPaymentsChart(t *testing.T) {
+//		r := difftest.Render(t, "charts/payments", difftest.Options{Values: []string{"ci/prod.yaml"}})
+//		r.Contains("Deployment", "payments", "replicas: 3")
+//		r.Omits("Ingress", "payments", "nginx.ingress.kubernetes.io/ssl-redirect")
+//		r.MatchFixture("testdata/payments-prod.yaml")
+//	}
+//
+// Set HELM_GIT_DIFF_UPDATE_FIXTURES=1 to rewrite fixtures from the current rendering.
+package difftest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pmezard/go-difflib/difflib"
+
+	"github.com/ihs7/helm-git-diff/pkg/manifest"
+	"github.com/ihs7/helm-git-diff/pkg/render"
+)
+
+// UpdateFixturesEnv names the environment variable that makes MatchFixture
+// write the rendering to the fixture instead of comparing against it.
+const UpdateFixturesEnv = "HELM_GIT_DIFF_UPDATE_FIXTURES"
+
+// Options control how a chart is rendered. The zero value renders the chart
+// with its default values, the chart name as release name and sorted keys.
+// The fields match the helm-git-diff flags of the same name; KeepKeyOrder is
+// the inverse of --sort-keys.
+type Options struct {
+	ReleaseName      string
+	Namespace        string
+	Values           []string
+	Set              []string
+	KubeVersion      string
+	APIVersions      []string
+	IncludeCRDs      bool
+	PostRenderer     string
+	NoHooks          bool
+	AllowLookup      bool
+	LookupFixtures   string
+	IgnoreFields     []string
+	IgnoreHelmLabels bool
+	KeepKeyOrder     bool
+	ShowSecrets      bool
+	HelmBinary       string
+}
+
+// Rendering holds the normalized resources of a rendered chart.
+type Rendering struct {
+	t         testing.TB
+	Resources []manifest.Resource
+}
+
+// Render runs helm template for the chart at chartPath and fails the test if
+// rendering or parsing fails. Chart dependencies must already be built.
+func Render(t testing.TB, chartPath string, opts Options) *Rendering {
+	t.Helper()
+
+	output, err := helmTemplate(t, chartPath, opts)
+	if err != nil {
+		t.Fatalf("rendering %s: %v", chartPath, err)
+	}
+	resources, err := manifest.Parse(output)
+	if err != nil {
+		t.Fatalf("parsing %s: %v", chartPath, err)
+	}
+
+	fields := opts.IgnoreFields
+	if opts.IgnoreHelmLabels {
+		fields = append(append([]string{}, fields...), manifest.HelmLabelFields...)
+	}
+	for i := range resources {
+		if !opts.ShowSecrets && resources[i].Kind == "Secret" {
+			resources[i].Content = manifest.RedactSecret(resources[i].Content, nil)
+		}
+		if !opts.KeepKeyOrder || len(fields) > 0 {
+			resources[i].Content = manifest.Normalize(resources[i].Content, fields, !opts.KeepKeyOrder)
+		}
+	}
+	sort.SliceStable(resources, func(i, j int) bool {
+		return resourceKey(resources[i]) < resourceKey(resources[j])
+	})
+	return &Rendering{t: t, Resources: resources}
+}
+
+// Find returns the resource with the given kind and name.
+func (r *Rendering) Find(kind, name string) (manifest.Resource, bool) {
+	for _, res := range r.Resources {
+		if res.Kind == kind && res.Name == name {
+			return res, true
+		}
+	}
+	return manifest.Resource{}, false
+}
+
+// Resource returns the resource with the given kind and name and fails the
+// test if the chart does not render it.
+func (r *Rendering) Resource(kind, name string) manifest.Resource {
+	r.t.Helper()
+	res, ok := r.Find(kind, name)
+	if !ok {
+		r.t.Fatalf("%s %s not rendered", kind, name)
+	}
+	return res
+}
+
+// Contains fails the test unless the resource's normalized YAML contains text.
+func (r *Rendering) Contains(kind, name, text string) {
+	r.t.Helper()
+	if res := r.Resource(kind, name); !strings.Contains(res.Content, text) {
+		r.t.Errorf("%s %s does not contain %q:\n%s", kind, name, text, res.Content)
+	}
+}
+
+// Omits fails the test if the resource's normalized YAML contains text.
+func (r *Rendering) Omits(kind, name, text string) {
+	r.t.Helper()
+	if res := r.Resource(kind, name); strings.Contains(res.Content, text) {
+		r.t.Errorf("%s %s contains %q:\n%s", kind, name, text, res.Content)
+	}
+}
+
+// String returns the normalized resources as one manifest, ordered by
+// apiVersion, kind, namespace and name.
+func (r *Rendering) String() string {
+	var b strings.Builder
+	for _, res := range r.Resources {
+		b.WriteString("---\n")
+		if res.Source != "" {
+			fmt.Fprintf(&b, "# Source: %s\n", res.Source)
+		}
+		b.WriteString(strings.TrimSuffix(res.Content, "\n"))
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// MatchFixture compares the rendering with the fixture at path and fails the
+// test with a unified diff if they differ.
+func (r *Rendering) MatchFixture(path string) {
+	r.t.Helper()
+	rendered := r.String()
+
+	if os.Getenv(UpdateFixturesEnv) != "" {
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			r.t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(rendered), 0644); err != nil {
+			r.t.Fatal(err)
+		}
+		return
+	}
+
+	fixture, err := os.ReadFile(path)
+	if err != nil {
+		r.t.Fatalf("reading fixture (set %s=1 to create it): %v", UpdateFixturesEnv, err)
+	}
+	if string(fixture) == rendered {
+		return
+	}
+	diff, err := difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(fixture)),
+		B:        difflib.SplitLines(rendered),
+		FromFile: path,
+		ToFile:   "rendered",
+		Context:  3,
+	})
+	if err != nil {
+		r.t.Fatal(err)
+	}
+	r.t.Errorf("rendering differs from %s (set %s=1 to update):\n%s", path, UpdateFixturesEnv, diff)
+}
+
+func helmTemplate(t testing.TB, chartPath string, opts Options) (string, error) {
+	if opts.LookupFixtures != "" {
+		if opts.AllowLookup {
+			return "", fmt.Errorf("LookupFixtures cannot be combined with AllowLookup")
+		}
+		stubbed, err := stubLookups(t, chartPath, opts.LookupFixtures)
+		if err != nil {
+			return "", fmt.Errorf("stubbing lookup calls: %w", err)
+		}
+		chartPath = stubbed
+	}
+
+	helm := opts.HelmBinary
+	if helm == "" {
+		helm = "helm"
+	}
+	return render.Chart(helm, chartPath, opts.Values, opts.Set, render.Options{
+		ReleaseName:  opts.ReleaseName,
+		Namespace:    opts.Namespace,
+		KubeVersion:  opts.KubeVersion,
+		APIVersions:  opts.APIVersions,
+		IncludeCRDs:  opts.IncludeCRDs,
+		PostRenderer: opts.PostRenderer,
+		NoHooks:      opts.NoHooks,
+		AllowLookup:  opts.AllowLookup,
+	})
+}
+
+// stubLookups copies the chart to a temporary directory and rewrites its
+// lookup calls there, leaving the chart under test untouched.
+func stubLookups(t testing.TB, chartPath, fixturesFile string) (string, error) {
+	fixtures, err := render.LoadLookupFixtures(fixturesFile)
+	if err != nil {
+		return "", err
+	}
+	helper, err := render.LookupHelper(fixtures)
+	if err != nil {
+		return "", err
+	}
+
+	stubbed := t.TempDir()
+	if err := os.CopyFS(stubbed, os.DirFS(chartPath)); err != nil {
+		return "", err
+	}
+	return stubbed, render.StubLookups(stubbed, helper)
+}
+
+func resourceKey(res manifest.Resource) string {
+	return fmt.Sprintf("%s/%s/%s/%s", res.APIVersion, res.Kind, res.Namespace, res.Name)
+}
@@ -0,0 +1,117 @@
+package difftest
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+type recorder struct {
+	testing.TB
+	errors []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...any) {
+	r.errors = append(r.errors, fmt.Sprintf(format, args...))
+}
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func fakeHelm(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake helm script requires a POSIX shell")
+	}
+	helm := filepath.Join(t.TempDir(), "helm")
+	writeFile(t, helm, `#!/bin/sh
+for f in "$3"/templates/*.yaml; do
+  echo "---"
+  echo "# Source: app/templates/$(basename "$f")"
+  sed "s/RELEASE/$2/" "$f"
+done
+`)
+	if err := os.Chmod(helm, 0755); err != nil {
+		t.Fatal(err)
+	}
+	return helm
+}
+
+func TestRender(t *testing.T) {
+	helm := fakeHelm(t)
+	chart := t.TempDir()
+	writeFile(t, filepath.Join(chart, "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 1.0.0\n")
+	writeFile(t, filepath.Join(chart, "templates", "service.yaml"), "kind: Service\napiVersion: v1\nmetadata:\n  name: RELEASE\nspec:\n  port: 80\n")
+	writeFile(t, filepath.Join(chart, "templates", "secret.yaml"), "apiVersion: v1\nkind: Secret\nmetadata:\n  name: RELEASE\ndata:\n  password: c2VjcmV0\n")
+
+	r := Render(t, chart, Options{HelmBinary: helm})
+	r.Contains("Service", "app", "apiVersion: v1\nkind: Service")
+	r.Omits("Secret", "app", "c2VjcmV0")
+	if _, ok := r.Find("Ingress", "app"); ok {
+		t.Error("expected no Ingress")
+	}
+
+	expected := "---\n# Source: app/templates/secret.yaml\napiVersion: v1\ndata:\n  password: redacted\nkind: Secret\nmetadata:\n  name: app\n" +
+		"---\n# Source: app/templates/service.yaml\napiVersion: v1\nkind: Service\nmetadata:\n  name: app\nspec:\n  port: 80\n"
+	if r.String() != expected {
+		t.Errorf("unexpected rendering:\n%s", r.String())
+	}
+
+	fixture := filepath.Join(t.TempDir(), "testdata", "app.yaml")
+	t.Setenv(UpdateFixturesEnv, "1")
+	r.MatchFixture(fixture)
+	t.Setenv(UpdateFixturesEnv, "")
+	r.MatchFixture(fixture)
+
+	writeFile(t, filepath.Join(chart, "templates", "service.yaml"), "apiVersion: v1\nkind: Service\nmetadata:\n  name: RELEASE\nspec:\n  port: 8080\n")
+	rec := &recorder{TB: t}
+	changed := Render(rec, chart, Options{HelmBinary: helm, ReleaseName: "payments"})
+	changed.MatchFixture(fixture)
+	changed.Contains("Service", "payments", "port: 80\n")
+	if len(rec.errors) != 2 {
+		t.Fatalf("expected 2 failures, got %q", rec.errors)
+	}
+	if !strings.Contains(rec.errors[0], "-  name: app\n+  name: payments") || !strings.Contains(rec.errors[0], "-  port: 80\n+  port: 8080") {
+		t.Errorf("expected a unified diff against the fixture, got:\n%s", rec.errors[0])
+	}
+	if !strings.HasPrefix(rec.errors[1], `Service payments does not contain "port: 80\n"`) {
+		t.Errorf("unexpected failure %q", rec.errors[1])
+	}
+}
+
+func TestRenderOptions(t *testing.T) {
+	helm := fakeHelm(t)
+	chart := t.TempDir()
+	writeFile(t, filepath.Join(chart, "Chart.yaml"), "apiVersion: v2\nname: app\nversion: 1.0.0\n")
+	service := "kind: Service\napiVersion: v1\nmetadata:\n  name: RELEASE\n  labels:\n    helm.sh/chart: app-1.0.0\n    tier: web\n"
+	writeFile(t, filepath.Join(chart, "templates", "service.yaml"), service)
+	secret := `password: {{ (lookup "v1" "Secret" "payments" "db").data.password }}`
+	writeFile(t, filepath.Join(chart, "templates", "configmap.yaml"), "apiVersion: v1\nkind: ConfigMap\nmetadata:\n  name: RELEASE\ndata:\n  "+secret+"\n")
+	fixtures := filepath.Join(t.TempDir(), "fixtures.yaml")
+	writeFile(t, fixtures, "apiVersion: v1\nkind: Secret\nmetadata:\n  name: db\n  namespace: payments\n")
+
+	r := Render(t, chart, Options{HelmBinary: helm, IgnoreHelmLabels: true, KeepKeyOrder: true, LookupFixtures: fixtures})
+	r.Contains("Service", "app", "kind: Service\napiVersion: v1\n")
+	r.Omits("Service", "app", "helm.sh/chart")
+	r.Contains("ConfigMap", "app", `include "helm-git-diff.lookup"`)
+	if content, _ := os.ReadFile(filepath.Join(chart, "templates", "configmap.yaml")); !strings.Contains(string(content), secret) {
+		t.Errorf("expected the chart under test to be left untouched, got %s", content)
+	}
+
+	unordered := Render(t, chart, Options{HelmBinary: helm, KeepKeyOrder: true})
+	if res := unordered.Resource("Service", "app"); res.Content != strings.Replace(service, "RELEASE", "app", 1) {
+		t.Errorf("expected the rendered document unchanged, got:\n%s", res.Content)
+	}
+}
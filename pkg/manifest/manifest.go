@@ -0,0 +1,244 @@
+// Package manifest parses and normalizes rendered Kubernetes manifests the way
+// helm-git-diff compares them.
+package manifest
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Resource is one document of a rendered manifest.
+type Resource struct {
+	APIVersion  string
+	Kind        string
+	Namespace   string
+	Name        string
+	Source      string
+	Labels      map[string]string
+	Annotations map[string]string
+	Content     string
+}
+
+// RedactSecret replaces the values under data and stringData of a Secret with a
+// short HMAC-SHA256 under key. Renderings redacted with the same key still show
+// which values changed, while the output cannot be checked against guessed
+// values without the key. With a nil key every value becomes "redacted".
+func RedactSecret(content string, key []byte) string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil || len(doc.Content) == 0 || doc.Content[0].Kind != yaml.MappingNode {
+		return content
+	}
+
+	root := doc.Content[0]
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != "data" && root.Content[i].Value != "stringData" {
+			continue
+		}
+		data := root.Content[i+1]
+		if data.Kind != yaml.MappingNode {
+			continue
+		}
+		for j := 1; j < len(data.Content); j += 2 {
+			redacted := "redacted"
+			if key != nil {
+				mac := hmac.New(sha256.New, key)
+				mac.Write([]byte(data.Content[j].Value))
+				redacted = "redacted-hmac:" + hex.EncodeToString(mac.Sum(nil))[:16]
+			}
+			data.Content[j].Kind = yaml.ScalarNode
+			data.Content[j].Tag = "!!str"
+			data.Content[j].Style = 0
+			data.Content[j].Content = nil
+			data.Content[j].Value = redacted
+		}
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return content
+	}
+	return out.String()
+}
+
+// HelmLabelFields are the labels that change with every chart or app version
+// bump. Passing them to Normalize hides that churn.
+var HelmLabelFields = []string{
+	"metadata.labels.helm.sh/chart",
+	"metadata.labels.app.kubernetes.io/version",
+	"metadata.labels.app.kubernetes.io/managed-by",
+	"spec.template.metadata.labels.helm.sh/chart",
+	"spec.template.metadata.labels.app.kubernetes.io/version",
+	"spec.template.metadata.labels.app.kubernetes.io/managed-by",
+}
+
+// Normalize removes ignoreFields (dot-separated paths, * matches any key or
+// list item) from a resource and optionally sorts its mapping keys.
+func Normalize(content string, ignoreFields []string, sortKeys bool) string {
+	var doc yaml.Node
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil || len(doc.Content) == 0 {
+		return content
+	}
+
+	for _, field := range ignoreFields {
+		removeField(doc.Content[0], strings.Split(field, "."))
+	}
+	if sortKeys {
+		sortMappingKeys(doc.Content[0])
+	}
+
+	var out bytes.Buffer
+	encoder := yaml.NewEncoder(&out)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(&doc); err != nil {
+		return content
+	}
+	return out.String()
+}
+
+func removeField(node *yaml.Node, path []string) {
+	if len(path) == 0 {
+		return
+	}
+
+	switch node.Kind {
+	case yaml.SequenceNode:
+		if path[0] != "*" {
+			return
+		}
+		for _, item := range node.Content {
+			removeField(item, path[1:])
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			n := matchFieldKey(node.Content[i].Value, path)
+			switch {
+			case n == 0:
+				continue
+			case n == len(path):
+				node.Content = append(node.Content[:i], node.Content[i+2:]...)
+				i -= 2
+			default:
+				removeField(node.Content[i+1], path[n:])
+			}
+		}
+	}
+}
+
+func matchFieldKey(key string, path []string) int {
+	if path[0] == "*" {
+		return 1
+	}
+	for n := len(path); n >= 1; n-- {
+		if key == strings.Join(path[:n], ".") {
+			return n
+		}
+	}
+	return 0
+}
+
+func sortMappingKeys(node *yaml.Node) {
+	if node.Kind == yaml.MappingNode {
+		pairs := make([][2]*yaml.Node, 0, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			pairs = append(pairs, [2]*yaml.Node{node.Content[i], node.Content[i+1]})
+		}
+		sort.SliceStable(pairs, func(a, b int) bool {
+			return pairs[a][0].Value < pairs[b][0].Value
+		})
+		for i, pair := range pairs {
+			node.Content[2*i], node.Content[2*i+1] = pair[0], pair[1]
+		}
+	}
+	for _, child := range node.Content {
+		sortMappingKeys(child)
+	}
+}
+
+// Parse splits a rendered manifest into resources, skipping empty documents.
+func Parse(manifest string) ([]Resource, error) {
+	var resources []Resource
+	for _, doc := range Split(manifest) {
+		var obj struct {
+			APIVersion string `yaml:"apiVersion"`
+			Kind       string `yaml:"kind"`
+			Metadata   struct {
+				Name        string            `yaml:"name"`
+				Namespace   string            `yaml:"namespace"`
+				Labels      map[string]string `yaml:"labels"`
+				Annotations map[string]string `yaml:"annotations"`
+			} `yaml:"metadata"`
+		}
+		if err := yaml.Unmarshal([]byte(doc), &obj); err != nil {
+			return nil, fmt.Errorf("parsing manifest document: %w", err)
+		}
+		if obj.Kind == "" {
+			continue
+		}
+
+		resources = append(resources, Resource{
+			APIVersion:  obj.APIVersion,
+			Kind:        obj.Kind,
+			Namespace:   obj.Metadata.Namespace,
+			Name:        obj.Metadata.Name,
+			Source:      source(doc),
+			Labels:      obj.Metadata.Labels,
+			Annotations: obj.Metadata.Annotations,
+			Content:     stripSource(doc),
+		})
+	}
+	return resources, nil
+}
+
+// Split returns the non-empty documents of a multi-document YAML manifest.
+func Split(manifest string) []string {
+	var docs []string
+	var current []string
+
+	flush := func() {
+		doc := strings.TrimSpace(strings.Join(current, "\n"))
+		if doc != "" {
+			docs = append(docs, doc+"\n")
+		}
+		current = nil
+	}
+
+	for _, line := range strings.Split(manifest, "\n") {
+		if strings.TrimRight(line, " \t\r") == "---" {
+			flush()
+			continue
+		}
+		current = append(current, line)
+	}
+	flush()
+
+	return docs
+}
+
+func source(doc string) string {
+	for _, line := range strings.Split(doc, "\n") {
+		if strings.HasPrefix(line, "# Source: ") {
+			return strings.TrimPrefix(line, "# Source: ")
+		}
+	}
+	return ""
+}
+
+func stripSource(doc string) string {
+	lines := strings.Split(doc, "\n")
+	kept := lines[:0]
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "# Source: ") {
+			kept = append(kept, line)
+		}
+	}
+	return strings.Join(kept, "\n")
+}
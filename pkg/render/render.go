@@ -0,0 +1,327 @@
+// Package render runs helm template the way helm-git-diff renders a chart, so
+// the plugin and pkg/difftest pass the same flags and stub lookup calls the
+// same way.
+package render
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Options are the helm template flags besides values. The zero value renders
+// with the chart name as release name and helm's defaults.
+type Options struct {
+	ReleaseName  string
+	Namespace    string
+	KubeVersion  string
+	APIVersions  []string
+	IncludeCRDs  bool
+	PostRenderer string
+	NoHooks      bool
+	AllowLookup  bool
+}
+
+// Args returns the helm template flags for o, without the release name.
+func (o Options) Args() []string {
+	var args []string
+	if o.Namespace != "" {
+		args = append(args, "--namespace", o.Namespace)
+	}
+	if o.KubeVersion != "" {
+		args = append(args, "--kube-version", o.KubeVersion)
+	}
+	for _, apiVersion := range o.APIVersions {
+		args = append(args, "--api-versions", apiVersion)
+	}
+	if o.IncludeCRDs {
+		args = append(args, "--include-crds")
+	}
+	if o.PostRenderer != "" {
+		args = append(args, "--post-renderer", o.PostRenderer)
+	}
+	if o.NoHooks {
+		args = append(args, "--no-hooks")
+	}
+	if o.AllowLookup {
+		args = append(args, "--dry-run=server")
+	}
+	return args
+}
+
+// ReleaseName returns opts.ReleaseName, or the chart's name when it is empty.
+func ReleaseName(chartPath string, opts Options) (string, error) {
+	if opts.ReleaseName != "" {
+		return opts.ReleaseName, nil
+	}
+	chartName, err := ChartName(chartPath)
+	if err != nil {
+		return "", fmt.Errorf("getting chart name: %w", err)
+	}
+	return chartName, nil
+}
+
+// ChartName returns the name field of the chart's Chart.yaml.
+func ChartName(chartPath string) (string, error) {
+	content, err := os.ReadFile(filepath.Join(chartPath, "Chart.yaml"))
+	if err != nil {
+		return "", fmt.Errorf("reading Chart.yaml: %w", err)
+	}
+
+	for line := range strings.SplitSeq(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if name, ok := strings.CutPrefix(line, "name:"); ok {
+			name = strings.Trim(strings.TrimSpace(name), "\"'")
+			if name != "" {
+				return name, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("chart name not found in Chart.yaml")
+}
+
+// Chart runs helm template for the chart at chartPath and returns the rendered
+// manifest. Values files are passed in order, followed by the --set values.
+func Chart(helmBinary, chartPath string, valuesFiles, setValues []string, opts Options) (string, error) {
+	release, err := ReleaseName(chartPath, opts)
+	if err != nil {
+		return "", err
+	}
+
+	args := []string{"template", release, chartPath}
+	for _, valuesFile := range valuesFiles {
+		args = append(args, "-f", valuesFile)
+	}
+	for _, sv := range setValues {
+		args = append(args, "--set", sv)
+	}
+	args = append(args, opts.Args()...)
+
+	var stderr bytes.Buffer
+	helmCmd := exec.Command(helmBinary, args...)
+	helmCmd.Stderr = &stderr
+	output, err := helmCmd.Output()
+	if err != nil {
+		if _, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("helm template failed: %s", stderr.String())
+		}
+		return "", fmt.Errorf("running helm template: %w", err)
+	}
+	return string(output), nil
+}
+
+// LoadLookupFixtures reads the Kubernetes objects in file, which may be List
+// documents, and indexes them the way lookup queries them: by name, by
+// namespace and across namespaces.
+func LoadLookupFixtures(file string) (map[string]any, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	fixtures := make(map[string]any)
+	addItem := func(key string, object map[string]any) {
+		list, _ := fixtures[key].(map[string]any)
+		if list == nil {
+			list = map[string]any{"items": []any{}}
+			fixtures[key] = list
+		}
+		list["items"] = append(list["items"].([]any), object)
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for index := 1; ; index++ {
+		var doc map[string]any
+		if err := decoder.Decode(&doc); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", file, err)
+		}
+		if doc == nil {
+			continue
+		}
+
+		objects := []any{doc}
+		if kind, _ := doc["kind"].(string); strings.HasSuffix(kind, "List") {
+			objects, _ = doc["items"].([]any)
+		}
+		for _, item := range objects {
+			object, _ := item.(map[string]any)
+			apiVersion, _ := object["apiVersion"].(string)
+			kind, _ := object["kind"].(string)
+			metadata, _ := object["metadata"].(map[string]any)
+			name, _ := metadata["name"].(string)
+			namespace, _ := metadata["namespace"].(string)
+			if apiVersion == "" || kind == "" || name == "" {
+				return nil, fmt.Errorf("document %d: apiVersion, kind and metadata.name are required", index)
+			}
+
+			fixtures[lookupKey(apiVersion, kind, namespace, name)] = object
+			addItem(lookupKey(apiVersion, kind, namespace, ""), object)
+			if namespace != "" {
+				addItem(lookupKey(apiVersion, kind, "", ""), object)
+			}
+		}
+	}
+	return fixtures, nil
+}
+
+func lookupKey(apiVersion, kind, namespace, name string) string {
+	return apiVersion + "|" + kind + "|" + namespace + "|" + name
+}
+
+// LookupHelper returns the template that StubLookups adds to a chart in place
+// of the cluster: it answers lookup calls from fixtures.
+func LookupHelper(fixtures map[string]any) (string, error) {
+	data, err := json.Marshal(fixtures)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(string(data), "`") {
+		return "", fmt.Errorf("fixtures must not contain backticks")
+	}
+
+	return `{{- define "helm-git-diff.lookup" -}}
+{{- $fixtures := fromJson ` + "`" + string(data) + "`" + ` -}}
+{{- $key := printf "%s|%s|%s|%s" (index . 0) (index . 1) (index . 2) (index . 3) -}}
+{{- toJson (get $fixtures $key | default dict) -}}
+{{- end -}}
+`, nil
+}
+
+// StubLookups rewrites the lookup calls in the templates of the chart at
+// chartPath, including its subcharts, to use helper. The files are changed in
+// place, so chartPath must be a copy.
+func StubLookups(chartPath, helper string) error {
+	stubbed := false
+	err := filepath.WalkDir(chartPath, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(chartPath, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if d.IsDir() || !strings.HasPrefix(rel, "templates/") && !strings.Contains(rel, "/templates/") {
+			return nil
+		}
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		rewritten := rewriteLookupCalls(string(content))
+		if rewritten == string(content) {
+			return nil
+		}
+		stubbed = true
+		return os.WriteFile(path, []byte(rewritten), 0644)
+	})
+	if err != nil || !stubbed {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Join(chartPath, "templates"), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(chartPath, "templates", "_helm-git-diff-lookup.tpl"), []byte(helper), 0644)
+}
+
+var (
+	templateActionPattern = regexp.MustCompile(`(?s)\{\{(.*?)\}\}`)
+	lookupCallPattern     = regexp.MustCompile(`(?:^|[^\w.$])lookup\s`)
+)
+
+func rewriteLookupCalls(content string) string {
+	var out strings.Builder
+	last := 0
+	for _, action := range templateActionPattern.FindAllStringSubmatchIndex(content, -1) {
+		start, end := action[2], action[3]
+		text := content[start:end]
+		var rewritten strings.Builder
+		pos := 0
+		for _, match := range lookupCallPattern.FindAllStringIndex(text, -1) {
+			callStart := match[0] + strings.Index(text[match[0]:], "lookup")
+			if callStart < pos {
+				continue
+			}
+			args, argsEnd, ok := lookupArguments(text, match[1])
+			if !ok {
+				continue
+			}
+			rewritten.WriteString(text[pos:callStart])
+			rewritten.WriteString(`(fromJson (include "helm-git-diff.lookup" (list ` + strings.Join(args, " ") + `)))`)
+			pos = argsEnd
+		}
+		rewritten.WriteString(text[pos:])
+
+		out.WriteString(content[last:start])
+		out.WriteString(rewritten.String())
+		last = end
+	}
+	out.WriteString(content[last:])
+	return out.String()
+}
+
+func lookupArguments(text string, pos int) ([]string, int, bool) {
+	var args []string
+	for len(args) < 4 {
+		for pos < len(text) && (text[pos] == ' ' || text[pos] == '\t' || text[pos] == '\n') {
+			pos++
+		}
+		if pos >= len(text) {
+			return nil, 0, false
+		}
+
+		start := pos
+		switch text[pos] {
+		case '"':
+			pos++
+			for pos < len(text) && text[pos] != '"' {
+				if text[pos] == '\\' {
+					pos++
+				}
+				pos++
+			}
+			pos++
+		case '`':
+			pos++
+			for pos < len(text) && text[pos] != '`' {
+				pos++
+			}
+			pos++
+		case '(':
+			depth := 0
+			for ; pos < len(text); pos++ {
+				if text[pos] == '(' {
+					depth++
+				} else if text[pos] == ')' {
+					depth--
+					if depth == 0 {
+						pos++
+						break
+					}
+				}
+			}
+		case ')', '|', '-':
+			return nil, 0, false
+		default:
+			for pos < len(text) && !strings.ContainsRune(" \t\n)|", rune(text[pos])) {
+				pos++
+			}
+		}
+		if pos > len(text) {
+			return nil, 0, false
+		}
+		args = append(args, text[start:pos])
+	}
+	return args, pos, true
+}
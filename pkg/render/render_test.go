@@ -0,0 +1,151 @@
+package render
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, content string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChart(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake helm script requires a POSIX shell")
+	}
+	helm := filepath.Join(t.TempDir(), "helm")
+	writeFile(t, helm, "#!/bin/sh\nif [ \"$2\" = broken ]; then echo 'Error: parse error' >&2; exit 1; fi\necho \"$@\"\n")
+	if err := os.Chmod(helm, 0755); err != nil {
+		t.Fatal(err)
+	}
+	chart := t.TempDir()
+	writeFile(t, filepath.Join(chart, "Chart.yaml"), "apiVersion: v2\nname: \"app\"\nversion: 1.0.0\n")
+
+	output, err := Chart(helm, chart, []string{"prod.yaml"}, []string{"replicas=3"}, Options{Namespace: "payments", PostRenderer: "./kustomize.sh", NoHooks: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := "template app " + chart + " -f prod.yaml --set replicas=3 --namespace payments --post-renderer ./kustomize.sh --no-hooks\n"
+	if output != expected {
+		t.Errorf("expected %q, got %q", expected, output)
+	}
+
+	if _, err := Chart(helm, chart, nil, nil, Options{ReleaseName: "broken"}); err == nil || !strings.Contains(err.Error(), "helm template failed: Error: parse error") {
+		t.Errorf("expected helm's error output, got %v", err)
+	}
+	if _, err := Chart(helm, t.TempDir(), nil, nil, Options{}); err == nil || !strings.Contains(err.Error(), "getting chart name") {
+		t.Errorf("expected an error for a directory without Chart.yaml, got %v", err)
+	}
+}
+
+func TestRewriteLookupCalls(t *testing.T) {
+	tests := []struct {
+		name     string
+		content  string
+		expected string
+	}{
+		{
+			name:     "simple call",
+			content:  `{{- $secret := lookup "v1" "Secret" .Release.Namespace "db" -}}`,
+			expected: `{{- $secret := (fromJson (include "helm-git-diff.lookup" (list "v1" "Secret" .Release.Namespace "db"))) -}}`,
+		},
+		{
+			name:     "parenthesized call and arguments",
+			content:  `{{ (lookup "v1" "ConfigMap" (printf "%s-ns" .Values.env) $name).data.key }}`,
+			expected: `{{ ((fromJson (include "helm-git-diff.lookup" (list "v1" "ConfigMap" (printf "%s-ns" .Values.env) $name)))).data.key }}`,
+		},
+		{
+			name:     "outside actions and field names",
+			content:  "# lookup \"v1\" \"Secret\" \"a\" \"b\"\nvalue: {{ .Values.lookup }}\n",
+			expected: "# lookup \"v1\" \"Secret\" \"a\" \"b\"\nvalue: {{ .Values.lookup }}\n",
+		},
+		{
+			name:     "piped argument",
+			content:  `{{ "db" | lookup "v1" "Secret" "ns" }}`,
+			expected: `{{ "db" | lookup "v1" "Secret" "ns" }}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rewriteLookupCalls(tt.content); got != tt.expected {
+				t.Errorf("expected:\n%s\ngot:\n%s", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestLookupFixtures(t *testing.T) {
+	dir := t.TempDir()
+	fixturesPath := filepath.Join(dir, "fixtures.yaml")
+	writeFile(t, fixturesPath, `apiVersion: v1
+kind: Secret
+metadata:
+  name: db
+  namespace: payments
+data:
+  password: c2VjcmV0
+---
+apiVersion: v1
+kind: List
+items:
+  - apiVersion: v1
+    kind: Namespace
+    metadata:
+      name: payments
+`)
+
+	fixtures, err := LoadLookupFixtures(fixturesPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{
+		lookupKey("v1", "Secret", "payments", "db"),
+		lookupKey("v1", "Secret", "payments", ""),
+		lookupKey("v1", "Secret", "", ""),
+		lookupKey("v1", "Namespace", "", "payments"),
+	} {
+		if _, ok := fixtures[key]; !ok {
+			t.Errorf("expected fixture %q, got keys %v", key, fixtures)
+		}
+	}
+	if items := fixtures[lookupKey("v1", "Secret", "payments", "")].(map[string]any)["items"].([]any); len(items) != 1 {
+		t.Errorf("expected one listed secret, got %d", len(items))
+	}
+
+	helper, err := LookupHelper(fixtures)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(helper, `define "helm-git-diff.lookup"`) || !strings.Contains(helper, `"v1|Secret|payments|db"`) {
+		t.Errorf("unexpected helper template:\n%s", helper)
+	}
+
+	chart := filepath.Join(dir, "chart")
+	writeFile(t, filepath.Join(chart, "templates", "secret.yaml"), `password: {{ (lookup "v1" "Secret" "payments" "db").data.password }}`+"\n")
+	writeFile(t, filepath.Join(chart, "templates", "service.yaml"), "kind: Service\n")
+	if err := StubLookups(chart, helper); err != nil {
+		t.Fatal(err)
+	}
+	content, _ := os.ReadFile(filepath.Join(chart, "templates", "secret.yaml"))
+	if !strings.Contains(string(content), `include "helm-git-diff.lookup"`) {
+		t.Errorf("expected lookup call to be rewritten, got %s", content)
+	}
+	if _, err := os.Stat(filepath.Join(chart, "templates", "_helm-git-diff-lookup.tpl")); err != nil {
+		t.Errorf("expected helper template to be written: %v", err)
+	}
+
+	writeFile(t, fixturesPath, "kind: Secret\nmetadata:\n  name: db\n")
+	if _, err := LoadLookupFixtures(fixturesPath); err == nil {
+		t.Error("expected an error for a fixture without apiVersion")
+	}
+}